@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Takes a consistent copy of the live database and writes it to path. VACUUM INTO reads
+// within a single transaction so the server can keep serving (and writing) while it runs.
+func BackupTo(db *sql.DB, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Backup file %s already exists", path)
+	}
+	_, err := db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// Returns the name of a new timestamped backup file in the backup directory
+func backupPath(dir string, t time.Time) string {
+	base := strings.TrimSuffix(filepath.Base(*dbPath), filepath.Ext(*dbPath))
+	return filepath.Join(dir, base+"-"+t.Format("20060102T150405")+".db")
+}
+
+// Creates a timestamped backup in the backup directory and removes the oldest backups so that
+// only keep remain
+func BackupAndRotate(db *sql.DB, dir string, keep int) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := backupPath(dir, time.Now())
+	err = BackupTo(db, path)
+	if err != nil {
+		return "", err
+	}
+	return path, RotateBackups(dir, keep)
+}
+
+func RotateBackups(dir string, keep int) error {
+	base := strings.TrimSuffix(filepath.Base(*dbPath), filepath.Ext(*dbPath))
+	files, err := filepath.Glob(filepath.Join(dir, base+"-*.db"))
+	if err != nil {
+		return err
+	}
+	//The timestamp in the name sorts oldest first
+	sort.Strings(files)
+	for len(files) > keep {
+		log.Println("Removing old backup", files[0])
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Checks that the file is a healthy movie night database this binary can run against, and
+// returns its schema version
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	bdb, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer bdb.Close()
+	var check string
+	err = bdb.QueryRow("PRAGMA integrity_check").Scan(&check)
+	if err != nil {
+		return 0, err
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("Integrity check failed: %s", check)
+	}
+	var n int
+	err = bdb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('users','movies','showtimes','votes')").Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n != 4 {
+		return 0, errors.New("Not a movie night database")
+	}
+	//Databases from before migrations existed have no migration history, they are version 0
+	err = bdb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'version' AND sql LIKE '%description%'").Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	v, err := SchemaVersion(bdb)
+	if err != nil {
+		return 0, err
+	}
+	if v > LatestSchemaVersion() {
+		return v, fmt.Errorf("Backup schema version %d is newer than this binary supports (%d)", v, LatestSchemaVersion())
+	}
+	return v, nil
+}
+
+// The files sqlite keeps next to a database while it is being written. A hot journal or wal
+// left next to the restored database would be played back into it.
+var sqliteSidecars = []string{"-journal", "-wal", "-shm"}
+
+// Replaces the database at dbPath with the backup. The server must not be running. The
+// current database is kept alongside as a safety copy, along with its journal and wal files,
+// before the files are swapped.
+func Restore(backup, dbPath string) error {
+	v, err := ValidateBackup(backup)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restoring %s (schema version %d) to %s\n", backup, v, dbPath)
+
+	//Copy next to the destination first so that the final swap is an atomic rename
+	tmp := dbPath + ".restore"
+	err = copyFile(backup, tmp)
+	if err != nil {
+		return err
+	}
+	safety := dbPath + ".pre-restore-" + time.Now().Format("20060102T150405")
+	if _, err := os.Stat(dbPath); err == nil {
+		err = os.Rename(dbPath, safety)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		log.Println("Previous database moved to", safety)
+	}
+	//The journal and wal go with the safety copy, it may need them to be consistent
+	for _, suffix := range sqliteSidecars {
+		if _, err := os.Stat(dbPath + suffix); err != nil {
+			continue
+		}
+		err = os.Rename(dbPath+suffix, safety+suffix)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		log.Println("Previous database", suffix[1:], "moved to", safety+suffix)
+	}
+	return os.Rename(tmp, dbPath)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// The tables that are exported, and the columns within them that hold secrets and so are left
+// out of the export
+var exportTables = []struct {
+	Table   string
+	Exclude []string
+}{
+	{"users", []string{"password", "ott", "giftcard", "giftcardpin", "rewardcard"}},
+	{"user_roles", nil},
+	{"groups", nil},
+	{"group_members", nil},
+	{"abilities", nil},
+	{"movies", nil},
+	{"movie_aliases", nil},
+	{"theatres", nil},
+	{"group_theatres", nil},
+	{"showtimes", nil},
+	{"votes", nil},
+	{"rsvps", nil},
+	{"invites", nil},
+	{"weeks", nil},
+	{"week_locks", nil},
+	{"showtime_hides", nil},
+	{"ballot_history", nil},
+}
+
+// Writes the movie night data as a json object keyed by table name, each holding an array of
+// rows. Secrets like passwords and gift card numbers are left out.
+func ExportJSON(db *sql.DB, w io.Writer) error {
+	ret := make(map[string][]map[string]interface{})
+	for _, t := range exportTables {
+		rows, err := db.Query("SELECT * FROM " + t.Table)
+		if err != nil {
+			return err
+		}
+		cols, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ret[t.Table] = make([]map[string]interface{}, 0)
+		for rows.Next() {
+			vals := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+			err = rows.Scan(ptrs...)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			row := make(map[string]interface{})
+			for i, c := range cols {
+				if contains(t.Exclude, c) {
+					continue
+				}
+				if b, ok := vals[i].([]byte); ok {
+					vals[i] = string(b)
+				}
+				row[c] = vals[i]
+			}
+			ret[t.Table] = append(ret[t.Table], row)
+		}
+		rows.Close()
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(&ret)
+}
+
+// Runs one of the command line subcommands:
+//
+//	backup [file]  Takes an online backup, by default into the backup directory
+//	restore file   Replaces the database with a backup, the server must be stopped
+//	export [file]  Exports the data as json, by default to stdout
+func RunCommand(args []string) error {
+	switch args[0] {
+	case "backup":
+		bdb, err := sql.Open("sqlite3", *dbPath)
+		if err != nil {
+			return err
+		}
+		defer bdb.Close()
+		if len(args) > 1 {
+			return BackupTo(bdb, args[1])
+		}
+		path, err := BackupAndRotate(bdb, *backupDir, *backupKeep)
+		if err == nil {
+			log.Println("Backed up to", path)
+		}
+		return err
+	case "restore":
+		if len(args) < 2 {
+			return errors.New("Usage: movie-night restore <backup file>")
+		}
+		return Restore(args[1], *dbPath)
+	case "export":
+		bdb, err := sql.Open("sqlite3", *dbPath)
+		if err != nil {
+			return err
+		}
+		defer bdb.Close()
+		w := io.Writer(os.Stdout)
+		if len(args) > 1 {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return ExportJSON(bdb, w)
+	}
+	return fmt.Errorf("Unknown command %s, expected one of backup, restore or export", args[0])
+}
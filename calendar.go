@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// A Calendar works out when things happen around a weekly movie night. Every week calculation
+// in the application goes through one, so that the event day, when voting opens, when the vote
+// locks and which showtimes count are all configuration rather than tuesday specific logic.
+//
+// Every calculation happens in the calendars time zone, whatever zone the server runs in or
+// the time passed in carries. Days are always added on the calendar rather than as 24 hour
+// durations, so a week that crosses a daylight saving change still starts and ends at midnight.
+type Calendar struct {
+	// The time zone the movie night is held in
+	Location *time.Location
+	// The day of the week the movie night is held
+	EventDay time.Weekday
+	// How long after the start of an event day the vote for the following event opens
+	VotingOpens time.Duration
+	// How far into the event day the vote locks
+	LockAt time.Duration
+	// Showtimes that start before this hour aren't considered for the movie night
+	MinShowtimeHour int
+}
+
+// The calendar variable holds the configured defaults, groups swap in their own event day
+var calendar = Calendar{Location: time.Local, EventDay: time.Tuesday, VotingOpens: 24 * time.Hour, LockAt: 16*time.Hour + 30*time.Minute, MinShowtimeHour: 17}
+
+func (c Calendar) Validate() error {
+	if c.Location == nil {
+		return errors.New("The calendar needs a time zone")
+	}
+	if c.EventDay < time.Sunday || c.EventDay > time.Saturday {
+		return errors.New("The event day must be from Sun=0 to Sat=6")
+	}
+	if c.VotingOpens <= 0 || c.VotingOpens > 7*24*time.Hour {
+		return errors.New("Voting must open within a week after the event day")
+	}
+	if c.LockAt < 0 || c.LockAt >= c.VotingOpens {
+		return errors.New("The vote must lock on the event day, before voting for the next event opens")
+	}
+	if c.MinShowtimeHour < 0 || c.MinShowtimeHour > 23 {
+		return errors.New("The minimum showtime hour must be from 0 to 23")
+	}
+	return nil
+}
+
+// Returns t in the calendars time zone
+func (c Calendar) In(t time.Time) time.Time {
+	return t.In(c.Location)
+}
+
+// Returns midnight at the start of the day t falls on, moved by the given number of days
+func startOfDay(t time.Time, days int) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+days, 0, 0, 0, 0, t.Location())
+}
+
+// Adds an offset, which can be longer than a day, to midnight of the given day. The offset is
+// read as a wall clock, so 16h30m is half past four even on a day that is 23 or 25 hours long.
+func offsetDay(day time.Time, offset time.Duration) time.Time {
+	y, m, d := day.Date()
+	days := int(offset / (24 * time.Hour))
+	rest := offset % (24 * time.Hour)
+	return time.Date(y, m, d+days, int(rest/time.Hour), int(rest%time.Hour/time.Minute), int(rest%time.Minute/time.Second), int(rest%time.Second), day.Location())
+}
+
+// Returns midnight at the start of the event day that the vote open at t is for
+func (c Calendar) EventDate(t time.Time) time.Time {
+	t = c.In(t)
+	//The most recent event day, which could be today
+	e := startOfDay(t, -((int(t.Weekday()) - int(c.EventDay) + 7) % 7))
+	if t.Before(offsetDay(e, c.VotingOpens)) {
+		return e
+	}
+	return startOfDay(e, 7)
+}
+
+// Returns the beginning (sunday) and end (saturday) of the week holding the event that the
+// vote open at t is for. Votes and showtimes are grouped by this week.
+func (c Calendar) Week(t time.Time) (time.Time, time.Time) {
+	e := c.EventDate(t)
+	bow := startOfDay(e, -int(e.Weekday()))
+	eow := startOfDay(bow, 7).Add(-time.Nanosecond)
+	return bow, eow
+}
+
+// Returns the beginning (sunday) and end (saturday) of the calendar week t falls in
+func (c Calendar) WeekAt(t time.Time) (time.Time, time.Time) {
+	t = c.In(t)
+	bow := startOfDay(t, -int(t.Weekday()))
+	eow := startOfDay(bow, 7).Add(-time.Nanosecond)
+	return bow, eow
+}
+
+// Returns when voting opened for the event that the vote open at t is for
+func (c Calendar) VotingOpensAt(t time.Time) time.Time {
+	return offsetDay(startOfDay(c.EventDate(t), -7), c.VotingOpens)
+}
+
+// Returns when the vote open at t locks, which may already have passed
+func (c Calendar) LockTime(t time.Time) time.Time {
+	return offsetDay(c.EventDate(t), c.LockAt)
+}
+
+// Returns the first lock time after t
+func (c Calendar) NextLock(t time.Time) time.Time {
+	lock := c.LockTime(t)
+	if !lock.After(t) {
+		lock = offsetDay(startOfDay(c.EventDate(t), 7), c.LockAt)
+	}
+	return lock
+}
+
+// Returns midnight at the start of the first event day after the day t falls on
+func (c Calendar) NextEventDate(t time.Time) time.Time {
+	t = c.In(t)
+	days := (int(c.EventDay) - int(t.Weekday()) + 7) % 7
+	if days == 0 {
+		days = 7
+	}
+	return startOfDay(t, days)
+}
+
+// Reports whether a showtime is late enough in the day to be part of the movie night. The hour
+// is read in the zone the showtime carries, which should be the zone of its theatre.
+func (c Calendar) IsEventShowtime(showtime time.Time) bool {
+	return showtime.Hour() >= c.MinShowtimeHour
+}
+
+// Returns the first time after t that falls on the weekday at hour:minute
+func (c Calendar) NextWeekly(t time.Time, day time.Weekday, hour, minute int) time.Time {
+	t = c.In(t)
+	y, m, d := t.Date()
+	days := (int(day) - int(t.Weekday()) + 7) % 7
+	next := time.Date(y, m, d+days, hour, minute, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(y, m, d+days+7, hour, minute, 0, 0, t.Location())
+	}
+	return next
+}
+
+// Returns the first time after t that falls at hour:minute
+func (c Calendar) NextDaily(t time.Time, hour, minute int) time.Time {
+	t = c.In(t)
+	y, m, d := t.Date()
+	next := time.Date(y, m, d, hour, minute, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(y, m, d+1, hour, minute, 0, 0, t.Location())
+	}
+	return next
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func denverCalendar(t *testing.T, day time.Weekday) Calendar {
+	loc, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Calendar{Location: loc, EventDay: day, VotingOpens: 24 * time.Hour, LockAt: 16*time.Hour + 30*time.Minute, MinShowtimeHour: 17}
+}
+
+func at(c Calendar, year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, c.Location)
+}
+
+// In 2024 Denver sprang forward on Sunday March 10 and fell back on Sunday November 3
+func TestCalendarEventDate(t *testing.T) {
+	tue := denverCalendar(t, time.Tuesday)
+	sun := denverCalendar(t, time.Sunday)
+	tests := []struct {
+		name string
+		c    Calendar
+		t    time.Time
+		want time.Time
+	}{
+		{"spring forward sunday", tue, at(tue, 2024, 3, 10, 12, 0), at(tue, 2024, 3, 12, 0, 0)},
+		{"spring event day before voting opens", tue, at(tue, 2024, 3, 12, 23, 59), at(tue, 2024, 3, 12, 0, 0)},
+		{"spring voting opens", tue, at(tue, 2024, 3, 13, 0, 0), at(tue, 2024, 3, 19, 0, 0)},
+		{"spring forward is the event day", sun, at(sun, 2024, 3, 10, 20, 0), at(sun, 2024, 3, 10, 0, 0)},
+		{"fall back is the event day", sun, at(sun, 2024, 11, 3, 1, 30), at(sun, 2024, 11, 3, 0, 0)},
+		{"fall back voting opens", sun, at(sun, 2024, 11, 4, 0, 0), at(sun, 2024, 11, 10, 0, 0)},
+		{"new years eve", tue, at(tue, 2024, 12, 30, 12, 0), at(tue, 2024, 12, 31, 0, 0)},
+		{"new years day", tue, at(tue, 2025, 1, 1, 0, 0), at(tue, 2025, 1, 7, 0, 0)},
+		{"from another zone", tue, time.Date(2024, 3, 13, 5, 0, 0, 0, time.UTC), at(tue, 2024, 3, 12, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.c.EventDate(tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("EventDate(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalendarWeek(t *testing.T) {
+	c := denverCalendar(t, time.Tuesday)
+	tests := []struct {
+		name     string
+		t        time.Time
+		bow      time.Time
+		eow      time.Time
+		duration time.Duration
+	}{
+		{"spring forward", at(c, 2024, 3, 11, 9, 0), at(c, 2024, 3, 10, 0, 0), at(c, 2024, 3, 17, 0, 0), 7*24*time.Hour - time.Hour},
+		{"fall back", at(c, 2024, 11, 4, 9, 0), at(c, 2024, 11, 3, 0, 0), at(c, 2024, 11, 10, 0, 0), 7*24*time.Hour + time.Hour},
+		{"december to january", at(c, 2024, 12, 30, 9, 0), at(c, 2024, 12, 29, 0, 0), at(c, 2025, 1, 5, 0, 0), 7 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bow, eow := c.Week(tt.t)
+			if !bow.Equal(tt.bow) {
+				t.Errorf("bow = %v, want %v", bow, tt.bow)
+			}
+			if want := tt.eow.Add(-time.Nanosecond); !eow.Equal(want) {
+				t.Errorf("eow = %v, want %v", eow, want)
+			}
+			if d := eow.Sub(bow) + time.Nanosecond; d != tt.duration {
+				t.Errorf("the week lasts %v, want %v", d, tt.duration)
+			}
+			//Any time in the week finds the same week
+			wbow, weow := c.WeekAt(eow)
+			if !wbow.Equal(bow) || !weow.Equal(eow) {
+				t.Errorf("WeekAt(%v) = %v %v, want %v %v", eow, wbow, weow, bow, eow)
+			}
+		})
+	}
+}
+
+func TestCalendarLockTime(t *testing.T) {
+	tue := denverCalendar(t, time.Tuesday)
+	sun := denverCalendar(t, time.Sunday)
+	tests := []struct {
+		name string
+		c    Calendar
+		t    time.Time
+		want time.Time
+	}{
+		{"spring forward week", tue, at(tue, 2024, 3, 10, 12, 0), at(tue, 2024, 3, 12, 16, 30)},
+		{"spring forward is the event day", sun, at(sun, 2024, 3, 10, 1, 0), at(sun, 2024, 3, 10, 16, 30)},
+		{"fall back is the event day", sun, at(sun, 2024, 11, 3, 1, 0), at(sun, 2024, 11, 3, 16, 30)},
+		{"passed lock", sun, at(sun, 2024, 11, 3, 20, 0), at(sun, 2024, 11, 3, 16, 30)},
+		{"new years eve", tue, at(tue, 2024, 12, 29, 12, 0), at(tue, 2024, 12, 31, 16, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.c.LockTime(tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("LockTime(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalendarNextLock(t *testing.T) {
+	tue := denverCalendar(t, time.Tuesday)
+	sun := denverCalendar(t, time.Sunday)
+	tests := []struct {
+		name string
+		c    Calendar
+		t    time.Time
+		want time.Time
+	}{
+		{"into spring forward", sun, at(sun, 2024, 3, 3, 17, 0), at(sun, 2024, 3, 10, 16, 30)},
+		{"out of spring forward", sun, at(sun, 2024, 3, 10, 16, 30), at(sun, 2024, 3, 17, 16, 30)},
+		{"into fall back", sun, at(sun, 2024, 10, 27, 17, 0), at(sun, 2024, 11, 3, 16, 30)},
+		{"before fall back lock", sun, at(sun, 2024, 11, 3, 1, 30), at(sun, 2024, 11, 3, 16, 30)},
+		{"out of fall back", sun, at(sun, 2024, 11, 3, 17, 0), at(sun, 2024, 11, 10, 16, 30)},
+		{"across new year", tue, at(tue, 2024, 12, 31, 17, 0), at(tue, 2025, 1, 7, 16, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.c.NextLock(tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("NextLock(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
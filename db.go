@@ -1,35 +1,26 @@
 package main
 
 import (
-	"crypto/sha512"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"net/http"
-	"net/url"
+	"strings"
 	"time"
+	"unicode"
 )
 
-// The db variable is the global database variable
+// The db variable is the global database variable. It backs the SQLiteStore, as well as the
+// sessions, roles and audit log.
 var db *sql.DB
 
 // This variable contains an array of sql commands to be run upon startup
 var dbInits = []string{
 	"PRAGMA foreign_keys = ON"}
 
-// This variable contains an array of sql commands to initialize the database, if not already
-var dbCreates = []string{
-	"CREATE TABLE IF NOT EXISTS version (id INTEGER PRIMARY KEY, version TEXT)",
-	"INSERT INTO version (version) VALUES ('" + version + "')",
-	"CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, email TEXT NOT NULL UNIQUE, password TEXT, ott TEXT, weekly_not INTEGER DEFAULT 1, lock_not INTEGER DEFAULT 1, act_not INTEGER DEFAULT 0, giftcard TEXT NOT NULL DEFAULT '', giftcardpin TEXT NOT NULL DEFAULT '', rewardcard TEXT NOT NULL DEFAULT '', zip TEXT NOT NULL DEFAULT '84043', phone TEXT NOT NULL DEFAULT '', carrier TEXT NOT NULL DEFAULT '')",
-	"CREATE TABLE IF NOT EXISTS abilities (userid INTEGER NOT NULL, ability TEXT NOT NULL, PRIMARY KEY(userid,ability), FOREIGN KEY(userid) REFERENCES users(id))",
-	"CREATE TABLE IF NOT EXISTS movies (id INTEGER NOT NULL PRIMARY KEY, imdb TEXT NOT NULL DEFAULT 'unknown', title TEXT NOT NULL DEFAULT 'UNKNOWN', json TEXT NOT NULL DEFAULT '{}')",
-	"CREATE TABLE IF NOT EXISTS showtimes (id INTEGER NOT NULL PRIMARY KEY, movieid INTEGER NOT NULL, showtime TIMESTAMP NOT NULL, screen TEXT NOT NULL, location TEXT NOT NULL, address TEXT NOT NULL, preview TEXT NOT NULL, buy TEXT NOT NULL, FOREIGN KEY(movieid) REFERENCES movies(id))",
-	"CREATE TABLE IF NOT EXISTS votes (userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, votes INTEGER NOT NULL, PRIMARY KEY(userid, showtimeid), FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
-	"CREATE TABLE IF NOT EXISTS rsvps (userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, value TEXT NOT NULL, UNIQUE (userid, showtimeid) ON CONFLICT REPLACE, FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+// This variable contains an array of sql commands to be run upon startup, after the database
+// has been migrated to the latest schema
+var dbSeeds = []string{
 	"INSERT OR REPLACE INTO users (id, name, email, weekly_not, lock_not, act_not) VALUES (0, 'System', 'movienight@murphysean.com',0,0,0)"}
 
 // This function is run before any other database commands are issued. It will ensure that
@@ -43,35 +34,108 @@ func InitDB(db *sql.DB) {
 			log.Fatal(err)
 		}
 	}
-	for _, v := range dbCreates {
+	err := Migrate(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initMovieSearch(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range dbSeeds {
 		_, err := db.Exec(v)
 		if err != nil {
-			log.Println("ErrorCreateSql:", v)
+			log.Println("ErrorSeedSql:", v)
 			log.Fatal(err)
 		}
 	}
 
-	validateUserStmt = mustPrepare(validateUserSql)
-	resetPasswordStmt = mustPrepare(resetPasswordSql)
-	registerUserStmt = mustPrepare(registerUserSql)
-	finishRegistrationStmt = mustPrepare(finishRegistrationSql)
-	getUserStmt = mustPrepare(getUserSql)
-	getUserForEmailStmt = mustPrepare(getUserForEmailSql)
-	getUserForOttStmt = mustPrepare(getUserForOttSql)
-	getUserAbilitiesStmt = mustPrepare(getUserAbilitiesSql)
-	updateUserPrefsStmt = mustPrepare(updateUserPrefsSql)
-	getShowtimeStmt = mustPrepare(getShowtimeSql)
-	getShowtimesForWeekOfStmt = mustPrepare(getShowtimesForWeekOfSql)
-	getTopShowtimesForWeekOfStmt = mustPrepare(getTopShowtimesForWeekOfSql)
-	deleteVotesForUserStmt = mustPrepare(deleteVotesForUserSql)
-	insertVotesForUserStmt = mustPrepare(insertVotesForUserSql)
-	getMovieByTitleStmt = mustPrepare(getMovieByTitleSql)
-	getMovieStmt = mustPrepare(getMovieSql)
-	insertMovieStmt = mustPrepare(insertMovieSql)
-	insertShowtimeStmt = mustPrepare(insertShowtimeSql)
-	insertRsvpStmt = mustPrepare(insertRsvpSql)
-	migrateShowtimeStmt = mustPrepare(migrateShowtimeSql)
-	deleteMovieStmt = mustPrepare(deleteMovieSql)
+	seedRoles(db)
+
+	getUserDirectAbilitiesStmt = mustPrepare(getUserDirectAbilitiesSql)
+	getUserRolesStmt = mustPrepare(getUserRolesSql)
+	grantAbilityStmt = mustPrepare(grantAbilitySql)
+	revokeAbilityStmt = mustPrepare(revokeAbilitySql)
+	assignRoleStmt = mustPrepare(assignRoleSql)
+	unassignRoleStmt = mustPrepare(unassignRoleSql)
+	insertAuditStmt = mustPrepare(insertAuditSql)
+	insertSessionStmt = mustPrepare(insertSessionSql)
+	getSessionForTokenStmt = mustPrepare(getSessionForTokenSql)
+	touchSessionStmt = mustPrepare(touchSessionSql)
+	getSessionsForUserStmt = mustPrepare(getSessionsForUserSql)
+	deleteSessionStmt = mustPrepare(deleteSessionSql)
+	deleteExpiredSessionsStmt = mustPrepare(deleteExpiredSessionsSql)
+}
+
+// Movies are searched with a fts5 index, when sqlite was built with fts5 (see Development).
+// The index isn't a migration, so that the same database works with builds with and without
+// fts5. Triggers keep the index in sync with the movies, a build without fts5 drops them and
+// the next build with fts5 rebuilds the index.
+func initMovieSearch(db *sql.DB) error {
+	var fts bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts)
+	if err != nil {
+		return err
+	}
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'movies_fts_%'").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if (fts && n == 3) || (!fts && n == 0) {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	up := execAll(
+		"DROP TRIGGER IF EXISTS movies_fts_insert",
+		"DROP TRIGGER IF EXISTS movies_fts_update",
+		"DROP TRIGGER IF EXISTS movies_fts_delete")
+	if fts {
+		fmt.Println("Building the movie search index")
+		up = execAll(
+			"CREATE VIRTUAL TABLE IF NOT EXISTS movies_fts USING fts5(title, megaplex, plot, genre)",
+			"DELETE FROM movies_fts",
+			"INSERT INTO movies_fts (rowid, title, megaplex, plot, genre) SELECT id, json_extract(json, '$.Title'), title, json_extract(json, '$.Plot'), json_extract(json, '$.Genre') FROM movies",
+			//Movies are inserted with INSERT OR REPLACE, which doesn't fire the delete trigger
+			`CREATE TRIGGER IF NOT EXISTS movies_fts_insert AFTER INSERT ON movies BEGIN
+			DELETE FROM movies_fts WHERE rowid = new.id;
+			INSERT INTO movies_fts (rowid, title, megaplex, plot, genre) VALUES (new.id, json_extract(new.json, '$.Title'), new.title, json_extract(new.json, '$.Plot'), json_extract(new.json, '$.Genre'));
+		END`,
+			`CREATE TRIGGER IF NOT EXISTS movies_fts_update AFTER UPDATE ON movies BEGIN
+			DELETE FROM movies_fts WHERE rowid = old.id;
+			INSERT INTO movies_fts (rowid, title, megaplex, plot, genre) VALUES (new.id, json_extract(new.json, '$.Title'), new.title, json_extract(new.json, '$.Plot'), json_extract(new.json, '$.Genre'));
+		END`,
+			`CREATE TRIGGER IF NOT EXISTS movies_fts_delete AFTER DELETE ON movies BEGIN
+			DELETE FROM movies_fts WHERE rowid = old.id;
+		END`)
+	} else {
+		fmt.Println("Sqlite was built without fts5, movies will be searched without the index")
+	}
+	err = up(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Makes sure every role and the abilities it bundles exist in the database
+func seedRoles(db *sql.DB) {
+	for role, abilities := range roleAbilities {
+		_, err := db.Exec("INSERT OR IGNORE INTO roles (name) VALUES (?)", role)
+		if err != nil {
+			log.Fatal("seedRoles:1:", err)
+		}
+		for _, ability := range abilities {
+			_, err = db.Exec("INSERT OR IGNORE INTO role_abilities (role, ability) VALUES (?,?)", role, ability)
+			if err != nil {
+				log.Fatal("seedRoles:2:", err)
+			}
+		}
+	}
 }
 
 func mustPrepare(sql string) *sql.Stmt {
@@ -83,43 +147,259 @@ func mustPrepare(sql string) *sql.Stmt {
 	return s
 }
 
-var validateUserStmt *sql.Stmt
-
-const validateUserSql = `SELECT id, name, email FROM users WHERE email = ? AND password = ? LIMIT 1`
+// The SQLiteStore is the Store backed by the sqlite database
+type SQLiteStore struct {
+	db *sql.DB
+
+	getUserPasswordStmt                *sql.Stmt
+	setUserPasswordStmt                *sql.Stmt
+	setUserOttStmt                     *sql.Stmt
+	registerUserStmt                   *sql.Stmt
+	completeRegistrationStmt           *sql.Stmt
+	getUserStmt                        *sql.Stmt
+	getUserForEmailStmt                *sql.Stmt
+	getUserForOttStmt                  *sql.Stmt
+	getUserAbilitiesStmt               *sql.Stmt
+	updateUserPrefsStmt                *sql.Stmt
+	getShowtimeStmt                    *sql.Stmt
+	getShowtimesForWeekOfStmt          *sql.Stmt
+	weekLockedStmt                     *sql.Stmt
+	deleteVotesForUserStmt             *sql.Stmt
+	insertVotesForUserStmt             *sql.Stmt
+	getMovieByTitleStmt                *sql.Stmt
+	getMovieStmt                       *sql.Stmt
+	insertMovieStmt                    *sql.Stmt
+	insertShowtimeStmt                 *sql.Stmt
+	insertRsvpStmt                     *sql.Stmt
+	migrateShowtimeStmt                *sql.Stmt
+	deleteMovieStmt                    *sql.Stmt
+	getGroupStmt                       *sql.Stmt
+	getGroupsStmt                      *sql.Stmt
+	getGroupsForUserStmt               *sql.Stmt
+	insertGroupStmt                    *sql.Stmt
+	getGroupMembersStmt                *sql.Stmt
+	addGroupMemberStmt                 *sql.Stmt
+	removeGroupMemberStmt              *sql.Stmt
+	getJobStateStmt                    *sql.Stmt
+	saveJobStateStmt                   *sql.Stmt
+	getTheatreStmt                     *sql.Stmt
+	getTheatresStmt                    *sql.Stmt
+	upsertTheatreStmt                  *sql.Stmt
+	getGroupTheatresStmt               *sql.Stmt
+	enableGroupTheatreStmt             *sql.Stmt
+	disableGroupTheatreStmt            *sql.Stmt
+	updateShowtimeStmt                 *sql.Stmt
+	getShowtimesForTheatreStmt         *sql.Stmt
+	getShowtimeForPerformanceStmt      *sql.Stmt
+	getRsvpsStmt                       *sql.Stmt
+	migrateVotesStmt                   *sql.Stmt
+	deleteShowtimeVotesStmt            *sql.Stmt
+	migrateRsvpsStmt                   *sql.Stmt
+	getCancelledShowtimesForWeekOfStmt *sql.Stmt
+	getInviteStmt                      *sql.Stmt
+	saveInviteStmt                     *sql.Stmt
+	getMetadataCacheStmt               *sql.Stmt
+	saveMetadataCacheStmt              *sql.Stmt
+	insertMovieMatchStmt               *sql.Stmt
+	getMovieMatchStmt                  *sql.Stmt
+	getMovieMatchForTitleStmt          *sql.Stmt
+	getMovieMatchesStmt                *sql.Stmt
+	resolveMovieMatchStmt              *sql.Stmt
+	mergeShowtimeIdsStmt               *sql.Stmt
+	mergeCountVotesStmt                *sql.Stmt
+	mergeCountRsvpsStmt                *sql.Stmt
+	getMovieAliasesStmt                *sql.Stmt
+	moveMovieAliasesStmt               *sql.Stmt
+	mergeMatchIdsStmt                  *sql.Stmt
+	moveMovieMatchesStmt               *sql.Stmt
+	insertMovieAliasStmt               *sql.Stmt
+	deleteMovieAliasStmt               *sql.Stmt
+	insertMovieMergeStmt               *sql.Stmt
+	getMovieMergeStmt                  *sql.Stmt
+	getMovieMergesStmt                 *sql.Stmt
+	getLaterMovieMergesStmt            *sql.Stmt
+	restoreShowtimeStmt                *sql.Stmt
+	restoreMovieAliasStmt              *sql.Stmt
+	restoreMovieMatchStmt              *sql.Stmt
+	undoMovieMergeStmt                 *sql.Stmt
+	searchMoviesStmt                   *sql.Stmt
+	browseMoviesStmt                   *sql.Stmt
+	getShowtimesForMovieStmt           *sql.Stmt
+	getMovieVotesStmt                  *sql.Stmt
+	getBallotsStmt                     *sql.Stmt
+	getWeekStmt                        *sql.Stmt
+	saveWeekStmt                       *sql.Stmt
+	insertWeekStmt                     *sql.Stmt
+	lockWeekStmt                       *sql.Stmt
+	insertWeekLockStmt                 *sql.Stmt
+	unlockWeekStmt                     *sql.Stmt
+	markLockEmailStmt                  *sql.Stmt
+	getWeekLocksStmt                   *sql.Stmt
+	migrateWeekLockStmt                *sql.Stmt
+	hideShowtimeStmt                   *sql.Stmt
+	restoreShowtimeHideStmt            *sql.Stmt
+	getShowtimeHideStmt                *sql.Stmt
+	getShowtimeHidesStmt               *sql.Stmt
+	insertBallotVersionStmt            *sql.Stmt
+	getBallotHistoryStmt               *sql.Stmt
+	getLockedWeeksStmt                 *sql.Stmt
+}
 
-func ValidateUser(email, password string) (*User, error) {
-	sum := sha512.Sum512_256([]byte(*salt + password))
-	sep := base64.StdEncoding.EncodeToString(sum[:])
-	u := new(User)
-	err := validateUserStmt.QueryRow(email, sep).Scan(&u.Id, &u.Name, &u.Email)
+// Prepares all the store statements against an already initialized database
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	s := &SQLiteStore{db: db}
+	stmts := []struct {
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{&s.getUserPasswordStmt, getUserPasswordSql},
+		{&s.setUserPasswordStmt, setUserPasswordSql},
+		{&s.setUserOttStmt, setUserOttSql},
+		{&s.registerUserStmt, registerUserSql},
+		{&s.completeRegistrationStmt, completeRegistrationSql},
+		{&s.getUserStmt, getUserSql},
+		{&s.getUserForEmailStmt, getUserForEmailSql},
+		{&s.getUserForOttStmt, getUserForOttSql},
+		{&s.getUserAbilitiesStmt, getUserAbilitiesSql},
+		{&s.updateUserPrefsStmt, updateUserPrefsSql},
+		{&s.getShowtimeStmt, getShowtimeSql},
+		{&s.getShowtimesForWeekOfStmt, getShowtimesForWeekOfSql},
+		{&s.weekLockedStmt, weekLockedSql},
+		{&s.deleteVotesForUserStmt, deleteVotesForUserSql},
+		{&s.insertVotesForUserStmt, insertVotesForUserSql},
+		{&s.getMovieByTitleStmt, getMovieByTitleSql},
+		{&s.getMovieStmt, getMovieSql},
+		{&s.insertMovieStmt, insertMovieSql},
+		{&s.insertShowtimeStmt, insertShowtimeSql},
+		{&s.insertRsvpStmt, insertRsvpSql},
+		{&s.migrateShowtimeStmt, migrateShowtimeSql},
+		{&s.deleteMovieStmt, deleteMovieSql},
+		{&s.getGroupStmt, getGroupSql},
+		{&s.getGroupsStmt, getGroupsSql},
+		{&s.getGroupsForUserStmt, getGroupsForUserSql},
+		{&s.insertGroupStmt, insertGroupSql},
+		{&s.getGroupMembersStmt, getGroupMembersSql},
+		{&s.addGroupMemberStmt, addGroupMemberSql},
+		{&s.removeGroupMemberStmt, removeGroupMemberSql},
+		{&s.getJobStateStmt, getJobStateSql},
+		{&s.saveJobStateStmt, saveJobStateSql},
+		{&s.getTheatreStmt, getTheatreSql},
+		{&s.getTheatresStmt, getTheatresSql},
+		{&s.upsertTheatreStmt, upsertTheatreSql},
+		{&s.getGroupTheatresStmt, getGroupTheatresSql},
+		{&s.enableGroupTheatreStmt, enableGroupTheatreSql},
+		{&s.disableGroupTheatreStmt, disableGroupTheatreSql},
+		{&s.updateShowtimeStmt, updateShowtimeSql},
+		{&s.getShowtimesForTheatreStmt, getShowtimesForTheatreSql},
+		{&s.getShowtimeForPerformanceStmt, getShowtimeForPerformanceSql},
+		{&s.getRsvpsStmt, getRsvpsSql},
+		{&s.migrateVotesStmt, migrateVotesSql},
+		{&s.deleteShowtimeVotesStmt, deleteShowtimeVotesSql},
+		{&s.migrateRsvpsStmt, migrateRsvpsSql},
+		{&s.getCancelledShowtimesForWeekOfStmt, getCancelledShowtimesForWeekOfSql},
+		{&s.getInviteStmt, getInviteSql},
+		{&s.saveInviteStmt, saveInviteSql},
+		{&s.getMetadataCacheStmt, getMetadataCacheSql},
+		{&s.saveMetadataCacheStmt, saveMetadataCacheSql},
+		{&s.insertMovieMatchStmt, insertMovieMatchSql},
+		{&s.getMovieMatchStmt, getMovieMatchSql},
+		{&s.getMovieMatchForTitleStmt, getMovieMatchForTitleSql},
+		{&s.getMovieMatchesStmt, getMovieMatchesSql},
+		{&s.resolveMovieMatchStmt, resolveMovieMatchSql},
+		{&s.mergeShowtimeIdsStmt, mergeShowtimeIdsSql},
+		{&s.mergeCountVotesStmt, mergeCountVotesSql},
+		{&s.mergeCountRsvpsStmt, mergeCountRsvpsSql},
+		{&s.getMovieAliasesStmt, getMovieAliasesSql},
+		{&s.moveMovieAliasesStmt, moveMovieAliasesSql},
+		{&s.mergeMatchIdsStmt, mergeMatchIdsSql},
+		{&s.moveMovieMatchesStmt, moveMovieMatchesSql},
+		{&s.insertMovieAliasStmt, insertMovieAliasSql},
+		{&s.deleteMovieAliasStmt, deleteMovieAliasSql},
+		{&s.insertMovieMergeStmt, insertMovieMergeSql},
+		{&s.getMovieMergeStmt, getMovieMergeSql},
+		{&s.getMovieMergesStmt, getMovieMergesSql},
+		{&s.getLaterMovieMergesStmt, getLaterMovieMergesSql},
+		{&s.restoreShowtimeStmt, restoreShowtimeSql},
+		{&s.restoreMovieAliasStmt, restoreMovieAliasSql},
+		{&s.restoreMovieMatchStmt, restoreMovieMatchSql},
+		{&s.undoMovieMergeStmt, undoMovieMergeSql},
+		{&s.browseMoviesStmt, browseMoviesSql},
+		{&s.getShowtimesForMovieStmt, getShowtimesForMovieSql},
+		{&s.getMovieVotesStmt, getMovieVotesSql},
+		{&s.getBallotsStmt, getBallotsSql},
+		{&s.getWeekStmt, getWeekSql},
+		{&s.saveWeekStmt, saveWeekSql},
+		{&s.insertWeekStmt, insertWeekSql},
+		{&s.lockWeekStmt, lockWeekSql},
+		{&s.insertWeekLockStmt, insertWeekLockSql},
+		{&s.unlockWeekStmt, unlockWeekSql},
+		{&s.markLockEmailStmt, markLockEmailSql},
+		{&s.getWeekLocksStmt, getWeekLocksSql},
+		{&s.migrateWeekLockStmt, migrateWeekLockSql},
+		{&s.hideShowtimeStmt, hideShowtimeSql},
+		{&s.restoreShowtimeHideStmt, restoreShowtimeHideSql},
+		{&s.getShowtimeHideStmt, getShowtimeHideSql},
+		{&s.getShowtimeHidesStmt, getShowtimeHidesSql},
+		{&s.insertBallotVersionStmt, insertBallotVersionSql},
+		{&s.getBallotHistoryStmt, getBallotHistorySql},
+		{&s.getLockedWeeksStmt, getLockedWeeksSql},
+	}
+	for _, v := range stmts {
+		var err error
+		*v.stmt, err = db.Prepare(v.sql)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", v.sql, err)
+		}
+	}
+	//Without the fts5 index movies are searched with LIKE
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'movies_fts_insert'").Scan(&n)
 	if err != nil {
 		return nil, err
 	}
-	u.Abilities, err = GetUserAbilities(u.Id)
-	if err != nil {
-		return u, err
+	if n > 0 {
+		s.searchMoviesStmt, err = db.Prepare(searchMoviesSql)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", searchMoviesSql, err)
+		}
 	}
-	return u, nil
+	return s, nil
 }
 
-var resetPasswordStmt *sql.Stmt
-
-const resetPasswordSql = `UPDATE users SET ott = ? WHERE email = ?`
+const getUserPasswordSql = `SELECT id, name, email, password FROM users WHERE email = ? AND password IS NOT NULL LIMIT 1`
 
-func ResetPassword(email, ott string) (*User, error) {
-	_, err := resetPasswordStmt.Exec(ott, email)
+func (s *SQLiteStore) GetUserPassword(email string) (*User, string, error) {
+	u := new(User)
+	var encoded string
+	err := s.getUserPasswordStmt.QueryRow(email).Scan(&u.Id, &u.Name, &u.Email, &encoded)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	u.Abilities, err = s.GetUserAbilities(u.Id)
+	if err != nil {
+		return u, encoded, err
 	}
-	return GetUserForEmail(email)
+	return u, encoded, nil
+}
+
+const setUserPasswordSql = `UPDATE users SET password = ? WHERE id = ?`
+
+func (s *SQLiteStore) SetUserPassword(userId int, hash string) error {
+	_, err := s.setUserPasswordStmt.Exec(hash, userId)
+	return err
 }
 
-var registerUserStmt *sql.Stmt
+const setUserOttSql = `UPDATE users SET ott = ? WHERE email = ?`
+
+func (s *SQLiteStore) SetUserOtt(email, ott string) error {
+	_, err := s.setUserOttStmt.Exec(ott, email)
+	return err
+}
 
 const registerUserSql = `INSERT INTO users (name, email, ott) VALUES(?,?,?)`
 
-func RegisterUser(name, email, ott string) (*User, error) {
-	res, err := registerUserStmt.Exec(name, email, ott)
+func (s *SQLiteStore) RegisterUser(name, email, ott string) (*User, error) {
+	res, err := s.registerUserStmt.Exec(name, email, ott)
 	if err != nil {
 		return nil, err
 	}
@@ -134,150 +414,211 @@ func RegisterUser(name, email, ott string) (*User, error) {
 	return u, nil
 }
 
-var finishRegistrationStmt *sql.Stmt
-
-const finishRegistrationSql = `UPDATE users SET ott = NULL, password = ? WHERE ott = ?`
+const completeRegistrationSql = `UPDATE users SET ott = NULL, password = ? WHERE ott = ?`
 
-func FinishRegistration(ott, password string) (*User, error) {
-	sum := sha512.Sum512_256([]byte(*salt + password))
-	sep := base64.StdEncoding.EncodeToString(sum[:])
-	u, err := GetUserForOtt(ott)
+func (s *SQLiteStore) CompleteRegistration(ott, hash string) (*User, error) {
+	u, err := s.GetUserForOtt(ott)
 	if err != nil {
 		return nil, err
 	}
-	_, err = finishRegistrationStmt.Exec(sep, ott)
+	_, err = s.completeRegistrationStmt.Exec(hash, ott)
 	if err != nil {
 		return nil, err
 	}
-	u.Abilities, err = GetUserAbilities(u.Id)
-	if err != nil {
-		return u, err
-	}
 	return u, nil
 }
 
-var getUserStmt *sql.Stmt
-
-const getUserSql = `SELECT id, name, email, weekly_not, lock_not, act_not, giftcard, giftcardpin, rewardcard, zip, phone, carrier FROM users WHERE id = ? LIMIT 1`
+const getUserSql = `SELECT id, name, email, weekly_not, lock_not, act_not, giftcard, giftcardpin, rewardcard, zip, phone, carrier, timezone FROM users WHERE id = ? LIMIT 1`
 
-func GetUser(id int) (*User, error) {
+func (s *SQLiteStore) GetUser(id int) (*User, error) {
 	u := new(User)
-	err := getUserStmt.QueryRow(id).Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification, &u.GiftCard, &u.GiftCardPin, &u.RewardCard, &u.Zip, &u.Phone, &u.Carrier)
+	err := s.getUserStmt.QueryRow(id).Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification, &u.GiftCard, &u.GiftCardPin, &u.RewardCard, &u.Zip, &u.Phone, &u.Carrier, &u.TimeZone)
 	if err != nil {
 		return nil, err
 	}
-	u.Abilities, err = GetUserAbilities(u.Id)
+	u.Abilities, err = s.GetUserAbilities(u.Id)
 	if err != nil {
 		return u, err
 	}
 	return u, nil
 }
 
-var getUserForEmailStmt *sql.Stmt
+const getUserForEmailSql = `SELECT id, name, email, weekly_not, lock_not, act_not, giftcard, giftcardpin, rewardcard, zip, phone, carrier, timezone FROM users WHERE email LIKE ? LIMIT 1`
 
-const getUserForEmailSql = `SELECT id, name, email, weekly_not, lock_not, act_not, giftcard, giftcardpin, rewardcard, zip, phone, carrier FROM users WHERE email LIKE ? LIMIT 1`
-
-func GetUserForEmail(email string) (*User, error) {
+func (s *SQLiteStore) GetUserForEmail(email string) (*User, error) {
 	u := new(User)
-	err := getUserForEmailStmt.QueryRow(email).Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification, &u.GiftCard, &u.GiftCardPin, &u.RewardCard, &u.Zip, &u.Phone, &u.Carrier)
+	err := s.getUserForEmailStmt.QueryRow(email).Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification, &u.GiftCard, &u.GiftCardPin, &u.RewardCard, &u.Zip, &u.Phone, &u.Carrier, &u.TimeZone)
 	if err != nil {
 		return nil, err
 	}
-	u.Abilities, err = GetUserAbilities(u.Id)
+	u.Abilities, err = s.GetUserAbilities(u.Id)
 	if err != nil {
 		return u, err
 	}
 	return u, nil
 }
 
-var getUserForOttStmt *sql.Stmt
-
 const getUserForOttSql = `SELECT id, name, email FROM users WHERE ott = ? LIMIT 1`
 
-func GetUserForOtt(ott string) (*User, error) {
+func (s *SQLiteStore) GetUserForOtt(ott string) (*User, error) {
 	u := new(User)
-	err := getUserForOttStmt.QueryRow(ott).Scan(&u.Id, &u.Name, &u.Email)
+	err := s.getUserForOttStmt.QueryRow(ott).Scan(&u.Id, &u.Name, &u.Email)
 	if err != nil {
 		return nil, err
 	}
-	u.Abilities, err = GetUserAbilities(u.Id)
+	u.Abilities, err = s.GetUserAbilities(u.Id)
 	if err != nil {
 		return u, err
 	}
 	return u, nil
 }
 
-var getUserAbilitiesStmt *sql.Stmt
+const getUserAbilitiesSql = `SELECT ability FROM abilities WHERE userid = ?
+UNION
+SELECT ra.ability FROM user_roles ur, role_abilities ra WHERE ur.role = ra.role AND ur.userid = ?`
+
+// Returns the effective abilities of a user, both those granted directly and those that come
+// from the users roles
+func (s *SQLiteStore) GetUserAbilities(userId int) ([]string, error) {
+	return queryStrings(s.getUserAbilitiesStmt, userId, userId)
+}
+
+var getUserDirectAbilitiesStmt *sql.Stmt
+
+const getUserDirectAbilitiesSql = `SELECT ability FROM abilities WHERE userid = ? ORDER BY ability`
+
+func GetUserDirectAbilities(userId int) ([]string, error) {
+	return queryStrings(getUserDirectAbilitiesStmt, userId)
+}
+
+var getUserRolesStmt *sql.Stmt
+
+const getUserRolesSql = `SELECT role FROM user_roles WHERE userid = ? ORDER BY role`
 
-const getUserAbilitiesSql = `SELECT ability FROM abilities WHERE userid = ?`
+func GetUserRoles(userId int) ([]string, error) {
+	return queryStrings(getUserRolesStmt, userId)
+}
 
-func GetUserAbilities(userId int) ([]string, error) {
-	abilities := make([]string, 0)
-	rows, err := getUserAbilitiesStmt.Query(userId)
+func queryStrings(stmt *sql.Stmt, args ...interface{}) ([]string, error) {
+	ret := make([]string, 0)
+	rows, err := stmt.Query(args...)
 	if err != nil {
-		return abilities, err
+		return ret, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var ability string
-		rows.Scan(&ability)
-		abilities = append(abilities, ability)
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+var grantAbilityStmt *sql.Stmt
+
+const grantAbilitySql = `INSERT OR IGNORE INTO abilities (userid, ability) VALUES (?,?)`
+
+func GrantAbility(actorId, userId int, ability string) error {
+	return execWithAudit(actorId, "ability.grant", fmt.Sprintf("user:%d", userId), ability, grantAbilityStmt, userId, ability)
+}
+
+var revokeAbilityStmt *sql.Stmt
+
+const revokeAbilitySql = `DELETE FROM abilities WHERE userid = ? AND ability = ?`
+
+func RevokeAbility(actorId, userId int, ability string) error {
+	return execWithAudit(actorId, "ability.revoke", fmt.Sprintf("user:%d", userId), ability, revokeAbilityStmt, userId, ability)
+}
+
+var assignRoleStmt *sql.Stmt
+
+const assignRoleSql = `INSERT OR IGNORE INTO user_roles (userid, role) VALUES (?,?)`
+
+func AssignRole(actorId, userId int, role string) error {
+	return execWithAudit(actorId, "role.assign", fmt.Sprintf("user:%d", userId), role, assignRoleStmt, userId, role)
+}
+
+var unassignRoleStmt *sql.Stmt
+
+const unassignRoleSql = `DELETE FROM user_roles WHERE userid = ? AND role = ?`
+
+func UnassignRole(actorId, userId int, role string) error {
+	return execWithAudit(actorId, "role.unassign", fmt.Sprintf("user:%d", userId), role, unassignRoleStmt, userId, role)
+}
+
+var insertAuditStmt *sql.Stmt
+
+const insertAuditSql = `INSERT INTO audit (created, actorid, action, subject, detail) VALUES (?,?,?,?,?)`
+
+// Runs the statement and records who did it in the audit table, all within one transaction
+func execWithAudit(actorId int, action, subject, detail string, stmt *sql.Stmt, args ...interface{}) error {
+	commit := false
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	_, err = tx.Stmt(stmt).Exec(args...)
+	if err != nil {
+		return err
 	}
-	return abilities, nil
+	_, err = tx.Stmt(insertAuditStmt).Exec(time.Now().UTC(), actorId, action, subject, detail)
+	if err != nil {
+		return err
+	}
+	commit = true
+	return nil
 }
 
-func GetUsersForPreference(n PreferenceType) ([]*User, error) {
+func (s *SQLiteStore) GetUsersForPreference(groupId int, n PreferenceType) ([]*User, error) {
 	users := make([]*User, 0)
-	rows, err := db.Query("SELECT id, name, email, weekly_not, lock_not, act_not FROM users WHERE " + n.String() + " = 1 AND ott IS NULL AND password IS NOT NULL")
+	rows, err := s.db.Query("SELECT u.id, u.name, u.email, u.weekly_not, u.lock_not, u.act_not, u.timezone FROM users u, group_members gm WHERE gm.userid = u.id AND gm.groupid = ? AND u."+n.String()+" = 1 AND u.ott IS NULL AND u.password IS NOT NULL", groupId)
 	if err != nil {
 		return users, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		u := new(User)
-		rows.Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification)
+		rows.Scan(&u.Id, &u.Name, &u.Email, &u.WeeklyNotification, &u.LockNotification, &u.ActivityNotification, &u.TimeZone)
 		users = append(users, u)
 	}
 	return users, nil
 }
 
-var updateUserPrefsStmt *sql.Stmt
-
-const updateUserPrefsSql = `UPDATE users SET weekly_not = ?, lock_not = ?, act_not = ?, giftcard = ?, giftcardpin = ?, rewardcard = ?, zip = ?, phone = ?, carrier = ? WHERE id = ?`
+const updateUserPrefsSql = `UPDATE users SET weekly_not = ?, lock_not = ?, act_not = ?, giftcard = ?, giftcardpin = ?, rewardcard = ?, zip = ?, phone = ?, carrier = ?, timezone = ? WHERE id = ?`
 
-func UpdateUserPrefs(user *User) error {
-	_, err := updateUserPrefsStmt.Exec(user.WeeklyNotification, user.LockNotification, user.ActivityNotification, user.GiftCard, user.GiftCardPin, user.RewardCard, user.Zip, user.Phone, user.Carrier, user.Id)
+func (s *SQLiteStore) UpdateUserPrefs(user *User) error {
+	_, err := s.updateUserPrefsStmt.Exec(user.WeeklyNotification, user.LockNotification, user.ActivityNotification, user.GiftCard, user.GiftCardPin, user.RewardCard, user.Zip, user.Phone, user.Carrier, user.TimeZone, user.Id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func ScrubUser(user *User) *User {
-	user.GiftCard = ""
-	user.GiftCardPin = ""
-	user.RewardCard = ""
-	user.Zip = ""
-	user.Phone = ""
-	user.Carrier = ""
-	return user
-}
-
-var getShowtimeStmt *sql.Stmt
-
-const getShowtimeSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.location, st.address, st.preview, st.buy, m.id, m.imdb, m.title, m.json, IFNULL(SUM(v.votes),0) votes  
+const getShowtimeSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.theatreid, IFNULL(t.name,''), IFNULL(t.address,''), st.preview, st.buy, st.provider, st.cancelled, st.changed, m.id, m.imdb, m.title, m.json, IFNULL(SUM(v.votes),0) votes  
 FROM showtimes st, movies m 
-LEFT JOIN votes v ON st.id = v.showtimeid 
+LEFT JOIN theatres t ON st.theatreid = t.id 
+LEFT JOIN votes v ON st.id = v.showtimeid AND (? = 0 OR v.groupid = ?) 
 WHERE st.movieid = m.id 
-AND st.id = ?`
+AND st.id = ?
+GROUP BY st.id`
 
-func GetShowtime(id int) (*Showtime, error) {
+func (s *SQLiteStore) GetShowtime(groupId, id int) (*Showtime, error) {
 	var mid int
 	var mi string
 	var mt string
 	var j string
 	st := new(Showtime)
-	err := getShowtimeStmt.QueryRow(id).Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &mid, &mi, &mt, &j, &st.Votes)
+	err := s.getShowtimeStmt.QueryRow(groupId, groupId, id).Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.TheatreId, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &st.Provider, &st.Cancelled, &st.Changed, &mid, &mi, &mt, &j, &st.Votes)
 	if err != nil {
 		return nil, err
 	}
@@ -286,39 +627,41 @@ func GetShowtime(id int) (*Showtime, error) {
 	if err != nil {
 		return st, err
 	}
-	m.Id = id
+	m.Id = mid
 	m.Imdb = mi
 	m.MegaPlexTitle = mt
 	st.Movie = m
 	return st, nil
 }
 
-var getShowtimesForWeekOfStmt *sql.Stmt
-
-const getShowtimesForWeekOfSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.location, st.address, st.preview, st.buy, m.id, m.imdb, m.title, m.json,
-	IFNULL(SUM(v.votes),0) globalvotes, IFNULL(pv.votes,0) personvote
+const getShowtimesForWeekOfSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.theatreid, IFNULL(t.name,''), IFNULL(t.address,''), st.preview, st.buy, st.provider, st.cancelled, st.changed, m.id, m.imdb, m.title, m.json,
+	IFNULL(SUM(v.votes),0) globalvotes, IFNULL(SUM(v.veto),0) vetoes, IFNULL(pv.votes,0) personvote, IFNULL(pv.veto,0) personveto
 FROM showtimes st, movies m
-LEFT JOIN votes v ON st.id = v.showtimeid
-LEFT JOIN votes pv ON st.id = pv.showtimeid AND pv.userid = ?
+LEFT JOIN theatres t ON st.theatreid = t.id
+LEFT JOIN votes v ON st.id = v.showtimeid AND v.groupid = ?
+LEFT JOIN votes pv ON st.id = pv.showtimeid AND pv.groupid = ? AND pv.userid = ?
 WHERE st.movieid = m.id
+AND st.cancelled = 0
 AND strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?)
+AND (st.theatreid IN (SELECT gt.theatreid FROM group_theatres gt WHERE gt.groupid = ?) OR NOT EXISTS (SELECT 1 FROM group_theatres gt WHERE gt.groupid = ?))
+AND NOT EXISTS (SELECT 1 FROM showtime_hides h WHERE h.groupid = ? AND h.showtimeid = st.id AND h.restored IS NULL)
 GROUP BY st.id
-HAVING globalvotes > -3
 ORDER BY globalvotes DESC, st.showtime ASC`
 
-func GetShowtimesForWeekOf(bow, eow time.Time, userId int) ([]*Showtime, error) {
+func (s *SQLiteStore) GetShowtimesForWeekOf(groupId int, bow, eow time.Time, userId int) ([]*Showtime, error) {
 	showtimes := make([]*Showtime, 0)
-	rows, err := getShowtimesForWeekOfStmt.Query(userId, bow, eow)
+	rows, err := s.getShowtimesForWeekOfStmt.Query(groupId, groupId, userId, bow, eow, groupId, groupId, groupId)
 	if err != nil {
 		return showtimes, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		st := new(Showtime)
 		var mid int
 		var mi string
 		var mt string
 		var j string
-		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &mid, &mi, &mt, &j, &st.Votes, &st.Vote)
+		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.TheatreId, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &st.Provider, &st.Cancelled, &st.Changed, &mid, &mi, &mt, &j, &st.Votes, &st.Vetoes, &st.Vote, &st.Veto)
 		if err != nil {
 			return showtimes, err
 		}
@@ -337,58 +680,19 @@ func GetShowtimesForWeekOf(bow, eow time.Time, userId int) ([]*Showtime, error)
 	return showtimes, nil
 }
 
-var getTopShowtimesForWeekOfStmt *sql.Stmt
-
-const getTopShowtimesForWeekOfSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.location, st.address, st.preview, st.buy, m.id, m.imdb, m.title, m.json,
-	IFNULL(SUM(v.votes),0) globalvotes
-FROM showtimes st, movies m
-LEFT JOIN votes v ON st.id = v.showtimeid
-WHERE st.movieid = m.id
-AND strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?)
-GROUP BY st.id
-ORDER BY globalvotes DESC, st.showtime ASC LIMIT ?`
-
-func GetTopShowtimesForWeekOf(bow, eow time.Time, topN int) ([]*Showtime, error) {
-	showtimes := make([]*Showtime, 0)
-	rows, err := getTopShowtimesForWeekOfStmt.Query(bow, eow, topN)
-	if err != nil {
-		return showtimes, err
-	}
-	for rows.Next() {
-		st := new(Showtime)
-		var mid int
-		var mi string
-		var mt string
-		var j string
-		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &mid, &mi, &mt, &j, &st.Votes)
-		if err != nil {
-			return showtimes, err
-		}
-		m := new(Movie)
-		err := json.Unmarshal([]byte(j), &m)
-		if err != nil {
-			return showtimes, err
-		}
-		m.Id = mid
-		m.Imdb = mi
-		m.MegaPlexTitle = mt
-		st.Movie = m
-		showtimes = append(showtimes, st)
-	}
-	return showtimes, nil
-}
-
-var deleteVotesForUserStmt *sql.Stmt
-
-const deleteVotesForUserSql = `DELETE FROM votes WHERE userid = ? AND showtimeid IN (SELECT st.id FROM showtimes st WHERE strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?))`
+const weekLockedSql = `SELECT COUNT(*) FROM weeks WHERE groupid = ? AND weekof = ? AND locked IS NOT NULL`
+const deleteVotesForUserSql = `DELETE FROM votes WHERE groupid = ? AND userid = ? AND showtimeid IN (SELECT st.id FROM showtimes st WHERE strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?))`
 
-var insertVotesForUserStmt *sql.Stmt
+const insertVotesForUserSql = `INSERT INTO votes (groupid, userid, showtimeid, votes, veto) VALUES (?,?,?,?,?)`
 
-const insertVotesForUserSql = `INSERT INTO votes (userid, showtimeid, votes) VALUES (?,?,?)`
+const insertBallotVersionSql = `INSERT INTO ballot_history (groupid, userid, weekof, votes, vetoes, created) VALUES (?,?,?,?,?,?)`
 
-func InsertVotesForUser(bow, eow time.Time, userId int, votes []*Showtime) error {
+func (s *SQLiteStore) InsertVotesForUser(groupId int, bow, eow time.Time, userId int, votes []*Showtime) error {
 	commit := false
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if commit {
 			tx.Commit()
@@ -396,36 +700,95 @@ func InsertVotesForUser(bow, eow time.Time, userId int, votes []*Showtime) error
 			tx.Rollback()
 		}
 	}()
+	//The lock is checked along with the write, so that a ballot can't land after the lock
+	var locked int
+	err = tx.Stmt(s.weekLockedStmt).QueryRow(groupId, bow.Unix()).Scan(&locked)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Stmt(deleteVotesForUserStmt).Exec(userId, bow, eow)
+	if locked > 0 {
+		return ErrWeekLocked
+	}
+	_, err = tx.Stmt(s.deleteVotesForUserStmt).Exec(groupId, userId, bow, eow)
 	if err != nil {
 		return err
 	}
-	stmt := tx.Stmt(insertVotesForUserStmt)
+	stmt := tx.Stmt(s.insertVotesForUserStmt)
 	defer stmt.Close()
 
+	bv := map[int]int{}
+	vetoes := []int{}
 	for _, v := range votes {
-		_, err = stmt.Exec(userId, v.Id, v.Vote)
+		_, err = stmt.Exec(groupId, userId, v.Id, v.Vote, v.Veto)
 		if err != nil {
 			return err
 		}
+		if v.Vote != 0 {
+			bv[v.Id] = v.Vote
+		}
+		if v.Veto {
+			vetoes = append(vetoes, v.Id)
+		}
+	}
+	bj, err := json.Marshal(bv)
+	if err != nil {
+		return err
+	}
+	vj, err := json.Marshal(vetoes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.insertBallotVersionStmt).Exec(groupId, userId, bow.Unix(), string(bj), string(vj), time.Now().UTC())
+	if err != nil {
+		return err
 	}
 	commit = true
 	return nil
 }
 
-var getMovieByTitleStmt *sql.Stmt
+const getBallotHistorySql = `SELECT id, groupid, userid, weekof, votes, vetoes, created FROM ballot_history WHERE groupid = ? AND weekof = ? ORDER BY id`
+
+func (s *SQLiteStore) GetBallotHistory(groupId int, bow time.Time) ([]*BallotVersion, error) {
+	history := make([]*BallotVersion, 0)
+	rows, err := s.getBallotHistoryStmt.Query(groupId, bow.Unix())
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		bv := new(BallotVersion)
+		var weekOf int64
+		var votes, vetoes string
+		err = rows.Scan(&bv.Id, &bv.GroupId, &bv.UserId, &weekOf, &votes, &vetoes, &bv.Created)
+		if err != nil {
+			return history, err
+		}
+		err = json.Unmarshal([]byte(votes), &bv.Votes)
+		if err != nil {
+			return history, err
+		}
+		err = json.Unmarshal([]byte(vetoes), &bv.Vetoes)
+		if err != nil {
+			return history, err
+		}
+		bv.WeekOf = time.Unix(weekOf, 0).UTC()
+		history = append(history, bv)
+	}
+	return history, rows.Err()
+}
 
-const getMovieByTitleSql = `SELECT m.id, m.imdb, m.title, m.json FROM movies m WHERE title = ? LIMIT 1`
+// Titles that were merged into another movie resolve to that movie
+const getMovieByTitleSql = `SELECT m.id, m.imdb, m.title, m.json FROM movies m WHERE m.title = ? COLLATE NOCASE
+UNION ALL
+SELECT m.id, m.imdb, m.title, m.json FROM movies m, movie_aliases a WHERE a.movieid = m.id AND a.title = ?
+LIMIT 1`
 
-func GetMovieByTitle(title string) (*Movie, error) {
+func (s *SQLiteStore) GetMovieByTitle(title string) (*Movie, error) {
 	m := new(Movie)
 	var id int
 	var imdb string
 	var j string
-	err := getMovieByTitleStmt.QueryRow(title).Scan(&id, &imdb, &title, &j)
+	err := s.getMovieByTitleStmt.QueryRow(title, title).Scan(&id, &imdb, &title, &j)
 	if err != nil {
 		return nil, err
 	}
@@ -439,16 +802,14 @@ func GetMovieByTitle(title string) (*Movie, error) {
 	return m, nil
 }
 
-var getMovieStmt *sql.Stmt
-
-const getMovieSql = `SELECT m.id, m.imdb, m.title, m.json FROM movies m WHERE id = ? LIMIT 1`
-
-func GetMovie(id int) (*Movie, error) {
+func scanMovie(row interface {
+	Scan(dest ...interface{}) error
+}) (*Movie, error) {
 	m := new(Movie)
 	var j string
-	err := getMovieStmt.QueryRow(id).Scan(&m.Id, &m.Imdb, &m.MegaPlexTitle, &j)
+	err := row.Scan(&m.Id, &m.Imdb, &m.MegaPlexTitle, &j)
 	if err != nil {
-		return InsertMovieByIMDBId(fmt.Sprintf("tt%d", id), "")
+		return nil, err
 	}
 	err = json.Unmarshal([]byte(j), &m)
 	if err != nil {
@@ -457,23 +818,26 @@ func GetMovie(id int) (*Movie, error) {
 	return m, nil
 }
 
-var insertMovieStmt *sql.Stmt
+const getMovieSql = `SELECT m.id, m.imdb, m.title, m.json FROM movies m WHERE id = ? LIMIT 1`
+
+func (s *SQLiteStore) GetMovie(id int) (*Movie, error) {
+	return scanMovie(s.getMovieStmt.QueryRow(id))
+}
 
 const insertMovieSql = "INSERT OR REPLACE INTO movies (id, imdb, title, json) VALUES (?,?,?,?)"
 
-func InsertMovie(movie *Movie) (*Movie, error) {
+func (s *SQLiteStore) InsertMovie(movie *Movie) (*Movie, error) {
 	b, err := json.Marshal(&movie)
 	if err != nil {
 		return movie, err
 	}
-	var id int
-	_, err = fmt.Sscanf(movie.Imdb, "tt%d", &id)
+	id, err := movieIdFor(movie)
 	if err != nil {
 		return movie, err
 	}
 	movie.Id = id
 	//Insert/Replace the movie into the database
-	_, err = insertMovieStmt.Exec(id, movie.Imdb, movie.MegaPlexTitle, b)
+	_, err = s.insertMovieStmt.Exec(id, movie.Imdb, movie.MegaPlexTitle, b)
 	if err != nil {
 		return movie, err
 	}
@@ -481,134 +845,1333 @@ func InsertMovie(movie *Movie) (*Movie, error) {
 	return movie, nil
 }
 
-func InsertMovieByTitle(title, year string) (*Movie, error) {
-	//Utilize omdb api to fetch Json
-	values := url.Values{}
-	values.Set("t", title)
-	values.Set("y", year)
-	values.Set("plot", "full")
-	values.Set("r", "json")
-	values.Set("tomatoes", "true")
-	resp, err := http.Get("http://www.omdbapi.com/?" + values.Encode())
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	movie := new(Movie)
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&movie)
-	if err != nil {
-		return nil, err
-	}
-	movie.MegaPlexTitle = title
-	return InsertMovie(movie)
+func (s *SQLiteStore) InsertMovieAlias(title string, movieId int) error {
+	_, err := s.insertMovieAliasStmt.Exec(title, movieId)
+	return err
 }
 
-func InsertMovieByIMDBId(imdbId string, title string) (*Movie, error) {
-	var id int
-	_, err := fmt.Sscanf(imdbId, "tt%d", &id)
+const migrateShowtimeSql = `UPDATE showtimes SET movieid = ? WHERE movieid = ?`
+const deleteMovieSql = `DELETE FROM movies WHERE id = ?`
+
+const insertShowtimeSql = `INSERT INTO showtimes (movieid, showtime, screen, theatreid, preview, buy, provider, cancelled) VALUES (?,?,?,?,?,?,?,?)`
+
+func (s *SQLiteStore) InsertShowtime(st *Showtime) (*Showtime, error) {
+	//Instants are stored in utc, they are shown in the zone of whoever is looking
+	st.Showtime = st.Showtime.UTC()
+	r, err := s.insertShowtimeStmt.Exec(st.MovieId, st.Showtime, st.Screen, st.TheatreId, st.PreviewSeatsLink, st.BuyTicketsLink, st.Provider, st.Cancelled)
 	if err != nil {
 		return nil, err
 	}
-	//Utilize omdb api to fetch Json
-	values := url.Values{}
-	values.Set("i", imdbId)
-	values.Set("plot", "full")
-	values.Set("r", "json")
-	values.Set("tomatoes", "true")
-	resp, err := http.Get("http://www.omdbapi.com/?" + values.Encode())
-	if err != nil {
-		return nil, err
+	if t, err := s.GetTheatre(st.TheatreId); err == nil {
+		st.Location = t.Name
+		st.Address = t.Address
 	}
-	defer resp.Body.Close()
-
-	movie := new(Movie)
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&movie)
+	lid, err := r.LastInsertId()
 	if err != nil {
-		return nil, err
-	}
-	if title == "" {
-		title = movie.Title
+		return st, err
 	}
-	movie.MegaPlexTitle = title
-	return InsertMovie(movie)
-}
-
-func InsertDummyMovie(title string) (*Movie, error) {
-	movie := new(Movie)
-	movie.Id = rand.Int()
-	movie.MegaPlexTitle = title
-	movie.Title = title
-	movie.Imdb = fmt.Sprintf("tt%d", movie.Id)
-	return InsertMovie(movie)
+	st.Id = int(lid)
+	return st, nil
 }
 
-var migrateShowtimeStmt *sql.Stmt
-
-const migrateShowtimeSql = `UPDATE showtimes SET movieid = ? WHERE movieid = ?`
+const updateShowtimeSql = `UPDATE showtimes SET movieid = ?, showtime = ?, screen = ?, buy = ?, cancelled = ?, changed = ? WHERE id = ?`
 
-func MigrateShowtimesToNewMovieId(oldMovieId, movieId int) error {
-	_, err := migrateShowtimeStmt.Exec(movieId, oldMovieId)
+func (s *SQLiteStore) UpdateShowtime(st *Showtime) error {
+	st.Showtime = st.Showtime.UTC()
+	_, err := s.updateShowtimeStmt.Exec(st.MovieId, st.Showtime, st.Screen, st.BuyTicketsLink, st.Cancelled, st.Changed, st.Id)
 	return err
 }
 
-var deleteMovieStmt *sql.Stmt
-
-const deleteMovieSql = `DELETE FROM movies WHERE id = ?`
+const getShowtimeForPerformanceSql = `SELECT st.id FROM showtimes st WHERE st.provider = ? AND st.theatreid = ? AND st.preview = ?`
 
-func DeleteMovie(movieId int) error {
-	_, err := deleteMovieStmt.Exec(movieId)
-	return err
+func (s *SQLiteStore) GetShowtimeForPerformance(provider, theatreId, performance string) (*Showtime, error) {
+	var id int
+	err := s.getShowtimeForPerformanceStmt.QueryRow(provider, theatreId, performance).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetShowtime(0, id)
 }
 
-var insertShowtimeStmt *sql.Stmt
-
-const insertShowtimeSql = `INSERT INTO showtimes (movieid, showtime, screen, location, address, preview, buy) VALUES (?,?,?,?,?,?,?)`
+const getShowtimesForTheatreSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.theatreid, IFNULL(t.name,''), IFNULL(t.address,''), st.preview, st.buy, st.provider, st.cancelled, st.changed, m.id, m.imdb, m.title, m.json
+FROM showtimes st, movies m
+LEFT JOIN theatres t ON st.theatreid = t.id
+WHERE st.movieid = m.id
+AND st.provider = ? AND st.theatreid = ?
+AND strftime('%s', st.showtime) >= strftime('%s', ?) AND strftime('%s', st.showtime) < strftime('%s', ?)
+ORDER BY st.showtime ASC, st.id ASC`
 
-func InsertShowtime(movieId int, showtime time.Time, screen string, location string, address string, preview string, buy string) (*Showtime, error) {
-	r, err := insertShowtimeStmt.Exec(movieId, showtime, screen, location, address, preview, buy)
+func (s *SQLiteStore) GetShowtimesForTheatre(provider, theatreId string, from, to time.Time) ([]*Showtime, error) {
+	showtimes := make([]*Showtime, 0)
+	rows, err := s.getShowtimesForTheatreStmt.Query(provider, theatreId, from, to)
 	if err != nil {
-		return nil, err
+		return showtimes, err
 	}
-	st := new(Showtime)
-	st.MovieId = movieId
-	st.Showtime = showtime
-	st.Screen = screen
-	st.Location = location
-	st.Address = address
-	st.PreviewSeatsLink = preview
-	st.BuyTicketsLink = buy
-	lid, err := r.LastInsertId()
-	if err != nil {
-		return st, err
+	defer rows.Close()
+	for rows.Next() {
+		st := new(Showtime)
+		var mid int
+		var mi string
+		var mt string
+		var j string
+		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.TheatreId, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &st.Provider, &st.Cancelled, &st.Changed, &mid, &mi, &mt, &j)
+		if err != nil {
+			return showtimes, err
+		}
+		m := new(Movie)
+		err := json.Unmarshal([]byte(j), &m)
+		if err != nil {
+			return showtimes, err
+		}
+		m.Id = mid
+		m.Imdb = mi
+		m.MegaPlexTitle = mt
+		st.Movie = m
+		showtimes = append(showtimes, st)
 	}
-	st.Id = int(lid)
-
-	return st, nil
+	return showtimes, nil
 }
 
-func LockVoteForWinner(bow, eow time.Time, winner *Showtime) error {
-	v := new(Showtime)
-	v.Id = winner.Id
-	v.MovieId = winner.MovieId
-	v.Screen = winner.Screen
-	v.Showtime = winner.Showtime
-	v.Vote = 1000
-	return InsertVotesForUser(bow, eow, 0, []*Showtime{v})
-}
+const insertRsvpSql = `INSERT INTO rsvps (groupid,userid,showtimeid,value) VALUES (?,?,?,?)`
 
-func AdminDownvote(showtimeId int) error {
-	_, err := insertVotesForUserStmt.Exec(0, showtimeId, -5)
+func (s *SQLiteStore) InsertRsvp(groupId int, userId int, showtimeId int, value string) error {
+	_, err := s.insertRsvpStmt.Exec(groupId, userId, showtimeId, value)
 	return err
 }
 
-var insertRsvpStmt *sql.Stmt
-
-const insertRsvpSql = `INSERT INTO rsvps (userid,showtimeid,value) VALUES (?,?,?)`
+const getRsvpsSql = `SELECT groupid, userid, showtimeid, value FROM rsvps WHERE groupid = ? AND showtimeid = ? ORDER BY userid`
 
-func InsertRsvp(userId int, showtimeId int, value string) error {
-	_, err := insertRsvpStmt.Exec(userId, showtimeId, value)
+func (s *SQLiteStore) GetRsvps(groupId, showtimeId int) ([]*Rsvp, error) {
+	rsvps := make([]*Rsvp, 0)
+	rows, err := s.getRsvpsStmt.Query(groupId, showtimeId)
+	if err != nil {
+		return rsvps, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := new(Rsvp)
+		err = rows.Scan(&r.GroupId, &r.UserId, &r.ShowtimeId, &r.Value)
+		if err != nil {
+			return rsvps, err
+		}
+		rsvps = append(rsvps, r)
+	}
+	return rsvps, nil
+}
+
+const migrateVotesSql = `INSERT INTO votes (groupid, userid, showtimeid, votes, veto) SELECT groupid, userid, ?, votes, veto FROM votes WHERE groupid = ? AND showtimeid = ?
+ON CONFLICT(groupid, userid, showtimeid) DO UPDATE SET votes = MAX(votes.votes, excluded.votes), veto = MAX(votes.votes, excluded.votes) <= 0 AND MAX(votes.veto, excluded.veto)`
+const deleteShowtimeVotesSql = `DELETE FROM votes WHERE groupid = ? AND showtimeid = ?`
+const migrateRsvpsSql = `UPDATE OR REPLACE rsvps SET showtimeid = ? WHERE groupid = ? AND showtimeid = ?`
+const migrateWeekLockSql = `UPDATE weeks SET showtimeid = ? WHERE groupid = ? AND showtimeid = ?`
+
+func (s *SQLiteStore) MigrateVotes(groupId, fromShowtimeId, toShowtimeId int) error {
+	commit := false
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	_, err = tx.Stmt(s.migrateVotesStmt).Exec(toShowtimeId, groupId, fromShowtimeId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.deleteShowtimeVotesStmt).Exec(groupId, fromShowtimeId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.migrateRsvpsStmt).Exec(toShowtimeId, groupId, fromShowtimeId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.migrateWeekLockStmt).Exec(toShowtimeId, groupId, fromShowtimeId)
+	if err != nil {
+		return err
+	}
+	commit = true
+	return nil
+}
+
+const getCancelledShowtimesForWeekOfSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.theatreid, IFNULL(t.name,''), IFNULL(t.address,''), st.preview, st.buy, st.provider, st.cancelled, st.changed, m.id, m.imdb, m.title, m.json,
+	SUM(v.votes) globalvotes
+FROM showtimes st, movies m, votes v
+LEFT JOIN theatres t ON st.theatreid = t.id
+WHERE st.movieid = m.id
+AND st.id = v.showtimeid AND v.groupid = ?
+AND st.cancelled = 1
+AND strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?)
+GROUP BY st.id
+ORDER BY globalvotes DESC, st.showtime ASC`
+
+func (s *SQLiteStore) GetCancelledShowtimesForWeekOf(groupId int, bow, eow time.Time) ([]*Showtime, error) {
+	showtimes := make([]*Showtime, 0)
+	rows, err := s.getCancelledShowtimesForWeekOfStmt.Query(groupId, bow, eow)
+	if err != nil {
+		return showtimes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		st := new(Showtime)
+		var mid int
+		var mi string
+		var mt string
+		var j string
+		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.TheatreId, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &st.Provider, &st.Cancelled, &st.Changed, &mid, &mi, &mt, &j, &st.Votes)
+		if err != nil {
+			return showtimes, err
+		}
+		m := new(Movie)
+		err := json.Unmarshal([]byte(j), &m)
+		if err != nil {
+			return showtimes, err
+		}
+		m.Id = mid
+		m.Imdb = mi
+		m.MegaPlexTitle = mt
+		st.Movie = m
+		showtimes = append(showtimes, st)
+	}
+	return showtimes, nil
+}
+
+const getInviteSql = `SELECT groupid, weekof, showtimeid, showtime, sequence, cancelled FROM invites WHERE groupid = ? AND weekof = ?`
+
+func (s *SQLiteStore) GetInvite(groupId int, bow time.Time) (*Invite, error) {
+	inv := new(Invite)
+	var weekOf int64
+	err := s.getInviteStmt.QueryRow(groupId, bow.Unix()).Scan(&inv.GroupId, &weekOf, &inv.ShowtimeId, &inv.Showtime, &inv.Sequence, &inv.Cancelled)
+	if err != nil {
+		return nil, err
+	}
+	inv.WeekOf = time.Unix(weekOf, 0).UTC()
+	return inv, nil
+}
+
+const saveInviteSql = `INSERT OR REPLACE INTO invites (groupid, weekof, showtimeid, showtime, sequence, cancelled) VALUES (?,?,?,?,?,?)`
+
+func (s *SQLiteStore) SaveInvite(inv *Invite) error {
+	_, err := s.saveInviteStmt.Exec(inv.GroupId, inv.WeekOf.Unix(), inv.ShowtimeId, inv.Showtime.UTC(), inv.Sequence, inv.Cancelled)
+	return err
+}
+
+const getBallotsSql = `SELECT v.userid, v.showtimeid, v.votes, v.veto FROM votes v, showtimes st
+WHERE v.showtimeid = st.id AND v.groupid = ? AND v.userid <> 0
+AND strftime('%s', st.showtime) BETWEEN strftime('%s', ?) AND strftime('%s', ?)
+ORDER BY v.userid`
+
+func (s *SQLiteStore) GetBallots(groupId int, bow, eow time.Time) ([]*Ballot, error) {
+	ballots := make([]*Ballot, 0)
+	rows, err := s.getBallotsStmt.Query(groupId, bow, eow)
+	if err != nil {
+		return ballots, err
+	}
+	defer rows.Close()
+	var b *Ballot
+	for rows.Next() {
+		var userId, showtimeId, votes int
+		var veto bool
+		err = rows.Scan(&userId, &showtimeId, &votes, &veto)
+		if err != nil {
+			return ballots, err
+		}
+		if b == nil || b.UserId != userId {
+			b = &Ballot{UserId: userId, Votes: make(map[int]int), Vetoes: make(map[int]bool)}
+			ballots = append(ballots, b)
+		}
+		b.Votes[showtimeId] = votes
+		if veto {
+			b.Vetoes[showtimeId] = true
+		}
+	}
+	return ballots, rows.Err()
+}
+
+const weekColumns = `groupid, weekof, method, tiebreak, tiewinner, locked, lockedby, showtimeid, lockemail`
+
+const getWeekSql = `SELECT ` + weekColumns + ` FROM weeks WHERE groupid = ? AND weekof = ?`
+
+func (s *SQLiteStore) GetWeek(groupId int, bow time.Time) (*Week, error) {
+	w := new(Week)
+	var weekOf int64
+	err := s.getWeekStmt.QueryRow(groupId, bow.Unix()).Scan(&w.GroupId, &weekOf, &w.Method, &w.TieBreak, &w.TieWinner, &w.Locked, &w.LockedBy, &w.ShowtimeId, &w.LockEmail)
+	if err != nil {
+		return nil, err
+	}
+	w.WeekOf = time.Unix(weekOf, 0).UTC()
+	return w, nil
+}
+
+const getLockedWeeksSql = `SELECT ` + weekColumns + `, COUNT(*) OVER () FROM weeks WHERE groupid = ? AND locked IS NOT NULL ORDER BY weekof DESC LIMIT ? OFFSET ?`
+
+func (s *SQLiteStore) GetLockedWeeks(groupId, limit, offset int) ([]*Week, int, error) {
+	weeks := make([]*Week, 0)
+	rows, err := s.getLockedWeeksStmt.Query(groupId, limit, offset)
+	if err != nil {
+		return weeks, 0, err
+	}
+	defer rows.Close()
+	total := 0
+	for rows.Next() {
+		w := new(Week)
+		var weekOf int64
+		err = rows.Scan(&w.GroupId, &weekOf, &w.Method, &w.TieBreak, &w.TieWinner, &w.Locked, &w.LockedBy, &w.ShowtimeId, &w.LockEmail, &total)
+		if err != nil {
+			return weeks, 0, err
+		}
+		w.WeekOf = time.Unix(weekOf, 0).UTC()
+		weeks = append(weeks, w)
+	}
+	if err = rows.Err(); err != nil {
+		return weeks, 0, err
+	}
+	//Past the last page there are no rows to count with
+	if len(weeks) == 0 && offset > 0 {
+		_, total, err = s.GetLockedWeeks(groupId, 1, 0)
+	}
+	return weeks, total, err
+}
+
+const saveWeekSql = `INSERT OR REPLACE INTO weeks (` + weekColumns + `) VALUES (?,?,?,?,?,?,?,?,?)`
+
+func (s *SQLiteStore) SaveWeek(w *Week) error {
+	_, err := s.saveWeekStmt.Exec(w.GroupId, w.WeekOf.Unix(), w.Method, w.TieBreak, w.TieWinner, w.Locked, w.LockedBy, w.ShowtimeId, w.LockEmail)
+	return err
+}
+
+const insertWeekSql = `INSERT OR IGNORE INTO weeks (` + weekColumns + `) VALUES (?,?,?,?,?,?,?,?,?)`
+
+func (s *SQLiteStore) OpenWeek(w *Week) error {
+	_, err := s.insertWeekStmt.Exec(w.GroupId, w.WeekOf.Unix(), w.Method, w.TieBreak, w.TieWinner, nil, 0, 0, nil)
+	return err
+}
+
+const lockWeekSql = `UPDATE weeks SET locked = ?, lockedby = ?, showtimeid = ? WHERE groupid = ? AND weekof = ? AND locked IS NULL`
+
+const insertWeekLockSql = `INSERT INTO week_locks (groupid, weekof, action, showtimeid, reason, userid, created) VALUES (?,?,?,?,?,?,?)`
+
+func (s *SQLiteStore) LockWeek(w *Week, reason string) error {
+	commit := false
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	_, err = tx.Stmt(s.insertWeekStmt).Exec(w.GroupId, w.WeekOf.Unix(), w.Method, w.TieBreak, w.TieWinner, nil, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Stmt(s.lockWeekStmt).Exec(w.Locked, w.LockedBy, w.ShowtimeId, w.GroupId, w.WeekOf.Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrAlreadyLocked
+	}
+	_, err = tx.Stmt(s.insertWeekLockStmt).Exec(w.GroupId, w.WeekOf.Unix(), WeekLockActionLock, w.ShowtimeId, reason, w.LockedBy, w.Locked)
+	if err != nil {
+		return err
+	}
+	commit = true
+	return nil
+}
+
+const unlockWeekSql = `UPDATE weeks SET locked = NULL, lockedby = 0, showtimeid = 0 WHERE groupid = ? AND weekof = ? AND locked IS NOT NULL`
+
+func (s *SQLiteStore) UnlockWeek(groupId int, bow time.Time, userId int, reason string) error {
+	commit := false
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	w := new(Week)
+	var weekOf int64
+	err = tx.Stmt(s.getWeekStmt).QueryRow(groupId, bow.Unix()).Scan(&w.GroupId, &weekOf, &w.Method, &w.TieBreak, &w.TieWinner, &w.Locked, &w.LockedBy, &w.ShowtimeId, &w.LockEmail)
+	if err == sql.ErrNoRows || (err == nil && w.Locked == nil) {
+		return ErrNotLocked
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.unlockWeekStmt).Exec(groupId, bow.Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(s.insertWeekLockStmt).Exec(groupId, bow.Unix(), WeekLockActionUnlock, w.ShowtimeId, reason, userId, time.Now())
+	if err != nil {
+		return err
+	}
+	commit = true
+	return nil
+}
+
+const markLockEmailSql = `UPDATE weeks SET lockemail = ? WHERE groupid = ? AND weekof = ? AND lockemail IS NULL`
+
+func (s *SQLiteStore) MarkLockEmail(groupId int, bow, at time.Time) (bool, error) {
+	res, err := s.markLockEmailStmt.Exec(at, groupId, bow.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const getWeekLocksSql = `SELECT id, groupid, weekof, action, showtimeid, reason, userid, created FROM week_locks WHERE groupid = ? AND weekof = ? ORDER BY id`
+
+func (s *SQLiteStore) GetWeekLocks(groupId int, bow time.Time) ([]*WeekLock, error) {
+	locks := make([]*WeekLock, 0)
+	rows, err := s.getWeekLocksStmt.Query(groupId, bow.Unix())
+	if err != nil {
+		return locks, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		l := new(WeekLock)
+		var weekOf int64
+		err = rows.Scan(&l.Id, &l.GroupId, &weekOf, &l.Action, &l.ShowtimeId, &l.Reason, &l.UserId, &l.Created)
+		if err != nil {
+			return locks, err
+		}
+		l.WeekOf = time.Unix(weekOf, 0).UTC()
+		locks = append(locks, l)
+	}
+	return locks, rows.Err()
+}
+
+const hideShowtimeSql = `INSERT INTO showtime_hides (groupid, showtimeid, reason, userid, created) SELECT ?, ?, ?, ?, ?
+WHERE NOT EXISTS (SELECT 1 FROM showtime_hides WHERE groupid = ? AND showtimeid = ? AND restored IS NULL)`
+
+func (s *SQLiteStore) HideShowtime(h *ShowtimeHide) (*ShowtimeHide, error) {
+	created := time.Now().UTC()
+	res, err := s.hideShowtimeStmt.Exec(h.GroupId, h.ShowtimeId, h.Reason, h.UserId, created, h.GroupId, h.ShowtimeId)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrAlreadyHidden
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetShowtimeHide(int(id))
+}
+
+const restoreShowtimeHideSql = `UPDATE showtime_hides SET restored = ?, restoredby = ? WHERE id = ? AND restored IS NULL`
+
+func (s *SQLiteStore) RestoreShowtime(id, userId int) (*ShowtimeHide, error) {
+	res, err := s.restoreShowtimeHideStmt.Exec(time.Now().UTC(), userId, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.GetShowtimeHide(id)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrHideRestored
+	}
+	return h, nil
+}
+
+const showtimeHideColumns = `id, groupid, showtimeid, reason, userid, created, restored, restoredby`
+
+func scanShowtimeHide(row interface {
+	Scan(dest ...interface{}) error
+}) (*ShowtimeHide, error) {
+	h := new(ShowtimeHide)
+	err := row.Scan(&h.Id, &h.GroupId, &h.ShowtimeId, &h.Reason, &h.UserId, &h.Created, &h.Restored, &h.RestoredBy)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+const getShowtimeHideSql = `SELECT ` + showtimeHideColumns + ` FROM showtime_hides WHERE id = ?`
+
+func (s *SQLiteStore) GetShowtimeHide(id int) (*ShowtimeHide, error) {
+	return scanShowtimeHide(s.getShowtimeHideStmt.QueryRow(id))
+}
+
+const getShowtimeHidesSql = `SELECT ` + showtimeHideColumns + ` FROM showtime_hides WHERE groupid = ? AND (? OR restored IS NULL) ORDER BY id DESC`
+
+func (s *SQLiteStore) GetShowtimeHides(groupId int, all bool) ([]*ShowtimeHide, error) {
+	hides := make([]*ShowtimeHide, 0)
+	rows, err := s.getShowtimeHidesStmt.Query(groupId, all)
+	if err != nil {
+		return hides, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		h, err := scanShowtimeHide(rows)
+		if err != nil {
+			return hides, err
+		}
+		hides = append(hides, h)
+	}
+	return hides, rows.Err()
+}
+
+const getMetadataCacheSql = `SELECT key, provider, movies, fetched FROM movie_metadata WHERE key = ?`
+
+func (s *SQLiteStore) GetMetadataCache(key string) (*MetadataCacheEntry, error) {
+	e := new(MetadataCacheEntry)
+	var movies string
+	err := s.getMetadataCacheStmt.QueryRow(key).Scan(&e.Key, &e.Provider, &movies, &e.Fetched)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(movies), &e.Movies)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+const saveMetadataCacheSql = `INSERT OR REPLACE INTO movie_metadata (key, provider, movies, fetched) VALUES (?,?,?,?)`
+
+func (s *SQLiteStore) SaveMetadataCache(e *MetadataCacheEntry) error {
+	movies := e.Movies
+	if movies == nil {
+		movies = make([]*Movie, 0)
+	}
+	b, err := json.Marshal(movies)
+	if err != nil {
+		return err
+	}
+	_, err = s.saveMetadataCacheStmt.Exec(e.Key, e.Provider, string(b), e.Fetched.UTC())
+	return err
+}
+
+const movieMatchColumns = `id, title, featurecode, movieid, confidence, candidates, status, created, resolved, resolvedby`
+
+func scanMovieMatch(row interface {
+	Scan(dest ...interface{}) error
+}) (*MovieMatch, error) {
+	mm := new(MovieMatch)
+	var candidates string
+	var resolvedBy *int
+	err := row.Scan(&mm.Id, &mm.Title, &mm.FeatureCode, &mm.MovieId, &mm.Confidence, &candidates, &mm.Status, &mm.Created, &mm.Resolved, &resolvedBy)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(candidates), &mm.Candidates)
+	if err != nil {
+		return nil, err
+	}
+	if resolvedBy != nil {
+		mm.ResolvedBy = *resolvedBy
+	}
+	return mm, nil
+}
+
+const insertMovieMatchSql = `INSERT INTO movie_matches (title, featurecode, movieid, confidence, candidates, status, created) VALUES (?,?,?,?,?,?,?)
+	ON CONFLICT (title) DO UPDATE SET featurecode = excluded.featurecode, movieid = excluded.movieid, confidence = excluded.confidence, candidates = excluded.candidates
+	WHERE status = 'pending'`
+
+func (s *SQLiteStore) InsertMovieMatch(mm *MovieMatch) (*MovieMatch, error) {
+	if mm.Candidates == nil {
+		mm.Candidates = make([]*MatchCandidate, 0)
+	}
+	b, err := json.Marshal(mm.Candidates)
+	if err != nil {
+		return mm, err
+	}
+	_, err = s.insertMovieMatchStmt.Exec(mm.Title, mm.FeatureCode, mm.MovieId, mm.Confidence, string(b), mm.Status, mm.Created.UTC())
+	if err != nil {
+		return mm, err
+	}
+	return s.GetMovieMatchForTitle(mm.Title)
+}
+
+const getMovieMatchSql = `SELECT ` + movieMatchColumns + ` FROM movie_matches WHERE id = ?`
+
+func (s *SQLiteStore) GetMovieMatch(id int) (*MovieMatch, error) {
+	return scanMovieMatch(s.getMovieMatchStmt.QueryRow(id))
+}
+
+const getMovieMatchForTitleSql = `SELECT ` + movieMatchColumns + ` FROM movie_matches WHERE title = ?`
+
+func (s *SQLiteStore) GetMovieMatchForTitle(title string) (*MovieMatch, error) {
+	return scanMovieMatch(s.getMovieMatchForTitleStmt.QueryRow(title))
+}
+
+const getMovieMatchesSql = `SELECT ` + movieMatchColumns + ` FROM movie_matches WHERE status = ? ORDER BY id`
+
+func (s *SQLiteStore) GetMovieMatches(status string) ([]*MovieMatch, error) {
+	matches := make([]*MovieMatch, 0)
+	rows, err := s.getMovieMatchesStmt.Query(status)
+	if err != nil {
+		return matches, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		mm, err := scanMovieMatch(rows)
+		if err != nil {
+			return matches, err
+		}
+		matches = append(matches, mm)
+	}
+	return matches, rows.Err()
+}
+
+const resolveMovieMatchSql = `UPDATE movie_matches SET status = ?, movieid = ?, resolved = ?, resolvedby = ? WHERE id = ?`
+
+func (s *SQLiteStore) ResolveMovieMatch(id int, status string, movieId, userId int) error {
+	_, err := s.resolveMovieMatchStmt.Exec(status, movieId, time.Now().UTC(), userId, id)
+	return err
+}
+
+const mergeShowtimeIdsSql = `SELECT id FROM showtimes WHERE movieid = ? ORDER BY id`
+const mergeCountVotesSql = `SELECT COUNT(*) FROM votes WHERE userid <> 0 AND showtimeid IN (SELECT id FROM showtimes WHERE movieid = ?)`
+const mergeCountRsvpsSql = `SELECT COUNT(*) FROM rsvps WHERE showtimeid IN (SELECT id FROM showtimes WHERE movieid = ?)`
+const getMovieAliasesSql = `SELECT title FROM movie_aliases WHERE movieid = ? ORDER BY title`
+const mergeMatchIdsSql = `SELECT id FROM movie_matches WHERE movieid = ? ORDER BY id`
+
+// Works out what merging the movies would move, within the transaction. The movie to merge
+// into is left nil when it isn't in the database yet.
+func (s *SQLiteStore) previewMovieMerge(tx *sql.Tx, fromId, toId int) (*MovieMerge, error) {
+	if fromId == toId {
+		return nil, ErrMergeSameMovie
+	}
+	from, err := scanMovie(tx.Stmt(s.getMovieStmt).QueryRow(fromId))
+	if err != nil {
+		return nil, err
+	}
+	merge := &MovieMerge{FromMovieId: fromId, ToMovieId: toId, From: from, Alias: from.MegaPlexTitle, Aliases: make([]string, 0), ShowtimeIds: make([]int, 0), MatchIds: make([]int, 0)}
+	merge.To, err = scanMovie(tx.Stmt(s.getMovieStmt).QueryRow(toId))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if merge.To != nil && strings.EqualFold(merge.To.MegaPlexTitle, from.MegaPlexTitle) {
+		merge.Alias = ""
+	}
+
+	rows, err := tx.Stmt(s.mergeShowtimeIdsStmt).Query(fromId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		merge.ShowtimeIds = append(merge.ShowtimeIds, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	arows, err := tx.Stmt(s.getMovieAliasesStmt).Query(fromId)
+	if err != nil {
+		return nil, err
+	}
+	defer arows.Close()
+	for arows.Next() {
+		var title string
+		err = arows.Scan(&title)
+		if err != nil {
+			return nil, err
+		}
+		merge.Aliases = append(merge.Aliases, title)
+	}
+	if err = arows.Err(); err != nil {
+		return nil, err
+	}
+	mrows, err := tx.Stmt(s.mergeMatchIdsStmt).Query(fromId)
+	if err != nil {
+		return nil, err
+	}
+	defer mrows.Close()
+	for mrows.Next() {
+		var id int
+		err = mrows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		merge.MatchIds = append(merge.MatchIds, id)
+	}
+	if err = mrows.Err(); err != nil {
+		return nil, err
+	}
+	err = tx.Stmt(s.mergeCountVotesStmt).QueryRow(fromId).Scan(&merge.Votes)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Stmt(s.mergeCountRsvpsStmt).QueryRow(fromId).Scan(&merge.Rsvps)
+	if err != nil {
+		return nil, err
+	}
+	return merge, nil
+}
+
+func (s *SQLiteStore) PreviewMovieMerge(fromId, toId int) (*MovieMerge, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	merge, err := s.previewMovieMerge(tx, fromId, toId)
+	tx.Rollback()
+	if err != nil {
+		return nil, err
+	}
+	merge.Showtimes = make([]*Showtime, 0, len(merge.ShowtimeIds))
+	for _, id := range merge.ShowtimeIds {
+		st, err := s.GetShowtime(0, id)
+		if err != nil {
+			return nil, err
+		}
+		merge.Showtimes = append(merge.Showtimes, st)
+	}
+	return merge, nil
+}
+
+const moveMovieAliasesSql = `UPDATE movie_aliases SET movieid = ? WHERE movieid = ?`
+const moveMovieMatchesSql = `UPDATE movie_matches SET movieid = ? WHERE movieid = ?`
+const insertMovieAliasSql = `INSERT OR REPLACE INTO movie_aliases (title, movieid) VALUES (?,?)`
+const deleteMovieAliasSql = `DELETE FROM movie_aliases WHERE title = ? AND movieid = ?`
+const insertMovieMergeSql = `INSERT INTO movie_merges (frommovieid, tomovieid, movie, alias, aliases, showtimes, matches, votes, rsvps, created, userid) VALUES (?,?,?,?,?,?,?,?,?,?,?)`
+
+func (s *SQLiteStore) MergeMovies(fromId, toId, userId int) (*MovieMerge, error) {
+	commit := false
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	merge, err := s.previewMovieMerge(tx, fromId, toId)
+	if err != nil {
+		return nil, err
+	}
+	if merge.To == nil {
+		return nil, sql.ErrNoRows
+	}
+	_, err = tx.Stmt(s.migrateShowtimeStmt).Exec(toId, fromId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Stmt(s.moveMovieAliasesStmt).Exec(toId, fromId)
+	if err != nil {
+		return nil, err
+	}
+	if merge.Alias != "" {
+		_, err = tx.Stmt(s.insertMovieAliasStmt).Exec(merge.Alias, toId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Stmt(s.moveMovieMatchesStmt).Exec(toId, fromId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Stmt(s.deleteMovieStmt).Exec(fromId)
+	if err != nil {
+		return nil, err
+	}
+	movie, err := json.Marshal(merge.From)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := json.Marshal(merge.Aliases)
+	if err != nil {
+		return nil, err
+	}
+	showtimes, err := json.Marshal(merge.ShowtimeIds)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := json.Marshal(merge.MatchIds)
+	if err != nil {
+		return nil, err
+	}
+	merge.Created = time.Now().UTC()
+	merge.UserId = userId
+	r, err := tx.Stmt(s.insertMovieMergeStmt).Exec(fromId, toId, string(movie), merge.Alias, string(aliases), string(showtimes), string(matches), merge.Votes, merge.Rsvps, merge.Created, userId)
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	merge.Id = int(id)
+	commit = true
+	return merge, nil
+}
+
+const movieMergeColumns = `id, frommovieid, tomovieid, movie, alias, aliases, showtimes, matches, votes, rsvps, created, userid, undone, undoneby`
+
+func scanMovieMerge(row interface {
+	Scan(dest ...interface{}) error
+}) (*MovieMerge, error) {
+	merge := new(MovieMerge)
+	var movie, aliases, showtimes, matches string
+	var undoneBy *int
+	err := row.Scan(&merge.Id, &merge.FromMovieId, &merge.ToMovieId, &movie, &merge.Alias, &aliases, &showtimes, &matches, &merge.Votes, &merge.Rsvps, &merge.Created, &merge.UserId, &merge.Undone, &undoneBy)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(movie), &merge.From)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(aliases), &merge.Aliases)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(showtimes), &merge.ShowtimeIds)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(matches), &merge.MatchIds)
+	if err != nil {
+		return nil, err
+	}
+	if undoneBy != nil {
+		merge.UndoneBy = *undoneBy
+	}
+	return merge, nil
+}
+
+const getMovieMergeSql = `SELECT ` + movieMergeColumns + ` FROM movie_merges WHERE id = ?`
+
+func (s *SQLiteStore) GetMovieMerge(id int) (*MovieMerge, error) {
+	return scanMovieMerge(s.getMovieMergeStmt.QueryRow(id))
+}
+
+const getMovieMergesSql = `SELECT ` + movieMergeColumns + ` FROM movie_merges ORDER BY id DESC`
+
+func (s *SQLiteStore) GetMovieMerges() ([]*MovieMerge, error) {
+	merges := make([]*MovieMerge, 0)
+	rows, err := s.getMovieMergesStmt.Query()
+	if err != nil {
+		return merges, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		merge, err := scanMovieMerge(rows)
+		if err != nil {
+			return merges, err
+		}
+		merges = append(merges, merge)
+	}
+	return merges, rows.Err()
+}
+
+const getLaterMovieMergesSql = `SELECT COUNT(*) FROM movie_merges WHERE id > ? AND frommovieid = ? AND undone IS NULL`
+const restoreShowtimeSql = `UPDATE showtimes SET movieid = ? WHERE id = ? AND movieid = ?`
+const restoreMovieAliasSql = `UPDATE movie_aliases SET movieid = ? WHERE title = ? AND movieid = ?`
+const restoreMovieMatchSql = `UPDATE movie_matches SET movieid = ? WHERE id = ? AND movieid = ?`
+const undoMovieMergeSql = `UPDATE movie_merges SET undone = ?, undoneby = ? WHERE id = ?`
+
+func (s *SQLiteStore) UndoMovieMerge(id, userId int) (*MovieMerge, error) {
+	commit := false
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if commit {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	merge, err := scanMovieMerge(tx.Stmt(s.getMovieMergeStmt).QueryRow(id))
+	if err != nil {
+		return nil, err
+	}
+	if merge.Undone != nil {
+		return nil, ErrMergeUndone
+	}
+	var later int
+	err = tx.Stmt(s.getLaterMovieMergesStmt).QueryRow(id, merge.ToMovieId).Scan(&later)
+	if err != nil {
+		return nil, err
+	}
+	if later > 0 {
+		return nil, ErrMergeConflict
+	}
+	_, err = scanMovie(tx.Stmt(s.getMovieStmt).QueryRow(merge.FromMovieId))
+	if err == nil {
+		return nil, ErrMergeReimported
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	//The json of a movie doesn't always hold its id, the merge does
+	merge.From.Id = merge.FromMovieId
+	b, err := json.Marshal(merge.From)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Stmt(s.insertMovieStmt).Exec(merge.FromMovieId, merge.From.Imdb, merge.From.MegaPlexTitle, b)
+	if err != nil {
+		return nil, err
+	}
+	for _, stId := range merge.ShowtimeIds {
+		_, err = tx.Stmt(s.restoreShowtimeStmt).Exec(merge.FromMovieId, stId, merge.ToMovieId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, title := range merge.Aliases {
+		_, err = tx.Stmt(s.restoreMovieAliasStmt).Exec(merge.FromMovieId, title, merge.ToMovieId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, matchId := range merge.MatchIds {
+		_, err = tx.Stmt(s.restoreMovieMatchStmt).Exec(merge.FromMovieId, matchId, merge.ToMovieId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if merge.Alias != "" {
+		_, err = tx.Stmt(s.deleteMovieAliasStmt).Exec(merge.Alias, merge.ToMovieId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now().UTC()
+	_, err = tx.Stmt(s.undoMovieMergeStmt).Exec(now, userId, id)
+	if err != nil {
+		return nil, err
+	}
+	merge.Undone = &now
+	merge.UndoneBy = userId
+	commit = true
+	return merge, nil
+}
+
+// Builds the fts5 match expression for the text, every word has to match the start of a word
+func movieMatchExpr(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for i, w := range words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+const movieFilterSql = `AND (? = '' OR json_extract(m.json, '$.Genre') LIKE '%' || ? || '%')
+AND (? = '' OR json_extract(m.json, '$.Rated') = ? COLLATE NOCASE)
+AND (? = '' OR json_extract(m.json, '$.Year') = ?)`
+
+const searchMoviesSql = `SELECT m.id, m.imdb, m.title, m.json, COUNT(*) OVER () FROM movies_fts, movies m
+WHERE movies_fts.rowid = m.id AND movies_fts MATCH ?
+` + movieFilterSql + `
+ORDER BY movies_fts.rank LIMIT ? OFFSET ?`
+
+const browseMoviesSql = `SELECT m.id, m.imdb, m.title, m.json, COUNT(*) OVER () FROM movies m
+WHERE (? = '' OR m.title LIKE '%' || ? || '%' OR json_extract(m.json, '$.Title') LIKE '%' || ? || '%' OR json_extract(m.json, '$.Plot') LIKE '%' || ? || '%' OR json_extract(m.json, '$.Genre') LIKE '%' || ? || '%')
+` + movieFilterSql + `
+ORDER BY IFNULL(NULLIF(json_extract(m.json, '$.Title'), ''), m.title) COLLATE NOCASE, m.id LIMIT ? OFFSET ?`
+
+func (s *SQLiteStore) SearchMovies(q MovieQuery) ([]*Movie, int, error) {
+	movies := make([]*Movie, 0)
+	filters := []interface{}{q.Genre, q.Genre, q.Rated, q.Rated, q.Year, q.Year}
+	var rows *sql.Rows
+	var err error
+	if expr := movieMatchExpr(q.Text); s.searchMoviesStmt != nil && expr != "" {
+		args := append([]interface{}{expr}, filters...)
+		rows, err = s.searchMoviesStmt.Query(append(args, q.Limit, q.Offset)...)
+	} else {
+		args := []interface{}{q.Text, q.Text, q.Text, q.Text, q.Text}
+		args = append(args, filters...)
+		rows, err = s.browseMoviesStmt.Query(append(args, q.Limit, q.Offset)...)
+	}
+	if err != nil {
+		return movies, 0, err
+	}
+	defer rows.Close()
+	total := 0
+	for rows.Next() {
+		m := new(Movie)
+		var j string
+		err = rows.Scan(&m.Id, &m.Imdb, &m.MegaPlexTitle, &j, &total)
+		if err != nil {
+			return movies, 0, err
+		}
+		err = json.Unmarshal([]byte(j), &m)
+		if err != nil {
+			return movies, 0, err
+		}
+		movies = append(movies, m)
+	}
+	if err = rows.Err(); err != nil {
+		return movies, 0, err
+	}
+	//Past the last page there are no rows to count with
+	if len(movies) == 0 && q.Offset > 0 {
+		q.Limit, q.Offset = 1, 0
+		_, total, err = s.SearchMovies(q)
+	}
+	return movies, total, err
+}
+
+const getShowtimesForMovieSql = `SELECT st.id, st.movieid, st.showtime, st.screen, st.theatreid, IFNULL(t.name,''), IFNULL(t.address,''), st.preview, st.buy, st.provider, st.cancelled, st.changed
+FROM showtimes st
+LEFT JOIN theatres t ON st.theatreid = t.id
+WHERE st.movieid = ?
+ORDER BY st.showtime ASC, st.id ASC`
+
+func (s *SQLiteStore) GetShowtimesForMovie(movieId int) ([]*Showtime, error) {
+	showtimes := make([]*Showtime, 0)
+	rows, err := s.getShowtimesForMovieStmt.Query(movieId)
+	if err != nil {
+		return showtimes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		st := new(Showtime)
+		err = rows.Scan(&st.Id, &st.MovieId, &st.Showtime, &st.Screen, &st.TheatreId, &st.Location, &st.Address, &st.PreviewSeatsLink, &st.BuyTicketsLink, &st.Provider, &st.Cancelled, &st.Changed)
+		if err != nil {
+			return showtimes, err
+		}
+		showtimes = append(showtimes, st)
+	}
+	return showtimes, rows.Err()
+}
+
+const getMovieVotesSql = `SELECT v.showtimeid, SUM(v.votes) FROM votes v, showtimes st
+WHERE v.showtimeid = st.id AND st.movieid = ? AND v.groupid = ? AND v.userid <> 0
+GROUP BY v.showtimeid`
+
+func (s *SQLiteStore) GetMovieVotes(groupId, movieId int) (map[int]int, error) {
+	votes := make(map[int]int)
+	rows, err := s.getMovieVotesStmt.Query(movieId, groupId)
+	if err != nil {
+		return votes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, n int
+		err = rows.Scan(&id, &n)
+		if err != nil {
+			return votes, err
+		}
+		votes[id] = n
+	}
+	return votes, rows.Err()
+}
+
+const getGroupSql = `SELECT id, name, eventday, created FROM groups WHERE id = ?`
+
+func (s *SQLiteStore) GetGroup(id int) (*Group, error) {
+	g := new(Group)
+	err := s.getGroupStmt.QueryRow(id).Scan(&g.Id, &g.Name, &g.EventDay, &g.Created)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+const getGroupsSql = `SELECT id, name, eventday, created FROM groups ORDER BY id`
+
+func (s *SQLiteStore) GetGroups() ([]*Group, error) {
+	return scanGroups(s.getGroupsStmt)
+}
+
+const getGroupsForUserSql = `SELECT g.id, g.name, g.eventday, g.created FROM groups g, group_members gm WHERE gm.groupid = g.id AND gm.userid = ? ORDER BY g.id`
+
+func (s *SQLiteStore) GetGroupsForUser(userId int) ([]*Group, error) {
+	return scanGroups(s.getGroupsForUserStmt, userId)
+}
+
+func scanGroups(stmt *sql.Stmt, args ...interface{}) ([]*Group, error) {
+	groups := make([]*Group, 0)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		g := new(Group)
+		err = rows.Scan(&g.Id, &g.Name, &g.EventDay, &g.Created)
+		if err != nil {
+			return groups, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+const insertGroupSql = `INSERT INTO groups (name, eventday, created) VALUES (?,?,?)`
+
+func (s *SQLiteStore) InsertGroup(name string, eventDay time.Weekday) (*Group, error) {
+	g := &Group{Name: name, EventDay: eventDay, Created: time.Now().UTC()}
+	r, err := s.insertGroupStmt.Exec(g.Name, g.EventDay, g.Created)
+	if err != nil {
+		return nil, err
+	}
+	lid, err := r.LastInsertId()
+	if err != nil {
+		return g, err
+	}
+	g.Id = int(lid)
+	return g, nil
+}
+
+const getGroupMembersSql = `SELECT u.id, u.name, u.email FROM users u, group_members gm WHERE gm.userid = u.id AND gm.groupid = ? ORDER BY u.name`
+
+func (s *SQLiteStore) GetGroupMembers(groupId int) ([]*User, error) {
+	users := make([]*User, 0)
+	rows, err := s.getGroupMembersStmt.Query(groupId)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := new(User)
+		err = rows.Scan(&u.Id, &u.Name, &u.Email)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+const addGroupMemberSql = `INSERT OR IGNORE INTO group_members (groupid, userid, joined) VALUES (?,?,?)`
+
+func (s *SQLiteStore) AddGroupMember(groupId, userId int) error {
+	_, err := s.addGroupMemberStmt.Exec(groupId, userId, time.Now().UTC())
+	return err
+}
+
+const removeGroupMemberSql = `DELETE FROM group_members WHERE groupid = ? AND userid = ?`
+
+func (s *SQLiteStore) RemoveGroupMember(groupId, userId int) error {
+	_, err := s.removeGroupMemberStmt.Exec(groupId, userId)
+	return err
+}
+
+const getJobStateSql = `SELECT name, spec, lastrun, nextrun, lasterror, failures FROM jobs WHERE name = ?`
+
+func (s *SQLiteStore) GetJobState(name string) (*JobState, error) {
+	js := new(JobState)
+	err := s.getJobStateStmt.QueryRow(name).Scan(&js.Name, &js.Spec, &js.LastRun, &js.NextRun, &js.LastError, &js.Failures)
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+const saveJobStateSql = `INSERT OR REPLACE INTO jobs (name, spec, lastrun, nextrun, lasterror, failures) VALUES (?,?,?,?,?,?)`
+
+func (s *SQLiteStore) SaveJobState(js *JobState) error {
+	_, err := s.saveJobStateStmt.Exec(js.Name, js.Spec, js.LastRun.UTC(), js.NextRun.UTC(), js.LastError, js.Failures)
+	return err
+}
+
+const theatreColumns = `t.id, t.name, t.shortname, t.address, t.latitude, t.longitude, t.phone, t.timezone`
+
+func scanTheatres(stmt *sql.Stmt, args ...interface{}) ([]*Theatre, error) {
+	theatres := make([]*Theatre, 0)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return theatres, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := new(Theatre)
+		err = rows.Scan(&t.Id, &t.Name, &t.ShortName, &t.Address, &t.Latitude, &t.Longitude, &t.Phone, &t.TimeZone)
+		if err != nil {
+			return theatres, err
+		}
+		theatres = append(theatres, t)
+	}
+	return theatres, nil
+}
+
+const getTheatreSql = `SELECT ` + theatreColumns + ` FROM theatres t WHERE t.id = ?`
+
+func (s *SQLiteStore) GetTheatre(id string) (*Theatre, error) {
+	t := new(Theatre)
+	err := s.getTheatreStmt.QueryRow(id).Scan(&t.Id, &t.Name, &t.ShortName, &t.Address, &t.Latitude, &t.Longitude, &t.Phone, &t.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+const getTheatresSql = `SELECT ` + theatreColumns + ` FROM theatres t ORDER BY t.name`
+
+func (s *SQLiteStore) GetTheatres() ([]*Theatre, error) {
+	return scanTheatres(s.getTheatresStmt)
+}
+
+const upsertTheatreSql = `INSERT INTO theatres (id, name, shortname, address, latitude, longitude, phone, timezone) VALUES (?,?,?,?,?,?,?,?)
+ON CONFLICT(id) DO UPDATE SET name = excluded.name, shortname = excluded.shortname, address = excluded.address,
+latitude = excluded.latitude, longitude = excluded.longitude, phone = excluded.phone, timezone = excluded.timezone`
+
+func (s *SQLiteStore) UpsertTheatre(t *Theatre) error {
+	_, err := s.upsertTheatreStmt.Exec(t.Id, t.Name, t.ShortName, t.Address, t.Latitude, t.Longitude, t.Phone, t.TimeZone)
+	return err
+}
+
+const getGroupTheatresSql = `SELECT ` + theatreColumns + ` FROM theatres t, group_theatres gt WHERE gt.theatreid = t.id AND gt.groupid = ? ORDER BY t.name`
+
+func (s *SQLiteStore) GetGroupTheatres(groupId int) ([]*Theatre, error) {
+	theatres, err := scanTheatres(s.getGroupTheatresStmt, groupId)
+	for _, t := range theatres {
+		t.Enabled = true
+	}
+	return theatres, err
+}
+
+const enableGroupTheatreSql = `INSERT OR IGNORE INTO group_theatres (groupid, theatreid) VALUES (?,?)`
+const disableGroupTheatreSql = `DELETE FROM group_theatres WHERE groupid = ? AND theatreid = ?`
+
+func (s *SQLiteStore) SetGroupTheatre(groupId int, theatreId string, enabled bool) error {
+	var err error
+	if enabled {
+		_, err = s.enableGroupTheatreStmt.Exec(groupId, theatreId)
+	} else {
+		_, err = s.disableGroupTheatreStmt.Exec(groupId, theatreId)
+	}
+	return err
+}
+
+var insertSessionStmt *sql.Stmt
+
+const insertSessionSql = `INSERT INTO sessions (token, userid, created, lastseen, expires, useragent, ip) VALUES (?,?,?,?,?,?,?)`
+
+func InsertSession(userId int, userAgent, ip string, now time.Time) (*Session, error) {
+	now = now.UTC()
+	s := new(Session)
+	s.Token = GenUUIDv4()
+	s.UserId = userId
+	s.Created = now
+	s.LastSeen = now
+	s.Expires = now.Add(*sessionTTL)
+	s.UserAgent = userAgent
+	s.Ip = ip
+	r, err := insertSessionStmt.Exec(s.Token, s.UserId, s.Created, s.LastSeen, s.Expires, s.UserAgent, s.Ip)
+	if err != nil {
+		return nil, err
+	}
+	lid, err := r.LastInsertId()
+	if err != nil {
+		return s, err
+	}
+	s.Id = int(lid)
+	return s, nil
+}
+
+var getSessionForTokenStmt *sql.Stmt
+
+const getSessionForTokenSql = `SELECT id, token, userid, created, lastseen, expires, useragent, ip FROM sessions WHERE token = ? AND strftime('%s', expires) > strftime('%s', ?) LIMIT 1`
+
+// Returns the session for the given token as long as it hasn't expired as of now
+func GetSessionForToken(token string, now time.Time) (*Session, error) {
+	s := new(Session)
+	err := getSessionForTokenStmt.QueryRow(token, now).Scan(&s.Id, &s.Token, &s.UserId, &s.Created, &s.LastSeen, &s.Expires, &s.UserAgent, &s.Ip)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+var touchSessionStmt *sql.Stmt
+
+const touchSessionSql = `UPDATE sessions SET lastseen = ?, expires = ? WHERE id = ?`
+
+// Slides the expiration of a session forward. To avoid a write on every request the session
+// is only updated if it hasn't been seen in the last minute.
+func TouchSession(s *Session, now time.Time) error {
+	if now.Sub(s.LastSeen) < time.Minute {
+		return nil
+	}
+	s.LastSeen = now.UTC()
+	s.Expires = s.LastSeen.Add(*sessionTTL)
+	_, err := touchSessionStmt.Exec(s.LastSeen, s.Expires, s.Id)
 	return err
 }
+
+var getSessionsForUserStmt *sql.Stmt
+
+const getSessionsForUserSql = `SELECT id, token, userid, created, lastseen, expires, useragent, ip FROM sessions WHERE userid = ? AND strftime('%s', expires) > strftime('%s', ?) ORDER BY lastseen DESC`
+
+func GetSessionsForUser(userId int, now time.Time) ([]*Session, error) {
+	sessions := make([]*Session, 0)
+	rows, err := getSessionsForUserStmt.Query(userId, now)
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := new(Session)
+		err = rows.Scan(&s.Id, &s.Token, &s.UserId, &s.Created, &s.LastSeen, &s.Expires, &s.UserAgent, &s.Ip)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+var deleteSessionStmt *sql.Stmt
+
+const deleteSessionSql = `DELETE FROM sessions WHERE id = ? AND userid = ?`
+
+// Deletes the session, but only if it belongs to the given user. Returns sql.ErrNoRows if
+// there was no such session for the user.
+func DeleteSession(id, userId int) error {
+	r, err := deleteSessionStmt.Exec(id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+var deleteExpiredSessionsStmt *sql.Stmt
+
+const deleteExpiredSessionsSql = `DELETE FROM sessions WHERE strftime('%s', expires) <= strftime('%s', ?)`
+
+func DeleteExpiredSessions(now time.Time) (int64, error) {
+	r, err := deleteExpiredSessionsStmt.Exec(now)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
@@ -90,13 +90,22 @@ func SendRegistrationEmail(u *User, ott string) {
 	}
 }
 
-func SendWeeklyEmail(to *User, standings []*Showtime, bow, eow time.Time) {
+// Emails for groups other than the default group carry the group name in their subject
+func groupSubject(g *Group, subject string) string {
+	if g.Id == DefaultGroupId {
+		return subject
+	}
+	return subject + " (" + g.Name + ")"
+}
+
+func SendWeeklyEmail(g *Group, to *User, standings []*Showtime, bow, eow time.Time) {
 	params := struct {
+		Group     *Group
 		User      *User
 		Standings []*Showtime
 		Voted     bool
 		UrlPre    string
-	}{User: to, Standings: standings, UrlPre: *appUrl}
+	}{Group: g, User: to, Standings: standings, UrlPre: *appUrl}
 
 	for _, v := range standings {
 		if v.Vote > 0 {
@@ -109,10 +118,10 @@ func SendWeeklyEmail(to *User, standings []*Showtime, bow, eow time.Time) {
 	emailHeaders.Set("MIME-Version", "1.0")
 	emailHeaders.Set("From", "Movie Night <"+*emailFrom+">")
 	emailHeaders.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
-	emailHeaders.Set("Subject", "Movie Night Weekly Notification")
+	emailHeaders.Set("Subject", groupSubject(g, "Movie Night Weekly Notification"))
 	emailHeaders.Set("To", to.Name+" <"+to.Email+">")
-	emailHeaders.Set("References", "<movie-night."+bow.Format(time.RFC3339)+"@murphysean.com>")
-	emailHeaders.Set("In-Reply-To", "<movie-night."+bow.Format(time.RFC3339)+"@murphysean.com>")
+	emailHeaders.Set("References", g.ThreadId(bow))
+	emailHeaders.Set("In-Reply-To", g.ThreadId(bow))
 
 	err := SendSimpleEmail(to.Email, *emailFrom, "email-weekly.md", "email-weekly.html", params, emailHeaders)
 	if err != nil {
@@ -120,8 +129,8 @@ func SendWeeklyEmail(to *User, standings []*Showtime, bow, eow time.Time) {
 	}
 }
 
-func SendActivityEmails(voter *User, votes []*Showtime, standings []*Showtime, bow, eow time.Time) {
-	users, err := GetUsersForPreference(ActivityPreferenceType)
+func SendActivityEmails(g *Group, voter *User, votes []*Showtime, standings []*Showtime, bow, eow time.Time) {
+	users, err := store.GetUsersForPreference(g.Id, ActivityPreferenceType)
 	if err != nil {
 		log.Println("SendActivityEmails:1:", err)
 		return
@@ -130,27 +139,28 @@ func SendActivityEmails(voter *User, votes []*Showtime, standings []*Showtime, b
 		if u.Id == voter.Id {
 			continue
 		}
-		SendActivityEmail(u, voter, votes, standings, bow, eow)
+		SendActivityEmail(g, u, voter, votes, standings, bow, eow)
 	}
 }
 
-func SendActivityEmail(to *User, voter *User, votes []*Showtime, standings []*Showtime, bow, eow time.Time) {
+func SendActivityEmail(g *Group, to *User, voter *User, votes []*Showtime, standings []*Showtime, bow, eow time.Time) {
 	params := struct {
+		Group     *Group
 		User      *User
 		Voter     *User
 		Votes     []*Showtime
 		Standings []*Showtime
 		UrlPre    string
-	}{User: to, Voter: voter, Votes: votes, Standings: standings, UrlPre: *appUrl}
+	}{Group: g, User: to, Voter: voter, Votes: votes, Standings: standings, UrlPre: *appUrl}
 
 	emailHeaders := textproto.MIMEHeader{}
 	emailHeaders.Set("MIME-Version", "1.0")
 	emailHeaders.Set("From", "Movie Night <"+*emailFrom+">")
 	emailHeaders.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
-	emailHeaders.Set("Subject", "Movie Night Activity")
+	emailHeaders.Set("Subject", groupSubject(g, "Movie Night Activity"))
 	emailHeaders.Set("To", to.Name+" <"+to.Email+">")
-	emailHeaders.Set("References", "<movie-night."+bow.Format(time.RFC3339)+"@murphysean.com>")
-	emailHeaders.Set("In-Reply-To", "<movie-night."+bow.Format(time.RFC3339)+"@murphysean.com>")
+	emailHeaders.Set("References", g.ThreadId(bow))
+	emailHeaders.Set("In-Reply-To", g.ThreadId(bow))
 
 	err := SendSimpleEmail(to.Email, *emailFrom, "email-activity.md", "email-activity.html", params, emailHeaders)
 	if err != nil {
@@ -158,7 +168,23 @@ func SendActivityEmail(to *User, voter *User, votes []*Showtime, standings []*Sh
 	}
 }
 
-func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
+// The values the lock, update and cancel emails and their calendar invite are rendered with.
+// Every invite for a groups week shares its UID, the sequence tells calendars which is newest.
+type inviteParams struct {
+	Group     *Group
+	User      *User
+	Winner    *Showtime
+	WinnerEnd time.Time
+	WeekOf    time.Time
+	Now       time.Time
+	UrlPre    string
+	Hmac      string
+	Method    string
+	Sequence  int
+	Reason    string
+}
+
+func newInviteParams(g *Group, to *User, winner *Showtime, inv *Invite, method, reason string) inviteParams {
 	mac := hmac.New(sha256.New, []byte(*salt))
 	mac.Write([]byte(fmt.Sprintf("%d%d", to.Id, winner.Id)))
 	hmac := base64.StdEncoding.EncodeToString(mac.Sum(nil))
@@ -169,19 +195,29 @@ func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
 		rt = time.Hour * 2
 	}
 	//TODO Think about whether to add an average trailer time to the movie, atm I think that the offset of credits makes this unneeded
-	params := struct {
-		User      *User
-		Winner    *Showtime
-		WinnerEnd time.Time
-		WeekOf    time.Time
-		Now       time.Time
-		UrlPre    string
-		Hmac      string
-	}{User: to, Winner: winner, WinnerEnd: winner.Showtime.Add(rt), WeekOf: weekOf, Now: time.Now(), UrlPre: *appUrl, Hmac: hmac}
+	return inviteParams{Group: g, User: to, Winner: winner, WinnerEnd: winner.Showtime.Add(rt), WeekOf: inv.WeekOf, Now: time.Now(),
+		UrlPre: *appUrl, Hmac: hmac, Method: method, Sequence: inv.Sequence, Reason: reason}
+}
 
-	//Abort sending if the user hasn't voted this period
-	bow, eow := GetBeginningAndEndOfWeekForTime(time.Now())
-	standings, err := GetShowtimesForWeekOf(bow, eow, to.Id)
+func inviteHeaders(g *Group, to *User, subject string, weekOf time.Time) textproto.MIMEHeader {
+	emailHeaders := textproto.MIMEHeader{}
+	emailHeaders.Set("MIME-Version", "1.0")
+	emailHeaders.Set("From", "Movie Night <"+*emailFrom+">")
+	emailHeaders.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	emailHeaders.Set("Subject", groupSubject(g, subject))
+	emailHeaders.Set("To", to.Name+" <"+to.Email+">")
+	emailHeaders.Set("References", g.ThreadId(weekOf))
+	emailHeaders.Set("In-Reply-To", g.ThreadId(weekOf))
+	return emailHeaders
+}
+
+func SendLockEmail(g *Group, to *User, winner *Showtime, inv *Invite) {
+	params := newInviteParams(g, to, winner, inv, "REQUEST", "")
+
+	//Abort sending if the user hasn't voted in the week, which needn't be the week open now
+	//when a missed lock is caught up
+	bow, eow := g.Calendar().WeekAt(g.Calendar().In(inv.WeekOf))
+	standings, err := store.GetShowtimesForWeekOf(g.Id, bow, eow, to.Id)
 	if err != nil {
 		return
 	}
@@ -198,19 +234,42 @@ func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
 		return
 	}
 
+	headers := inviteHeaders(g, to, "Movie Night Confirmation", inv.WeekOf)
+	err = SendCalendarEmail(to.Email, *emailFrom, "email-lock.md", "email-lock.html", "email-lock.ical", params, headers)
+	if err != nil {
+		log.Println("SendLockEmail:", err)
+	}
+}
+
+// Sends an updated invite after the winning showtime moved, or was replaced by another
+// performance of the same movie
+func SendInviteUpdateEmail(g *Group, to *User, winner *Showtime, inv *Invite, reason string) {
+	params := newInviteParams(g, to, winner, inv, "REQUEST", reason)
+	headers := inviteHeaders(g, to, "Movie Night Update", inv.WeekOf)
+	err := SendCalendarEmail(to.Email, *emailFrom, "email-update.md", "email-update.html", "email-lock.ical", params, headers)
+	if err != nil {
+		log.Println("SendInviteUpdateEmail:", err)
+	}
+}
+
+// Cancels the invite after the winning showtime was cancelled with nothing to replace it
+func SendInviteCancelEmail(g *Group, to *User, winner *Showtime, inv *Invite, reason string) {
+	params := newInviteParams(g, to, winner, inv, "CANCEL", reason)
+	headers := inviteHeaders(g, to, "Movie Night Cancelled", inv.WeekOf)
+	err := SendCalendarEmail(to.Email, *emailFrom, "email-cancel.md", "email-cancel.html", "email-lock.ical", params, headers)
+	if err != nil {
+		log.Println("SendInviteCancelEmail:", err)
+	}
+}
+
+// Sends a text and html email along with a calendar invite, both inline and as an attachment.
+// The params must carry the calendar Method.
+func SendCalendarEmail(to, from, textTmpl, htmlTmpl, icalTmpl string, params inviteParams, headers textproto.MIMEHeader) error {
 	var b bytes.Buffer
 
-	emailHeaders := textproto.MIMEHeader{}
-	emailHeaders.Set("MIME-Version", "1.0")
-	emailHeaders.Set("From", "Movie Night <"+*emailFrom+">")
-	emailHeaders.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
-	emailHeaders.Set("Subject", "Movie Night Confirmation")
-	emailHeaders.Set("To", to.Name+" <"+to.Email+">")
-	emailHeaders.Set("References", "<movie-night."+weekOf.Format(time.RFC3339)+"@murphysean.com>")
-	emailHeaders.Set("In-Reply-To", "<movie-night."+weekOf.Format(time.RFC3339)+"@murphysean.com>")
 	mmpw := multipart.NewWriter(&b)
-	emailHeaders.Set("Content-Type", "multipart/mixed; boundary="+mmpw.Boundary())
-	for k, vv := range emailHeaders {
+	headers.Set("Content-Type", "multipart/mixed; boundary="+mmpw.Boundary())
+	for k, vv := range headers {
 		for _, v := range vv {
 			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
 		}
@@ -226,14 +285,14 @@ func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
 	tHeader.Set("Content-Transfer-Encoding", "quoted-printable")
 	tw, err := mpw.CreatePart(tHeader)
 	if err != nil {
-		log.Println("SendLockEmail:1:", err)
-		return
+		log.Println("SendCalendarEmail:1:", err)
+		return err
 	}
 	tqpw := quotedprintable.NewWriter(tw)
-	err = mnt.ExecuteTemplate(tqpw, "email-lock.md", params)
+	err = mnt.ExecuteTemplate(tqpw, textTmpl, params)
 	if err != nil {
-		log.Println("SendLockEmail:2:", err)
-		return
+		log.Println("SendCalendarEmail:2:", err)
+		return err
 	}
 	tqpw.Close()
 
@@ -242,30 +301,30 @@ func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
 	hHeader.Set("Content-Transfer-Encoding", "quoted-printable")
 	hw, err := mpw.CreatePart(hHeader)
 	if err != nil {
-		log.Println("SendLockEmail:3:", err)
-		return
+		log.Println("SendCalendarEmail:3:", err)
+		return err
 	}
 	hqpw := quotedprintable.NewWriter(hw)
-	err = mnt.ExecuteTemplate(hqpw, "email-lock.html", params)
+	err = mnt.ExecuteTemplate(hqpw, htmlTmpl, params)
 	if err != nil {
-		log.Println("SendLockEmail:4:", err)
-		return
+		log.Println("SendCalendarEmail:4:", err)
+		return err
 	}
 	hqpw.Close()
 
 	cHeader := textproto.MIMEHeader{}
-	cHeader.Set("Content-Type", mime.FormatMediaType("text/calendar", map[string]string{"charset": "UTF-8", "method": "REQUEST"}))
+	cHeader.Set("Content-Type", mime.FormatMediaType("text/calendar", map[string]string{"charset": "UTF-8", "method": params.Method}))
 	cHeader.Set("Content-Transfer-Encoding", "quoted-printable")
 	cw, err := mpw.CreatePart(cHeader)
 	if err != nil {
-		log.Println("SendLockEmail:5:", err)
-		return
+		log.Println("SendCalendarEmail:5:", err)
+		return err
 	}
 	cqpw := quotedprintable.NewWriter(cw)
-	err = mnt.ExecuteTemplate(cqpw, "email-lock.ical", params)
+	err = mnt.ExecuteTemplate(cqpw, icalTmpl, params)
 	if err != nil {
-		log.Println("SendLockEmail:6:", err)
-		return
+		log.Println("SendCalendarEmail:6:", err)
+		return err
 	}
 	cqpw.Close()
 	mpw.Close()
@@ -276,21 +335,17 @@ func SendLockEmail(to *User, winner *Showtime, weekOf time.Time) {
 	aHeader.Set("Content-Transfer-Encoding", "base64")
 	aw, err := mmpw.CreatePart(aHeader)
 	if err != nil {
-		log.Println("SendLockEmail:7:", err)
-		return
+		log.Println("SendCalendarEmail:7:", err)
+		return err
 	}
 	lbw := NewLineBreakWriter(aw, 76)
 	b64enc := base64.NewEncoder(base64.StdEncoding, lbw)
-	mnt.ExecuteTemplate(b64enc, "email-lock.ical", params)
+	mnt.ExecuteTemplate(b64enc, icalTmpl, params)
 	b64enc.Close()
 
 	mmpw.Close()
 
-	err = SendEmail(to.Email, *emailFrom, b.Bytes())
-	if err != nil {
-		log.Println("SendLockEmail:7:", err)
-		return
-	}
+	return SendEmail(to, from, b.Bytes())
 }
 
 func SendSimpleEmail(to, from, textTmpl, htmlTmpl string, params interface{}, headers textproto.MIMEHeader) error {
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The default group is the original tuesday night group. Newly registered users join it, and
+// requests that don't name a group fall back to it.
+const DefaultGroupId = 1
+
+var ErrAlreadyLocked = errors.New("Vote appears to already be locked")
+var ErrNotLocked = errors.New("The vote isn't locked")
+var ErrWeekLocked = errors.New("Voting is locked for this week")
+var ErrNoReason = errors.New("A reason is needed to unlock the vote or lock it again")
+var ErrNoShowtimes = errors.New("No Winners returned")
+
+// Returns the calendar of the group, which is the configured calendar on the groups event day
+func (g *Group) Calendar() Calendar {
+	c := calendar
+	c.EventDay = g.EventDay
+	return c
+}
+
+// Returns the beginning and end of the groups voting week for the given time
+func (g *Group) WeekOf(t time.Time) (time.Time, time.Time) {
+	return g.Calendar().Week(t)
+}
+
+// Emails about the same week of the same group are threaded together using this id
+func (g *Group) ThreadId(bow time.Time) string {
+	return fmt.Sprintf("<movie-night.%d.%s@murphysean.com>", g.Id, bow.Format(time.RFC3339))
+}
+
+// Users belong to the groups they have joined. Users with the admin.groups ability can act on
+// every group.
+func IsGroupMember(groupId int, u *User) bool {
+	if u == nil {
+		return false
+	}
+	if contains(u.Abilities, AbilityAdminGroups) {
+		return true
+	}
+	groups, err := store.GetGroupsForUser(u.Id)
+	if err != nil {
+		log.Println("IsGroupMember:", err)
+		return false
+	}
+	for _, g := range groups {
+		if g.Id == groupId {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the group a request acts on. That is the group named by the 'group' query param, or
+// else the first group the user belongs to. Anonymous requests can only see the default group.
+// On failure the http status code to respond with is returned along with the error.
+func GroupForRequest(r *http.Request, u *User) (*Group, int, error) {
+	gs := r.URL.Query().Get("group")
+	if gs == "" {
+		if u == nil {
+			g, err := store.GetGroup(DefaultGroupId)
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			return g, http.StatusOK, nil
+		}
+		groups, err := store.GetGroupsForUser(u.Id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(groups) == 0 {
+			return nil, http.StatusForbidden, errors.New("Not a member of any group")
+		}
+		return groups[0], http.StatusOK, nil
+	}
+	groupId, err := strconv.Atoi(gs)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("'group' must be a group id")
+	}
+	g, err := store.GetGroup(groupId)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if u == nil && g.Id != DefaultGroupId {
+		return nil, http.StatusUnauthorized, errors.New("Unauthorized")
+	}
+	if u != nil && !IsGroupMember(g.Id, u) {
+		return nil, http.StatusForbidden, errors.New("Not a member of this group")
+	}
+	return g, http.StatusOK, nil
+}
+
+// Locks the groups vote for the week on the current winner under the weeks voting method, after
+// which no more votes are taken. The user is the admin locking the week, or 0 for the scheduler.
+// The invite that goes out is saved, so that the recheck job can update it if the showtime
+// changes. The lock email goes out to the members of the group that want it the first time the
+// week locks. A week that is locked again after being unlocked sends an updated invite instead,
+// if the winner changed.
+func LockGroup(g *Group, bow, eow time.Time, userId int, reason string) (*Showtime, error) {
+	week, err := GetWeek(g, bow)
+	if err != nil {
+		return nil, err
+	}
+	if week.Locked != nil {
+		winner, err := store.GetShowtime(g.Id, week.ShowtimeId)
+		if err != nil {
+			return nil, err
+		}
+		return winner, ErrAlreadyLocked
+	}
+	standings, err := WeekStandings(g, bow, eow, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(standings) == 0 {
+		return nil, ErrNoShowtimes
+	}
+	winner := standings[0]
+	now := time.Now()
+	week.Locked, week.LockedBy, week.ShowtimeId = &now, userId, winner.Id
+	err = store.LockWeek(week, reason)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := store.GetInvite(g.Id, bow)
+	changed := false
+	if err != nil {
+		inv = &Invite{GroupId: g.Id, WeekOf: bow}
+	} else if inv.Cancelled || inv.ShowtimeId != winner.Id {
+		inv.Sequence++
+		changed = true
+	}
+	inv.ShowtimeId, inv.Showtime, inv.Cancelled = winner.Id, winner.Showtime, false
+	err = store.SaveInvite(inv)
+	if err != nil {
+		return winner, err
+	}
+	first, err := store.MarkLockEmail(g.Id, bow, now)
+	if err != nil {
+		return winner, err
+	}
+	if !first && !changed {
+		return winner, nil
+	}
+	users, err := store.GetUsersForPreference(g.Id, LockPreferenceType)
+	if err != nil {
+		return winner, err
+	}
+	if reason == "" {
+		reason = "The vote was locked again."
+	}
+	for _, u := range users {
+		if first {
+			fmt.Println("Sending Lock Email To", u.Email)
+			SendLockEmail(g, u, winner, inv)
+		} else {
+			fmt.Println("Sending Update Email To", u.Email)
+			SendInviteUpdateEmail(g, u, winner, inv, reason)
+		}
+	}
+	return winner, nil
+}
+
+// Locks the groups vote for the week on behalf of an admin. A week that was unlocked needs a
+// reason to be locked again, which goes out with the updated invites.
+func AdminLockGroup(g *Group, bow, eow time.Time, userId int, reason string) (*Showtime, error) {
+	locks, err := store.GetWeekLocks(g.Id, bow)
+	if err != nil {
+		return nil, err
+	}
+	if len(locks) > 0 && reason == "" {
+		return nil, ErrNoReason
+	}
+	return LockGroup(g, bow, eow, userId, reason)
+}
+
+// Unlocks the groups vote for the week, so that votes are taken again until it is locked again.
+// The invite of the winner is cancelled, and everyone that answered it without declining gets
+// the cancellation along with the reason.
+func UnlockGroup(g *Group, bow time.Time, userId int, reason string) error {
+	if reason == "" {
+		return ErrNoReason
+	}
+	err := store.UnlockWeek(g.Id, bow, userId, reason)
+	if err != nil {
+		return err
+	}
+	inv, err := store.GetInvite(g.Id, bow)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if inv.Cancelled {
+		return nil
+	}
+	winner, err := store.GetShowtime(g.Id, inv.ShowtimeId)
+	if err != nil {
+		return err
+	}
+	inv.Cancelled = true
+	fmt.Println("Vote of group", g.Id, "unlocked:", reason)
+	return sendInviteChange(g, winner, inv, reason)
+}
+
+// This api handler manages groups and their membership.
+//
+//	GET /api/groups                          The users groups (every group for admins)
+//	POST /api/groups                         Creates a group {"name":"Team A","eventDay":4}
+//	GET /api/groups/{id}                     The group and its members
+//	POST /api/groups/{id}/members            Adds a member {"userId":2} or {"email":"a@b.com"}
+//	DELETE /api/groups/{id}/members/{userId} Removes a member, users may remove themselves
+//
+// Creating groups and adding members requires the admin.groups ability.
+func APIGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	isAdmin := contains(u.Abilities, AbilityAdminGroups)
+	re := regexp.MustCompile(`^/api/groups/?([^/]*)/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	if pm == nil || (pm[2] != "" && pm[2] != "members") {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if pm[1] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			var groups []*Group
+			var err error
+			if isAdmin {
+				groups, err = store.GetGroups()
+			} else {
+				groups, err = store.GetGroupsForUser(u.Id)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			e := json.NewEncoder(w)
+			e.Encode(&groups)
+		case http.MethodPost:
+			if !isAdmin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			var ng = struct {
+				Name     string        `json:"name"`
+				EventDay *time.Weekday `json:"eventDay"`
+			}{}
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&ng)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			eventDay := calendar.EventDay
+			if ng.EventDay != nil {
+				eventDay = *ng.EventDay
+			}
+			if ng.Name == "" || eventDay < time.Sunday || eventDay > time.Saturday {
+				http.Error(w, "Include a 'name', and an 'eventDay' from Sun=0 to Sat=6", http.StatusBadRequest)
+				return
+			}
+			g, err := store.InsertGroup(ng.Name, eventDay)
+			if err != nil {
+				log.Println("APIGroupsHandler:1:", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			e := json.NewEncoder(w)
+			e.Encode(&g)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	groupId, err := strconv.Atoi(pm[1])
+	if err != nil {
+		http.Error(w, "Invalid Group Identifier", http.StatusNotFound)
+		return
+	}
+	g, err := store.GetGroup(groupId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && pm[2] == "":
+		if !IsGroupMember(g.Id, u) {
+			http.Error(w, "Not a member of this group", http.StatusForbidden)
+			return
+		}
+	case r.Method == http.MethodPost && pm[2] == "members" && pm[3] == "":
+		if !isAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var nm = struct {
+			UserId int    `json:"userId"`
+			Email  string `json:"email"`
+		}{}
+		d := json.NewDecoder(r.Body)
+		err := d.Decode(&nm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var member *User
+		if nm.Email != "" {
+			member, err = store.GetUserForEmail(nm.Email)
+		} else {
+			member, err = store.GetUser(nm.UserId)
+		}
+		if err != nil || member.Id == 0 {
+			http.Error(w, "Include the 'userId' or 'email' of a registered user", http.StatusBadRequest)
+			return
+		}
+		err = store.AddGroupMember(g.Id, member.Id)
+		if err != nil {
+			log.Println("APIGroupsHandler:2:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case r.Method == http.MethodDelete && pm[2] == "members" && pm[3] != "":
+		memberId := u.Id
+		if pm[3] != "me" {
+			memberId, err = strconv.Atoi(pm[3])
+			if err != nil {
+				http.Error(w, "Invalid User Identifier", http.StatusNotFound)
+				return
+			}
+		}
+		if memberId != u.Id && !isAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		err = store.RemoveGroupMember(g.Id, memberId)
+		if err != nil {
+			log.Println("APIGroupsHandler:3:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	g.Members, err = store.GetGroupMembers(g.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isAdmin {
+		for _, m := range g.Members {
+			m.Email = ""
+		}
+	}
+	e := json.NewEncoder(w)
+	err = e.Encode(&g)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -17,9 +19,12 @@ import (
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -36,13 +41,28 @@ func contains(arr []string, s string) bool {
 	return false
 }
 
-func AdminMovieHandler(w http.ResponseWriter, r *http.Request) {
-	//Lock this down to only users with the admin ability
-	u := LoggedInUser(r.Context())
-	if u == nil || !contains(u.Abilities, "admin.movie") {
-		http.Error(w, "Forbidden", http.StatusUnauthorized)
-		return
+// Returns the page and page size given by the 'page' and 'pageSize' query params, pages count
+// from 1
+func pageParams(v url.Values, defaultSize, maxSize int) (int, int, error) {
+	page, pageSize := 1, defaultSize
+	if p := v.Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("'page' must be a number from 1")
+		}
+		page = n
 	}
+	if ps := v.Get("pageSize"); ps != "" {
+		n, err := strconv.Atoi(ps)
+		if err != nil || n < 1 || n > maxSize {
+			return 0, 0, errors.New("'pageSize' must be a number from 1 to " + strconv.Itoa(maxSize))
+		}
+		pageSize = n
+	}
+	return page, pageSize, nil
+}
+
+func AdminMovieHandler(w http.ResponseWriter, r *http.Request) {
 	m := r.URL.Query().Get("imdb")
 	movie, err := InsertMovieByIMDBId(m, r.URL.Query().Get("title"))
 	if err != nil {
@@ -58,124 +78,264 @@ func AdminMovieHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		//Migrate all showtimes linked to old movie id to newly created one
-		err = MigrateShowtimesToNewMovieId(oldMovieId, movie.Id)
+		//Merge the old movie into the newly created one, so its title resolves to it from now on
+		_, err = MergeMovies(oldMovieId, movie.Id, LoggedInUser(r.Context()).Id)
 		if err != nil {
 			log.Println("AdminMovieHandler:3:", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		//Delete the old movie
-		err = DeleteMovie(oldMovieId)
-		if err != nil {
-			log.Println("AdminMovieHandler:4:", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
 	}
 }
 
 func AdminShowtimeHandler(w http.ResponseWriter, r *http.Request) {
-	u := LoggedInUser(r.Context())
-	if u == nil || !contains(u.Abilities, "admin.showtimes") {
-		http.Error(w, "Forbidden", http.StatusUnauthorized)
-		return
-	}
-	var locations = []string{
-		mp.LocationThanksgivingPoint,
-		mp.LocationGeneva,
-		mp.LocationJordanCommons,
-		mp.LocationTheDistrict}
 	l := r.URL.Query().Get("location")
 	date := r.URL.Query().Get("date")
 	if l == "" {
-		l = locations[0]
+		l = mp.LocationThanksgivingPoint
 	}
 	if l == "" || date == "" {
 		http.Error(w, "Need 'location' and 'date' query params", http.StatusBadRequest)
 		return
 	}
-	li := -1
-	for i, v := range locations {
-		if v == l {
-			li = i
-			break
+	theatre, err := store.GetTheatre(l)
+	if err != nil {
+		theatres, _ := store.GetTheatres()
+		ids := make([]string, 0)
+		for _, v := range theatres {
+			ids = append(ids, v.Id)
 		}
-	}
-	if li < 0 {
-		http.Error(w, "'location' query param must be one of:\n"+strings.Join(locations, ","), http.StatusBadRequest)
+		http.Error(w, "'location' query param must be one of:\n"+strings.Join(ids, ","), http.StatusBadRequest)
 		return
 	}
 
-	t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	t, err := time.ParseInLocation("2006-01-02", date, theatre.Location())
 	if err != nil {
 		http.Error(w, "Couldn't parse date, must be in YYYY-MM-DD format\n"+err.Error(), http.StatusBadRequest)
 		return
 	}
-	fetchShowtimes(l, t)
+	report, err := fetchShowtimes([]*Theatre{theatre}, t)
+	fmt.Println(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	e := json.NewEncoder(w)
+	err = e.Encode(&report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
+// Locks the groups open week on its winner. A week that was unlocked needs the 'reason' query
+// param to be locked again.
 func AdminLockHandler(w http.ResponseWriter, r *http.Request) {
 	u := LoggedInUser(r.Context())
-	if u == nil || !contains(u.Abilities, "admin.lock") {
-		http.Error(w, "Forbidden", http.StatusUnauthorized)
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
 		return
 	}
-	bow, eow := GetBeginningAndEndOfWeekForTime(time.Now())
-	winners, err := GetTopShowtimesForWeekOf(bow, eow, 1)
-	if err != nil {
+	bow, eow := g.WeekOf(time.Now())
+	_, err = AdminLockGroup(g, bow, eow, u.Id, r.URL.Query().Get("reason"))
+	if err == ErrNoShowtimes || err == ErrAlreadyLocked || err == ErrNoReason {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(winners) == 0 {
-		http.Error(w, "No Winners returned", http.StatusBadRequest)
+	if err != nil {
+		log.Println("AdminLockHandler:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	winner := winners[0]
-	//If the vote is manually closed earlier, it will give the winner 1000 votes to ensure that it remains the winner
-	//Also it will have already sent out the emails, so this routine should just forego it's purpose
-	if winner.Votes < 1000 {
-		err := LockVoteForWinner(bow, eow, winners[0])
+}
+
+// Hides the showtime given by the 'showtimeId' query param from the group, for the 'reason'
+// query param. See APIAdminHidesHandler for listing and restoring hidden showtimes.
+func AdminDownvoteHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if r.URL.Query().Get("showtimeId") != "" {
+		showtimeId, err := strconv.Atoi(r.URL.Query().Get("showtimeId"))
 		if err != nil {
+			http.Error(w, "showtimeId not a valid int", http.StatusBadRequest)
+			return
+		}
+		_, err = HideShowtime(g, showtimeId, u.Id, r.URL.Query().Get("reason"))
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		case ErrNoHideReason:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case ErrAlreadyHidden:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Println("AdminDownvoteHandler:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// This api handler manages the roles and abilities granted to a user. A GET responds with the
+// users roles, directly granted abilities and effective abilities. A POST grants, and a DELETE
+// revokes, either an ability or a role:
+//
+//	{"ability":"admin.lock"} or {"role":"curator"}
+//
+// The DELETE method also accepts 'ability' or 'role' query params.
+func APIAdminUserAbilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	re := regexp.MustCompile(`/api/admin/users/([^/]*)/abilities`)
+	puidm := re.FindStringSubmatch(r.URL.Path)
+	if len(puidm) < 2 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	userId, err := strconv.Atoi(puidm[1])
+	if err != nil {
+		http.Error(w, "Invalid User Identifier", http.StatusNotFound)
+		return
+	}
+	if _, err := store.GetUser(userId); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var grant = struct {
+		Ability string `json:"ability"`
+		Role    string `json:"role"`
+	}{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if r.Method == http.MethodDelete && (r.URL.Query().Get("ability") != "" || r.URL.Query().Get("role") != "") {
+			grant.Ability = r.URL.Query().Get("ability")
+			grant.Role = r.URL.Query().Get("role")
+		} else {
+			d := json.NewDecoder(r.Body)
+			err := d.Decode(&grant)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if (grant.Ability == "") == (grant.Role == "") {
+			http.Error(w, "Include exactly one of 'ability' or 'role'", http.StatusBadRequest)
+			return
+		}
+		if grant.Ability != "" && !isAbility(grant.Ability) {
+			http.Error(w, "'ability' must be one of:\n"+strings.Join(abilities, ","), http.StatusBadRequest)
 			return
 		}
-		users, err := GetUsersForPreference(LockPreferenceType)
+		if grant.Role != "" && !isRole(grant.Role) {
+			http.Error(w, "Unknown role: "+grant.Role, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && grant.Ability != "":
+			err = GrantAbility(u.Id, userId, grant.Ability)
+		case r.Method == http.MethodPost:
+			err = AssignRole(u.Id, userId, grant.Role)
+		case grant.Ability != "":
+			err = RevokeAbility(u.Id, userId, grant.Ability)
+		default:
+			err = UnassignRole(u.Id, userId, grant.Role)
+		}
 		if err != nil {
+			log.Println("APIAdminUserAbilitiesHandler:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		for _, u := range users {
-			fmt.Println("Sending Lock Email To", u.Email)
-			SendLockEmail(u, winner, bow)
-		}
-	} else {
-		http.Error(w, "Vote appears to already be locked", http.StatusBadRequest)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-}
 
-func AdminDownvoteHandler(w http.ResponseWriter, r *http.Request) {
-	u := LoggedInUser(r.Context())
-	if u == nil || !contains(u.Abilities, "admin.downvote") {
-		http.Error(w, "Forbidden", http.StatusUnauthorized)
+	var ret = struct {
+		UserId    int      `json:"userId"`
+		Roles     []string `json:"roles"`
+		Abilities []string `json:"abilities"`
+		Effective []string `json:"effective"`
+	}{UserId: userId}
+	ret.Roles, err = GetUserRoles(userId)
+	if err == nil {
+		ret.Abilities, err = GetUserDirectAbilities(userId)
+	}
+	if err == nil {
+		ret.Effective, err = store.GetUserAbilities(userId)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if r.URL.Query().Get("showtimeId") != "" {
-		showtimeId, err := strconv.Atoi(r.URL.Query().Get("showtimeId"))
+	e := json.NewEncoder(w)
+	err = e.Encode(&ret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// This api handler takes an online backup of the database. A GET downloads a fresh backup,
+// while a POST writes one to the backup directory (rotating out old ones) and responds with
+// its path.
+func APIAdminBackupHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		f, err := ioutil.TempFile("", "mn-backup-*.db")
 		if err != nil {
-			http.Error(w, "showtimeId not a valid int", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = AdminDownvote(showtimeId)
+		//VACUUM INTO wants to create the file itself
+		f.Close()
+		os.Remove(f.Name())
+		defer os.Remove(f.Name())
+		err = BackupTo(db, f.Name())
 		if err != nil {
-			log.Println("AdminDownvoteHandler:", err)
+			log.Println("APIAdminBackupHandler:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(backupPath("", time.Now()))+"\"")
+		http.ServeFile(w, r, f.Name())
+	case http.MethodPost:
+		path, err := BackupAndRotate(db, *backupDir, *backupKeep)
+		if err != nil {
+			log.Println("APIAdminBackupHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		e := json.NewEncoder(w)
+		e.Encode(map[string]string{"path": path})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// This api handler exports the movie night data as json, leaving out secrets
+func APIAdminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	err := ExportJSON(db, &buf)
+	if err != nil {
+		log.Println("APIAdminExportHandler:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
 // From emails I've seen, DECLINED, ACCEPTED
 func RsvpResponseHandler(w http.ResponseWriter, r *http.Request) {
 	u := LoggedInUser(r.Context())
@@ -210,7 +370,7 @@ func RsvpResponseHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		u, err = GetUser(userId)
+		u, err = store.GetUser(userId)
 		if err != nil {
 			fmt.Println("Bad Rsvp Response: invalid userId", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -226,7 +386,23 @@ func RsvpResponseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	st, err := GetShowtime(showtimeId)
+	//Links sent before groups existed don't carry a group, they were all for the default group
+	groupId := DefaultGroupId
+	if r.URL.Query().Get("groupId") != "" {
+		groupId, err = strconv.Atoi(r.URL.Query().Get("groupId"))
+		if err != nil {
+			fmt.Println("Bad Rsvp Response: groupId int", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !IsGroupMember(groupId, u) {
+		fmt.Println("Bad Rsvp Response: not a member of group", groupId)
+		http.Error(w, "Not a member of this group", http.StatusForbidden)
+		return
+	}
+
+	st, err := store.GetShowtime(groupId, showtimeId)
 	if err != nil {
 		fmt.Println("Bad Rsvp Response: invalid showtime", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -235,10 +411,10 @@ func RsvpResponseHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet {
 		buzz := fmt.Sprintf("%s: %s", u.Name, value)
-		InsertRsvp(u.Id, st.Id, value)
+		store.InsertRsvp(groupId, u.Id, st.Id, value)
 		go SendBuzzMessage("Movie-Night: RSVP", buzz)
 		ScrubUser(u)
-		sseManager.SendRSVP(u, value)
+		sseManager.SendRSVP(groupId, u, value)
 		fmt.Println(buzz)
 	}
 
@@ -303,7 +479,7 @@ func EmailResponseHandler(w http.ResponseWriter, r *http.Request) {
 						return
 					}
 					status := getCalResponse(cal)
-					u, err := GetUserForEmail(email.From)
+					u, err := store.GetUserForEmail(email.From)
 					if err != nil {
 						log.Println("EmailResponseHandler:7:", err)
 						http.Error(w, err.Error(), http.StatusBadRequest)
@@ -313,7 +489,7 @@ func EmailResponseHandler(w http.ResponseWriter, r *http.Request) {
 					go SendBuzzMessage("Movie-Night: RSVP", buzz)
 					//TODO Get Showtimeid from email cal appoint
 					showtimeId := 0
-					InsertRsvp(u.Id, showtimeId, status)
+					store.InsertRsvp(DefaultGroupId, u.Id, showtimeId, status)
 					fmt.Println(buzz)
 					fmt.Println("Recieved an email response from", email.From, "with a cal response of", status)
 				} else {
@@ -348,49 +524,29 @@ func getCalResponse(cal []byte) (status string) {
 ///////////////////////////////////////////////////////////////////////////////////////////
 //API SECTION
 
-type ImageCache struct {
-	sync.RWMutex
-	Cache map[int][]byte
-}
-
-func NewImageCache() *ImageCache {
-	ret := new(ImageCache)
-	ret.Cache = make(map[int][]byte)
-	return ret
-}
-
-func (ic *ImageCache) Put(movieId int, bytes []byte) {
-	ic.Lock()
-	defer ic.Unlock()
-	ic.Cache[movieId] = bytes
-}
-
-func (ic *ImageCache) Get(movieId int) ([]byte, bool) {
-	ic.RLock()
-	defer ic.RUnlock()
-	b, ok := ic.Cache[movieId]
-	return b, ok
-}
-
-var imageCache = NewImageCache()
-
 func APIMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var movieId int = -1
 	var err error
-	re := regexp.MustCompile(`/api/movies/([^/]*)`)
+	re := regexp.MustCompile(`/api/movies/?([^/]*)/?([^/]*)`)
 	pmidm := re.FindStringSubmatch(r.URL.Path)
-	if len(pmidm) > 1 {
-		movieId, err = strconv.Atoi(pmidm[1])
-		if err != nil {
-			movieId = -1
-		}
+	if pmidm == nil || pmidm[1] == "" {
+		APIMovieSearchHandler(w, r)
+		return
 	}
-	if movieId < 0 {
+	movieId, err = strconv.Atoi(pmidm[1])
+	if err != nil || movieId < 0 || (pmidm[2] != "" && pmidm[2] != "history") {
 		http.Error(w, "Invalid Movie Identifier", http.StatusNotFound)
 		return
 	}
+	if pmidm[2] == "history" {
+		APIMovieHistoryHandler(w, r, movieId)
+		return
+	}
 
-	m, err := GetMovie(movieId)
+	m, err := store.GetMovie(movieId)
+	if err != nil {
+		m, err = InsertMovieByIMDBId(fmt.Sprintf("tt%d", movieId), "")
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -405,32 +561,43 @@ func APIMoviesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		w.Header().Set("Cache-Control", "max-age=86400")
-		if b, ok := imageCache.Get(m.Id); ok {
-			w.Write(b)
+		size := r.URL.Query().Get("size")
+		if size == "" {
+			size = "original"
+		}
+		if _, ok := posterSizes[size]; !ok {
+			http.Error(w, "Unknown size, use thumb, medium or original", http.StatusBadRequest)
+			return
+		}
+		p, err := posterCache.Get(m, size)
+		if err != nil {
+			log.Println("APIMoviesHandler:1:", err)
+			p = placeholderPoster(size)
+		}
+		w.Header().Set("Content-Type", p.ContentType)
+		if p.Placeholder {
+			//Try the poster again soon
+			w.Header().Set("Cache-Control", "max-age=300")
 		} else {
-			resp, err := http.Get(m.Poster)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			defer resp.Body.Close()
-			b, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-			imageCache.Put(movieId, b)
-			w.Write(b)
+			w.Header().Set("Cache-Control", "max-age=86400")
+			w.Header().Set("ETag", p.ETag)
 		}
+		http.ServeContent(w, r, "", p.Modified, bytes.NewReader(p.Bytes))
 	}
 }
 
 // This api handler will respond with the available showtimes for the current week on a GET
-// request. On a POST or PUT request it will update the votes for the current user.
+// request. On a POST or PUT request it will update the votes for the current user. Both act
+// on the group given by the 'group' query param, or the users first group.
 func APIShowtimesHandler(w http.ResponseWriter, r *http.Request) {
 	u := LoggedInUser(r.Context())
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
 	n := time.Now()
-	bow, eow := GetBeginningAndEndOfWeekForTime(n)
+	bow, eow := g.WeekOf(n)
 	switch r.Method {
 	case http.MethodPost:
 		fallthrough
@@ -446,55 +613,110 @@ func APIShowtimesHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		sum := 0
-		for _, v := range votes {
-			if v.Vote > 3 {
-				http.Error(w, "No vote can be greater than 3", http.StatusBadRequest)
-				return
-			}
-			if v.Vote < -1 {
-				http.Error(w, "No vote can be less than -1", http.StatusBadRequest)
-				return
-			}
-			if v.Vote > 0 {
-				sum += v.Vote
+		week, err := GetWeek(g, bow)
+		if err != nil {
+			log.Println("APIShowtimesHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if week.Locked != nil {
+			http.Error(w, ErrWeekLocked.Error(), http.StatusConflict)
+			return
+		}
+		method, err := GetVotingMethod(week.Method)
+		if err != nil {
+			log.Println("APIShowtimesHandler:2:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		//A -1 was how the points method vetoed a showtime before vetoes were their own thing
+		if method.Name() == "points" {
+			for _, v := range votes {
+				if v.Vote == -1 {
+					v.Vote, v.Veto = 0, true
+				}
 			}
 		}
-		if sum > 6 {
-			http.Error(w, "Sum of all votes can't exceed 6", http.StatusBadRequest)
+		err = method.Validate(votes)
+		if err == nil {
+			err = ValidateVetoes(votes)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = InsertVotesForUser(bow, eow, u.Id, votes)
+		//Only the showtimes on the ballot of the open week take votes, which leaves out the
+		//showtimes of locked weeks, hidden showtimes and the theatres of other groups
+		open, err := store.GetShowtimesForWeekOf(g.Id, bow, eow, 0)
 		if err != nil {
+			log.Println("APIShowtimesHandler:3:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		sts := make([]*Showtime, 0)
+		ballot := make(map[int]*Showtime)
+		for _, s := range open {
+			ballot[s.Id] = s
+		}
 		for _, s := range votes {
-			v, err := GetShowtime(s.Id)
-			if err != nil {
+			if _, ok := ballot[s.Id]; !ok {
 				http.Error(w, fmt.Sprint("Invalid showtime id:", s.Id), http.StatusBadRequest)
 				return
 			}
-			v.Vote = s.Vote
-			if v.Vote > 0 || v.Vote == -1 {
+		}
+		//The first ballot keeps the week on the voting method and tie break it opened with
+		err = store.OpenWeek(week)
+		if err == nil {
+			err = store.InsertVotesForUser(g.Id, bow, eow, u.Id, votes)
+		}
+		if err == ErrWeekLocked {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sts := make([]*Showtime, 0)
+		for _, s := range votes {
+			v := ballot[s.Id]
+			v.Vote, v.Veto = s.Vote, s.Veto
+			if v.Vote > 0 || v.Veto {
 				sts = append(sts, v)
 			}
 		}
 		votes = sts
-		activityChannel <- Activity{User: u, Votes: votes}
+		activityChannel <- Activity{User: u, Group: g, Votes: votes}
 	case http.MethodGet:
 		var err error
 		var sts []*Showtime
 		if u == nil {
-			sts, err = GetTopShowtimesForWeekOf(bow, eow, 10)
+			sts, err = WeekStandings(g, bow, eow, 0)
+			if len(sts) > 10 {
+				sts = sts[:10]
+			}
 		} else {
-			sts, err = GetShowtimesForWeekOf(bow, eow, u.Id)
+			sts, err = WeekStandings(g, bow, eow, u.Id)
 		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		//The showtimes can be narrowed to some theatres by including a theatre param for each
+		if theatres := r.URL.Query()["theatre"]; len(theatres) > 0 {
+			filtered := make([]*Showtime, 0)
+			for _, st := range sts {
+				if contains(theatres, st.TheatreId) {
+					filtered = append(filtered, st)
+				}
+			}
+			sts = filtered
+		}
+		loc := calendar.Location
+		if u != nil {
+			loc = u.Location()
+		}
+		for _, st := range sts {
+			st.Showtime = st.Showtime.In(loc)
+		}
 		e := json.NewEncoder(w)
 		err = e.Encode(&sts)
 		if err != nil {
@@ -518,20 +740,12 @@ func APILoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if u, err := ValidateUser(loginObj.Email, loginObj.Password); err == nil {
-		nc := new(http.Cookie)
-		nc.Name = "movienightsid"
-		nc.Path = "/"
-		if uo, err := url.Parse(*appUrl); err == nil {
-			if len(uo.Path) > 1 && strings.HasSuffix(uo.Path, "/") {
-				nc.Path = uo.Path[:len(uo.Path)-1]
-			} else {
-				nc.Path = uo.Path
-			}
+		err = startSession(w, r, u)
+		if err != nil {
+			log.Println("APILoginHandler:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		nc.Value = GenUUIDv4()
-		nc.Expires = time.Now().Add(time.Hour * 24 * 365)
-		sessions[nc.Value] = u.Id
-		http.SetCookie(w, nc)
 
 		e := json.NewEncoder(w)
 		err = e.Encode(&u)
@@ -571,14 +785,161 @@ func APIResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		u, err := FinishRegistration(resetObj.OTT, resetObj.Password)
 		if err == nil {
 			//Log them in
-			nc := new(http.Cookie)
-			nc.Name = "movienightsid"
-			nc.Value = GenUUIDv4()
-			nc.Expires = time.Now().Add(time.Hour * 24 * 365)
-			sessions[nc.Value] = u.Id
-			http.SetCookie(w, nc)
+			err = startSession(w, r, u)
+			if err != nil {
+				log.Println("APIResetPasswordHandler:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// Creates a new persistent session for the user and sets the session cookie on the response
+func startSession(w http.ResponseWriter, r *http.Request, u *User) error {
+	s, err := InsertSession(u.Id, r.UserAgent(), remoteIp(r), time.Now())
+	if err != nil {
+		return err
+	}
+	nc := new(http.Cookie)
+	nc.Name = "movienightsid"
+	nc.Path = "/"
+	if uo, err := url.Parse(*appUrl); err == nil {
+		if len(uo.Path) > 1 && strings.HasSuffix(uo.Path, "/") {
+			nc.Path = uo.Path[:len(uo.Path)-1]
+		} else {
+			nc.Path = uo.Path
+		}
+	}
+	nc.Value = s.Token
+	nc.Expires = s.Expires
+	nc.HttpOnly = true
+	http.SetCookie(w, nc)
+	return nil
+}
+
+// The application usually sits behind a reverse proxy, so prefer the forwarded address
+func remoteIp(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	//Each proxy appends the address it got the request from, so the client is the last address
+	//that isn't one of the trusted proxies
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// The networks of the reverse proxies set with -trustedProxies
+var trustedProxyNets []*net.IPNet
+
+// Parses a comma separated list of addresses and CIDRs, like 127.0.0.1,10.0.0.0/8
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("Trusted proxy '%s' isn't an address or CIDR", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// This api handler will respond with the logged in sessions (devices) of the current user on
+// a GET request. A DELETE to /api/sessions/{id} will revoke that session.
+func APISessionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var sessionId int = -1
+	re := regexp.MustCompile(`/api/sessions/([^/]*)`)
+	psidm := re.FindStringSubmatch(r.URL.Path)
+	if len(psidm) > 1 {
+		if psidm[1] == "current" {
+			sessionId = LoggedInSession(r.Context()).Id
+		} else if id, err := strconv.Atoi(psidm[1]); err == nil {
+			sessionId = id
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := GetSessionsForUser(u.Id, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if cs := LoggedInSession(r.Context()); cs != nil {
+			for _, s := range sessions {
+				s.Current = s.Id == cs.Id
+			}
+		}
+		e := json.NewEncoder(w)
+		err = e.Encode(&sessions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if sessionId < 0 {
+			http.Error(w, "Invalid Session Identifier", http.StatusNotFound)
+			return
+		}
+		err := DeleteSession(sessionId, u.Id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -588,17 +949,23 @@ type SSEEvent struct {
 	Data  string `json:"data"`
 }
 
+// Each connection only receives the events of the group it was opened for
+type SSEConnection struct {
+	GroupId int
+	C       chan SSEEvent
+}
+
 type SSEManager struct {
 	sync.RWMutex
 	Counter  int64
-	Channels []chan SSEEvent
+	Channels []SSEConnection
 }
 
-func (ssem *SSEManager) CreateConnection() <-chan SSEEvent {
+func (ssem *SSEManager) CreateConnection(groupId int) <-chan SSEEvent {
 	ret := make(chan SSEEvent, 10)
 	ssem.Lock()
 	defer ssem.Unlock()
-	ssem.Channels = append(ssem.Channels, ret)
+	ssem.Channels = append(ssem.Channels, SSEConnection{groupId, ret})
 	return ret
 }
 
@@ -606,7 +973,7 @@ func (ssem *SSEManager) CloseConnection(val <-chan SSEEvent) {
 	ssem.Lock()
 	defer ssem.Unlock()
 	for i, v := range ssem.Channels {
-		if v == val {
+		if v.C == val {
 			ssem.Channels = append(ssem.Channels[:i], ssem.Channels[i+1:]...)
 		}
 	}
@@ -620,7 +987,7 @@ func (ssem *SSEManager) GetNextId() int64 {
 	return ret
 }
 
-func (ssem *SSEManager) SendActivity(user *User, activity []*Showtime) {
+func (ssem *SSEManager) SendActivity(groupId int, user *User, activity []*Showtime) {
 	nid := ssem.GetNextId()
 	ssem.RLock()
 	defer ssem.RUnlock()
@@ -634,11 +1001,13 @@ func (ssem *SSEManager) SendActivity(user *User, activity []*Showtime) {
 	}
 	e := SSEEvent{nid, "activity", string(b)}
 	for _, c := range ssem.Channels {
-		c <- e
+		if c.GroupId == groupId {
+			c.C <- e
+		}
 	}
 }
 
-func (ssem *SSEManager) SendRSVP(user *User, value string) {
+func (ssem *SSEManager) SendRSVP(groupId int, user *User, value string) {
 	nid := ssem.GetNextId()
 	ssem.RLock()
 	defer ssem.RUnlock()
@@ -652,7 +1021,9 @@ func (ssem *SSEManager) SendRSVP(user *User, value string) {
 	}
 	e := SSEEvent{nid, "rsvp", string(b)}
 	for _, c := range ssem.Channels {
-		c <- e
+		if c.GroupId == groupId {
+			c.C <- e
+		}
 	}
 }
 
@@ -666,7 +1037,13 @@ func APISSE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sseChan := sseManager.CreateConnection()
+	g, code, err := GroupForRequest(r, LoggedInUser(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	sseChan := sseManager.CreateConnection(g.Id)
 	defer sseManager.CloseConnection(sseChan)
 
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -674,8 +1051,8 @@ func APISSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	//Funnel all events in the system back down this pipe to the user
 	//Events include, new votes, rsvps, lock
-	fmt.Fprintf(w, "event: %d\n\n", "connectioncount")
-	fmt.Fprintf(w, "id: %d\n\n", sseManager.GetNextId)
+	fmt.Fprintf(w, "event: %s\n\n", "connectioncount")
+	fmt.Fprintf(w, "id: %d\n\n", sseManager.GetNextId())
 	fmt.Fprintf(w, "data: %d\n\n", len(sseManager.Channels))
 	flusher.Flush()
 
@@ -708,11 +1085,12 @@ func APISSE(w http.ResponseWriter, r *http.Request) {
 
 // This api handler will respond with the current user object (including preferences) on a
 // GET request. On a POST it will create a new user (register)
-// On a PUT request it will update the current user object.
+// On a PUT request it will update the current user object. The users voting stats are at
+// /api/users/{id}/stats, see APIUserStatsHandler.
 func APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 	var userId int = -1
 	var err error
-	re := regexp.MustCompile(`/api/users/([^/]*)`)
+	re := regexp.MustCompile(`/api/users/([^/]*)/?([^/]*)`)
 	puidm := re.FindStringSubmatch(r.URL.Path)
 	u := LoggedInUser(r.Context())
 	if len(puidm) > 1 {
@@ -725,6 +1103,14 @@ func APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	if len(puidm) > 2 && puidm[2] != "" {
+		if puidm[2] != "stats" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		APIUserStatsHandler(w, r, userId)
+		return
+	}
 	switch r.Method {
 	case http.MethodPost:
 		if u != nil {
@@ -738,8 +1124,12 @@ func APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		ott := GenUUIDv4()
-		u, err := RegisterUser(u.Name, u.Email, ott)
+		u, err := store.RegisterUser(u.Name, u.Email, ott)
 		if err == nil {
+			err = store.AddGroupMember(DefaultGroupId, u.Id)
+			if err != nil {
+				log.Println("APIUsersHandler:", err)
+			}
 			SendRegistrationEmail(u, ott)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -756,8 +1146,14 @@ func APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if u.TimeZone != "" {
+			if _, err := time.LoadLocation(u.TimeZone); err != nil {
+				http.Error(w, "'timeZone' must be an IANA time zone like America/Denver", http.StatusBadRequest)
+				return
+			}
+		}
 		u.Id = userId
-		UpdateUserPrefs(u)
+		store.UpdateUserPrefs(u)
 	case http.MethodGet:
 		if u == nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -768,12 +1164,12 @@ func APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
-		ret, err := GetUser(userId)
+		ret, err := store.GetUser(userId)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		ret.Abilities, err = GetUserAbilities(ret.Id)
+		ret.Abilities, err = store.GetUserAbilities(ret.Id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -815,22 +1211,22 @@ func APIPreviewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	showtime, err := GetShowtime(stid)
+	showtime, err := store.GetShowtime(0, stid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	theatreId := mp.GetIdFromLocation(showtime.Location)
+	theatreId := showtime.TheatreId
 	num := showtime.PreviewSeatsLink
 
-	layout, err := mp.GetLayout(num, theatreId)
+	layout, err := theatreProvider.GetLayout(num, theatreId)
 	if err != nil {
 		log.Printf("ApiPreview:Layout: Num: %s, Theatre: %s", num, theatreId)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	preview, err := mp.GetPreview(num, theatreId)
+	preview, err := theatreProvider.GetPreview(num, theatreId)
 	if err != nil {
 		log.Printf("ApiPreview:Preview: Num: %s, Theatre: %s", num, theatreId)
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Swaps in a memory store, a calendar in America/Denver and a buffered activity channel, with
+// emails printed rather than sent, for as long as the test runs. Returns a group voting this
+// week, as the handlers only take votes for the week open now.
+func setupHandlerTest(t *testing.T) *storeFixture {
+	oldStore, oldCalendar, oldMnt, oldDebug, oldActivity := store, calendar, mnt, *debug, activityChannel
+	t.Cleanup(func() {
+		store, calendar, mnt, *debug, activityChannel = oldStore, oldCalendar, oldMnt, oldDebug, oldActivity
+	})
+	store, calendar = NewMemoryStore(), denverCalendar(t, time.Tuesday)
+	mnt, *debug = template.Must(template.ParseGlob("templates/*")), true
+	activityChannel = make(chan Activity, 16)
+	bow, _ := calendar.Week(time.Now())
+	return newStoreFixture(t, store, bow)
+}
+
+// Serves the request with the handler as the user, who may be nil
+func serveAs(h http.HandlerFunc, u *User, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := context.WithValue(r.Context(), "liu", u)
+	ctx = context.WithValue(ctx, "lis", (*Session)(nil))
+	w := httptest.NewRecorder()
+	h(w, r.WithContext(ctx))
+	return w
+}
+
+func TestAPIShowtimesHandler(t *testing.T) {
+	f := setupHandlerTest(t)
+	a := f.users[0]
+	outsider, err := store.RegisterUser("C", "c@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/showtimes?group=" + strconv.Itoa(f.g.Id)
+	st0, st1 := strconv.Itoa(f.showtimes[0].Id), strconv.Itoa(f.showtimes[1].Id)
+
+	w := serveAs(APIShowtimesHandler, a, http.MethodGet, target, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d %s", w.Code, w.Body)
+	}
+	sts := make([]*Showtime, 0)
+	if err = json.NewDecoder(w.Body).Decode(&sts); err != nil || len(sts) != 3 {
+		t.Fatalf("GET returned %d showtimes (%v), want 3", len(sts), err)
+	}
+
+	rejected := []struct {
+		name string
+		u    *User
+		body string
+		code int
+	}{
+		{"anonymous", nil, `[{"id":` + st0 + `,"vote":1}]`, http.StatusUnauthorized},
+		{"not a member", outsider, `[{"id":` + st0 + `,"vote":1}]`, http.StatusForbidden},
+		{"not json", a, `{`, http.StatusBadRequest},
+		{"not on the ballot", a, `[{"id":9999,"vote":1}]`, http.StatusBadRequest},
+		{"too many points", a, `[{"id":` + st0 + `,"vote":3},{"id":` + st1 + `,"vote":3},{"id":` + strconv.Itoa(f.showtimes[2].Id) + `,"vote":1}]`, http.StatusBadRequest},
+		{"votes for a veto", a, `[{"id":` + st0 + `,"vote":1,"veto":true}]`, http.StatusBadRequest},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveAs(APIShowtimesHandler, tt.u, http.MethodPost, target, tt.body)
+			if w.Code != tt.code {
+				t.Errorf("POST = %d %s, want %d", w.Code, w.Body, tt.code)
+			}
+		})
+	}
+	if ballots, _ := store.GetBallots(f.g.Id, f.bow, f.eow); len(ballots) != 0 {
+		t.Fatalf("the rejected ballots left %d ballots", len(ballots))
+	}
+
+	w = serveAs(APIShowtimesHandler, a, http.MethodPost, target, `[{"id":`+st0+`,"vote":3},{"id":`+st1+`,"veto":true}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	ballots, err := store.GetBallots(f.g.Id, f.bow, f.eow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := ballotOf(ballots, a.Id); b == nil || b.Votes[f.showtimes[0].Id] != 3 || !b.Vetoes[f.showtimes[1].Id] {
+		t.Errorf("the ballot is %+v", b)
+	}
+	if week, err := store.GetWeek(f.g.Id, f.bow); err != nil || week.Method != *votingMethod {
+		t.Errorf("the week was saved as %+v (%v), want it saved with %s", week, err, *votingMethod)
+	}
+	select {
+	case act := <-activityChannel:
+		if act.User.Id != a.Id || len(act.Votes) != 2 {
+			t.Errorf("the activity is of %d with %d votes, want %d with 2", act.User.Id, len(act.Votes), a.Id)
+		}
+	default:
+		t.Error("the ballot sent no activity")
+	}
+
+	now := time.Now()
+	err = store.LockWeek(&Week{GroupId: f.g.Id, WeekOf: f.bow, Method: *votingMethod, TieBreak: *tieBreak, Locked: &now, ShowtimeId: f.showtimes[0].Id}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveAs(APIShowtimesHandler, a, http.MethodPost, target, `[{"id":`+st1+`,"vote":1}]`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("POST to a locked week = %d %s, want %d", w.Code, w.Body, http.StatusConflict)
+	}
+}
+
+func TestAPIWeeksLockHandler(t *testing.T) {
+	f := setupHandlerTest(t)
+	member, admin := f.users[1], *f.users[0]
+	admin.Abilities = []string{AbilityAdminLock}
+	target := "/api/weeks/current/lock?group=" + strconv.Itoa(f.g.Id)
+	err := store.InsertVotesForUser(f.g.Id, f.bow, f.eow, member.Id, []*Showtime{{Id: f.showtimes[1].Id, Vote: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite := func() *Invite {
+		inv, err := store.GetInvite(f.g.Id, f.bow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv
+	}
+
+	steps := []struct {
+		name   string
+		u      *User
+		method string
+		body   string
+		code   int
+	}{
+		{"members can't lock", member, http.MethodPost, "", http.StatusForbidden},
+		{"the first lock needs no reason", &admin, http.MethodPost, "", http.StatusOK},
+		{"a locked week can't be locked", &admin, http.MethodPost, `{"reason":"Again"}`, http.StatusConflict},
+		{"unlocking needs a reason", &admin, http.MethodDelete, "", http.StatusBadRequest},
+		{"unlock", &admin, http.MethodDelete, `{"reason":"Counted a vote twice"}`, http.StatusOK},
+		{"an open week can't be unlocked", &admin, http.MethodDelete, `{"reason":"Again"}`, http.StatusConflict},
+		{"locking again needs a reason", &admin, http.MethodPost, "", http.StatusBadRequest},
+		{"lock again", &admin, http.MethodPost, `{"reason":"Recounted"}`, http.StatusOK},
+	}
+	for _, step := range steps {
+		w := serveAs(APIWeeksHandler, step.u, step.method, target, step.body)
+		if w.Code != step.code {
+			t.Fatalf("%s: %s = %d %s, want %d", step.name, step.method, w.Code, w.Body, step.code)
+		}
+		switch step.name {
+		case "the first lock needs no reason":
+			if inv := invite(); inv.ShowtimeId != f.showtimes[1].Id || inv.Cancelled || inv.Sequence != 0 {
+				t.Errorf("the invite is %+v, want one for %d", inv, f.showtimes[1].Id)
+			}
+			//The member answers the invite, so they hear of the unlock
+			if err = store.InsertRsvp(f.g.Id, member.Id, f.showtimes[1].Id, "ACCEPTED"); err != nil {
+				t.Fatal(err)
+			}
+		case "unlock":
+			if inv := invite(); !inv.Cancelled || inv.Sequence != 1 {
+				t.Errorf("the invite of the unlocked week is %+v, want it cancelled with sequence 1", inv)
+			}
+			if w, _ := GetWeek(f.g, f.bow); w.Locked != nil {
+				t.Error("the week is still locked")
+			}
+		case "lock again":
+			if inv := invite(); inv.Cancelled || inv.Sequence != 2 {
+				t.Errorf("the invite of the locked week is %+v, want it sent again with sequence 2", inv)
+			}
+		}
+	}
+
+	w := serveAs(APIWeeksHandler, member, http.MethodGet, "/api/weeks/current/results?group="+strconv.Itoa(f.g.Id), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET results = %d %s", w.Code, w.Body)
+	}
+	res := new(WeekResults)
+	if err = json.NewDecoder(w.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Lock != "manual" || len(res.Locks) != 3 || res.Locks[1].Reason != "Counted a vote twice" {
+		t.Errorf("the results are locked %q with the log %+v", res.Lock, res.Locks)
+	}
+	if len(res.Standings) == 0 || res.Standings[0].Id != f.showtimes[1].Id {
+		t.Errorf("the standings don't start with the winner %d", f.showtimes[1].Id)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var ErrAlreadyHidden = errors.New("The showtime is already hidden")
+var ErrHideRestored = errors.New("The showtime was already restored")
+var ErrNoHideReason = errors.New("A reason is needed to hide a showtime")
+
+// A ShowtimeHide takes a showtime off a groups ballot, until it is restored. Each hide is kept,
+// so the hides of a showtime are its history.
+type ShowtimeHide struct {
+	Id         int        `json:"id"`
+	GroupId    int        `json:"groupId"`
+	ShowtimeId int        `json:"showtimeId"`
+	Reason     string     `json:"reason"`
+	UserId     int        `json:"userId"`
+	Created    time.Time  `json:"created"`
+	Restored   *time.Time `json:"restored,omitempty"`
+	RestoredBy int        `json:"restoredBy,omitempty"`
+	Showtime   *Showtime  `json:"showtime,omitempty"`
+}
+
+// Hides the showtime from the group on behalf of the user
+func HideShowtime(g *Group, showtimeId, userId int, reason string) (*ShowtimeHide, error) {
+	if reason == "" {
+		return nil, ErrNoHideReason
+	}
+	st, err := store.GetShowtime(g.Id, showtimeId)
+	if err != nil {
+		return nil, err
+	}
+	h, err := store.HideShowtime(&ShowtimeHide{GroupId: g.Id, ShowtimeId: st.Id, Reason: reason, UserId: userId})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Hid showtime", st.Id, "from group", g.Id, reason)
+	h.Showtime = st
+	return h, nil
+}
+
+// This api handler lists, hides and restores the showtimes hidden from the group given by the
+// 'group' query param, or the users first group.
+//
+//	GET /api/admin/hides?all=true          The hidden showtimes, newest first, all includes the
+//	                                       ones that were restored
+//	POST /api/admin/hides                  Hides a showtime {"showtimeId":12,"reason":"Sold out"}
+//	POST /api/admin/hides/{id}/restore     Puts the showtime back on the ballot
+func APIAdminHidesHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	re := regexp.MustCompile(`^/api/admin/hides/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	var hide *ShowtimeHide
+	switch {
+	case r.Method == http.MethodGet && pm[1] == "":
+		hides, err := store.GetShowtimeHides(g.Id, r.URL.Query().Get("all") == "true")
+		if err != nil {
+			log.Println("APIAdminHidesHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, h := range hides {
+			h.Showtime, err = store.GetShowtime(g.Id, h.ShowtimeId)
+			if err != nil {
+				log.Println("APIAdminHidesHandler:2:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&hides)
+		return
+	case r.Method == http.MethodPost && pm[1] == "":
+		var body = struct {
+			ShowtimeId int    `json:"showtimeId"`
+			Reason     string `json:"reason"`
+		}{}
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hide, err = HideShowtime(g, body.ShowtimeId, u.Id, body.Reason)
+	case r.Method == http.MethodPost && pm[1] != "" && pm[2] == "restore":
+		id, perr := strconv.Atoi(pm[1])
+		if perr != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		hide, err = store.GetShowtimeHide(id)
+		if err == nil && hide.GroupId != g.Id {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			hide, err = store.RestoreShowtime(id, u.Id)
+		}
+		if err == nil {
+			fmt.Println("Restored showtime", hide.ShowtimeId, "to group", g.Id)
+			hide.Showtime, err = store.GetShowtime(g.Id, hide.ShowtimeId)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case ErrNoHideReason:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrAlreadyHidden, ErrHideRestored:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		log.Println("APIAdminHidesHandler:3:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&hide)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"./mp"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Showtimes remember the provider they were imported from. Together with the theatre and the
+// performance number it identifies the performance, so importing it again updates the showtime
+// rather than adding another.
+const megaplexProvider = "megaplex"
+
+// An ImportReport describes what an import of showtimes changed. Updated showtimes list what
+// changed about them, and removed showtimes are the ones the provider stopped listing, which
+// are marked cancelled rather than deleted so their votes are kept.
+type ImportReport struct {
+	Date      string            `json:"date"`
+	Theatres  []string          `json:"theatres"`
+	Added     []*Showtime       `json:"added"`
+	Updated   []*ShowtimeChange `json:"updated"`
+	Removed   []*Showtime       `json:"removed"`
+	Unchanged int               `json:"unchanged"`
+	Errors    []string          `json:"errors"`
+}
+
+type ShowtimeChange struct {
+	Showtime *Showtime `json:"showtime"`
+	Changes  []string  `json:"changes"`
+}
+
+func (r *ImportReport) String() string {
+	return fmt.Sprintf("Imported showtimes for %s at %s: %d added, %d updated, %d removed, %d unchanged, %d errors",
+		r.Date, strings.Join(r.Theatres, ", "), len(r.Added), len(r.Updated), len(r.Removed), r.Unchanged, len(r.Errors))
+}
+
+// Movies are told apart by their megaplex feature code, which is the same at every theatre.
+// Features without one fall back to their title, ignoring case and spacing.
+func featureKey(p mp.Performance) string {
+	if p.FeatureCode != 0 {
+		return fmt.Sprint(p.FeatureCode)
+	}
+	return strings.ToLower(strings.Join(strings.Fields(p.FeatureTitle), " "))
+}
+
+// Lists what differs between the stored showtime and the freshly imported one
+func showtimeChanges(old, st *Showtime, title string, loc *time.Location) []string {
+	changes := make([]string, 0)
+	if old.Cancelled {
+		changes = append(changes, "restored")
+	}
+	if old.MovieId != st.MovieId {
+		changes = append(changes, fmt.Sprintf("movie %s -> %s", old.Movie.MegaPlexTitle, title))
+	}
+	if !old.Showtime.Equal(st.Showtime) {
+		changes = append(changes, fmt.Sprintf("moved %s -> %s", old.Showtime.In(loc).Format("Mon Jan 2 3:04PM"), st.Showtime.In(loc).Format("Mon Jan 2 3:04PM")))
+	}
+	if old.Screen != st.Screen {
+		changes = append(changes, fmt.Sprintf("screen %s -> %s", old.Screen, st.Screen))
+	}
+	if old.BuyTicketsLink != st.BuyTicketsLink {
+		changes = append(changes, fmt.Sprintf("buy %s -> %s", old.BuyTicketsLink, st.BuyTicketsLink))
+	}
+	return changes
+}
+
+// Imports the showtimes the theatres have on the date. Only the calendar date is used, it is
+// looked up in the zone of each theatre. A movie playing at several of the theatres is looked
+// up once and shared by all of its showtimes.
+//
+// Importing is idempotent. Performances seen before update their showtime, and showtimes of the
+// day the provider no longer lists, or that moved out of the evening, are marked cancelled. The
+// theatres that could be fetched are imported even when another fails, the last error is
+// returned along with the report.
+func fetchShowtimes(theatres []*Theatre, date time.Time) (*ImportReport, error) {
+	report := &ImportReport{
+		Date:     date.Format("2006-01-02"),
+		Theatres: make([]string, 0),
+		Added:    make([]*Showtime, 0),
+		Updated:  make([]*ShowtimeChange, 0),
+		Removed:  make([]*Showtime, 0),
+		Errors:   make([]string, 0),
+	}
+	var ferr error
+	fail := func(err error) {
+		log.Println("fetchShowtimes:", err)
+		report.Errors = append(report.Errors, err.Error())
+		ferr = err
+	}
+	type performance struct {
+		mp.Performance
+		Theatre *Theatre
+	}
+	showtimes := make([]performance, 0)
+	fetched := make([]*Theatre, 0)
+	for _, t := range theatres {
+		report.Theatres = append(report.Theatres, t.Name)
+		d := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, t.Location())
+		ps, err := theatreProvider.GetPerformancesForDay(t.Id, d)
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", t.Name, err))
+			continue
+		}
+		fetched = append(fetched, t)
+		for _, p := range ps {
+			showtimes = append(showtimes, performance{p, t})
+		}
+	}
+
+	movies := make(map[string]*Movie)
+	for _, st := range showtimes {
+		k := featureKey(st.Performance)
+		if _, ok := movies[k]; ok {
+			continue
+		}
+		m, err := movieForFeature(featureFromPerformance(st.Performance))
+		if err != nil {
+			log.Println("fetchShowtimes:2:", err)
+			return report, err
+		}
+		movies[k] = m
+	}
+
+	//The showtimes that the provider still lists, cancelled or not
+	seen := make(map[int]bool)
+	for _, p := range showtimes {
+		screen := p.Auditorium.Name
+		if len(p.Amenities) > 0 {
+			screen = strings.Join([]string{screen, strings.Join(p.Amenities, ",")}, ",")
+		}
+		if len(p.Formats) > 0 {
+			screen = strings.Join([]string{screen, strings.Join(p.Formats, ",")}, ",")
+		}
+		movie := movies[featureKey(p.Performance)]
+		st := &Showtime{
+			MovieId:          movie.Id,
+			Showtime:         p.Showtime.UTC(),
+			Screen:           screen,
+			TheatreId:        p.Theatre.Id,
+			PreviewSeatsLink: fmt.Sprintf("%d", p.Number),
+			BuyTicketsLink:   "/" + p.Theatre.ShortName + "/tickets/" + fmt.Sprintf("%d", p.Id),
+			Provider:         megaplexProvider,
+		}
+		evening := calendar.IsEventShowtime(p.Showtime.In(p.Theatre.Location()))
+		old, err := store.GetShowtimeForPerformance(st.Provider, st.TheatreId, st.PreviewSeatsLink)
+		if err != nil {
+			if !evening {
+				continue
+			}
+			st, err = store.InsertShowtime(st)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			seen[st.Id] = true
+			st.Showtime = st.Showtime.In(p.Theatre.Location())
+			st.Movie = movie
+			report.Added = append(report.Added, st)
+			continue
+		}
+		seen[old.Id] = true
+		st.Id = old.Id
+		if !evening {
+			if !old.Cancelled {
+				old.Cancelled = true
+				err = store.UpdateShowtime(old)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				old.Showtime = old.Showtime.In(p.Theatre.Location())
+				report.Removed = append(report.Removed, old)
+			}
+			continue
+		}
+		changes := showtimeChanges(old, st, movie.MegaPlexTitle, p.Theatre.Location())
+		if len(changes) == 0 {
+			report.Unchanged++
+			continue
+		}
+		st.Changed = strings.Join(changes, ", ")
+		err = store.UpdateShowtime(st)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		st.Showtime = st.Showtime.In(p.Theatre.Location())
+		st.Location, st.Address = old.Location, old.Address
+		st.Movie = movie
+		report.Updated = append(report.Updated, &ShowtimeChange{Showtime: st, Changes: changes})
+	}
+
+	//Whatever was imported for the day before and isn't listed anymore has been cancelled
+	for _, t := range fetched {
+		from := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, t.Location())
+		existing, err := store.GetShowtimesForTheatre(megaplexProvider, t.Id, from, from.AddDate(0, 0, 1))
+		if err != nil {
+			fail(err)
+			continue
+		}
+		for _, old := range existing {
+			if seen[old.Id] || old.Cancelled {
+				continue
+			}
+			old.Cancelled = true
+			err = store.UpdateShowtime(old)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			old.Showtime = old.Showtime.In(t.Location())
+			report.Removed = append(report.Removed, old)
+		}
+	}
+	return report, ferr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"./mp"
+	"testing"
+	"time"
+)
+
+// Imports the recorded megaplex fixtures into a memory store, with movies made up by the stub
+// provider, so no network is needed
+func TestFetchShowtimesFromFixtures(t *testing.T) {
+	oldStore, oldCalendar, oldTheatres, oldMovies := store, calendar, theatreProvider, movieProvider
+	t.Cleanup(func() {
+		store, calendar, theatreProvider, movieProvider = oldStore, oldCalendar, oldTheatres, oldMovies
+	})
+	store, calendar = NewMemoryStore(), denverCalendar(t, time.Tuesday)
+	theatreProvider = mp.NewFixtureProvider("mp/testdata/megaplex")
+	movieProvider = NewStubMetadataProvider()
+
+	n, err := SyncTheatres(theatreProvider)
+	if err != nil || n != 4 {
+		t.Fatalf("synced %d theatres (%v), want 4", n, err)
+	}
+	theatres := make([]*Theatre, 0)
+	for _, id := range []string{mp.LocationThanksgivingPoint, mp.LocationJordanCommons} {
+		th, err := store.GetTheatre(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		theatres = append(theatres, th)
+	}
+	date := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+
+	report, err := fetchShowtimes(theatres, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Only the performances from 5PM on are imported, three at Thanksgiving Point and two at Jordan Commons
+	if len(report.Added) != 5 || len(report.Updated) != 0 || len(report.Removed) != 0 || len(report.Errors) != 0 {
+		t.Fatalf("the first import was %s", report)
+	}
+	movies := make(map[int]bool)
+	for _, st := range report.Added {
+		if st.Provider != megaplexProvider || st.Movie == nil || st.Showtime.Hour() < 17 {
+			t.Errorf("imported %+v", st)
+		}
+		movies[st.MovieId] = true
+	}
+	//The Long Night plays at both theatres and is one movie
+	if len(movies) != 3 {
+		t.Errorf("the showtimes are of %d movies, want 3", len(movies))
+	}
+
+	report, err = fetchShowtimes(theatres, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 0 || len(report.Updated) != 0 || len(report.Removed) != 0 || report.Unchanged != 5 {
+		t.Errorf("importing again was %s, want nothing but 5 unchanged", report)
+	}
+	for _, th := range theatres {
+		from := time.Date(2026, 10, 20, 0, 0, 0, 0, th.Location())
+		sts, err := store.GetShowtimesForTheatre(megaplexProvider, th.Id, from, from.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, st := range sts {
+			if st.Cancelled {
+				t.Errorf("showtime %d at %s was cancelled", st.Id, th.Name)
+			}
+		}
+	}
+}
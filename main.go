@@ -1,6 +1,7 @@
 package main
 
 import (
+	"./mp"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -8,13 +9,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/jinzhu/now"
 	_ "github.com/mattn/go-sqlite3"
 	"html/template"
 	"log"
 	"net/http"
 	"strings"
 	"time"
+	//The zone database is embedded so that time zones load even on hosts without one
+	_ "time/tzdata"
 )
 
 type User struct {
@@ -29,6 +31,10 @@ type User struct {
 	RewardCard  string `json:"rewardCard"`
 	Zip         string `json:"zip"`
 
+	// The IANA time zone, like America/New_York, times are shown to the user in. Empty means
+	// the zone of the movie night.
+	TimeZone string `json:"timeZone"`
+
 	WeeklyNotification   bool `json:"weeklyNotification"`
 	LockNotification     bool `json:"lockNotification"`
 	ActivityNotification bool `json:"activityNotification"`
@@ -36,19 +42,44 @@ type User struct {
 	Abilities []string `json:"abilities,omitempty"`
 }
 
+// Returns the time zone the user prefers to see times in
+func (u *User) Location() *time.Location {
+	if u.TimeZone != "" {
+		if loc, err := time.LoadLocation(u.TimeZone); err == nil {
+			return loc
+		}
+	}
+	return calendar.Location
+}
+
+// Returns t in the users preferred time zone, templates use it to render times
+func (u *User) LocalTime(t time.Time) time.Time {
+	return t.In(u.Location())
+}
+
 type Showtime struct {
 	Id               int       `json:"id"`
 	MovieId          int       `json:"movieId"`
 	Movie            *Movie    `json:"movie"`
 	Showtime         time.Time `json:"showtime"`
 	Screen           string    `json:"screen"`
+	TheatreId        string    `json:"theatreId"`
 	Location         string    `json:"location"`
 	Address          string    `json:"address"`
 	PreviewSeatsLink string    `json:"previewSeatsLink"`
 	BuyTicketsLink   string    `json:"buyTicketsLink"`
+	Provider         string    `json:"provider"`
+	Cancelled        bool      `json:"cancelled"`
+	// Describes the last change the provider made to the showtime after it was imported
+	Changed string `json:"changed"`
 
 	Votes int `json:"votes"`
 	Vote  int `json:"vote"`
+	// Whether the user vetoed the showtime, and how many members of the group did
+	Veto   bool `json:"veto"`
+	Vetoes int  `json:"vetoes"`
+	// Set on the showtime its week is locked on
+	Locked bool `json:"locked,omitempty"`
 }
 
 type Movie struct {
@@ -74,6 +105,29 @@ type Movie struct {
 	TomatoConsensus  string `json:"tomatoConsensus"`
 }
 
+type Session struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"userId"`
+	Token     string    `json:"-"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"`
+	UserAgent string    `json:"userAgent"`
+	Ip        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+// A Group is a community that holds its own movie night. Each group votes separately, on the
+// week leading up to its event day, and has its own winner and notifications.
+type Group struct {
+	Id       int          `json:"id"`
+	Name     string       `json:"name"`
+	EventDay time.Weekday `json:"eventDay"`
+	Created  time.Time    `json:"created"`
+
+	Members []*User `json:"members,omitempty"`
+}
+
 type PreferenceType int
 
 const (
@@ -106,6 +160,9 @@ var mnt *template.Template
 // The port that the app will serve on
 var port = flag.String("port", "9000", "The port that the app will serve on")
 
+// The sqlite database file that holds all of the movie night data
+var dbPath = flag.String("db", "mn.db", "The path to the sqlite database file")
+
 // This flag is used for local testing, it will not send webhooks or emails but instead print off what it would send
 var debug = flag.Bool("debug", false, "Debug mode is used for local testing, it will not send webhooks or emails but instead print off what it would send")
 
@@ -122,16 +179,59 @@ var emailPass = flag.String("emailPass", "pass", "The smtp connection auth pass"
 var weeklyDay = flag.Int("weeklyDay", 6, "The day Sun=0 the weekly email reminder goes out")
 var weeklyHour = flag.Int("weeklyHour", 9, "The hour of the day the weekly email reminder goes out")
 var weeklyMinute = flag.Int("weeklyMinute", 0, "The minutes within the hour the weekly email reminder goes out")
-var lockDay = flag.Int("lockDay", 2, "The day Sun=0 the lock email goes out")
-var lockHour = flag.Int("lockHour", 16, "The hour of the day the lock email goes out")
-var lockMinute = flag.Int("lockMinute", 30, "The minutes within the hour the lock email goes out")
-
-var salt = flag.String("salt", "$murphyseanmovienight$:", "The salt to use to hash user passwords")
+var lockDay = flag.Int("lockDay", -1, "Deprecated, use -eventDay")
+var lockHour = flag.Int("lockHour", 16, "The hour of the event day the vote locks and the lock email goes out")
+var lockMinute = flag.Int("lockMinute", 30, "The minutes within the hour the vote locks and the lock email goes out")
+
+// These flags make up the calendar, which determines the voting week around the event day
+var timeZone = flag.String("timezone", "America/Denver", "The IANA time zone movie night is held in, all scheduling happens in it")
+var eventDay = flag.Int("eventDay", 2, "The day Sun=0 movie night is held, for groups that don't name their own")
+var votingOpens = flag.Duration("votingOpens", 24*time.Hour, "How long after the start of an event day voting for the next event opens")
+var minShowtimeHour = flag.Int("minShowtimeHour", 17, "Showtimes that start before this hour of the day are not imported")
+
+// The voting method and tie break weeks use unless an admin picks others for the week
+var votingMethod = flag.String("votingMethod", "points", "The voting method of new weeks, one of points, approval, irv or schulze")
+var tieBreak = flag.String("tieBreak", "earliest", "How showtimes that tie are ordered in new weeks, one of earliest, vetoes, coin or admin")
+var anonymousBallots = flag.Bool("anonymousBallots", false, "Leave the names of the voters out of the published results of a week")
+var vetoThreshold = flag.Int("vetoThreshold", 3, "Showtimes vetoed by this many members of a group are left off its ballot, or 0 to never leave them off")
+var vetoBudget = flag.Int("vetoBudget", 1, "The number of showtimes each member can veto in a week")
+
+// These flags determine where theatres and showtimes come from
+var megaplexUrl = flag.String("megaplexUrl", mp.DefaultBaseURL, "The base url of the megaplex api")
+var theatreFixtures = flag.String("theatreFixtures", "", "A directory of recorded megaplex responses to use instead of the megaplex api")
+
+// The theatreProvider variable is the global source of theatres and showtimes
+var theatreProvider mp.TheatreProvider
+
+// These flags determine where movie details like the plot, rating and poster come from
+var movieProviders = flag.String("movieProviders", "tmdb,omdb", "The movie metadata providers to try in order, of tmdb, omdb and stub")
+var omdbKey = flag.String("omdbKey", "", "The omdb api key, the omdb provider is skipped without one")
+var tmdbKey = flag.String("tmdbKey", "", "The tmdb v3 api key, the tmdb provider is skipped without one")
+var minMatchConfidence = flag.Float64("matchConfidence", 0.85, "The confidence from 0 to 1 a movie match needs to be used without an admin reviewing it")
+var movieMetadataTTL = flag.Duration("movieMetadataTTL", 30*24*time.Hour, "How long movie metadata responses are cached before they are fetched again")
+
+// These flags determine where downloaded posters are kept and how much room they may take
+var posterCacheDir = flag.String("posterCacheDir", "posters", "The directory downloaded posters and their renditions are kept in")
+var posterCacheSize = flag.Int64("posterCacheSize", 256, "The size in megabytes the poster cache directory is kept under")
+
+// The salt is used to sign rsvp links, and to verify passwords that haven't been upgraded
+// from the original sha512 scheme yet. New passwords are hashed with a per user random salt.
+var salt = flag.String("salt", "$murphyseanmovienight$:", "The secret used to sign rsvp links and verify legacy password hashes")
+var passwordHash = flag.String("passwordHash", "argon2id", "The algorithm used to hash new passwords, one of argon2id, scrypt or bcrypt")
+var adminEmail = flag.String("admin", "", "The email of a registered user to grant the admin role to on startup")
+var migrateOnly = flag.Bool("migrate-only", false, "Migrate the database to the latest schema and then exit")
 var appUrl = flag.String("url", "http://localhost:9000/", "The url prefix to use for callback urls")
 
-// This map contains a mapping of the session identifier cookie to the user id
-// that is logged in via this cookie
-var sessions = make(map[string]int)
+// This flag determines how long a login session stays valid without being used
+var sessionTTL = flag.Duration("sessionTTL", time.Hour*24*365, "How long a login session remains valid after it was last used")
+
+// The X-Forwarded-For header is only trusted for the address of a client from these proxies
+var trustedProxies = flag.String("trustedProxies", "", "The comma separated addresses or CIDRs of the reverse proxies whose X-Forwarded-For header is trusted")
+
+// These flags determine where backups are kept and when the nightly backup runs
+var backupDir = flag.String("backupDir", "backups", "The directory nightly and on demand backups are written to")
+var backupKeep = flag.Int("backupKeep", 7, "The number of backups kept in the backup directory, older backups are removed")
+var backupHour = flag.Int("backupHour", 3, "The hour of the day the nightly backup is taken, or -1 to disable nightly backups")
 
 // The goal with this application is to serve a website that:
 // 1. Displays Tue Night movie night options
@@ -141,8 +241,18 @@ func main() {
 	log.SetFlags(0)
 	flag.Parse()
 
+	//Subcommands (backup, restore, export) run against the database and exit
+	if flag.NArg() > 0 {
+		err := RunCommand(flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Printf("port:%s\n", *port)
 	log.Printf("debug:%t\n", *debug)
+	log.Printf("db:%s\n", *dbPath)
 	log.Printf("buzzUrl:%s\n", *buzzUrl)
 	log.Printf("emailFrom:%s\n", *emailFrom)
 	log.Printf("emailHost:%s\n", *emailHost)
@@ -151,19 +261,111 @@ func main() {
 	log.Printf("weeklyDay:%d\n", *weeklyDay)
 	log.Printf("weeklyHour:%d\n", *weeklyHour)
 	log.Printf("weeklyMinute:%d\n", *weeklyMinute)
-	log.Printf("lockDay:%d\n", *lockDay)
 	log.Printf("lockHour:%d\n", *lockHour)
 	log.Printf("lockMinute:%d\n", *lockMinute)
+	log.Printf("timezone:%s\n", *timeZone)
+	log.Printf("eventDay:%d\n", *eventDay)
+	log.Printf("votingOpens:%s\n", *votingOpens)
+	log.Printf("minShowtimeHour:%d\n", *minShowtimeHour)
+	log.Printf("votingMethod:%s\n", *votingMethod)
+	log.Printf("tieBreak:%s\n", *tieBreak)
+	log.Printf("anonymousBallots:%t\n", *anonymousBallots)
+	log.Printf("vetoThreshold:%d\n", *vetoThreshold)
+	log.Printf("vetoBudget:%d\n", *vetoBudget)
+	log.Printf("megaplexUrl:%s\n", *megaplexUrl)
+	log.Printf("theatreFixtures:%s\n", *theatreFixtures)
+	log.Printf("movieProviders:%s\n", *movieProviders)
+	log.Printf("movieMetadataTTL:%s\n", *movieMetadataTTL)
+	log.Printf("matchConfidence:%.2f\n", *minMatchConfidence)
+	log.Printf("posterCacheDir:%s\n", *posterCacheDir)
+	log.Printf("posterCacheSize:%d\n", *posterCacheSize)
 	log.Printf("salt:%s\n", *salt)
+	log.Printf("passwordHash:%s\n", *passwordHash)
+	log.Printf("admin:%s\n", *adminEmail)
 	log.Printf("appUrl:%s\n", *appUrl)
+	log.Printf("sessionTTL:%s\n", *sessionTTL)
+	log.Printf("trustedProxies:%s\n", *trustedProxies)
+	log.Printf("backupDir:%s\n", *backupDir)
+	log.Printf("backupKeep:%d\n", *backupKeep)
+	log.Printf("backupHour:%d\n", *backupHour)
+
+	if *lockDay >= 0 {
+		log.Println("-lockDay is deprecated, the vote now locks on the event day. Use -eventDay instead.")
+		*eventDay = *lockDay
+	}
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	calendar = Calendar{
+		Location:        loc,
+		EventDay:        time.Weekday(*eventDay),
+		VotingOpens:     *votingOpens,
+		LockAt:          time.Duration(*lockHour)*time.Hour + time.Duration(*lockMinute)*time.Minute,
+		MinShowtimeHour: *minShowtimeHour}
+	if err := calendar.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := GetVotingMethod(*votingMethod); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := GetTieBreak(*tieBreak); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := GetPasswordHasher(*passwordHash); err != nil {
+		log.Fatal(err)
+	}
+	if *vetoThreshold < 0 || *vetoBudget < 0 {
+		log.Fatal("-vetoThreshold and -vetoBudget can't be negative")
+	}
+	trustedProxyNets, err = parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	var err error
-	db, err = sql.Open("sqlite3", "mn.db")
+	db, err = sql.Open("sqlite3", *dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 	InitDB(db)
+	store, err = NewSQLiteStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *migrateOnly {
+		v, _ := SchemaVersion(db)
+		log.Printf("Database is at schema version %d\n", v)
+		return
+	}
+
+	if *adminEmail != "" {
+		u, err := store.GetUserForEmail(*adminEmail)
+		if err != nil {
+			log.Fatal("Couldn't find admin user ", *adminEmail, ": ", err)
+		}
+		if !contains(u.Abilities, AbilityAdminUsers) {
+			err = AssignRole(0, u.Id, RoleAdmin)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if *theatreFixtures != "" {
+		theatreProvider = mp.NewFixtureProvider(*theatreFixtures)
+	} else {
+		theatreProvider = mp.NewClient(*megaplexUrl, &http.Client{Timeout: 30 * time.Second})
+	}
+	mmp, err := NewMovieMetadataProvider(*movieProviders, *omdbKey, *tmdbKey, &http.Client{Timeout: 30 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	movieProvider = &CachedMetadataProvider{Provider: mmp, TTL: *movieMetadataTTL}
+	posterCache, err = NewPosterCache(*posterCacheDir, *posterCacheSize<<20, &http.Client{Timeout: 30 * time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	//Parse and associate all templates
 	mnt = template.Must(template.ParseGlob("templates/*"))
@@ -171,25 +373,68 @@ func main() {
 	fmt.Println("Serving www dir")
 	http.Handle("/", http.FileServer(http.Dir("www")))
 
+	http.HandleFunc("/api/movies", APIMoviesHandler)
 	http.HandleFunc("/api/movies/", APIMoviesHandler)
 	http.HandleFunc("/api/showtimes", APIShowtimesHandler)
+	http.HandleFunc("/api/weeks", APIWeeksHandler)
+	http.HandleFunc("/api/weeks/", APIWeeksHandler)
 	http.HandleFunc("/api/users/", APIUsersHandler)
 	http.HandleFunc("/api/login", APILoginHandler)
 	http.HandleFunc("/api/password", APIResetPasswordHandler)
+	http.HandleFunc("/api/sessions", APISessionsHandler)
+	http.HandleFunc("/api/sessions/", APISessionsHandler)
 	http.HandleFunc("/api/preview", APIPreviewHandler)
 	http.HandleFunc("/api/sse", APISSE)
-
-	http.HandleFunc("/admin/movie", AdminMovieHandler)
-	http.HandleFunc("/admin/showtime", AdminShowtimeHandler)
-	http.HandleFunc("/admin/lock", AdminLockHandler)
-	http.HandleFunc("/admin/downvote", AdminDownvoteHandler)
+	http.HandleFunc("/api/groups", APIGroupsHandler)
+	http.HandleFunc("/api/groups/", APIGroupsHandler)
+	http.HandleFunc("/api/theatres", APITheatresHandler)
+	http.HandleFunc("/api/theatres/", APITheatresHandler)
+
+	http.HandleFunc("/api/admin/users/", RequireAbility(AbilityAdminUsers, APIAdminUserAbilitiesHandler))
+	http.HandleFunc("/api/admin/backup", RequireAbility(AbilityAdminBackup, APIAdminBackupHandler))
+	http.HandleFunc("/api/admin/export", RequireAbility(AbilityAdminBackup, APIAdminExportHandler))
+	http.HandleFunc("/api/admin/jobs", RequireAbility(AbilityAdminJobs, APIAdminJobsHandler))
+	http.HandleFunc("/api/admin/jobs/", RequireAbility(AbilityAdminJobs, APIAdminJobsHandler))
+	http.HandleFunc("/api/admin/matches", RequireAbility(AbilityAdminMovie, APIAdminMatchesHandler))
+	http.HandleFunc("/api/admin/matches/", RequireAbility(AbilityAdminMovie, APIAdminMatchesHandler))
+	http.HandleFunc("/api/admin/merges", RequireAbility(AbilityAdminMovie, APIAdminMergesHandler))
+	http.HandleFunc("/api/admin/merges/", RequireAbility(AbilityAdminMovie, APIAdminMergesHandler))
+	http.HandleFunc("/api/admin/hides", RequireAbility(AbilityAdminDownvote, APIAdminHidesHandler))
+	http.HandleFunc("/api/admin/hides/", RequireAbility(AbilityAdminDownvote, APIAdminHidesHandler))
+
+	http.HandleFunc("/admin/movie", RequireAbility(AbilityAdminMovie, AdminMovieHandler))
+	http.HandleFunc("/admin/showtime", RequireAbility(AbilityAdminShowtimes, AdminShowtimeHandler))
+	http.HandleFunc("/admin/lock", RequireAbility(AbilityAdminLock, AdminLockHandler))
+	http.HandleFunc("/admin/downvote", RequireAbility(AbilityAdminDownvote, AdminDownvoteHandler))
 
 	http.HandleFunc("/callback/rsvp", RsvpResponseHandler)
 	http.HandleFunc("/callback/email", EmailResponseHandler)
 
-	go WeeklyEmailRoutine(*weeklyDay, *weeklyHour, *weeklyMinute)
-	go LockEmailRoutine(*lockDay, *lockHour, *lockMinute)
-	go GetShowtimesRoutine(3, 1, 0)
+	//The scheduled jobs run on cron specs in the calendars time zone
+	scheduler = NewScheduler(realClock{}, store, calendar.Location)
+	type job struct {
+		Name string
+		Spec string
+		Run  func(now time.Time) error
+	}
+	jobs := []job{
+		{"weekly-email", fmt.Sprintf("%d %d * * %d", *weeklyMinute, *weeklyHour, *weeklyDay), WeeklyEmailJob},
+		{"lock", lockSpec(calendar), LockJob},
+		{"theatres", "0 0 * * 3", TheatresJob},
+		{"showtimes", showtimesSpec(calendar), ShowtimesJob},
+		{"recheck", "0 12 * * *", RecheckJob},
+		{"session-sweep", "@hourly", SessionSweepJob},
+	}
+	if *backupHour >= 0 {
+		jobs = append(jobs, job{"backup", fmt.Sprintf("0 %d * * *", *backupHour), BackupJob})
+	}
+	for _, j := range jobs {
+		err = scheduler.Add(j.Name, j.Spec, j.Run)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	scheduler.Start()
 
 	go ActivityProcessingRoutine()
 	go DelayedActivityNotificationRoutine()
@@ -202,22 +447,36 @@ func LoggedInUser(c context.Context) *User {
 	return c.Value("liu").(*User)
 }
 
+func LoggedInSession(c context.Context) *Session {
+	return c.Value("lis").(*Session)
+}
+
 func authHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var u *User
-	c, err := r.Cookie("movienightsid")
-	if err == nil && sessions[c.Value] > 0 {
-		u, _ = GetUser(sessions[c.Value])
-	} else {
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			if sessions[authHeader[7:]] > 0 {
-				fmt.Println("DEBUG: HEADER FOUND")
-				u, _ = GetUser(sessions[authHeader[7:]])
-			}
+	var s *Session
+	tokens := make([]string, 0, 2)
+	if c, err := r.Cookie("movienightsid"); err == nil {
+		tokens = append(tokens, c.Value)
+	}
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		tokens = append(tokens, authHeader[7:])
+	}
+	//A stale cookie falls back to the bearer token
+	for _, token := range tokens {
+		ts, err := GetSessionForToken(token, time.Now())
+		if err != nil {
+			continue
+		}
+		u, _ = store.GetUser(ts.UserId)
+		if u != nil {
+			s = ts
+			TouchSession(s, time.Now())
+			break
 		}
 	}
 	ctx = context.WithValue(ctx, "liu", u)
+	ctx = context.WithValue(ctx, "lis", s)
 
 	http.DefaultServeMux.ServeHTTP(w, r.WithContext(ctx))
 }
@@ -235,19 +494,6 @@ func GenUUIDv4() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
 }
 
-// This application rolls on a weekly basis. This function will return the beginning and end
-// of a week as dates given a particular time.
-func GetBeginningAndEndOfWeekForTime(atime time.Time) (time.Time, time.Time) {
-	if atime.Weekday() > time.Tuesday {
-		atime = atime.AddDate(0, 0, 7)
-	}
-	n := now.New(atime)
-	bow := n.BeginningOfWeek()
-	eow := n.EndOfWeek()
-
-	return bow, eow
-}
-
 ///////////////////////////////////////////////////////////////////////////////////////////
 //WEBHOOK SECTION
 
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"./mp"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Placeholder movies stand in for features no movie could confidently be matched to. Their ids
+// start here, well above any imdb id, as they don't have one.
+const placeholderMovieIdBase = 10000000000
+
+const (
+	MatchPending  = "pending"
+	MatchAccepted = "accepted"
+	MatchRejected = "rejected"
+)
+
+// A MovieMatch is a megaplex feature that couldn't confidently be matched to a movie, queued
+// for an admin to review. Its showtimes point at a placeholder movie until it is accepted.
+type MovieMatch struct {
+	Id          int               `json:"id"`
+	Title       string            `json:"title"`
+	FeatureCode uint              `json:"featureCode"`
+	MovieId     int               `json:"movieId"`
+	Confidence  float64           `json:"confidence"`
+	Candidates  []*MatchCandidate `json:"candidates"`
+	Status      string            `json:"status"`
+	Created     time.Time         `json:"created"`
+	Resolved    *time.Time        `json:"resolved,omitempty"`
+	ResolvedBy  int               `json:"resolvedBy,omitempty"`
+}
+
+type MatchCandidate struct {
+	Movie      *Movie  `json:"movie"`
+	Confidence float64 `json:"confidence"`
+}
+
+// What the theatre tells about a feature, used to pick the right movie among the search results
+type featureInfo struct {
+	Code     uint
+	Title    string
+	Rating   string
+	Runtime  uint
+	Poster   string
+	Synopsis string
+	Genres   []string
+	// The day it is showing, new releases came out around then
+	Date time.Time
+}
+
+func featureFromPerformance(p mp.Performance) featureInfo {
+	return featureInfo{
+		Code:     p.FeatureCode,
+		Title:    strings.TrimSpace(p.FeatureTitle),
+		Rating:   p.FeatureRating,
+		Runtime:  p.FeatureRuntime,
+		Poster:   p.FeaturePoster,
+		Synopsis: p.FeatureSynopsis,
+		Genres:   p.FeatureGenres,
+		Date:     p.Showtime,
+	}
+}
+
+// Screen formats and event labels megaplex adds to the titles of features. They are only taken
+// off the end of a title or out of brackets, and the labels that are words of real titles too,
+// like The Spanish Prisoner or Hotel Luxe, only after a dash or colon.
+const titleFormats = `3d|2d|imax 3d|imax|d-box|dubbed|subtitled|in spanish|open captioned|open caption`
+const titleNoise = titleFormats + `|spanish|luxe|sensory friendly|early access|fan event|re-release|rerelease`
+
+var bracketNoiseRe = regexp.MustCompile(`(?i)\s*[(\[]\s*(?:` + titleNoise + `)(?:\s*[,/&]\s*(?:` + titleNoise + `))*\s*[)\]]`)
+var trailingNoiseRe = regexp.MustCompile(`(?i)(?:\s*[:\-–]\s*(?:` + titleNoise + `)|\s+(?:` + titleFormats + `))\s*$`)
+var anniversaryRe = regexp.MustCompile(`(?i)[\s:\-–(]*\b(\d{1,3})(st|nd|rd|th)\s+anniversary\b.*$`)
+
+// Strips the screen formats, labels and anniversary suffix from a megaplex title, returning the
+// title of the movie and which anniversary it is showing for, or 0.
+func cleanTitle(title string) (string, int) {
+	anniversary := 0
+	if m := anniversaryRe.FindStringSubmatch(title); m != nil {
+		anniversary, _ = strconv.Atoi(m[1])
+		title = anniversaryRe.ReplaceAllString(title, "")
+	}
+	title = bracketNoiseRe.ReplaceAllString(title, "")
+	//Labels can pile up, like Avatar: Dubbed IMAX 3D
+	for {
+		t := trailingNoiseRe.ReplaceAllString(title, "")
+		if t == title {
+			break
+		}
+		title = t
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	return strings.Trim(title, " :-–"), anniversary
+}
+
+// Reduces a title to lower case words, so that punctuation, spacing and a leading "the" don't
+// keep titles from comparing equal
+func titleKey(title string) string {
+	title = strings.ToLower(strings.Replace(title, "&", " and ", -1))
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return r
+		}
+		if r == '\'' || r == '’' {
+			return -1
+		}
+		return ' '
+	}, title)
+	title = strings.Join(strings.Fields(title), " ")
+	return strings.TrimPrefix(title, "the ")
+}
+
+// Returns how alike two titles are from 0 to 1. It is the better of the edit distance, and of
+// how many words they share, so that a missing subtitle doesn't count for too much.
+func titleSimilarity(a, b string) float64 {
+	a, b = titleKey(a), titleKey(b)
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	max := len(ra)
+	if len(rb) > max {
+		max = len(rb)
+	}
+	if max == 0 {
+		return 0
+	}
+	edit := 1 - float64(levenshtein(ra, rb))/float64(max)
+
+	wa, wb := strings.Fields(a), strings.Fields(b)
+	shared := 0
+	for _, x := range wa {
+		for _, y := range wb {
+			if x == y {
+				shared++
+				break
+			}
+		}
+	}
+	words := 2 * float64(shared) / float64(len(wa)+len(wb))
+	if words > edit {
+		return words
+	}
+	return edit
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(cur[j-1]+1, prev[j]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Returns the leading number of a field like "2019" or "128 min", or 0
+func leadingInt(s string) int {
+	var n int
+	fmt.Sscanf(strings.TrimSpace(s), "%d", &n)
+	return n
+}
+
+// Scores how likely the movie is the feature from 0 to 1. The title counts for the most, the
+// release year, runtime and rating only count when both sides know them.
+func matchConfidence(f featureInfo, clean string, anniversary int, m *Movie) float64 {
+	score := 0.6 * titleSimilarity(clean, m.Title)
+	weight := 0.6
+
+	if year := leadingInt(m.Year); year > 0 && !f.Date.IsZero() {
+		weight += 0.2
+		showing := f.Date.Year()
+		if anniversary > 0 {
+			//A 25th anniversary showing is of a movie from 25 years ago
+			if d := year - (showing - anniversary); d >= -1 && d <= 1 {
+				score += 0.2
+			}
+		} else if year >= showing-1 && year <= showing+1 {
+			score += 0.2
+		} else if year == showing-2 {
+			score += 0.1
+		}
+	}
+	if runtime := leadingInt(m.Runtime); runtime > 0 && f.Runtime > 0 {
+		weight += 0.1
+		d := runtime - int(f.Runtime)
+		if d < 0 {
+			d = -d
+		}
+		if d <= 5 {
+			score += 0.1
+		} else if d <= 15 {
+			score += 0.05
+		}
+	}
+	rating := func(r string) string {
+		r = strings.ToUpper(strings.Replace(r, " ", "", -1))
+		if r == "N/A" || r == "NR" || r == "NOTRATED" || r == "UNRATED" {
+			return ""
+		}
+		return r
+	}
+	if a, b := rating(f.Rating), rating(m.Rated); a != "" && b != "" {
+		weight += 0.1
+		if a == b {
+			score += 0.1
+		}
+	}
+	return score / weight
+}
+
+// Searches the movie metadata providers for the feature, and scores the results best first.
+// The confidence of the match is that of the best candidate, less some when the next best is
+// about as likely, so that the admins get to pick between them.
+func matchCandidates(f featureInfo) ([]*MatchCandidate, float64, error) {
+	clean, anniversary := cleanTitle(f.Title)
+	movies, err := movieProvider.SearchMovies(clean, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	candidates := make([]*MatchCandidate, 0)
+	for _, m := range movies {
+		candidates = append(candidates, &MatchCandidate{Movie: m, Confidence: matchConfidence(f, clean, anniversary, m)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	if len(candidates) == 0 {
+		return candidates, 0, nil
+	}
+	confidence := candidates[0].Confidence
+	if len(candidates) > 1 && confidence-candidates[1].Confidence < 0.05 {
+		confidence -= 0.15
+	}
+	return candidates, confidence, nil
+}
+
+// Returns a placeholder movie made from what the theatre tells about the feature. Features
+// with the same cleaned up title share a placeholder.
+func placeholderMovie(f featureInfo) *Movie {
+	clean, _ := cleanTitle(f.Title)
+	h := fnv.New32a()
+	h.Write([]byte(titleKey(clean)))
+	m := &Movie{
+		Id:            placeholderMovieIdBase + int(h.Sum32()),
+		MegaPlexTitle: f.Title,
+		Title:         clean,
+		Rated:         f.Rating,
+		Plot:          f.Synopsis,
+		Genre:         strings.Join(f.Genres, ", "),
+		Poster:        f.Poster,
+	}
+	if f.Runtime > 0 {
+		m.Runtime = fmt.Sprintf("%d min", f.Runtime)
+	}
+	return m
+}
+
+// Returns the movie for a megaplex feature. Features seen before keep their movie, new ones are
+// matched with the movie metadata providers. A match below -matchConfidence gets a placeholder
+// movie instead, and is queued for an admin to review.
+func movieForFeature(f featureInfo) (*Movie, error) {
+	m, err := store.GetMovieByTitle(f.Title)
+	if err == nil {
+		return m, nil
+	}
+	if mm, err := store.GetMovieMatchForTitle(f.Title); err == nil {
+		if m, err := store.GetMovie(mm.MovieId); err == nil {
+			return m, nil
+		}
+	}
+
+	candidates, confidence, err := matchCandidates(f)
+	if err != nil {
+		log.Println("Couldn't find movie for title", f.Title, err)
+		candidates = make([]*MatchCandidate, 0)
+	}
+	if len(candidates) > 0 && confidence >= *minMatchConfidence {
+		best := candidates[0].Movie
+		fmt.Printf("Matched %s to %s (%s) with confidence %.2f\n", f.Title, best.Title, best.Year, confidence)
+		//The movie may already be in under another title, like the 3D showing of it
+		if id, err := movieIdFor(best); err == nil {
+			if m, err := store.GetMovie(id); err == nil {
+				err = store.InsertMovieAlias(f.Title, m.Id)
+				if err != nil {
+					return nil, err
+				}
+				return m, nil
+			}
+		}
+		best.MegaPlexTitle = f.Title
+		if best.Poster == "N/A" || best.Poster == "" {
+			best.Poster = f.Poster
+		}
+		return store.InsertMovie(best)
+	}
+
+	m = placeholderMovie(f)
+	if existing, err := store.GetMovie(m.Id); err == nil {
+		m = existing
+	} else {
+		m, err = store.InsertMovie(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mm := &MovieMatch{Title: f.Title, FeatureCode: f.Code, MovieId: m.Id, Confidence: confidence, Candidates: candidates, Status: MatchPending, Created: time.Now()}
+	_, err = store.InsertMovieMatch(mm)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Queued %s for review with confidence %.2f\n", f.Title, mm.Confidence)
+	return m, nil
+}
+
+// Accepts the match with the movie of the imdb id, or with the best candidate when it is
+// empty. The placeholder is merged into the movie.
+func AcceptMovieMatch(mm *MovieMatch, imdbId string, userId int) (*Movie, error) {
+	if imdbId == "" {
+		if len(mm.Candidates) == 0 {
+			return nil, ErrMovieNotFound
+		}
+		imdbId = mm.Candidates[0].Movie.Imdb
+	}
+	var movie *Movie
+	for _, c := range mm.Candidates {
+		if c.Movie.Imdb == imdbId {
+			movie = c.Movie
+		}
+	}
+	var err error
+	if movie == nil {
+		movie, err = movieProvider.MovieByIMDBId(imdbId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	id, err := movieIdFor(movie)
+	if err != nil {
+		return nil, err
+	}
+	if existing, err := store.GetMovie(id); err == nil {
+		movie = existing
+	} else {
+		movie.MegaPlexTitle = mm.Title
+		movie, err = store.InsertMovie(movie)
+		if err != nil {
+			return nil, err
+		}
+	}
+	//Other titles pending on the same placeholder go along with it
+	if mm.MovieId != movie.Id {
+		_, err = MergeMovies(mm.MovieId, movie.Id, userId)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	err = store.ResolveMovieMatch(mm.Id, MatchAccepted, movie.Id, userId)
+	return movie, err
+}
+
+// This api handler is the review queue of features that couldn't confidently be matched to a
+// movie.
+//
+//	GET /api/admin/matches?status=pending  The matches with the status, pending by default
+//	GET /api/admin/matches/{id}            The match with its scored candidates
+//	POST /api/admin/matches/{id}/accept    Accepts the match {"imdbId":"tt123"}, the best
+//	                                       candidate is used without one
+//	POST /api/admin/matches/{id}/reject    Keeps the placeholder movie
+func APIAdminMatchesHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	re := regexp.MustCompile(`^/api/admin/matches/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	if pm[1] == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = MatchPending
+		}
+		matches, err := store.GetMovieMatches(status)
+		if err != nil {
+			log.Println("APIAdminMatchesHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&matches)
+		return
+	}
+	id, err := strconv.Atoi(pm[1])
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	mm, err := store.GetMovieMatch(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("APIAdminMatchesHandler:2:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && pm[2] == "":
+	case r.Method == http.MethodPost && (pm[2] == "accept" || pm[2] == "reject"):
+		if mm.Status != MatchPending {
+			http.Error(w, "The match was already "+mm.Status, http.StatusConflict)
+			return
+		}
+		if pm[2] == "reject" {
+			err = store.ResolveMovieMatch(mm.Id, MatchRejected, mm.MovieId, u.Id)
+			if err != nil {
+				log.Println("APIAdminMatchesHandler:3:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			break
+		}
+		var body = struct {
+			ImdbId string `json:"imdbId"`
+		}{}
+		if r.ContentLength != 0 {
+			d := json.NewDecoder(r.Body)
+			err = d.Decode(&body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		_, err = AcceptMovieMatch(mm, body.ImdbId, u.Id)
+		if err == ErrMovieNotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("APIAdminMatchesHandler:4:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mm, err = store.GetMovieMatch(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&mm)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCleanTitle(t *testing.T) {
+	tests := []struct {
+		title       string
+		clean       string
+		anniversary int
+	}{
+		{"Avatar", "Avatar", 0},
+		{"Avatar 3D", "Avatar", 0},
+		{"Avatar: IMAX 3D", "Avatar", 0},
+		{"Avatar (3D)", "Avatar", 0},
+		{"Avatar [IMAX, 3D]", "Avatar", 0},
+		{"Avatar - Dubbed IMAX 3D", "Avatar", 0},
+		{"Coco (Dubbed)", "Coco", 0},
+		{"Coco in Spanish", "Coco", 0},
+		{"Coco - Spanish", "Coco", 0},
+		{"Dune D-BOX", "Dune", 0},
+		{"Dune: Part Two - Luxe", "Dune: Part Two", 0},
+		{"Wicked (Sensory Friendly)", "Wicked", 0},
+		{"Wicked: Early Access", "Wicked", 0},
+		{"Jaws 50th Anniversary", "Jaws", 50},
+		{"Jaws (50th Anniversary)", "Jaws", 50},
+		{"Back to the Future: 40th Anniversary 3D", "Back to the Future", 40},
+		//Words of real titles stay put when they aren't labels
+		{"The Spanish Prisoner", "The Spanish Prisoner", 0},
+		{"Luxe", "Luxe", 0},
+		{"Hotel Luxe", "Hotel Luxe", 0},
+		{"Spanish", "Spanish", 0},
+		{"The 3D Kid", "The 3D Kid", 0},
+		{"Dubbed and Dangerous", "Dubbed and Dangerous", 0},
+		{"Imax: The Documentary", "Imax: The Documentary", 0},
+	}
+	for _, tt := range tests {
+		clean, anniversary := cleanTitle(tt.title)
+		if clean != tt.clean || anniversary != tt.anniversary {
+			t.Errorf("cleanTitle(%q) = %q, %d, want %q, %d", tt.title, clean, anniversary, tt.clean, tt.anniversary)
+		}
+	}
+}
+
+func TestTitleSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		min, max float64
+	}{
+		{"Avatar", "avatar", 1, 1},
+		{"The Matrix", "Matrix", 1, 1},
+		{"Fast & Furious", "Fast and Furious", 1, 1},
+		{"Ocean's Eleven", "Oceans Eleven", 1, 1},
+		{"Spider-Man: No Way Home", "Spider Man No Way Home", 1, 1},
+		{"Dune: Part Two", "Dune", 0.5, 0.8},
+		{"Avatar", "Avatar: The Way of Water", 0.3, 0.5},
+		{"The Spanish Prisoner", "The Prisoner", 0.6, 0.8},
+		{"Avatar", "Jaws", 0, 0.2},
+		{"", "Jaws", 0, 0},
+	}
+	for _, tt := range tests {
+		if got := titleSimilarity(tt.a, tt.b); got < tt.min || got > tt.max {
+			t.Errorf("titleSimilarity(%q, %q) = %.2f, want from %.2f to %.2f", tt.a, tt.b, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestMatchConfidence(t *testing.T) {
+	showing := time.Date(2026, 10, 20, 19, 0, 0, 0, time.UTC)
+	wicked := featureInfo{Title: "Wicked", Rating: "PG", Runtime: 160}
+	tests := []struct {
+		name     string
+		f        featureInfo
+		movie    Movie
+		min, max float64
+	}{
+		{"title only", featureInfo{Title: "Avatar"}, Movie{Title: "Avatar"}, 1, 1},
+		{"everything agrees", featureInfo{Title: "Wicked 3D", Rating: "PG", Runtime: 160}, Movie{Title: "Wicked", Year: "2026", Runtime: "160 min", Rated: "PG"}, 1, 1},
+		{"new release from last year", wicked, Movie{Title: "Wicked", Year: "2025"}, 1, 1},
+		{"old movie of the same title", wicked, Movie{Title: "Wicked", Year: "1998"}, 0.7, 0.8},
+		{"anniversary of the old movie", featureInfo{Title: "Jaws 50th Anniversary", Runtime: 124}, Movie{Title: "Jaws", Year: "1975", Runtime: "124 min"}, 1, 1},
+		{"anniversary of the remake", featureInfo{Title: "Jaws 50th Anniversary", Runtime: 124}, Movie{Title: "Jaws", Year: "2026", Runtime: "124 min"}, 0.7, 0.8},
+		{"runtime off by ten minutes", wicked, Movie{Title: "Wicked", Year: "2026", Runtime: "150 min"}, 0.9, 0.95},
+		{"different rating", wicked, Movie{Title: "Wicked", Year: "2026", Rated: "R"}, 0.85, 0.95},
+		{"unrated doesn't count", wicked, Movie{Title: "Wicked", Year: "2026", Rated: "Not Rated"}, 1, 1},
+		{"other movie", wicked, Movie{Title: "Jaws", Year: "1975"}, 0, 0.3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f.Date = showing
+			clean, anniversary := cleanTitle(tt.f.Title)
+			if got := matchConfidence(tt.f, clean, anniversary, &tt.movie); got < tt.min || got > tt.max {
+				t.Errorf("matchConfidence = %.3f, want from %.2f to %.2f", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+// Picks the movie from the year the feature is showing in over older movies of the same title,
+// and the old movie for an anniversary showing
+func TestMatchCandidatesByYear(t *testing.T) {
+	oldMovies := movieProvider
+	t.Cleanup(func() { movieProvider = oldMovies })
+	movieProvider = &fixedMetadataProvider{movies: []*Movie{
+		{Imdb: "tt0073195", Title: "Jaws", Year: "1975"},
+		{Imdb: "tt9000001", Title: "Jaws", Year: "2026"},
+	}}
+	showing := time.Date(2026, 10, 20, 19, 0, 0, 0, time.UTC)
+	tests := []struct {
+		title string
+		imdb  string
+	}{
+		{"Jaws", "tt9000001"},
+		{"Jaws 3D", "tt9000001"},
+		{"Jaws 50th Anniversary", "tt0073195"},
+	}
+	for _, tt := range tests {
+		candidates, confidence, err := matchCandidates(featureInfo{Title: tt.title, Date: showing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != 2 || candidates[0].Movie.Imdb != tt.imdb || confidence < 0.85 {
+			t.Errorf("%s matched %s with confidence %.2f, want %s", tt.title, candidates[0].Movie.Imdb, confidence, tt.imdb)
+		}
+	}
+}
+
+// Another title of a movie already in, like its 3D showing, is remembered as an alias of it
+func TestMovieForFeatureAddsAlias(t *testing.T) {
+	oldStore, oldMovies := store, movieProvider
+	t.Cleanup(func() { store, movieProvider = oldStore, oldMovies })
+	store = NewMemoryStore()
+	movieProvider = &fixedMetadataProvider{movies: []*Movie{{Imdb: "tt0499549", Title: "Avatar", Year: "2009"}}}
+	showing := time.Date(2009, 12, 18, 19, 0, 0, 0, time.UTC)
+
+	m, err := movieForFeature(featureInfo{Title: "Avatar", Date: showing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3d, err := movieForFeature(featureInfo{Title: "Avatar 3D", Date: showing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m3d.Id != m.Id || m3d.MegaPlexTitle != "Avatar" {
+		t.Fatalf("Avatar 3D is movie %d (%s), want %d", m3d.Id, m3d.MegaPlexTitle, m.Id)
+	}
+	byTitle, err := store.GetMovieByTitle("avatar 3d")
+	if err != nil || byTitle.Id != m.Id {
+		t.Fatalf("the 3D title doesn't lead to the movie: %v", err)
+	}
+	//Once aliased, the provider isn't asked again
+	movieProvider = &fixedMetadataProvider{}
+	if again, err := movieForFeature(featureInfo{Title: "Avatar 3D", Date: showing}); err != nil || again.Id != m.Id {
+		t.Errorf("importing Avatar 3D again gave %v, %v", again, err)
+	}
+}
+
+// The fixedMetadataProvider answers every search with the same movies
+type fixedMetadataProvider struct {
+	movies []*Movie
+}
+
+func (fp *fixedMetadataProvider) Name() string {
+	return "fixed"
+}
+
+func (fp *fixedMetadataProvider) SearchMovies(title, year string) ([]*Movie, error) {
+	if len(fp.movies) == 0 {
+		return nil, ErrMovieNotFound
+	}
+	ret := make([]*Movie, 0)
+	for _, m := range fp.movies {
+		c := *m
+		ret = append(ret, &c)
+	}
+	return ret, nil
+}
+
+func (fp *fixedMetadataProvider) MovieByIMDBId(imdbId string) (*Movie, error) {
+	for _, m := range fp.movies {
+		if m.Imdb == imdbId {
+			c := *m
+			return &c, nil
+		}
+	}
+	return nil, ErrMovieNotFound
+}
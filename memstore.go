@@ -0,0 +1,1350 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memUser struct {
+	User
+	Password string
+	Ott      string
+}
+
+type memVote struct {
+	GroupId    int
+	UserId     int
+	ShowtimeId int
+	Votes      int
+	Veto       bool
+}
+
+// The MemoryStore is a Store that keeps everything in memory. It mirrors the behavior of the
+// SQLiteStore so that handlers can be tested without touching disk. Lookups that find nothing
+// return sql.ErrNoRows just like the SQLiteStore.
+type MemoryStore struct {
+	sync.RWMutex
+	users       map[int]*memUser
+	abilities   map[int][]string
+	movies      map[int]Movie
+	showtimes   map[int]Showtime
+	votes       []memVote
+	rsvps       map[[3]int]string
+	groups      map[int]Group
+	members     map[int]map[int]bool
+	jobs        map[string]JobState
+	theatres    map[string]Theatre
+	gtheatres   map[int]map[string]bool
+	invites     map[[2]int64]Invite
+	weeks       map[[2]int64]Week
+	weekLocks   []WeekLock
+	hides       []ShowtimeHide
+	ballots     []BallotVersion
+	metadata    map[string]MetadataCacheEntry
+	matches     map[int]MovieMatch
+	aliases     map[string]int
+	merges      []MovieMerge
+	nextUserId  int
+	nextStId    int
+	nextGroupId int
+	nextMatchId int
+}
+
+func NewMemoryStore() *MemoryStore {
+	ms := new(MemoryStore)
+	ms.users = make(map[int]*memUser)
+	ms.abilities = make(map[int][]string)
+	ms.movies = make(map[int]Movie)
+	ms.showtimes = make(map[int]Showtime)
+	ms.rsvps = make(map[[3]int]string)
+	ms.groups = make(map[int]Group)
+	ms.members = make(map[int]map[int]bool)
+	ms.jobs = make(map[string]JobState)
+	ms.theatres = make(map[string]Theatre)
+	ms.gtheatres = make(map[int]map[string]bool)
+	ms.invites = make(map[[2]int64]Invite)
+	ms.weeks = make(map[[2]int64]Week)
+	ms.metadata = make(map[string]MetadataCacheEntry)
+	ms.matches = make(map[int]MovieMatch)
+	ms.aliases = make(map[string]int)
+	ms.users[0] = &memUser{User: User{Id: 0, Name: "System", Email: "movienight@murphysean.com"}}
+	ms.groups[DefaultGroupId] = Group{Id: DefaultGroupId, Name: "Movie Night", EventDay: time.Tuesday, Created: time.Now().UTC()}
+	ms.members[DefaultGroupId] = make(map[int]bool)
+	ms.nextUserId = 1
+	ms.nextStId = 1
+	ms.nextGroupId = DefaultGroupId + 1
+	return ms
+}
+
+// Grants an ability directly to a user, for setting up tests
+func (ms *MemoryStore) GrantAbility(userId int, ability string) {
+	ms.Lock()
+	defer ms.Unlock()
+	if !contains(ms.abilities[userId], ability) {
+		ms.abilities[userId] = append(ms.abilities[userId], ability)
+	}
+}
+
+// Returns a copy of the user so callers can't modify the stored user
+func (ms *MemoryStore) userCopy(mu *memUser) *User {
+	u := mu.User
+	u.Abilities = append([]string{}, ms.abilities[u.Id]...)
+	return &u
+}
+
+func (ms *MemoryStore) GetUser(id int) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if mu, ok := ms.users[id]; ok {
+		return ms.userCopy(mu), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) findUser(match func(mu *memUser) bool) *memUser {
+	for _, mu := range ms.users {
+		if match(mu) {
+			return mu
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetUserForEmail(email string) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if mu := ms.findUser(func(mu *memUser) bool { return strings.EqualFold(mu.Email, email) }); mu != nil {
+		return ms.userCopy(mu), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetUserForOtt(ott string) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if mu := ms.findUser(func(mu *memUser) bool { return ott != "" && mu.Ott == ott }); mu != nil {
+		return ms.userCopy(mu), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetUserPassword(email string) (*User, string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if mu := ms.findUser(func(mu *memUser) bool { return mu.Email == email && mu.Password != "" }); mu != nil {
+		return ms.userCopy(mu), mu.Password, nil
+	}
+	return nil, "", sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetUserAbilities(userId int) ([]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return append([]string{}, ms.abilities[userId]...), nil
+}
+
+func (ms *MemoryStore) GetUsersForPreference(groupId int, n PreferenceType) ([]*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	users := make([]*User, 0)
+	for _, mu := range ms.users {
+		if !ms.members[groupId][mu.Id] || mu.Ott != "" || mu.Password == "" {
+			continue
+		}
+		if (n == WeeklyPreferenceType && mu.WeeklyNotification) ||
+			(n == LockPreferenceType && mu.LockNotification) ||
+			(n == ActivityPreferenceType && mu.ActivityNotification) {
+			users = append(users, ms.userCopy(mu))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+func (ms *MemoryStore) RegisterUser(name, email, ott string) (*User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.findUser(func(mu *memUser) bool { return mu.Email == email }) != nil {
+		return nil, errors.New("UNIQUE constraint failed: users.email")
+	}
+	mu := &memUser{Ott: ott}
+	mu.Id = ms.nextUserId
+	mu.Name = name
+	mu.Email = email
+	mu.WeeklyNotification = true
+	mu.LockNotification = true
+	mu.Zip = "84043"
+	ms.nextUserId++
+	ms.users[mu.Id] = mu
+	return &User{Id: mu.Id, Name: name, Email: email}, nil
+}
+
+func (ms *MemoryStore) SetUserOtt(email, ott string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if mu := ms.findUser(func(mu *memUser) bool { return mu.Email == email }); mu != nil {
+		mu.Ott = ott
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SetUserPassword(userId int, hash string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if mu, ok := ms.users[userId]; ok {
+		mu.Password = hash
+	}
+	return nil
+}
+
+func (ms *MemoryStore) CompleteRegistration(ott, hash string) (*User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	mu := ms.findUser(func(mu *memUser) bool { return ott != "" && mu.Ott == ott })
+	if mu == nil {
+		return nil, sql.ErrNoRows
+	}
+	mu.Ott = ""
+	mu.Password = hash
+	return ms.userCopy(mu), nil
+}
+
+func (ms *MemoryStore) UpdateUserPrefs(user *User) error {
+	ms.Lock()
+	defer ms.Unlock()
+	mu, ok := ms.users[user.Id]
+	if !ok {
+		return nil
+	}
+	mu.WeeklyNotification = user.WeeklyNotification
+	mu.LockNotification = user.LockNotification
+	mu.ActivityNotification = user.ActivityNotification
+	mu.GiftCard = user.GiftCard
+	mu.GiftCardPin = user.GiftCardPin
+	mu.RewardCard = user.RewardCard
+	mu.Zip = user.Zip
+	mu.Phone = user.Phone
+	mu.Carrier = user.Carrier
+	mu.TimeZone = user.TimeZone
+	return nil
+}
+
+func (ms *MemoryStore) GetMovie(id int) (*Movie, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if m, ok := ms.movies[id]; ok {
+		return &m, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetMovieByTitle(title string) (*Movie, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	for _, m := range ms.movies {
+		if strings.EqualFold(m.MegaPlexTitle, title) {
+			return &m, nil
+		}
+	}
+	if m, ok := ms.movies[ms.aliases[strings.ToLower(title)]]; ok {
+		return &m, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) InsertMovie(movie *Movie) (*Movie, error) {
+	id, err := movieIdFor(movie)
+	if err != nil {
+		return movie, err
+	}
+	movie.Id = id
+	ms.Lock()
+	defer ms.Unlock()
+	ms.movies[id] = *movie
+	return movie, nil
+}
+
+func (ms *MemoryStore) InsertMovieAlias(title string, movieId int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.aliases[strings.ToLower(title)] = movieId
+	return nil
+}
+
+func (ms *MemoryStore) SearchMovies(q MovieQuery) ([]*Movie, int, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	words := strings.Fields(strings.ToLower(q.Text))
+	matches := make([]*Movie, 0)
+	for _, m := range ms.movies {
+		text := strings.ToLower(strings.Join([]string{m.Title, m.MegaPlexTitle, m.Plot, m.Genre}, " "))
+		match := true
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				match = false
+			}
+		}
+		if q.Genre != "" && !strings.Contains(strings.ToLower(m.Genre), strings.ToLower(q.Genre)) {
+			match = false
+		}
+		if q.Rated != "" && !strings.EqualFold(m.Rated, q.Rated) {
+			match = false
+		}
+		if q.Year != "" && m.Year != q.Year {
+			match = false
+		}
+		if match {
+			m := m
+			matches = append(matches, &m)
+		}
+	}
+	title := func(m *Movie) string {
+		if m.Title != "" {
+			return strings.ToLower(m.Title)
+		}
+		return strings.ToLower(m.MegaPlexTitle)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if title(matches[i]) != title(matches[j]) {
+			return title(matches[i]) < title(matches[j])
+		}
+		return matches[i].Id < matches[j].Id
+	})
+	total := len(matches)
+	if q.Offset >= total {
+		return make([]*Movie, 0), total, nil
+	}
+	matches = matches[q.Offset:]
+	if q.Limit >= 0 && q.Limit < len(matches) {
+		matches = matches[:q.Limit]
+	}
+	return matches, total, nil
+}
+
+func (ms *MemoryStore) GetShowtimesForMovie(movieId int) ([]*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	showtimes := make([]*Showtime, 0)
+	for _, st := range ms.showtimes {
+		if st.MovieId != movieId {
+			continue
+		}
+		if ret := ms.showtimeCopy(0, st); ret != nil {
+			ret.Movie = nil
+			ret.Votes = 0
+			showtimes = append(showtimes, ret)
+		}
+	}
+	sort.Slice(showtimes, func(i, j int) bool {
+		if !showtimes[i].Showtime.Equal(showtimes[j].Showtime) {
+			return showtimes[i].Showtime.Before(showtimes[j].Showtime)
+		}
+		return showtimes[i].Id < showtimes[j].Id
+	})
+	return showtimes, nil
+}
+
+func (ms *MemoryStore) GetMovieVotes(groupId, movieId int) (map[int]int, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	votes := make(map[int]int)
+	for _, v := range ms.votes {
+		if v.GroupId == groupId && v.UserId != 0 && ms.showtimes[v.ShowtimeId].MovieId == movieId {
+			votes[v.ShowtimeId] += v.Votes
+		}
+	}
+	return votes, nil
+}
+
+func (ms *MemoryStore) sumVotes(groupId, showtimeId int) int {
+	sum := 0
+	for _, v := range ms.votes {
+		if v.ShowtimeId == showtimeId && (groupId == 0 || v.GroupId == groupId) {
+			sum += v.Votes
+		}
+	}
+	return sum
+}
+
+func (ms *MemoryStore) userVote(groupId, showtimeId, userId int) (int, bool) {
+	for _, v := range ms.votes {
+		if v.GroupId == groupId && v.ShowtimeId == showtimeId && v.UserId == userId {
+			return v.Votes, v.Veto
+		}
+	}
+	return 0, false
+}
+
+func (ms *MemoryStore) countVetoes(groupId, showtimeId int) int {
+	n := 0
+	for _, v := range ms.votes {
+		if v.GroupId == groupId && v.ShowtimeId == showtimeId && v.Veto {
+			n++
+		}
+	}
+	return n
+}
+
+func (ms *MemoryStore) hidden(groupId, showtimeId int) bool {
+	for _, h := range ms.hides {
+		if h.GroupId == groupId && h.ShowtimeId == showtimeId && h.Restored == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the showtime with its movie and the groups total votes filled in, or nil
+// if the showtime's movie doesn't exist. A groupId of 0 totals the votes of every group.
+func (ms *MemoryStore) showtimeCopy(groupId int, st Showtime) *Showtime {
+	m, ok := ms.movies[st.MovieId]
+	if !ok {
+		return nil
+	}
+	st.Movie = &m
+	if t, ok := ms.theatres[st.TheatreId]; ok {
+		st.Location = t.Name
+		st.Address = t.Address
+	}
+	st.Votes = ms.sumVotes(groupId, st.Id)
+	st.Vote = 0
+	return &st
+}
+
+func (ms *MemoryStore) GetShowtime(groupId, id int) (*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if st, ok := ms.showtimes[id]; ok {
+		if ret := ms.showtimeCopy(groupId, st); ret != nil {
+			return ret, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) showtimesBetween(groupId int, bow, eow time.Time) []*Showtime {
+	showtimes := make([]*Showtime, 0)
+	for _, st := range ms.showtimes {
+		if st.Showtime.Before(bow.Truncate(time.Second)) || st.Showtime.Truncate(time.Second).After(eow) {
+			continue
+		}
+		if st.Cancelled {
+			continue
+		}
+		if len(ms.gtheatres[groupId]) > 0 && !ms.gtheatres[groupId][st.TheatreId] {
+			continue
+		}
+		if ret := ms.showtimeCopy(groupId, st); ret != nil {
+			showtimes = append(showtimes, ret)
+		}
+	}
+	sort.Slice(showtimes, func(i, j int) bool {
+		if showtimes[i].Votes != showtimes[j].Votes {
+			return showtimes[i].Votes > showtimes[j].Votes
+		}
+		if !showtimes[i].Showtime.Equal(showtimes[j].Showtime) {
+			return showtimes[i].Showtime.Before(showtimes[j].Showtime)
+		}
+		return showtimes[i].Id < showtimes[j].Id
+	})
+	return showtimes
+}
+
+func (ms *MemoryStore) GetShowtimesForWeekOf(groupId int, bow, eow time.Time, userId int) ([]*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	showtimes := make([]*Showtime, 0)
+	for _, st := range ms.showtimesBetween(groupId, bow, eow) {
+		if ms.hidden(groupId, st.Id) {
+			continue
+		}
+		st.Vetoes = ms.countVetoes(groupId, st.Id)
+		st.Vote, st.Veto = ms.userVote(groupId, st.Id, userId)
+		showtimes = append(showtimes, st)
+	}
+	return showtimes, nil
+}
+
+func (ms *MemoryStore) InsertShowtime(st *Showtime) (*Showtime, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.movies[st.MovieId]; !ok {
+		return nil, errors.New("FOREIGN KEY constraint failed")
+	}
+	if st.PreviewSeatsLink != "" && ms.showtimeForPerformance(st.Provider, st.TheatreId, st.PreviewSeatsLink) != nil {
+		return nil, errors.New("UNIQUE constraint failed")
+	}
+	ns := *st
+	ns.Id = ms.nextStId
+	ns.Showtime = st.Showtime.UTC()
+	ns.Location, ns.Address, ns.Movie, ns.Votes, ns.Vote = "", "", nil, 0, 0
+	ms.nextStId++
+	ms.showtimes[ns.Id] = ns
+	if t, ok := ms.theatres[ns.TheatreId]; ok {
+		ns.Location = t.Name
+		ns.Address = t.Address
+	}
+	return &ns, nil
+}
+
+func (ms *MemoryStore) UpdateShowtime(st *Showtime) error {
+	ms.Lock()
+	defer ms.Unlock()
+	old, ok := ms.showtimes[st.Id]
+	if !ok {
+		return nil
+	}
+	if _, ok := ms.movies[st.MovieId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	old.MovieId = st.MovieId
+	old.Showtime = st.Showtime.UTC()
+	old.Screen = st.Screen
+	old.BuyTicketsLink = st.BuyTicketsLink
+	old.Cancelled = st.Cancelled
+	old.Changed = st.Changed
+	ms.showtimes[st.Id] = old
+	return nil
+}
+
+func (ms *MemoryStore) showtimeForPerformance(provider, theatreId, performance string) *Showtime {
+	for _, st := range ms.showtimes {
+		if st.Provider == provider && st.TheatreId == theatreId && st.PreviewSeatsLink == performance {
+			return &st
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetShowtimeForPerformance(provider, theatreId, performance string) (*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if st := ms.showtimeForPerformance(provider, theatreId, performance); st != nil {
+		if ret := ms.showtimeCopy(0, *st); ret != nil {
+			return ret, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetShowtimesForTheatre(provider, theatreId string, from, to time.Time) ([]*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	showtimes := make([]*Showtime, 0)
+	for _, st := range ms.showtimes {
+		if st.Provider != provider || st.TheatreId != theatreId || st.Showtime.Before(from) || !st.Showtime.Before(to) {
+			continue
+		}
+		if ret := ms.showtimeCopy(0, st); ret != nil {
+			ret.Votes = 0
+			showtimes = append(showtimes, ret)
+		}
+	}
+	sort.Slice(showtimes, func(i, j int) bool {
+		if !showtimes[i].Showtime.Equal(showtimes[j].Showtime) {
+			return showtimes[i].Showtime.Before(showtimes[j].Showtime)
+		}
+		return showtimes[i].Id < showtimes[j].Id
+	})
+	return showtimes, nil
+}
+
+func (ms *MemoryStore) InsertVotesForUser(groupId int, bow, eow time.Time, userId int, votes []*Showtime) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.groups[groupId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	if w, ok := ms.weeks[[2]int64{int64(groupId), bow.Unix()}]; ok && w.Locked != nil {
+		return ErrWeekLocked
+	}
+	for _, v := range votes {
+		if _, ok := ms.showtimes[v.Id]; !ok {
+			return errors.New("FOREIGN KEY constraint failed")
+		}
+	}
+	kept := make([]memVote, 0, len(ms.votes))
+	for _, v := range ms.votes {
+		st := ms.showtimes[v.ShowtimeId]
+		if v.GroupId == groupId && v.UserId == userId && !st.Showtime.Before(bow.Truncate(time.Second)) && !st.Showtime.Truncate(time.Second).After(eow) {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	bv := BallotVersion{Id: len(ms.ballots) + 1, GroupId: groupId, UserId: userId, WeekOf: time.Unix(bow.Unix(), 0).UTC(), Votes: map[int]int{}, Vetoes: []int{}, Created: time.Now().UTC()}
+	for _, v := range votes {
+		kept = append(kept, memVote{GroupId: groupId, UserId: userId, ShowtimeId: v.Id, Votes: v.Vote, Veto: v.Veto})
+		if v.Vote != 0 {
+			bv.Votes[v.Id] = v.Vote
+		}
+		if v.Veto {
+			bv.Vetoes = append(bv.Vetoes, v.Id)
+		}
+	}
+	ms.votes = kept
+	ms.ballots = append(ms.ballots, bv)
+	return nil
+}
+
+func (ms *MemoryStore) GetBallotHistory(groupId int, bow time.Time) ([]*BallotVersion, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	history := make([]*BallotVersion, 0)
+	for _, bv := range ms.ballots {
+		if bv.GroupId != groupId || bv.WeekOf.Unix() != bow.Unix() {
+			continue
+		}
+		nb := bv
+		nb.Votes = make(map[int]int, len(bv.Votes))
+		for id, v := range bv.Votes {
+			nb.Votes[id] = v
+		}
+		nb.Vetoes = append([]int{}, bv.Vetoes...)
+		history = append(history, &nb)
+	}
+	return history, nil
+}
+
+func (ms *MemoryStore) HideShowtime(h *ShowtimeHide) (*ShowtimeHide, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.groups[h.GroupId]; !ok {
+		return nil, errors.New("FOREIGN KEY constraint failed")
+	}
+	if _, ok := ms.showtimes[h.ShowtimeId]; !ok {
+		return nil, errors.New("FOREIGN KEY constraint failed")
+	}
+	if ms.hidden(h.GroupId, h.ShowtimeId) {
+		return nil, ErrAlreadyHidden
+	}
+	nh := ShowtimeHide{Id: len(ms.hides) + 1, GroupId: h.GroupId, ShowtimeId: h.ShowtimeId, Reason: h.Reason, UserId: h.UserId, Created: time.Now().UTC()}
+	ms.hides = append(ms.hides, nh)
+	return &nh, nil
+}
+
+func (ms *MemoryStore) RestoreShowtime(id, userId int) (*ShowtimeHide, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if id < 1 || id > len(ms.hides) {
+		return nil, sql.ErrNoRows
+	}
+	h := &ms.hides[id-1]
+	if h.Restored != nil {
+		return nil, ErrHideRestored
+	}
+	restored := time.Now().UTC()
+	h.Restored, h.RestoredBy = &restored, userId
+	return copyShowtimeHide(*h), nil
+}
+
+// Returns a copy of the hide that doesn't share its restored time with the stored one
+func copyShowtimeHide(h ShowtimeHide) *ShowtimeHide {
+	if h.Restored != nil {
+		restored := *h.Restored
+		h.Restored = &restored
+	}
+	return &h
+}
+
+func (ms *MemoryStore) GetShowtimeHide(id int) (*ShowtimeHide, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if id < 1 || id > len(ms.hides) {
+		return nil, sql.ErrNoRows
+	}
+	return copyShowtimeHide(ms.hides[id-1]), nil
+}
+
+func (ms *MemoryStore) GetShowtimeHides(groupId int, all bool) ([]*ShowtimeHide, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	hides := make([]*ShowtimeHide, 0)
+	for i := len(ms.hides) - 1; i >= 0; i-- {
+		h := ms.hides[i]
+		if h.GroupId == groupId && (all || h.Restored == nil) {
+			hides = append(hides, copyShowtimeHide(h))
+		}
+	}
+	return hides, nil
+}
+
+func (ms *MemoryStore) InsertRsvp(groupId int, userId int, showtimeId int, value string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.rsvps[[3]int{groupId, userId, showtimeId}] = value
+	return nil
+}
+
+func (ms *MemoryStore) GetRsvps(groupId, showtimeId int) ([]*Rsvp, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	rsvps := make([]*Rsvp, 0)
+	for k, v := range ms.rsvps {
+		if k[0] == groupId && k[2] == showtimeId {
+			rsvps = append(rsvps, &Rsvp{GroupId: k[0], UserId: k[1], ShowtimeId: k[2], Value: v})
+		}
+	}
+	sort.Slice(rsvps, func(i, j int) bool { return rsvps[i].UserId < rsvps[j].UserId })
+	return rsvps, nil
+}
+
+func (ms *MemoryStore) MigrateVotes(groupId, fromShowtimeId, toShowtimeId int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.showtimes[toShowtimeId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	votes := make([]memVote, 0, len(ms.votes))
+	moved := make([]memVote, 0)
+	for _, v := range ms.votes {
+		if v.GroupId == groupId && v.ShowtimeId == fromShowtimeId {
+			moved = append(moved, v)
+			continue
+		}
+		votes = append(votes, v)
+	}
+	for _, m := range moved {
+		found := false
+		for i, v := range votes {
+			if v.GroupId == groupId && v.UserId == m.UserId && v.ShowtimeId == toShowtimeId {
+				if m.Votes > v.Votes {
+					votes[i].Votes = m.Votes
+				}
+				votes[i].Veto = votes[i].Votes <= 0 && (v.Veto || m.Veto)
+				found = true
+			}
+		}
+		if !found {
+			m.ShowtimeId = toShowtimeId
+			votes = append(votes, m)
+		}
+	}
+	ms.votes = votes
+	for k, v := range ms.rsvps {
+		if k[0] == groupId && k[2] == fromShowtimeId {
+			delete(ms.rsvps, k)
+			ms.rsvps[[3]int{k[0], k[1], toShowtimeId}] = v
+		}
+	}
+	for k, w := range ms.weeks {
+		if w.GroupId == groupId && w.ShowtimeId == fromShowtimeId {
+			w.ShowtimeId = toShowtimeId
+			ms.weeks[k] = w
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetCancelledShowtimesForWeekOf(groupId int, bow, eow time.Time) ([]*Showtime, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	showtimes := make([]*Showtime, 0)
+	for _, st := range ms.showtimes {
+		if !st.Cancelled || st.Showtime.Before(bow.Truncate(time.Second)) || st.Showtime.Truncate(time.Second).After(eow) {
+			continue
+		}
+		voted := false
+		for _, v := range ms.votes {
+			if v.GroupId == groupId && v.ShowtimeId == st.Id {
+				voted = true
+			}
+		}
+		if !voted {
+			continue
+		}
+		if ret := ms.showtimeCopy(groupId, st); ret != nil {
+			showtimes = append(showtimes, ret)
+		}
+	}
+	sort.Slice(showtimes, func(i, j int) bool {
+		if showtimes[i].Votes != showtimes[j].Votes {
+			return showtimes[i].Votes > showtimes[j].Votes
+		}
+		return showtimes[i].Showtime.Before(showtimes[j].Showtime)
+	})
+	return showtimes, nil
+}
+
+func (ms *MemoryStore) GetInvite(groupId int, bow time.Time) (*Invite, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	inv, ok := ms.invites[[2]int64{int64(groupId), bow.Unix()}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &inv, nil
+}
+
+func (ms *MemoryStore) SaveInvite(inv *Invite) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ni := *inv
+	ni.WeekOf = time.Unix(inv.WeekOf.Unix(), 0).UTC()
+	ni.Showtime = inv.Showtime.UTC()
+	ms.invites[[2]int64{int64(inv.GroupId), inv.WeekOf.Unix()}] = ni
+	return nil
+}
+
+func (ms *MemoryStore) GetBallots(groupId int, bow, eow time.Time) ([]*Ballot, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	byUser := make(map[int]*Ballot)
+	ballots := make([]*Ballot, 0)
+	for _, v := range ms.votes {
+		st := ms.showtimes[v.ShowtimeId]
+		if v.GroupId != groupId || v.UserId == 0 || st.Showtime.Before(bow.Truncate(time.Second)) || st.Showtime.Truncate(time.Second).After(eow) {
+			continue
+		}
+		b, ok := byUser[v.UserId]
+		if !ok {
+			b = &Ballot{UserId: v.UserId, Votes: make(map[int]int), Vetoes: make(map[int]bool)}
+			byUser[v.UserId] = b
+			ballots = append(ballots, b)
+		}
+		b.Votes[v.ShowtimeId] = v.Votes
+		if v.Veto {
+			b.Vetoes[v.ShowtimeId] = true
+		}
+	}
+	sort.Slice(ballots, func(i, j int) bool { return ballots[i].UserId < ballots[j].UserId })
+	return ballots, nil
+}
+
+// Returns a copy of the week that doesn't share its times with the stored one
+func copyWeek(w Week) *Week {
+	if w.Locked != nil {
+		locked := *w.Locked
+		w.Locked = &locked
+	}
+	if w.LockEmail != nil {
+		sent := *w.LockEmail
+		w.LockEmail = &sent
+	}
+	return &w
+}
+
+func (ms *MemoryStore) GetWeek(groupId int, bow time.Time) (*Week, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	w, ok := ms.weeks[[2]int64{int64(groupId), bow.Unix()}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copyWeek(w), nil
+}
+
+func (ms *MemoryStore) GetLockedWeeks(groupId, limit, offset int) ([]*Week, int, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	weeks := make([]*Week, 0)
+	for _, w := range ms.weeks {
+		if w.GroupId == groupId && w.Locked != nil {
+			weeks = append(weeks, copyWeek(w))
+		}
+	}
+	sort.Slice(weeks, func(i, j int) bool { return weeks[i].WeekOf.After(weeks[j].WeekOf) })
+	total := len(weeks)
+	if offset >= total {
+		return make([]*Week, 0), total, nil
+	}
+	weeks = weeks[offset:]
+	if limit >= 0 && limit < len(weeks) {
+		weeks = weeks[:limit]
+	}
+	return weeks, total, nil
+}
+
+func (ms *MemoryStore) SaveWeek(w *Week) error {
+	ms.Lock()
+	defer ms.Unlock()
+	nw := copyWeek(*w)
+	nw.WeekOf = time.Unix(w.WeekOf.Unix(), 0).UTC()
+	ms.weeks[[2]int64{int64(w.GroupId), w.WeekOf.Unix()}] = *nw
+	return nil
+}
+
+func (ms *MemoryStore) OpenWeek(w *Week) error {
+	ms.Lock()
+	defer ms.Unlock()
+	k := [2]int64{int64(w.GroupId), w.WeekOf.Unix()}
+	if _, ok := ms.weeks[k]; !ok {
+		ms.weeks[k] = Week{GroupId: w.GroupId, WeekOf: time.Unix(w.WeekOf.Unix(), 0).UTC(), Method: w.Method, TieBreak: w.TieBreak, TieWinner: w.TieWinner}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) LockWeek(w *Week, reason string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	k := [2]int64{int64(w.GroupId), w.WeekOf.Unix()}
+	cur, ok := ms.weeks[k]
+	if !ok {
+		cur = Week{GroupId: w.GroupId, WeekOf: time.Unix(w.WeekOf.Unix(), 0).UTC(), Method: w.Method, TieBreak: w.TieBreak, TieWinner: w.TieWinner}
+	}
+	if cur.Locked != nil {
+		return ErrAlreadyLocked
+	}
+	locked := *w.Locked
+	cur.Locked, cur.LockedBy, cur.ShowtimeId = &locked, w.LockedBy, w.ShowtimeId
+	ms.weeks[k] = cur
+	ms.weekLocks = append(ms.weekLocks, WeekLock{Id: len(ms.weekLocks) + 1, GroupId: w.GroupId, WeekOf: cur.WeekOf, Action: WeekLockActionLock, ShowtimeId: w.ShowtimeId, Reason: reason, UserId: w.LockedBy, Created: locked})
+	return nil
+}
+
+func (ms *MemoryStore) UnlockWeek(groupId int, bow time.Time, userId int, reason string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	k := [2]int64{int64(groupId), bow.Unix()}
+	cur, ok := ms.weeks[k]
+	if !ok || cur.Locked == nil {
+		return ErrNotLocked
+	}
+	ms.weekLocks = append(ms.weekLocks, WeekLock{Id: len(ms.weekLocks) + 1, GroupId: groupId, WeekOf: cur.WeekOf, Action: WeekLockActionUnlock, ShowtimeId: cur.ShowtimeId, Reason: reason, UserId: userId, Created: time.Now()})
+	cur.Locked, cur.LockedBy, cur.ShowtimeId = nil, 0, 0
+	ms.weeks[k] = cur
+	return nil
+}
+
+func (ms *MemoryStore) MarkLockEmail(groupId int, bow, at time.Time) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	k := [2]int64{int64(groupId), bow.Unix()}
+	cur, ok := ms.weeks[k]
+	if !ok || cur.LockEmail != nil {
+		return false, nil
+	}
+	cur.LockEmail = &at
+	ms.weeks[k] = cur
+	return true, nil
+}
+
+func (ms *MemoryStore) GetWeekLocks(groupId int, bow time.Time) ([]*WeekLock, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	locks := make([]*WeekLock, 0)
+	for _, l := range ms.weekLocks {
+		if l.GroupId == groupId && l.WeekOf.Unix() == bow.Unix() {
+			nl := l
+			locks = append(locks, &nl)
+		}
+	}
+	return locks, nil
+}
+
+func (ms *MemoryStore) GetGroup(id int) (*Group, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if g, ok := ms.groups[id]; ok {
+		return &g, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) groupsWhere(match func(g Group) bool) []*Group {
+	groups := make([]*Group, 0)
+	for _, g := range ms.groups {
+		if match(g) {
+			g := g
+			groups = append(groups, &g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+	return groups
+}
+
+func (ms *MemoryStore) GetGroups() ([]*Group, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return ms.groupsWhere(func(g Group) bool { return true }), nil
+}
+
+func (ms *MemoryStore) GetGroupsForUser(userId int) ([]*Group, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	return ms.groupsWhere(func(g Group) bool { return ms.members[g.Id][userId] }), nil
+}
+
+func (ms *MemoryStore) InsertGroup(name string, eventDay time.Weekday) (*Group, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	for _, g := range ms.groups {
+		if g.Name == name {
+			return nil, errors.New("UNIQUE constraint failed: groups.name")
+		}
+	}
+	g := Group{Id: ms.nextGroupId, Name: name, EventDay: eventDay, Created: time.Now().UTC()}
+	ms.nextGroupId++
+	ms.groups[g.Id] = g
+	ms.members[g.Id] = make(map[int]bool)
+	return &g, nil
+}
+
+func (ms *MemoryStore) GetGroupMembers(groupId int) ([]*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	users := make([]*User, 0)
+	for userId := range ms.members[groupId] {
+		mu := ms.users[userId]
+		users = append(users, &User{Id: mu.Id, Name: mu.Name, Email: mu.Email})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (ms *MemoryStore) AddGroupMember(groupId, userId int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.groups[groupId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	if _, ok := ms.users[userId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	ms.members[groupId][userId] = true
+	return nil
+}
+
+func (ms *MemoryStore) RemoveGroupMember(groupId, userId int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.members[groupId], userId)
+	return nil
+}
+
+func (ms *MemoryStore) GetMetadataCache(key string) (*MetadataCacheEntry, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	e, ok := ms.metadata[key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &e, nil
+}
+
+func (ms *MemoryStore) SaveMetadataCache(e *MetadataCacheEntry) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.metadata[e.Key] = *e
+	return nil
+}
+
+func (ms *MemoryStore) InsertMovieMatch(mm *MovieMatch) (*MovieMatch, error) {
+	ms.Lock()
+	for id, m := range ms.matches {
+		if strings.EqualFold(m.Title, mm.Title) {
+			if m.Status == MatchPending {
+				m.FeatureCode, m.MovieId, m.Confidence, m.Candidates = mm.FeatureCode, mm.MovieId, mm.Confidence, mm.Candidates
+				ms.matches[id] = m
+			}
+			ms.Unlock()
+			return ms.GetMovieMatch(id)
+		}
+	}
+	ms.nextMatchId++
+	m := *mm
+	m.Id = ms.nextMatchId
+	ms.matches[m.Id] = m
+	ms.Unlock()
+	return &m, nil
+}
+
+func (ms *MemoryStore) GetMovieMatch(id int) (*MovieMatch, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	m, ok := ms.matches[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &m, nil
+}
+
+func (ms *MemoryStore) GetMovieMatchForTitle(title string) (*MovieMatch, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	for _, m := range ms.matches {
+		if strings.EqualFold(m.Title, title) {
+			return &m, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (ms *MemoryStore) GetMovieMatches(status string) ([]*MovieMatch, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	matches := make([]*MovieMatch, 0)
+	for _, m := range ms.matches {
+		if m.Status == status {
+			m := m
+			matches = append(matches, &m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Id < matches[j].Id })
+	return matches, nil
+}
+
+func (ms *MemoryStore) ResolveMovieMatch(id int, status string, movieId, userId int) error {
+	ms.Lock()
+	defer ms.Unlock()
+	m, ok := ms.matches[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	now := time.Now()
+	m.Status, m.MovieId, m.Resolved, m.ResolvedBy = status, movieId, &now, userId
+	ms.matches[id] = m
+	return nil
+}
+
+func (ms *MemoryStore) previewMovieMerge(fromId, toId int) (*MovieMerge, error) {
+	if fromId == toId {
+		return nil, ErrMergeSameMovie
+	}
+	from, ok := ms.movies[fromId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	merge := &MovieMerge{FromMovieId: fromId, ToMovieId: toId, From: &from, Alias: from.MegaPlexTitle, Aliases: make([]string, 0), ShowtimeIds: make([]int, 0), MatchIds: make([]int, 0)}
+	if to, ok := ms.movies[toId]; ok {
+		merge.To = &to
+		if strings.EqualFold(to.MegaPlexTitle, from.MegaPlexTitle) {
+			merge.Alias = ""
+		}
+	}
+	moving := make(map[int]bool)
+	for id, st := range ms.showtimes {
+		if st.MovieId == fromId {
+			merge.ShowtimeIds = append(merge.ShowtimeIds, id)
+			moving[id] = true
+		}
+	}
+	sort.Ints(merge.ShowtimeIds)
+	for title, movieId := range ms.aliases {
+		if movieId == fromId {
+			merge.Aliases = append(merge.Aliases, title)
+		}
+	}
+	sort.Strings(merge.Aliases)
+	for id, m := range ms.matches {
+		if m.MovieId == fromId {
+			merge.MatchIds = append(merge.MatchIds, id)
+		}
+	}
+	sort.Ints(merge.MatchIds)
+	for _, v := range ms.votes {
+		if v.UserId != 0 && moving[v.ShowtimeId] {
+			merge.Votes++
+		}
+	}
+	for k := range ms.rsvps {
+		if moving[k[2]] {
+			merge.Rsvps++
+		}
+	}
+	return merge, nil
+}
+
+func (ms *MemoryStore) PreviewMovieMerge(fromId, toId int) (*MovieMerge, error) {
+	ms.RLock()
+	merge, err := ms.previewMovieMerge(fromId, toId)
+	ms.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	merge.Showtimes = make([]*Showtime, 0, len(merge.ShowtimeIds))
+	for _, id := range merge.ShowtimeIds {
+		st, err := ms.GetShowtime(0, id)
+		if err != nil {
+			return nil, err
+		}
+		merge.Showtimes = append(merge.Showtimes, st)
+	}
+	return merge, nil
+}
+
+func (ms *MemoryStore) MergeMovies(fromId, toId, userId int) (*MovieMerge, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	merge, err := ms.previewMovieMerge(fromId, toId)
+	if err != nil {
+		return nil, err
+	}
+	if merge.To == nil {
+		return nil, sql.ErrNoRows
+	}
+	for _, id := range merge.ShowtimeIds {
+		st := ms.showtimes[id]
+		st.MovieId = toId
+		ms.showtimes[id] = st
+	}
+	for _, title := range merge.Aliases {
+		ms.aliases[title] = toId
+	}
+	if merge.Alias != "" {
+		ms.aliases[strings.ToLower(merge.Alias)] = toId
+	}
+	for _, id := range merge.MatchIds {
+		m := ms.matches[id]
+		m.MovieId = toId
+		ms.matches[id] = m
+	}
+	delete(ms.movies, fromId)
+	merge.Id = len(ms.merges) + 1
+	merge.Created = time.Now().UTC()
+	merge.UserId = userId
+	ms.merges = append(ms.merges, *merge)
+	return merge, nil
+}
+
+func (ms *MemoryStore) UndoMovieMerge(id, userId int) (*MovieMerge, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if id < 1 || id > len(ms.merges) {
+		return nil, sql.ErrNoRows
+	}
+	merge := ms.merges[id-1]
+	if merge.Undone != nil {
+		return nil, ErrMergeUndone
+	}
+	for _, later := range ms.merges[id:] {
+		if later.FromMovieId == merge.ToMovieId && later.Undone == nil {
+			return nil, ErrMergeConflict
+		}
+	}
+	if _, ok := ms.movies[merge.FromMovieId]; ok {
+		return nil, ErrMergeReimported
+	}
+	ms.movies[merge.FromMovieId] = *merge.From
+	for _, stId := range merge.ShowtimeIds {
+		if st, ok := ms.showtimes[stId]; ok && st.MovieId == merge.ToMovieId {
+			st.MovieId = merge.FromMovieId
+			ms.showtimes[stId] = st
+		}
+	}
+	for _, title := range merge.Aliases {
+		if ms.aliases[title] == merge.ToMovieId {
+			ms.aliases[title] = merge.FromMovieId
+		}
+	}
+	if merge.Alias != "" && ms.aliases[strings.ToLower(merge.Alias)] == merge.ToMovieId {
+		delete(ms.aliases, strings.ToLower(merge.Alias))
+	}
+	for _, matchId := range merge.MatchIds {
+		if m, ok := ms.matches[matchId]; ok && m.MovieId == merge.ToMovieId {
+			m.MovieId = merge.FromMovieId
+			ms.matches[matchId] = m
+		}
+	}
+	now := time.Now().UTC()
+	merge.Undone = &now
+	merge.UndoneBy = userId
+	ms.merges[id-1] = merge
+	return &merge, nil
+}
+
+func (ms *MemoryStore) GetMovieMerge(id int) (*MovieMerge, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if id < 1 || id > len(ms.merges) {
+		return nil, sql.ErrNoRows
+	}
+	merge := ms.merges[id-1]
+	return &merge, nil
+}
+
+func (ms *MemoryStore) GetMovieMerges() ([]*MovieMerge, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	merges := make([]*MovieMerge, 0, len(ms.merges))
+	for i := len(ms.merges) - 1; i >= 0; i-- {
+		merge := ms.merges[i]
+		merges = append(merges, &merge)
+	}
+	return merges, nil
+}
+
+func (ms *MemoryStore) GetJobState(name string) (*JobState, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	js, ok := ms.jobs[name]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &js, nil
+}
+
+func (ms *MemoryStore) SaveJobState(js *JobState) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.jobs[js.Name] = *js
+	return nil
+}
+
+func (ms *MemoryStore) GetTheatre(id string) (*Theatre, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	t, ok := ms.theatres[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &t, nil
+}
+
+func (ms *MemoryStore) GetTheatres() ([]*Theatre, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	theatres := make([]*Theatre, 0)
+	for _, t := range ms.theatres {
+		t := t
+		theatres = append(theatres, &t)
+	}
+	sort.Slice(theatres, func(i, j int) bool { return theatres[i].Name < theatres[j].Name })
+	return theatres, nil
+}
+
+func (ms *MemoryStore) UpsertTheatre(t *Theatre) error {
+	ms.Lock()
+	defer ms.Unlock()
+	nt := *t
+	nt.Enabled = false
+	ms.theatres[t.Id] = nt
+	return nil
+}
+
+func (ms *MemoryStore) GetGroupTheatres(groupId int) ([]*Theatre, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	theatres := make([]*Theatre, 0)
+	for id := range ms.gtheatres[groupId] {
+		if t, ok := ms.theatres[id]; ok {
+			t.Enabled = true
+			theatres = append(theatres, &t)
+		}
+	}
+	sort.Slice(theatres, func(i, j int) bool { return theatres[i].Name < theatres[j].Name })
+	return theatres, nil
+}
+
+func (ms *MemoryStore) SetGroupTheatre(groupId int, theatreId string, enabled bool) error {
+	ms.Lock()
+	defer ms.Unlock()
+	if _, ok := ms.groups[groupId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	if _, ok := ms.theatres[theatreId]; !ok {
+		return errors.New("FOREIGN KEY constraint failed")
+	}
+	if !enabled {
+		delete(ms.gtheatres[groupId], theatreId)
+		return nil
+	}
+	if ms.gtheatres[groupId] == nil {
+		ms.gtheatres[groupId] = make(map[string]bool)
+	}
+	ms.gtheatres[groupId][theatreId] = true
+	return nil
+}
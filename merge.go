@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A MovieMerge moves the showtimes of one movie to another and removes the first, for when the
+// same movie was imported twice or matched to the wrong movie. The merge log keeps enough to
+// undo it: the removed movie, the showtimes and matches that moved and the aliases that changed.
+type MovieMerge struct {
+	Id          int    `json:"id"`
+	FromMovieId int    `json:"fromMovieId"`
+	ToMovieId   int    `json:"toMovieId"`
+	From        *Movie `json:"from"`
+	To          *Movie `json:"to,omitempty"`
+	// The megaplex title of the removed movie, which now resolves to the movie it was merged into
+	Alias string `json:"alias"`
+	// Aliases of the removed movie that were moved along with it
+	Aliases     []string    `json:"aliases"`
+	ShowtimeIds []int       `json:"showtimeIds"`
+	Showtimes   []*Showtime `json:"showtimes,omitempty"`
+	// Movie matches that resolved to the removed movie and now resolve to the other one
+	MatchIds []int `json:"matchIds"`
+	// The votes and rsvps on the showtimes that move
+	Votes    int        `json:"votes"`
+	Rsvps    int        `json:"rsvps"`
+	Created  time.Time  `json:"created"`
+	UserId   int        `json:"userId"`
+	Undone   *time.Time `json:"undone,omitempty"`
+	UndoneBy int        `json:"undoneBy,omitempty"`
+}
+
+var ErrMergeSameMovie = errors.New("Can't merge a movie into itself")
+var ErrMergeUndone = errors.New("The merge was already undone")
+var ErrMergeConflict = errors.New("The movie was merged again since, undo that merge first")
+var ErrMergeReimported = errors.New("The removed movie was imported again since, merge it instead")
+
+// Returns the movie to merge into, given by id or by imdb id. A movie that isn't in the
+// database yet is looked up with the movie metadata provider, and only inserted if insert is
+// set, so that previews don't leave movies behind.
+func mergeTarget(toMovieId int, imdbId string, insert bool) (*Movie, error) {
+	if imdbId == "" {
+		return store.GetMovie(toMovieId)
+	}
+	var id int
+	_, err := fmt.Sscanf(imdbId, "tt%d", &id)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := store.GetMovie(id); err == nil {
+		return m, nil
+	}
+	if insert {
+		return InsertMovieByIMDBId(imdbId, "")
+	}
+	m, err := movieProvider.MovieByIMDBId(imdbId)
+	if err != nil {
+		return nil, err
+	}
+	m.Id = id
+	return m, nil
+}
+
+// Merges the movies. Matches of the removed movie that were still pending review are accepted
+// with the movie it was merged into, since that is where their showtimes went.
+func MergeMovies(fromId, toId, userId int) (*MovieMerge, error) {
+	merge, err := store.MergeMovies(fromId, toId, userId)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := store.GetMovieMatches(MatchPending)
+	if err != nil {
+		return merge, err
+	}
+	moved := make(map[int]bool)
+	for _, id := range merge.MatchIds {
+		moved[id] = true
+	}
+	for _, p := range pending {
+		if moved[p.Id] {
+			err = store.ResolveMovieMatch(p.Id, MatchAccepted, toId, userId)
+			if err != nil {
+				return merge, err
+			}
+		}
+	}
+	return merge, nil
+}
+
+// This api handler merges movies, previewing what a merge moves and undoing merges.
+//
+//	GET /api/admin/merges                      The merge log, newest first
+//	GET /api/admin/merges/preview?from=1&to=2  What merging movie 1 into movie 2 would move, an
+//	                                           imdb id can be given instead, like to=tt123
+//	POST /api/admin/merges                     Merges {"fromMovieId":1,"toMovieId":2} or
+//	                                           {"fromMovieId":1,"imdbId":"tt123"}
+//	POST /api/admin/merges/{id}/undo           Undoes the merge
+func APIAdminMergesHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	re := regexp.MustCompile(`^/api/admin/merges/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	var merge *MovieMerge
+	var err error
+	switch {
+	case r.Method == http.MethodGet && pm[1] == "":
+		merges, err := store.GetMovieMerges()
+		if err != nil {
+			log.Println("APIAdminMergesHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&merges)
+		return
+	case r.Method == http.MethodGet && pm[1] == "preview":
+		from, perr := strconv.Atoi(r.URL.Query().Get("from"))
+		if perr != nil {
+			http.Error(w, "Need 'from' and 'to' query params", http.StatusBadRequest)
+			return
+		}
+		to, imdbId := r.URL.Query().Get("to"), ""
+		toId, perr := strconv.Atoi(to)
+		if perr != nil {
+			imdbId = to
+		}
+		var target *Movie
+		target, err = mergeTarget(toId, imdbId, false)
+		if err != nil {
+			http.Error(w, "Couldn't find the movie to merge into: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		merge, err = store.PreviewMovieMerge(from, target.Id)
+		if err == nil {
+			merge.To = target
+		}
+	case r.Method == http.MethodPost && pm[1] == "":
+		var body = struct {
+			FromMovieId int    `json:"fromMovieId"`
+			ToMovieId   int    `json:"toMovieId"`
+			ImdbId      string `json:"imdbId"`
+		}{}
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var target *Movie
+		target, err = mergeTarget(body.ToMovieId, body.ImdbId, true)
+		if err != nil {
+			http.Error(w, "Couldn't find the movie to merge into: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		merge, err = MergeMovies(body.FromMovieId, target.Id, u.Id)
+		if err == nil {
+			fmt.Println("Merged movie", merge.FromMovieId, merge.From.MegaPlexTitle, "into", merge.ToMovieId)
+		}
+	case r.Method == http.MethodPost && pm[1] != "" && pm[2] == "undo":
+		id, perr := strconv.Atoi(pm[1])
+		if perr != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		merge, err = store.UndoMovieMerge(id, u.Id)
+		if err == nil {
+			fmt.Println("Undid merge", merge.Id, "of movie", merge.FromMovieId, "into", merge.ToMovieId)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case ErrMergeSameMovie:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrMergeUndone, ErrMergeConflict, ErrMergeReimported:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		log.Println("APIAdminMergesHandler:2:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&merge)
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MovieMetadataProvider looks up the details of a movie, like its imdb id, plot, rating and
+// poster. Movies are returned without a megaplex title.
+type MovieMetadataProvider interface {
+	// The name the provider is configured by
+	Name() string
+	// Returns the movies matching the title best first, with their details, released in the
+	// year if it isn't empty. At most maxSearchResults are returned.
+	SearchMovies(title, year string) ([]*Movie, error)
+	MovieByIMDBId(imdbId string) (*Movie, error)
+}
+
+// The number of search results the details are fetched for
+const maxSearchResults = 5
+
+// Lookups that found nothing are only cached this long, as the movie may be added to the
+// provider soon after its first showtimes are up
+const metadataMissTTL = time.Hour
+
+var ErrMovieNotFound = errors.New("Movie not found")
+
+// The movieProvider variable is the global source of movie metadata
+var movieProvider MovieMetadataProvider
+
+// Builds the provider chain from a comma separated list of provider names. The omdb and tmdb
+// providers are left out when their api key isn't set, which fails if that leaves none.
+func NewMovieMetadataProvider(names, omdbKey, tmdbKey string, hc *http.Client) (MovieMetadataProvider, error) {
+	chain := make(MetadataChain, 0)
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "omdb":
+			if omdbKey == "" {
+				log.Println("Skipping the omdb movie provider, -omdbKey isn't set")
+				continue
+			}
+			chain = append(chain, NewOMDbProvider(OMDbURL, omdbKey, hc))
+		case "tmdb":
+			if tmdbKey == "" {
+				log.Println("Skipping the tmdb movie provider, -tmdbKey isn't set")
+				continue
+			}
+			chain = append(chain, NewTMDBProvider(TMDBURL, tmdbKey, hc))
+		case "stub":
+			chain = append(chain, NewStubMetadataProvider())
+		default:
+			return nil, fmt.Errorf("Unknown movie provider %q, must be one of omdb, tmdb or stub", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("No movie provider is left in -movieProviders, set -tmdbKey or -omdbKey, or use stub")
+	}
+	return chain, nil
+}
+
+// A MetadataChain tries each provider in turn, returning the first movie found
+type MetadataChain []MovieMetadataProvider
+
+func (mc MetadataChain) Name() string {
+	names := make([]string, 0)
+	for _, p := range mc {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (mc MetadataChain) SearchMovies(title, year string) ([]*Movie, error) {
+	return mc.first(func(p MovieMetadataProvider) ([]*Movie, error) {
+		return p.SearchMovies(title, year)
+	})
+}
+
+func (mc MetadataChain) MovieByIMDBId(imdbId string) (*Movie, error) {
+	movies, err := mc.first(func(p MovieMetadataProvider) ([]*Movie, error) {
+		m, err := p.MovieByIMDBId(imdbId)
+		return []*Movie{m}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return movies[0], nil
+}
+
+// Returns the movies of the first provider that found any. ErrMovieNotFound is only returned
+// when every provider answered that it didn't have the movie, otherwise the last failure is.
+func (mc MetadataChain) first(lookup func(p MovieMetadataProvider) ([]*Movie, error)) ([]*Movie, error) {
+	ferr := ErrMovieNotFound
+	for _, p := range mc {
+		movies, err := lookup(p)
+		if err == nil && len(movies) == 0 {
+			err = ErrMovieNotFound
+		}
+		if err == nil {
+			return movies, nil
+		}
+		if err != ErrMovieNotFound {
+			log.Println("MetadataChain:", p.Name(), err)
+			ferr = err
+		}
+	}
+	return nil, ferr
+}
+
+// A MetadataCacheEntry is a provider response kept in the movie_metadata table. Lookups that
+// found nothing are cached too, without any movies, for at most metadataMissTTL.
+type MetadataCacheEntry struct {
+	Key      string
+	Provider string
+	Movies   []*Movie
+	Fetched  time.Time
+}
+
+// The CachedMetadataProvider keeps the responses of a provider in the store, and only asks the
+// provider again once they are older than the TTL. If that fails the stale response is used.
+// Responses are only used by the provider that gave them, so changing the providers starts
+// the cache over.
+type CachedMetadataProvider struct {
+	Provider MovieMetadataProvider
+	TTL      time.Duration
+}
+
+func (cp *CachedMetadataProvider) Name() string {
+	return cp.Provider.Name()
+}
+
+func (cp *CachedMetadataProvider) SearchMovies(title, year string) ([]*Movie, error) {
+	key := "search:" + strings.ToLower(strings.TrimSpace(title)) + ":" + year
+	return cp.cached(key, func() ([]*Movie, error) {
+		return cp.Provider.SearchMovies(title, year)
+	})
+}
+
+func (cp *CachedMetadataProvider) MovieByIMDBId(imdbId string) (*Movie, error) {
+	movies, err := cp.cached("imdb:"+imdbId, func() ([]*Movie, error) {
+		m, err := cp.Provider.MovieByIMDBId(imdbId)
+		if err != nil {
+			return nil, err
+		}
+		return []*Movie{m}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return movies[0], nil
+}
+
+func (cp *CachedMetadataProvider) cached(key string, fetch func() ([]*Movie, error)) ([]*Movie, error) {
+	e, err := store.GetMetadataCache(key)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("CachedMetadataProvider:1:", err)
+	}
+	if e != nil && e.Provider != cp.Provider.Name() {
+		e = nil
+	}
+	if e != nil && time.Since(e.Fetched) < e.ttl(cp.TTL) {
+		return e.found()
+	}
+	movies, err := fetch()
+	if err != nil && err != ErrMovieNotFound {
+		if e != nil {
+			log.Println("CachedMetadataProvider: using a stale response for", key, err)
+			return e.found()
+		}
+		return nil, err
+	}
+	err = store.SaveMetadataCache(&MetadataCacheEntry{Key: key, Provider: cp.Provider.Name(), Movies: movies, Fetched: time.Now()})
+	if err != nil {
+		log.Println("CachedMetadataProvider:2:", err)
+	}
+	if len(movies) == 0 {
+		return nil, ErrMovieNotFound
+	}
+	return movies, nil
+}
+
+// Returns how long the entry is fresh for, which is shorter for lookups that found nothing
+func (e *MetadataCacheEntry) ttl(ttl time.Duration) time.Duration {
+	if len(e.Movies) == 0 && metadataMissTTL < ttl {
+		return metadataMissTTL
+	}
+	return ttl
+}
+
+// Returns copies of the cached movies, so callers are free to change them
+func (e *MetadataCacheEntry) found() ([]*Movie, error) {
+	if len(e.Movies) == 0 {
+		return nil, ErrMovieNotFound
+	}
+	movies := make([]*Movie, 0)
+	for _, m := range e.Movies {
+		m := *m
+		movies = append(movies, &m)
+	}
+	return movies, nil
+}
+
+const OMDbURL = "https://www.omdbapi.com/"
+
+// The OMDbProvider looks movies up with the omdb api, which needs an api key
+type OMDbProvider struct {
+	BaseURL    string
+	Key        string
+	HTTPClient *http.Client
+}
+
+func NewOMDbProvider(baseURL, key string, hc *http.Client) *OMDbProvider {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &OMDbProvider{BaseURL: baseURL, Key: key, HTTPClient: hc}
+}
+
+func (op *OMDbProvider) Name() string {
+	return "omdb"
+}
+
+type omdbMovie struct {
+	Movie
+	Ratings []struct {
+		Source string
+		Value  string
+	}
+	Response string
+	Error    string
+}
+
+func (op *OMDbProvider) get(values url.Values) (*Movie, error) {
+	values.Set("apikey", op.Key)
+	values.Set("plot", "full")
+	values.Set("r", "json")
+	resp, err := op.HTTPClient.Get(op.BaseURL + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("omdb: %s", resp.Status)
+	}
+	om := new(omdbMovie)
+	d := json.NewDecoder(resp.Body)
+	err = d.Decode(&om)
+	if err != nil {
+		return nil, err
+	}
+	if om.Response == "False" {
+		if strings.Contains(strings.ToLower(om.Error), "not found") {
+			return nil, ErrMovieNotFound
+		}
+		return nil, errors.New("omdb: " + om.Error)
+	}
+	//The tomato fields are gone from omdb, but the rotten tomatoes score is still in the ratings
+	for _, r := range om.Ratings {
+		if r.Source == "Rotten Tomatoes" {
+			om.TomatoMeter = strings.TrimSuffix(r.Value, "%")
+		}
+	}
+	return &om.Movie, nil
+}
+
+// Searches by title, and then fetches the details of the first results by their imdb id
+func (op *OMDbProvider) SearchMovies(title, year string) ([]*Movie, error) {
+	values := url.Values{}
+	values.Set("apikey", op.Key)
+	values.Set("s", title)
+	values.Set("type", "movie")
+	if year != "" {
+		values.Set("y", year)
+	}
+	resp, err := op.HTTPClient.Get(op.BaseURL + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("omdb: %s", resp.Status)
+	}
+	var search struct {
+		Search []struct {
+			Imdb string `json:"imdbID"`
+		}
+		Response string
+		Error    string
+	}
+	d := json.NewDecoder(resp.Body)
+	err = d.Decode(&search)
+	if err != nil {
+		return nil, err
+	}
+	if search.Response == "False" {
+		if strings.Contains(strings.ToLower(search.Error), "not found") {
+			return nil, ErrMovieNotFound
+		}
+		return nil, errors.New("omdb: " + search.Error)
+	}
+	movies := make([]*Movie, 0)
+	for i, r := range search.Search {
+		if i == maxSearchResults {
+			break
+		}
+		m, err := op.MovieByIMDBId(r.Imdb)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, m)
+	}
+	return movies, nil
+}
+
+func (op *OMDbProvider) MovieByIMDBId(imdbId string) (*Movie, error) {
+	values := url.Values{}
+	values.Set("i", imdbId)
+	return op.get(values)
+}
+
+const TMDBURL = "https://api.themoviedb.org/3"
+const tmdbImageURL = "https://image.tmdb.org/t/p/w500"
+
+// The TMDBProvider looks movies up with the v3 api of The Movie Database. Only movies tmdb
+// knows the imdb id of are returned, as movies are keyed on it.
+type TMDBProvider struct {
+	BaseURL    string
+	Key        string
+	HTTPClient *http.Client
+}
+
+func NewTMDBProvider(baseURL, key string, hc *http.Client) *TMDBProvider {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &TMDBProvider{BaseURL: baseURL, Key: key, HTTPClient: hc}
+}
+
+func (tp *TMDBProvider) Name() string {
+	return "tmdb"
+}
+
+// Gets the api path and decodes the json response into v
+func (tp *TMDBProvider) get(path string, values url.Values, v interface{}) error {
+	values.Set("api_key", tp.Key)
+	resp, err := tp.HTTPClient.Get(tp.BaseURL + path + "?" + values.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrMovieNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tmdb: GET %s: %s", path, resp.Status)
+	}
+	d := json.NewDecoder(resp.Body)
+	return d.Decode(v)
+}
+
+type tmdbMovie struct {
+	Id          int    `json:"id"`
+	ImdbId      string `json:"imdb_id"`
+	Title       string `json:"title"`
+	ReleaseDate string `json:"release_date"`
+	Runtime     int    `json:"runtime"`
+	Overview    string `json:"overview"`
+	PosterPath  string `json:"poster_path"`
+	Homepage    string `json:"homepage"`
+	Genres      []struct {
+		Name string `json:"name"`
+	} `json:"genres"`
+	ReleaseDates struct {
+		Results []struct {
+			Country      string `json:"iso_3166_1"`
+			ReleaseDates []struct {
+				Certification string `json:"certification"`
+			} `json:"release_dates"`
+		} `json:"results"`
+	} `json:"release_dates"`
+}
+
+func (tp *TMDBProvider) movie(id int) (*Movie, error) {
+	tm := new(tmdbMovie)
+	values := url.Values{}
+	values.Set("append_to_response", "release_dates")
+	err := tp.get(fmt.Sprintf("/movie/%d", id), values, tm)
+	if err != nil {
+		return nil, err
+	}
+	if tm.ImdbId == "" {
+		return nil, ErrMovieNotFound
+	}
+	m := &Movie{
+		Imdb:     tm.ImdbId,
+		Title:    tm.Title,
+		Released: tm.ReleaseDate,
+		Plot:     tm.Overview,
+		Website:  tm.Homepage,
+	}
+	if len(tm.ReleaseDate) >= 4 {
+		m.Year = tm.ReleaseDate[:4]
+	}
+	if tm.Runtime > 0 {
+		m.Runtime = fmt.Sprintf("%d min", tm.Runtime)
+	}
+	if tm.PosterPath != "" {
+		m.Poster = tmdbImageURL + tm.PosterPath
+	}
+	genres := make([]string, 0)
+	for _, g := range tm.Genres {
+		genres = append(genres, g.Name)
+	}
+	m.Genre = strings.Join(genres, ", ")
+	for _, r := range tm.ReleaseDates.Results {
+		if r.Country != "US" {
+			continue
+		}
+		for _, rd := range r.ReleaseDates {
+			if rd.Certification != "" {
+				m.Rated = rd.Certification
+				break
+			}
+		}
+	}
+	return m, nil
+}
+
+// Searches by title, and then fetches the details of the first results. Results tmdb doesn't
+// know the imdb id of are left out.
+func (tp *TMDBProvider) SearchMovies(title, year string) ([]*Movie, error) {
+	var search struct {
+		Results []tmdbMovie `json:"results"`
+	}
+	values := url.Values{}
+	values.Set("query", title)
+	if year != "" {
+		values.Set("year", year)
+	}
+	err := tp.get("/search/movie", values, &search)
+	if err != nil {
+		return nil, err
+	}
+	movies := make([]*Movie, 0)
+	for i, r := range search.Results {
+		if i == maxSearchResults {
+			break
+		}
+		m, err := tp.movie(r.Id)
+		if err == ErrMovieNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, m)
+	}
+	if len(movies) == 0 {
+		return nil, ErrMovieNotFound
+	}
+	return movies, nil
+}
+
+func (tp *TMDBProvider) MovieByIMDBId(imdbId string) (*Movie, error) {
+	var found struct {
+		MovieResults []tmdbMovie `json:"movie_results"`
+	}
+	values := url.Values{}
+	values.Set("external_source", "imdb_id")
+	err := tp.get("/find/"+url.PathEscape(imdbId), values, &found)
+	if err != nil {
+		return nil, err
+	}
+	if len(found.MovieResults) == 0 {
+		return nil, ErrMovieNotFound
+	}
+	return tp.movie(found.MovieResults[0].Id)
+}
+
+// The StubMetadataProvider makes up a movie for any title without going to the network, so
+// imports can be run offline and in tests. The made up imdb id is derived from the title, so
+// the same title always gets the same movie.
+type StubMetadataProvider struct {
+	sync.Mutex
+	movies map[string]*Movie
+}
+
+func NewStubMetadataProvider() *StubMetadataProvider {
+	return &StubMetadataProvider{movies: make(map[string]*Movie)}
+}
+
+func (sp *StubMetadataProvider) Name() string {
+	return "stub"
+}
+
+// Returns the one movie made up for the title
+func (sp *StubMetadataProvider) SearchMovies(title, year string) ([]*Movie, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, ErrMovieNotFound
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(title)))
+	m := &Movie{
+		Imdb:  fmt.Sprintf("tt9%07d", h.Sum32()%10000000),
+		Title: title,
+		Year:  year,
+		Plot:  "A stub plot for " + title + ".",
+	}
+	sp.Lock()
+	defer sp.Unlock()
+	sp.movies[m.Imdb] = m
+	ret := *m
+	return []*Movie{&ret}, nil
+}
+
+// Returns the movie made up for an earlier title lookup
+func (sp *StubMetadataProvider) MovieByIMDBId(imdbId string) (*Movie, error) {
+	sp.Lock()
+	defer sp.Unlock()
+	m, ok := sp.movies[imdbId]
+	if !ok {
+		return nil, ErrMovieNotFound
+	}
+	ret := *m
+	return &ret, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A Migration is one numbered step in the evolution of the database schema. Migrations are
+// applied in order, each within its own transaction, and recorded in the version table once
+// applied. Never edit or reorder a migration that has been released, add a new one instead.
+type Migration struct {
+	Id          int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// Returns a migration step that runs each of the sql statements in order
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, v := range stmts {
+			_, err := tx.Exec(v)
+			if err != nil {
+				return fmt.Errorf("%s: %v", v, err)
+			}
+		}
+		return nil
+	}
+}
+
+// The first migrations use 'IF NOT EXISTS' so that databases created before migrations
+// existed can adopt them without losing any data.
+var migrations = []Migration{
+	{1, "Initial schema", execAll(
+		"CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, email TEXT NOT NULL UNIQUE, password TEXT, ott TEXT, weekly_not INTEGER DEFAULT 1, lock_not INTEGER DEFAULT 1, act_not INTEGER DEFAULT 0, giftcard TEXT NOT NULL DEFAULT '', giftcardpin TEXT NOT NULL DEFAULT '', rewardcard TEXT NOT NULL DEFAULT '', zip TEXT NOT NULL DEFAULT '84043', phone TEXT NOT NULL DEFAULT '', carrier TEXT NOT NULL DEFAULT '')",
+		"CREATE TABLE IF NOT EXISTS abilities (userid INTEGER NOT NULL, ability TEXT NOT NULL, PRIMARY KEY(userid,ability), FOREIGN KEY(userid) REFERENCES users(id))",
+		"CREATE TABLE IF NOT EXISTS movies (id INTEGER NOT NULL PRIMARY KEY, imdb TEXT NOT NULL DEFAULT 'unknown', title TEXT NOT NULL DEFAULT 'UNKNOWN', json TEXT NOT NULL DEFAULT '{}')",
+		"CREATE TABLE IF NOT EXISTS showtimes (id INTEGER NOT NULL PRIMARY KEY, movieid INTEGER NOT NULL, showtime TIMESTAMP NOT NULL, screen TEXT NOT NULL, location TEXT NOT NULL, address TEXT NOT NULL, preview TEXT NOT NULL, buy TEXT NOT NULL, FOREIGN KEY(movieid) REFERENCES movies(id))",
+		"CREATE TABLE IF NOT EXISTS votes (userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, votes INTEGER NOT NULL, PRIMARY KEY(userid, showtimeid), FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+		"CREATE TABLE IF NOT EXISTS rsvps (userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, value TEXT NOT NULL, UNIQUE (userid, showtimeid) ON CONFLICT REPLACE, FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))")},
+	{2, "Persistent sessions", execAll(
+		"CREATE TABLE IF NOT EXISTS sessions (id INTEGER NOT NULL PRIMARY KEY, token TEXT NOT NULL UNIQUE, userid INTEGER NOT NULL, created TIMESTAMP NOT NULL, lastseen TIMESTAMP NOT NULL, expires TIMESTAMP NOT NULL, useragent TEXT NOT NULL DEFAULT '', ip TEXT NOT NULL DEFAULT '', FOREIGN KEY(userid) REFERENCES users(id))")},
+	{3, "Roles and audit log", execAll(
+		"CREATE TABLE IF NOT EXISTS roles (name TEXT NOT NULL PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS role_abilities (role TEXT NOT NULL, ability TEXT NOT NULL, PRIMARY KEY(role,ability), FOREIGN KEY(role) REFERENCES roles(name))",
+		"CREATE TABLE IF NOT EXISTS user_roles (userid INTEGER NOT NULL, role TEXT NOT NULL, PRIMARY KEY(userid,role), FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(role) REFERENCES roles(name))",
+		"CREATE TABLE IF NOT EXISTS audit (id INTEGER NOT NULL PRIMARY KEY, created TIMESTAMP NOT NULL, actorid INTEGER NOT NULL, action TEXT NOT NULL, subject TEXT NOT NULL, detail TEXT NOT NULL DEFAULT '', FOREIGN KEY(actorid) REFERENCES users(id))")},
+	//Everyone up to now belonged to the one tuesday night group, so existing users, votes and
+	//rsvps all move into the default group
+	{4, "Groups", execAll(
+		"CREATE TABLE groups (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL UNIQUE, eventday INTEGER NOT NULL DEFAULT 2, created TIMESTAMP NOT NULL)",
+		"CREATE TABLE group_members (groupid INTEGER NOT NULL, userid INTEGER NOT NULL, joined TIMESTAMP NOT NULL, PRIMARY KEY(groupid,userid), FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(userid) REFERENCES users(id))",
+		"INSERT INTO groups (id, name, eventday, created) VALUES (1, 'Movie Night', 2, CURRENT_TIMESTAMP)",
+		"INSERT INTO group_members (groupid, userid, joined) SELECT 1, id, CURRENT_TIMESTAMP FROM users WHERE id > 0",
+		"CREATE TABLE votes_new (groupid INTEGER NOT NULL, userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, votes INTEGER NOT NULL, PRIMARY KEY(groupid, userid, showtimeid), FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+		"INSERT INTO votes_new (groupid, userid, showtimeid, votes) SELECT 1, userid, showtimeid, votes FROM votes",
+		"DROP TABLE votes",
+		"ALTER TABLE votes_new RENAME TO votes",
+		"CREATE TABLE rsvps_new (groupid INTEGER NOT NULL, userid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, value TEXT NOT NULL, UNIQUE (groupid, userid, showtimeid) ON CONFLICT REPLACE, FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(userid) REFERENCES users(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+		"INSERT INTO rsvps_new (groupid, userid, showtimeid, value) SELECT 1, userid, showtimeid, value FROM rsvps",
+		"DROP TABLE rsvps",
+		"ALTER TABLE rsvps_new RENAME TO rsvps")},
+	//Showtimes and sessions were written with the offset of the servers local zone, rewrite them
+	//in utc so every stored instant looks the same
+	{5, "Time zones", execAll(
+		"ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT ''",
+		"UPDATE showtimes SET showtime = strftime('%Y-%m-%d %H:%M:%S+00:00', showtime) WHERE strftime('%s', showtime) IS NOT NULL",
+		"UPDATE sessions SET created = strftime('%Y-%m-%d %H:%M:%f+00:00', created), lastseen = strftime('%Y-%m-%d %H:%M:%f+00:00', lastseen), expires = strftime('%Y-%m-%d %H:%M:%f+00:00', expires) WHERE strftime('%s', created) IS NOT NULL AND strftime('%s', lastseen) IS NOT NULL AND strftime('%s', expires) IS NOT NULL")},
+	{6, "Scheduled jobs", execAll(
+		"CREATE TABLE jobs (name TEXT NOT NULL PRIMARY KEY, spec TEXT NOT NULL, lastrun TIMESTAMP NOT NULL, nextrun TIMESTAMP NOT NULL, lasterror TEXT NOT NULL DEFAULT '', failures INTEGER NOT NULL DEFAULT 0)")},
+	//Showtimes reference a theatre rather than carrying its name and address. The theatres the
+	//app used to know about are seeded so that existing showtimes keep their theatre.
+	{7, "Theatres", execAll(
+		"CREATE TABLE theatres (id TEXT NOT NULL PRIMARY KEY, name TEXT NOT NULL, shortname TEXT NOT NULL, address TEXT NOT NULL DEFAULT '', latitude TEXT NOT NULL DEFAULT '', longitude TEXT NOT NULL DEFAULT '', phone TEXT NOT NULL DEFAULT '', timezone TEXT NOT NULL DEFAULT 'America/Denver')",
+		"INSERT INTO theatres (id, name, shortname, address) VALUES ('683b08d3-6f8a-4501-a00f-a24601228dd6', 'Thanksgiving Point', 'thanksgivingpoint', '2935 Thanksgiving Way, Lehi, UT 84043'), ('24f371a5-1ad0-4ac5-b627-a24400a49818', 'The District', 'thedistrict', '3761 W Parkway Plaza Dr, South Jordan, UT, 84095'), ('9dafb9d0-ed8f-4a58-be62-a24b014cc0b4', 'Jordan Commons', 'jordancommons', '9335 State Street, Sandy, UT, 84070'), ('83dd4871-c771-42a6-9177-a44a00e0ddd0', 'Geneva', 'geneva', '600 North Mill Road, Vineyard, UT, 84058')",
+		"INSERT OR IGNORE INTO theatres (id, name, shortname, address) SELECT DISTINCT location, location, lower(replace(location, ' ', '')), address FROM showtimes WHERE location NOT IN (SELECT name FROM theatres)",
+		"CREATE TABLE group_theatres (groupid INTEGER NOT NULL, theatreid TEXT NOT NULL, PRIMARY KEY(groupid, theatreid), FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(theatreid) REFERENCES theatres(id))",
+		"INSERT INTO group_theatres (groupid, theatreid) SELECT id, '683b08d3-6f8a-4501-a00f-a24601228dd6' FROM groups",
+		"ALTER TABLE showtimes ADD COLUMN theatreid TEXT NOT NULL DEFAULT ''",
+		"UPDATE showtimes SET theatreid = IFNULL((SELECT t.id FROM theatres t WHERE t.name = showtimes.location), '')",
+		"ALTER TABLE showtimes DROP COLUMN location",
+		"ALTER TABLE showtimes DROP COLUMN address")},
+	//Imported showtimes are keyed by their provider, theatre and performance number, which is
+	//kept in the preview column. Showtimes imported more than once are merged into the first
+	//copy, along with their votes and rsvps, before the key is made unique.
+	{8, "Showtime import key", execAll(
+		"ALTER TABLE showtimes ADD COLUMN provider TEXT NOT NULL DEFAULT 'megaplex'",
+		"ALTER TABLE showtimes ADD COLUMN cancelled INTEGER NOT NULL DEFAULT 0",
+		"CREATE TEMP TABLE showtime_keepers AS SELECT s.id id, CASE WHEN s.preview = '' THEN s.id ELSE (SELECT MIN(d.id) FROM showtimes d WHERE d.provider = s.provider AND d.theatreid = s.theatreid AND d.preview = s.preview) END keeper FROM showtimes s",
+		"CREATE TEMP TABLE merged_votes AS SELECT v.groupid groupid, v.userid userid, IFNULL(k.keeper, v.showtimeid) showtimeid, MAX(v.votes) votes FROM votes v LEFT JOIN showtime_keepers k ON v.showtimeid = k.id GROUP BY 1, 2, 3",
+		"DELETE FROM votes",
+		"INSERT INTO votes (groupid, userid, showtimeid, votes) SELECT groupid, userid, showtimeid, votes FROM merged_votes",
+		"UPDATE OR REPLACE rsvps SET showtimeid = (SELECT k.keeper FROM showtime_keepers k WHERE k.id = rsvps.showtimeid) WHERE showtimeid IN (SELECT id FROM showtime_keepers WHERE id <> keeper)",
+		"DELETE FROM showtimes WHERE id IN (SELECT id FROM showtime_keepers WHERE id <> keeper)",
+		"DROP TABLE showtime_keepers",
+		"DROP TABLE merged_votes",
+		"CREATE UNIQUE INDEX showtimes_performance ON showtimes (provider, theatreid, preview) WHERE preview <> ''")},
+	//Weeks locked before invites were kept get theirs the next time they are rechecked
+	{9, "Calendar invites", execAll(
+		"CREATE TABLE invites (groupid INTEGER NOT NULL, weekof INTEGER NOT NULL, showtimeid INTEGER NOT NULL, showtime TIMESTAMP NOT NULL, sequence INTEGER NOT NULL DEFAULT 0, cancelled INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(groupid, weekof), FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+		"ALTER TABLE showtimes ADD COLUMN changed TEXT NOT NULL DEFAULT ''")},
+	{10, "Movie metadata cache", execAll(
+		"CREATE TABLE movie_metadata (key TEXT NOT NULL PRIMARY KEY, provider TEXT NOT NULL, movie TEXT NOT NULL DEFAULT '', fetched TIMESTAMP NOT NULL)")},
+	//The cache now holds search results, so it starts over. Movies that were given a random id
+	//because no match was found are queued for review.
+	{11, "Movie match review", execAll(
+		"DROP TABLE movie_metadata",
+		"CREATE TABLE movie_metadata (key TEXT NOT NULL PRIMARY KEY, provider TEXT NOT NULL, movies TEXT NOT NULL DEFAULT '[]', fetched TIMESTAMP NOT NULL)",
+		"CREATE TABLE movie_matches (id INTEGER PRIMARY KEY, title TEXT NOT NULL UNIQUE COLLATE NOCASE, featurecode INTEGER NOT NULL DEFAULT 0, movieid INTEGER NOT NULL, confidence REAL NOT NULL DEFAULT 0, candidates TEXT NOT NULL DEFAULT '[]', status TEXT NOT NULL DEFAULT 'pending', created TIMESTAMP NOT NULL, resolved TIMESTAMP, resolvedby INTEGER)",
+		"INSERT OR IGNORE INTO movie_matches (title, movieid, created) SELECT title, id, CURRENT_TIMESTAMP FROM movies WHERE id >= 10000000000")},
+	{12, "Movie merges", execAll(
+		"CREATE TABLE movie_aliases (title TEXT NOT NULL PRIMARY KEY COLLATE NOCASE, movieid INTEGER NOT NULL)",
+		"CREATE TABLE movie_merges (id INTEGER PRIMARY KEY, frommovieid INTEGER NOT NULL, tomovieid INTEGER NOT NULL, movie TEXT NOT NULL, alias TEXT NOT NULL DEFAULT '', aliases TEXT NOT NULL DEFAULT '[]', showtimes TEXT NOT NULL DEFAULT '[]', votes INTEGER NOT NULL DEFAULT 0, rsvps INTEGER NOT NULL DEFAULT 0, created TIMESTAMP NOT NULL, userid INTEGER NOT NULL, undone TIMESTAMP, undoneby INTEGER)")},
+	{13, "Voting methods", execAll(
+		"CREATE TABLE weeks (groupid INTEGER NOT NULL, weekof INTEGER NOT NULL, method TEXT NOT NULL DEFAULT 'points', PRIMARY KEY(groupid, weekof), FOREIGN KEY(groupid) REFERENCES groups(id))")},
+	{14, "Tie breaks", execAll(
+		"ALTER TABLE weeks ADD COLUMN tiebreak TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE weeks ADD COLUMN tiewinner INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE weeks ADD COLUMN locked TIMESTAMP",
+		"ALTER TABLE weeks ADD COLUMN lockedby INTEGER NOT NULL DEFAULT 0")},
+	{15, "Week lock state", func(tx *sql.Tx) error {
+		err := execAll(
+			"ALTER TABLE weeks ADD COLUMN showtimeid INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE weeks ADD COLUMN lockemail TIMESTAMP",
+			"CREATE TABLE week_locks (id INTEGER PRIMARY KEY, groupid INTEGER NOT NULL, weekof INTEGER NOT NULL, action TEXT NOT NULL, showtimeid INTEGER NOT NULL, reason TEXT NOT NULL DEFAULT '', userid INTEGER NOT NULL, created TIMESTAMP NOT NULL)")(tx)
+		if err != nil {
+			return err
+		}
+		return migrateLockVotes(tx)
+	}},
+	//A -1 vote was a veto, and admins downvoted showtimes off the ballot by voting -5 as the
+	//system user. Those downvotes become hides, with no record of who made them or why.
+	{16, "Vetoes and hides", execAll(
+		"ALTER TABLE votes ADD COLUMN veto INTEGER NOT NULL DEFAULT 0",
+		"UPDATE votes SET veto = 1, votes = 0 WHERE votes < 0 AND userid <> 0",
+		"CREATE TABLE showtime_hides (id INTEGER PRIMARY KEY, groupid INTEGER NOT NULL, showtimeid INTEGER NOT NULL, reason TEXT NOT NULL, userid INTEGER NOT NULL, created TIMESTAMP NOT NULL, restored TIMESTAMP, restoredby INTEGER NOT NULL DEFAULT 0, FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(showtimeid) REFERENCES showtimes(id))",
+		"CREATE UNIQUE INDEX showtime_hides_active ON showtime_hides (groupid, showtimeid) WHERE restored IS NULL",
+		"INSERT INTO showtime_hides (groupid, showtimeid, reason, userid, created) SELECT groupid, showtimeid, 'Downvoted before hides were kept', 0, CURRENT_TIMESTAMP FROM votes WHERE userid = 0 AND votes < 0",
+		"DELETE FROM votes WHERE userid = 0 AND votes < 0")},
+	//The history starts out empty, ballots sent in before it was kept only have their last
+	//version in votes
+	{17, "Ballot history", execAll(
+		"CREATE TABLE ballot_history (id INTEGER PRIMARY KEY, groupid INTEGER NOT NULL, userid INTEGER NOT NULL, weekof INTEGER NOT NULL, votes TEXT NOT NULL DEFAULT '{}', vetoes TEXT NOT NULL DEFAULT '[]', created TIMESTAMP NOT NULL, FOREIGN KEY(groupid) REFERENCES groups(id), FOREIGN KEY(userid) REFERENCES users(id))",
+		"CREATE INDEX ballot_history_week ON ballot_history (groupid, weekof)")},
+	{18, "Saved weeks", migrateSavedWeeks},
+	//Merges made before this moved no matches, so they have none to put back
+	{19, "Merged movie matches", execAll(
+		"ALTER TABLE movie_merges ADD COLUMN matches TEXT NOT NULL DEFAULT '[]'")},
+}
+
+// Weeks used to only be saved once a method or tie break was picked for them, or they were
+// locked, so the rest went by whatever the flags said when they were tallied. Every week with
+// votes is saved with the methods the flags give now, which is what they have been tallied
+// with, and saved weeks without a tie break get the default one.
+func migrateSavedWeeks(tx *sql.Tx) error {
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		return err
+	}
+	type voteWeek struct {
+		groupId  int
+		showtime time.Time
+	}
+	voted := make([]voteWeek, 0)
+	rows, err := tx.Query("SELECT DISTINCT v.groupid, st.showtime FROM votes v, showtimes st WHERE v.showtimeid = st.id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var vw voteWeek
+		err = rows.Scan(&vw.groupId, &vw.showtime)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		voted = append(voted, vw)
+	}
+	rows.Close()
+	for _, vw := range voted {
+		bow, _ := Calendar{Location: loc}.WeekAt(vw.showtime)
+		_, err = tx.Exec("INSERT OR IGNORE INTO weeks (groupid, weekof, method, tiebreak) VALUES (?,?,?,?)", vw.groupId, bow.Unix(), *votingMethod, *tieBreak)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE weeks SET tiebreak = ? WHERE tiebreak = ''", *tieBreak)
+	return err
+}
+
+// Weeks used to be locked by giving the winner 1000 votes from the system user. Each of those
+// weeks is locked on that showtime instead, with its lock email already sent, and the votes are
+// removed. Weeks that didn't record who locked them count as locked by the scheduler.
+func migrateLockVotes(tx *sql.Tx) error {
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		return err
+	}
+	type lockVote struct {
+		groupId, showtimeId int
+		showtime            time.Time
+	}
+	locks := make([]lockVote, 0)
+	rows, err := tx.Query("SELECT v.groupid, v.showtimeid, st.showtime FROM votes v, showtimes st WHERE v.showtimeid = st.id AND v.userid = 0 AND v.votes >= 1000")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var l lockVote
+		err = rows.Scan(&l.groupId, &l.showtimeId, &l.showtime)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		locks = append(locks, l)
+	}
+	rows.Close()
+	now := time.Now()
+	for _, l := range locks {
+		bow, _ := Calendar{Location: loc}.WeekAt(l.showtime)
+		_, err = tx.Exec("INSERT INTO weeks (groupid, weekof, showtimeid, locked, lockemail) VALUES (?,?,?,?,?) ON CONFLICT(groupid, weekof) DO UPDATE SET showtimeid = excluded.showtimeid, locked = IFNULL(weeks.locked, excluded.locked), lockemail = excluded.lockemail",
+			l.groupId, bow.Unix(), l.showtimeId, now, now)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO week_locks (groupid, weekof, action, showtimeid, reason, userid, created) SELECT groupid, weekof, ?, showtimeid, ?, lockedby, locked FROM weeks WHERE groupid = ? AND weekof = ?",
+			WeekLockActionLock, "Locked before the lock was kept with the week", l.groupId, bow.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM votes WHERE userid = 0 AND votes >= 1000")
+	return err
+}
+
+// The schema version this binary knows how to run against
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Id
+}
+
+// Before migrations the version table got a new row with the application version on every
+// boot. Those rows are kept around in version_legacy, and the version table is recreated to
+// hold the history of applied migrations.
+func prepareVersionTable(db *sql.DB) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'version' AND sql LIKE '%description%'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'version'").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		_, err = db.Exec("ALTER TABLE version RENAME TO version_legacy")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("CREATE TABLE version (id INTEGER NOT NULL PRIMARY KEY, description TEXT NOT NULL, applied TIMESTAMP NOT NULL, version TEXT NOT NULL)")
+	return err
+}
+
+// Returns the highest migration that has been applied to the database
+func SchemaVersion(db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRow("SELECT IFNULL(MAX(id),0) FROM version").Scan(&v)
+	return v, err
+}
+
+// Applies every migration the database hasn't seen yet. It refuses to touch a database that
+// has a newer schema than this binary knows about.
+func Migrate(db *sql.DB) error {
+	err := prepareVersionTable(db)
+	if err != nil {
+		return err
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("Database schema version %d is newer than this binary supports (%d)", current, LatestSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.Id <= current {
+			continue
+		}
+		log.Printf("Applying migration %d: %s\n", m.Id, m.Description)
+		err = applyMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("Migration %d failed: %v", m.Id, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = m.Up(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO version (id, description, applied, version) VALUES (?,?,?,?)", m.Id, m.Description, time.Now().UTC(), version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
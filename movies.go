@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const defaultMoviesPageSize = 20
+const maxMoviesPageSize = 100
+
+// A MovieQuery searches the movies by text over the title, plot and genre, and filters them
+// by genre, rating and year. Empty fields don't filter.
+type MovieQuery struct {
+	Text   string
+	Genre  string
+	Rated  string
+	Year   string
+	Limit  int
+	Offset int
+}
+
+type MoviePage struct {
+	Movies   []*Movie `json:"movies"`
+	Total    int      `json:"total"`
+	Page     int      `json:"page"`
+	PageSize int      `json:"pageSize"`
+}
+
+// A MovieWeek is a week the movie was on a groups ballot, with the votes the members gave its
+// showtimes and whether the week is locked on one of them.
+type MovieWeek struct {
+	GroupId    int       `json:"groupId"`
+	GroupName  string    `json:"groupName"`
+	WeekOf     time.Time `json:"weekOf"`
+	Showtimes  int       `json:"showtimes"`
+	Votes      int       `json:"votes"`
+	Won        bool      `json:"won"`
+	ShowtimeId int       `json:"showtimeId,omitempty"`
+}
+
+// Returns the weeks the movie was on the ballot of the groups, newest first. A movie is on a
+// groups ballot when it has showtimes at the theatres the group has enabled.
+func MovieHistory(movieId int, groups []*Group) ([]*MovieWeek, error) {
+	showtimes, err := store.GetShowtimesForMovie(movieId)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*MovieWeek, 0)
+	for _, g := range groups {
+		theatres, err := store.GetGroupTheatres(g.Id)
+		if err != nil {
+			return nil, err
+		}
+		enabled := make(map[string]bool)
+		for _, t := range theatres {
+			enabled[t.Id] = true
+		}
+		votes, err := store.GetMovieVotes(g.Id, movieId)
+		if err != nil {
+			return nil, err
+		}
+		locked, _, err := store.GetLockedWeeks(g.Id, -1, 0)
+		if err != nil {
+			return nil, err
+		}
+		winners := make(map[int64]int)
+		for _, lw := range locked {
+			winners[lw.WeekOf.Unix()] = lw.ShowtimeId
+		}
+		weeks := make(map[time.Time]*MovieWeek)
+		for _, st := range showtimes {
+			if st.Cancelled && votes[st.Id] == 0 {
+				continue
+			}
+			if len(enabled) > 0 && !enabled[st.TheatreId] {
+				continue
+			}
+			//Ballots run sunday through saturday, like the week the showtimes are fetched for
+			bow, _ := g.Calendar().WeekAt(st.Showtime)
+			w, ok := weeks[bow]
+			if !ok {
+				w = &MovieWeek{GroupId: g.Id, GroupName: g.Name, WeekOf: bow}
+				weeks[bow] = w
+				if winner, ok := winners[bow.Unix()]; ok {
+					for _, s := range showtimes {
+						if s.Id == winner {
+							w.Won, w.ShowtimeId = true, s.Id
+						}
+					}
+				}
+			}
+			w.Showtimes++
+			w.Votes += votes[st.Id]
+		}
+		for _, w := range weeks {
+			history = append(history, w)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].WeekOf.Equal(history[j].WeekOf) {
+			return history[i].WeekOf.After(history[j].WeekOf)
+		}
+		return history[i].GroupId < history[j].GroupId
+	})
+	return history, nil
+}
+
+// This api handler searches the movies.
+//
+//	GET /api/movies?q=space&genre=drama&rated=PG-13&year=2024&page=1&pageSize=20
+func APIMovieSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.URL.Query()
+	page, pageSize, err := pageParams(v, defaultMoviesPageSize, maxMoviesPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := MovieQuery{Text: v.Get("q"), Genre: v.Get("genre"), Rated: v.Get("rated"), Year: v.Get("year"), Limit: pageSize, Offset: (page - 1) * pageSize}
+	movies, total, err := store.SearchMovies(q)
+	if err != nil {
+		log.Println("APIMovieSearchHandler:1:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&MoviePage{Movies: movies, Total: total, Page: page, PageSize: pageSize})
+}
+
+// This api handler returns the weeks the movie was on the ballot of the users groups.
+//
+//	GET /api/movies/{id}/history
+func APIMovieHistoryHandler(w http.ResponseWriter, r *http.Request, movieId int) {
+	u := LoggedInUser(r.Context())
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var groups []*Group
+	var err error
+	if contains(u.Abilities, AbilityAdminGroups) {
+		groups, err = store.GetGroups()
+	} else {
+		groups, err = store.GetGroupsForUser(u.Id)
+	}
+	if err != nil {
+		log.Println("APIMovieHistoryHandler:1:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history, err := MovieHistory(movieId, groups)
+	if err != nil {
+		log.Println("APIMovieHistoryHandler:2:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&history)
+}
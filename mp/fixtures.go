@@ -0,0 +1,117 @@
+package mp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Fixtures are recorded api responses saved under a directory at the path they were fetched
+// from, with .json added. For example the schedule of a theatre is kept at
+//
+//	<dir>/api/theatres/schedule/<theatreId>.json
+//
+// scripts/record-megaplex.sh records a fresh set from the live api.
+
+// The FixtureProvider is a TheatreProvider that reads recorded responses straight from disk
+type FixtureProvider struct {
+	Dir string
+}
+
+var _ TheatreProvider = (*FixtureProvider)(nil)
+
+func NewFixtureProvider(dir string) *FixtureProvider {
+	return &FixtureProvider{Dir: dir}
+}
+
+// Decodes the fixture recorded for the api path into v
+func (fp *FixtureProvider) load(apiPath string, v interface{}) error {
+	f, err := os.Open(fixturePath(fp.Dir, apiPath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	return d.Decode(v)
+}
+
+// Returns the file a fixture for the api path is kept in. The path is cleaned so that it
+// can't point outside of the fixture directory.
+func fixturePath(dir, apiPath string) string {
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+apiPath))+".json")
+}
+
+func (fp *FixtureProvider) GetTheatres() ([]Theatre, error) {
+	ret := make([]Theatre, 0)
+	err := fp.load("/api/theatres/all", &ret)
+	return ret, err
+}
+
+func (fp *FixtureProvider) GetTheatre(theatreId string) (Theatre, error) {
+	return findTheatre(fp, theatreId)
+}
+
+func (fp *FixtureProvider) GetSchedule(theatreId string) (Schedule, error) {
+	ret := Schedule{}
+	err := fp.load("/api/theatres/schedule/"+theatreId, &ret)
+	return ret, err
+}
+
+func (fp *FixtureProvider) GetPerformancesForDay(theatreId string, date time.Time) ([]Performance, error) {
+	s, err := fp.GetSchedule(theatreId)
+	if err != nil {
+		return []Performance{}, err
+	}
+	return performancesForDay(schedulePerformances(s), date), nil
+}
+
+func (fp *FixtureProvider) GetPerformance(performanceNumber string) (SinglePerformance, error) {
+	ret := SinglePerformance{}
+	err := fp.load(fmt.Sprintf("/api/theatres/tickets/%s", performanceNumber), &ret)
+	return ret, err
+}
+
+func (fp *FixtureProvider) GetLayout(performanceNumber string, theatreId string) (Layout, error) {
+	ret := Layout{}
+	err := fp.load(fmt.Sprintf("/api/features/performances/seats/layout/%s/%s", performanceNumber, theatreId), &ret)
+	return ret, err
+}
+
+func (fp *FixtureProvider) GetPreview(performanceNumber string, theatreId string) (Preview, error) {
+	ret := Preview{}
+	err := fp.load(fmt.Sprintf("/api/features/performances/seats/preview/%s/%s", performanceNumber, theatreId), &ret)
+	return ret, err
+}
+
+// Serves the fixtures in dir as if it were the megaplex api. Point a Client at the servers URL
+// to exercise the real http client offline:
+//
+//	s := mp.NewFixtureServer("mp/testdata/megaplex")
+//	defer s.Close()
+//	c := mp.NewClient(s.URL, s.Client())
+func NewFixtureServer(dir string) *httptest.Server {
+	return httptest.NewServer(FixtureHandler(dir))
+}
+
+// Responds to api requests with the recorded fixture, or a 404 if none was recorded
+func FixtureHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := os.Open(fixturePath(dir, r.URL.Path))
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeContent(w, r, "", time.Time{}, f)
+	})
+}
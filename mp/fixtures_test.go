@@ -0,0 +1,111 @@
+package mp
+
+import (
+	"testing"
+	"time"
+)
+
+// Runs the recorded fixtures through the real http client, so the api types are checked
+// against what megaplex sends without going to the network
+func TestClientAgainstFixtures(t *testing.T) {
+	s := NewFixtureServer("testdata/megaplex")
+	defer s.Close()
+	c := NewClient(s.URL, s.Client())
+
+	theatres, err := c.GetTheatres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(theatres) != 4 {
+		t.Fatalf("got %d theatres, want 4", len(theatres))
+	}
+	tp, err := c.GetTheatre(LocationThanksgivingPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.Name != "Thanksgiving Point" || tp.ShortName() != "thanksgivingpoint" || tp.TimeZone() != "America/Denver" {
+		t.Errorf("got theatre %q (%s, %s)", tp.Name, tp.ShortName(), tp.TimeZone())
+	}
+
+	loc, err := time.LoadLocation(tp.TimeZone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := c.GetPerformancesForDay(LocationThanksgivingPoint, time.Date(2026, 10, 20, 0, 0, 0, 0, loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 5 {
+		t.Fatalf("got %d performances on 2026-10-20, want 5", len(ps))
+	}
+	for _, p := range ps {
+		if p.BusinessDate != "20261020" || p.FeatureTitle == "" || p.FeatureCode == 0 {
+			t.Errorf("performance %d is on %s for %q (%d)", p.Id, p.BusinessDate, p.FeatureTitle, p.FeatureCode)
+		}
+	}
+	if ps, _ = c.GetPerformancesForDay(LocationThanksgivingPoint, time.Date(2026, 10, 21, 0, 0, 0, 0, loc)); len(ps) != 0 {
+		t.Errorf("got %d performances on 2026-10-21, want none", len(ps))
+	}
+
+	layout, err := c.GetLayout("10452", LocationThanksgivingPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Seats) != 32 || layout.TotalRowCount != 4 || layout.TotalColumnCount != 8 || len(layout.SeatMessages) != 1 {
+		t.Errorf("got %d seats in %dx%d", len(layout.Seats), layout.TotalRowCount, layout.TotalColumnCount)
+	}
+	preview, err := c.GetPreview("10452", LocationThanksgivingPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Id != "10452" || len(preview.SeatInfo.Statuses) != 5 || len(preview.SeatInfo.Overrides) != 1 {
+		t.Errorf("got preview %s with %d statuses and %d overrides", preview.Id, len(preview.SeatInfo.Statuses), len(preview.SeatInfo.Overrides))
+	}
+
+	if _, err = c.GetSchedule(LocationGeneva); err == nil {
+		t.Error("got a schedule for a theatre without a fixture")
+	}
+}
+
+// The FixtureProvider reads the same fixtures from disk, and should agree with the client
+func TestFixtureProviderMatchesServer(t *testing.T) {
+	s := NewFixtureServer("testdata/megaplex")
+	defer s.Close()
+	c := NewClient(s.URL, s.Client())
+	fp := NewFixtureProvider("testdata/megaplex")
+
+	date := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	for _, id := range []string{LocationThanksgivingPoint, LocationJordanCommons} {
+		want, err := c.GetPerformancesForDay(id, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fp.GetPerformancesForDay(id, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s: the provider has %d performances, the server %d", id, len(got), len(want))
+		}
+		for i := range got {
+			if got[i].Id != want[i].Id || !got[i].Showtime.Equal(want[i].Showtime) || got[i].FeatureTitle != want[i].FeatureTitle {
+				t.Errorf("%s: performance %d is %d at %s, the server has %d at %s", id, i, got[i].Id, got[i].Showtime, want[i].Id, want[i].Showtime)
+			}
+		}
+	}
+}
+
+func TestFixtureHandlerStaysInDir(t *testing.T) {
+	s := NewFixtureServer("testdata/megaplex")
+	defer s.Close()
+	for _, p := range []string{"/api/../../../fixtures", "/api/theatres/missing", "/%2e%2e/%2e%2e/fixtures"} {
+		resp, err := s.Client().Get(s.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("GET %s = %d, want 404", p, resp.StatusCode)
+		}
+	}
+}
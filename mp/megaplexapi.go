@@ -5,77 +5,64 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
+	"strings"
 	"time"
+	"unicode"
 )
 
-const (
-	LocationThanksgivingPoint = "683b08d3-6f8a-4501-a00f-a24601228dd6"
-	LocationTheDistrict       = "24f371a5-1ad0-4ac5-b627-a24400a49818"
-	LocationJordanCommons     = "9dafb9d0-ed8f-4a58-be62-a24b014cc0b4"
-	LocationGeneva            = "83dd4871-c771-42a6-9177-a44a00e0ddd0"
-)
-
-func GetShortNameFromId(id string) string {
-	switch id {
-	case LocationThanksgivingPoint:
-		return "thanksgivingpoint"
-	case LocationTheDistrict:
-		return "thedistrict"
-	case LocationJordanCommons:
-		return "jordancommons"
-	case LocationGeneva:
-		return "geneva"
-	default:
-		return "Unknown"
-	}
+// A TheatreProvider is a source of theatres and their showtimes. The Client talks to the
+// megaplex api, the FixtureProvider serves recorded responses so imports can run offline.
+type TheatreProvider interface {
+	GetTheatres() ([]Theatre, error)
+	// Returns the performances on the day, which should be given in the zone of the theatre
+	GetPerformancesForDay(theatreId string, date time.Time) ([]Performance, error)
+	GetPerformance(performanceNumber string) (SinglePerformance, error)
+	GetLayout(performanceNumber string, theatreId string) (Layout, error)
+	GetPreview(performanceNumber string, theatreId string) (Preview, error)
 }
 
-func GetIdFromLocation(location string) string {
-	switch location {
-	case "Thanksgiving Point":
-		return LocationThanksgivingPoint
-	case "The District":
-		return LocationTheDistrict
-	case "Jordan Commons":
-		return LocationJordanCommons
-	case "Geneva":
-		return LocationGeneva
-	default:
-		return "Unknown"
-	}
+const DefaultBaseURL = "https://www.megaplextheatres.com"
+
+// The Client is the TheatreProvider for the megaplex api
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
 }
 
-func GetLocationFromId(id string) string {
-	switch id {
-	case LocationThanksgivingPoint:
-		return "Thanksgiving Point"
-	case LocationTheDistrict:
-		return "The District"
-	case LocationJordanCommons:
-		return "Jordan Commons"
-	case LocationGeneva:
-		return "Geneva"
-	default:
-		return "Unknown"
+var _ TheatreProvider = (*Client)(nil)
+
+// Creates a client for the api at baseURL, using http.DefaultClient when hc is nil
+func NewClient(baseURL string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
 	}
+	return &Client{BaseURL: baseURL, HTTPClient: hc}
 }
 
-func GetAddressFromId(id string) string {
-	switch id {
-	case LocationThanksgivingPoint:
-		return "2935 Thanksgiving Way, Lehi, UT 84043"
-	case LocationTheDistrict:
-		return "3761 W Parkway Plaza Dr, South Jordan, UT, 84095"
-	case LocationJordanCommons:
-		return "9335 State Street, Sandy, UT, 84070"
-	case LocationGeneva:
-		return "600 North Mill Road, Vineyard, UT, 84058"
-	default:
-		return "Unknown"
+// The DefaultClient is used by the package level functions
+var DefaultClient = NewClient(DefaultBaseURL, nil)
+
+// Gets the api path and decodes the json response into v
+func (c *Client) get(path string, v interface{}) error {
+	resp, err := c.HTTPClient.Get(c.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
 	}
+	d := json.NewDecoder(resp.Body)
+	return d.Decode(v)
 }
 
+const (
+	LocationThanksgivingPoint = "683b08d3-6f8a-4501-a00f-a24601228dd6"
+	LocationTheDistrict       = "24f371a5-1ad0-4ac5-b627-a24400a49818"
+	LocationJordanCommons     = "9dafb9d0-ed8f-4a58-be62-a24b014cc0b4"
+	LocationGeneva            = "83dd4871-c771-42a6-9177-a44a00e0ddd0"
+)
+
 type Theatre struct {
 	HeroImage struct {
 		Path   string `json:"filePath"`
@@ -93,34 +80,58 @@ type Theatre struct {
 	Phone     string `json:"phone"`
 }
 
-func GetTheatres() ([]Theatre, error) {
-	ret := make([]Theatre, 0)
+// Returns the name megaplex uses for the theatre in its urls, like thanksgivingpoint
+func (t Theatre) ShortName() string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, t.Name)
+}
 
-	resp, err := http.Get("https://www.megaplextheatres.com/api/theatres/all")
-	if err != nil {
-		return ret, err
+// The time zones of the states megaplex has theatres in
+var stateTimeZones = map[string]string{
+	"UT": "America/Denver",
+	"NV": "America/Los_Angeles",
+	"ID": "America/Boise",
+	"AZ": "America/Phoenix",
+}
+
+// Returns the IANA time zone the theatre is in. Showtimes and business dates are local to it.
+func (t Theatre) TimeZone() string {
+	if tz, ok := stateTimeZones[strings.ToUpper(strings.TrimSpace(t.State))]; ok {
+		return tz
 	}
-	defer resp.Body.Close()
+	return "America/Denver"
+}
 
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ret)
+func (c *Client) GetTheatres() ([]Theatre, error) {
+	ret := make([]Theatre, 0)
+	err := c.get("/api/theatres/all", &ret)
 	return ret, err
 }
 
+func GetTheatres() ([]Theatre, error) {
+	return DefaultClient.GetTheatres()
+}
+
+func (c *Client) GetTheatre(theatreId string) (Theatre, error) {
+	return findTheatre(c, theatreId)
+}
+
 func GetTheatre(theatreId string) (Theatre, error) {
-	ts := make([]Theatre, 0)
+	return DefaultClient.GetTheatre(theatreId)
+}
 
-	resp, err := http.Get("https://www.megaplextheatres.com/api/theatres/all")
+func findTheatre(p TheatreProvider, theatreId string) (Theatre, error) {
+	ts, err := p.GetTheatres()
 	if err != nil {
 		return Theatre{}, err
 	}
-	defer resp.Body.Close()
-
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ts)
 	for _, v := range ts {
 		if v.Id == theatreId {
-			return v, err
+			return v, nil
 		}
 	}
 	return Theatre{}, errors.New("Not Found")
@@ -187,6 +198,10 @@ type Performance struct {
 	FeatureCode            uint      `json:"featureCode"`
 	FeatureTitle           string    `json:"-"`
 	FeaturePoster          string    `json:"-"`
+	FeatureRating          string    `json:"-"`
+	FeatureRuntime         uint      `json:"-"`
+	FeatureSynopsis        string    `json:"-"`
+	FeatureGenres          []string  `json:"-"`
 	Formats                []string  `json:"formats"`
 	IMAXFlag               bool      `json:"imaxFlag"`
 	ReservedSeating        bool      `json:"isReservedSeating"`
@@ -206,56 +221,69 @@ type Schedule struct {
 	Schedule         []Feature `json:"schedule"`
 }
 
-func GetSchedule(theatreId string) (Schedule, error) {
+func (c *Client) GetSchedule(theatreId string) (Schedule, error) {
 	ret := Schedule{}
+	err := c.get("/api/theatres/schedule/"+theatreId, &ret)
+	return ret, err
+}
 
-	resp, err := http.Get("https://www.megaplextheatres.com/api/theatres/schedule/" + theatreId)
-	if err != nil {
-		return ret, err
-	}
-	defer resp.Body.Close()
-
-	b, _ := httputil.DumpResponse(resp, true)
-	fmt.Printf("%s\n", b)
-
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ret)
-	if err != nil {
-		return ret, err
-	}
-	return ret, nil
+func GetSchedule(theatreId string) (Schedule, error) {
+	return DefaultClient.GetSchedule(theatreId)
 }
 
-func GetPerformances(theatreId string) ([]Performance, error) {
-	s, err := GetSchedule(theatreId)
-	if err != nil {
-		return []Performance{}, err
-	}
+// Flattens the schedule into its performances, each one labelled with its feature
+func schedulePerformances(s Schedule) []Performance {
 	ret := make([]Performance, 0)
 	for _, f := range s.Schedule {
 		for _, p := range f.Performances {
 			p.FeatureCode = f.FeatureCode
 			p.FeatureTitle = f.Title
 			p.FeaturePoster = f.Poster.Large
+			p.FeatureRating = f.Rating
+			p.FeatureRuntime = f.Runtime
+			p.FeatureSynopsis = f.Synopsis
+			p.FeatureGenres = f.Genres
 			ret = append(ret, p)
 		}
 	}
-	return ret, nil
+	return ret
 }
 
-func GetPerformancesForDay(theatreId string, date time.Time) ([]Performance, error) {
+// Returns the performances on the business date of the day. The date should be in the zone of
+// the theatre.
+func performancesForDay(performances []Performance, date time.Time) []Performance {
 	ret := make([]Performance, 0)
-	performances, err := GetPerformances(theatreId)
-	if err != nil {
-		return performances, err
-	}
-	ds := date.Local().Format("20060102")
+	ds := date.Format("20060102")
 	for _, p := range performances {
 		if ds == p.BusinessDate {
 			ret = append(ret, p)
 		}
 	}
-	return ret, nil
+	return ret
+}
+
+func (c *Client) GetPerformances(theatreId string) ([]Performance, error) {
+	s, err := c.GetSchedule(theatreId)
+	if err != nil {
+		return []Performance{}, err
+	}
+	return schedulePerformances(s), nil
+}
+
+func GetPerformances(theatreId string) ([]Performance, error) {
+	return DefaultClient.GetPerformances(theatreId)
+}
+
+func (c *Client) GetPerformancesForDay(theatreId string, date time.Time) ([]Performance, error) {
+	performances, err := c.GetPerformances(theatreId)
+	if err != nil {
+		return performances, err
+	}
+	return performancesForDay(performances, date), nil
+}
+
+func GetPerformancesForDay(theatreId string, date time.Time) ([]Performance, error) {
+	return DefaultClient.GetPerformancesForDay(theatreId, date)
 }
 
 type TicketTypes struct {
@@ -284,20 +312,16 @@ type SinglePerformance struct {
 	TicketTypes TicketTypes `json:"TicketTypes"`
 }
 
-func GetPerformance(performanceNumber string) (SinglePerformance, error) {
+func (c *Client) GetPerformance(performanceNumber string) (SinglePerformance, error) {
 	ret := SinglePerformance{}
-
-	resp, err := http.Get(fmt.Sprintf("https://www.megaplextheatres.com/api/theatres/tickets/%s", performanceNumber))
-	if err != nil {
-		return ret, err
-	}
-	defer resp.Body.Close()
-
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ret)
+	err := c.get(fmt.Sprintf("/api/theatres/tickets/%s", performanceNumber), &ret)
 	return ret, err
 }
 
+func GetPerformance(performanceNumber string) (SinglePerformance, error) {
+	return DefaultClient.GetPerformance(performanceNumber)
+}
+
 type Layout struct {
 	SeatMessages []struct {
 		Message string `json:"message"`
@@ -314,20 +338,16 @@ type Layout struct {
 	//Zones []
 }
 
-func GetLayout(performanceNumber string, theatreId string) (Layout, error) {
+func (c *Client) GetLayout(performanceNumber string, theatreId string) (Layout, error) {
 	ret := Layout{}
-
-	resp, err := http.Get(fmt.Sprintf("https://www.megaplextheatres.com/api/features/performances/seats/layout/%s/%s", performanceNumber, theatreId))
-	if err != nil {
-		return ret, err
-	}
-	defer resp.Body.Close()
-
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ret)
+	err := c.get(fmt.Sprintf("/api/features/performances/seats/layout/%s/%s", performanceNumber, theatreId), &ret)
 	return ret, err
 }
 
+func GetLayout(performanceNumber string, theatreId string) (Layout, error) {
+	return DefaultClient.GetLayout(performanceNumber, theatreId)
+}
+
 type Preview struct {
 	Id     string `json:"id"`
 	Result struct {
@@ -348,16 +368,12 @@ type Preview struct {
 	} `json:"seatInfo"`
 }
 
-func GetPreview(performanceNumber string, theatreId string) (Preview, error) {
+func (c *Client) GetPreview(performanceNumber string, theatreId string) (Preview, error) {
 	ret := Preview{}
-
-	resp, err := http.Get(fmt.Sprintf("https://www.megaplextheatres.com/api/features/performances/seats/preview/%s/%s", performanceNumber, theatreId))
-	if err != nil {
-		return ret, err
-	}
-	defer resp.Body.Close()
-
-	d := json.NewDecoder(resp.Body)
-	err = d.Decode(&ret)
+	err := c.get(fmt.Sprintf("/api/features/performances/seats/preview/%s/%s", performanceNumber, theatreId), &ret)
 	return ret, err
 }
+
+func GetPreview(performanceNumber string, theatreId string) (Preview, error) {
+	return DefaultClient.GetPreview(performanceNumber, theatreId)
+}
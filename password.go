@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+// Passwords are stored in a self describing format so that the algorithm and cost can change
+// over time without locking anyone out. Every format except bcrypt (which has its own well
+// known encoding) follows the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//	$2a$10$<bcrypt salt and hash>
+//
+// Anything not starting with a '$' is a legacy sha512/256 hash salted with the -salt flag.
+type PasswordHasher interface {
+	// The algorithm identifier that appears in the encoded hash
+	Name() string
+	// Hashes the password with a freshly generated random salt
+	Hash(password string) (string, error)
+	// Reports whether the password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// Reports whether the encoded hash was made with weaker parameters than the hasher uses now
+	NeedsRehash(encoded string) bool
+}
+
+var ErrUnknownPasswordHash = errors.New("Unknown password hash format")
+var ErrUnknownPasswordHasher = errors.New("Unknown password hash algorithm, use argon2id, scrypt or bcrypt")
+
+var passwordHashers = map[string]PasswordHasher{
+	"argon2id": &Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 2, KeyLen: 32},
+	"scrypt":   &ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32},
+	"bcrypt":   &BcryptHasher{Cost: bcrypt.DefaultCost},
+	"legacy":   &LegacyHasher{},
+}
+
+// Returns the hasher new passwords can be hashed with by its name. The legacy hasher can never
+// be chosen for new passwords.
+func GetPasswordHasher(name string) (PasswordHasher, error) {
+	h, ok := passwordHashers[name]
+	if !ok || name == "legacy" {
+		return nil, ErrUnknownPasswordHasher
+	}
+	return h, nil
+}
+
+// Returns the hasher that new passwords should be hashed with, as configured by the
+// -passwordHash flag, which is checked at startup
+func CurrentPasswordHasher() PasswordHasher {
+	h, err := GetPasswordHasher(*passwordHash)
+	if err != nil {
+		return passwordHashers["argon2id"]
+	}
+	return h
+}
+
+// Identifies the hasher that produced the encoded password
+func passwordHasherFor(encoded string) (PasswordHasher, error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return passwordHashers["legacy"], nil
+	}
+	parts := strings.SplitN(encoded[1:], "$", 2)
+	switch parts[0] {
+	case "argon2id":
+		return passwordHashers["argon2id"], nil
+	case "scrypt":
+		return passwordHashers["scrypt"], nil
+	case "2a", "2b", "2y":
+		return passwordHashers["bcrypt"], nil
+	}
+	return nil, ErrUnknownPasswordHash
+}
+
+func HashPassword(password string) (string, error) {
+	return CurrentPasswordHasher().Hash(password)
+}
+
+// Checks the password against the encoded hash. When the password is valid, rehash will be
+// true if the stored hash should be replaced because it uses an old algorithm or old costs.
+func VerifyPassword(password, encoded string) (ok bool, rehash bool, err error) {
+	h, err := passwordHasherFor(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	ok, err = h.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	current := CurrentPasswordHasher()
+	rehash = h.Name() != current.Name() || h.NeedsRehash(encoded)
+	return true, rehash, nil
+}
+
+func genSalt(n int) ([]byte, error) {
+	s := make([]byte, n)
+	_, err := rand.Read(s)
+	return s, err
+}
+
+var b64 = base64.RawStdEncoding
+
+// Splits a PHC formatted string into its parameter, salt and hash sections
+func parsePHC(encoded, name string) (params string, salt []byte, hash []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	// "", name, [version], params, salt, hash
+	if len(parts) < 5 || parts[1] != name {
+		return "", nil, nil, ErrUnknownPasswordHash
+	}
+	params = parts[len(parts)-3]
+	salt, err = b64.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	hash, err = b64.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return params, salt, hash, nil
+}
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+func (h *Argon2idHasher) Name() string {
+	return "argon2id"
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := genSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) params(encoded string) (m uint32, t uint32, p uint8, salt []byte, hash []byte, err error) {
+	params, salt, hash, err := parsePHC(encoded, h.Name())
+	if err != nil {
+		return
+	}
+	_, err = fmt.Sscanf(params, "m=%d,t=%d,p=%d", &m, &t, &p)
+	return
+}
+
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	m, t, p, salt, hash, err := h.params(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(key, hash) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	m, t, p, _, hash, err := h.params(encoded)
+	return err != nil || m < h.Memory || t < h.Time || p != h.Threads || uint32(len(hash)) < h.KeyLen
+}
+
+type ScryptHasher struct {
+	LogN   int
+	R      int
+	P      int
+	KeyLen int
+}
+
+func (h *ScryptHasher) Name() string {
+	return "scrypt"
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := genSalt(16)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<uint(h.LogN), h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *ScryptHasher) params(encoded string) (ln int, r int, p int, salt []byte, hash []byte, err error) {
+	params, salt, hash, err := parsePHC(encoded, h.Name())
+	if err != nil {
+		return
+	}
+	_, err = fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &ln, &r, &p)
+	return
+}
+
+func (h *ScryptHasher) Verify(password, encoded string) (bool, error) {
+	ln, r, p, salt, hash, err := h.params(encoded)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, len(hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, hash) == 1, nil
+}
+
+func (h *ScryptHasher) NeedsRehash(encoded string) bool {
+	ln, r, p, _, hash, err := h.params(encoded)
+	return err != nil || ln < h.LogN || r < h.R || p < h.P || len(hash) < h.KeyLen
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(b), err
+}
+
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// The original password scheme: sha512/256 of the application wide salt and the password. It
+// is only kept around to verify existing passwords so they can be upgraded on login.
+type LegacyHasher struct{}
+
+func (h *LegacyHasher) Name() string {
+	return "legacy"
+}
+
+func (h *LegacyHasher) Hash(password string) (string, error) {
+	sum := sha512.Sum512_256([]byte(*salt + password))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func (h *LegacyHasher) Verify(password, encoded string) (bool, error) {
+	sep, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(sep), []byte(encoded)) == 1, nil
+}
+
+func (h *LegacyHasher) NeedsRehash(encoded string) bool {
+	return true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Swaps in hashers with low costs so the tests run quickly, and the -passwordHash and -salt
+// flags, for as long as the test runs
+func cheapPasswordHashers(t *testing.T, current string) {
+	oldHashers, oldCurrent, oldSalt := passwordHashers, *passwordHash, *salt
+	t.Cleanup(func() {
+		passwordHashers, *passwordHash, *salt = oldHashers, oldCurrent, oldSalt
+	})
+	passwordHashers = map[string]PasswordHasher{
+		"argon2id": &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32},
+		"scrypt":   &ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32},
+		"bcrypt":   &BcryptHasher{Cost: 4},
+		"legacy":   &LegacyHasher{},
+	}
+	*passwordHash, *salt = current, "pepper"
+}
+
+func TestGetPasswordHasher(t *testing.T) {
+	for _, name := range []string{"argon2id", "scrypt", "bcrypt"} {
+		if h, err := GetPasswordHasher(name); err != nil || h.Name() != name {
+			t.Errorf("GetPasswordHasher(%q) = %v, %v", name, h, err)
+		}
+	}
+	for _, name := range []string{"legacy", "bcrpyt", "", "Argon2id"} {
+		if _, err := GetPasswordHasher(name); err != ErrUnknownPasswordHasher {
+			t.Errorf("GetPasswordHasher(%q) = %v, want %v", name, err, ErrUnknownPasswordHasher)
+		}
+	}
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	tests := []struct {
+		hasher string
+		prefix string
+	}{
+		{"argon2id", "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"scrypt", "$scrypt$ln=4,r=8,p=1$"},
+		{"bcrypt", "$2a$04$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hasher, func(t *testing.T) {
+			cheapPasswordHashers(t, tt.hasher)
+			encoded, err := HashPassword("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(encoded, tt.prefix) {
+				t.Errorf("the hash %q doesn't start with %q", encoded, tt.prefix)
+			}
+			if again, _ := HashPassword("correct horse"); again == encoded {
+				t.Error("hashing twice gave the same hash, the salt isn't random")
+			}
+			ok, rehash, err := VerifyPassword("correct horse", encoded)
+			if err != nil || !ok || rehash {
+				t.Errorf("the password verified as %v, rehash %v, %v", ok, rehash, err)
+			}
+			ok, _, err = VerifyPassword("correct horsE", encoded)
+			if err != nil || ok {
+				t.Errorf("the wrong password verified as %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+// Hashes made with another algorithm, or weaker costs, still verify but are due a rehash
+func TestPasswordRehash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hasher  PasswordHasher
+		current PasswordHasher
+		rehash  bool
+	}{
+		{"legacy", &LegacyHasher{}, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, true},
+		{"other algorithm", &BcryptHasher{Cost: 4}, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, true},
+		{"same argon2id costs", &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, false},
+		{"less argon2id memory", &Argon2idHasher{Time: 1, Memory: 512, Threads: 1, KeyLen: 32}, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, true},
+		{"fewer argon2id passes", &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, &Argon2idHasher{Time: 2, Memory: 1024, Threads: 1, KeyLen: 32}, true},
+		{"shorter argon2id key", &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 16}, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, true},
+		{"lower scrypt cost", &ScryptHasher{LogN: 3, R: 8, P: 1, KeyLen: 32}, &ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32}, true},
+		{"higher scrypt cost", &ScryptHasher{LogN: 5, R: 8, P: 1, KeyLen: 32}, &ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32}, false},
+		{"lower bcrypt cost", &BcryptHasher{Cost: 4}, &BcryptHasher{Cost: 5}, true},
+		{"same bcrypt cost", &BcryptHasher{Cost: 5}, &BcryptHasher{Cost: 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cheapPasswordHashers(t, tt.current.Name())
+			passwordHashers[tt.current.Name()] = tt.current
+			encoded, err := tt.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, rehash, err := VerifyPassword("correct horse", encoded)
+			if err != nil || !ok || rehash != tt.rehash {
+				t.Errorf("the password verified as %v, rehash %v, %v, want rehash %v", ok, rehash, err, tt.rehash)
+			}
+		})
+	}
+}
+
+// Logging in with a password hashed the old way stores it again with the current hasher
+func TestValidateUserUpgradesHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hasher  PasswordHasher
+		current string
+		upgrade bool
+	}{
+		{"legacy to argon2id", &LegacyHasher{}, "argon2id", true},
+		{"legacy to bcrypt", &LegacyHasher{}, "bcrypt", true},
+		{"scrypt to argon2id", &ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32}, "argon2id", true},
+		{"weaker argon2id", &Argon2idHasher{Time: 1, Memory: 512, Threads: 1, KeyLen: 32}, "argon2id", true},
+		{"current", &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32}, "argon2id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cheapPasswordHashers(t, tt.current)
+			oldStore := store
+			t.Cleanup(func() { store = oldStore })
+			store = NewMemoryStore()
+			u, err := store.RegisterUser("A", "a@example.com", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := tt.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.SetUserPassword(u.Id, encoded); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = ValidateUser("a@example.com", "wrong"); err != ErrInvalidPassword {
+				t.Errorf("a wrong password gave %v, want %v", err, ErrInvalidPassword)
+			}
+			if _, stored, _ := store.GetUserPassword("a@example.com"); stored != encoded {
+				t.Fatal("a wrong password changed the stored hash")
+			}
+			if _, err = ValidateUser("a@example.com", "correct horse"); err != nil {
+				t.Fatal(err)
+			}
+			_, stored, err := store.GetUserPassword("a@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (stored != encoded) != tt.upgrade {
+				t.Fatalf("the stored hash went from %q to %q, want upgraded %v", encoded, stored, tt.upgrade)
+			}
+			if h, _ := passwordHasherFor(stored); h.Name() != tt.current {
+				t.Errorf("the password is stored with %s, want %s", h.Name(), tt.current)
+			}
+			if _, err = ValidateUser("a@example.com", "correct horse"); err != nil {
+				t.Errorf("the upgraded hash doesn't validate: %v", err)
+			}
+		})
+	}
+}
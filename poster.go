@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// The renditions posters are served in, by the width they are scaled down to. The original
+// is served as the provider sent it.
+var posterSizes = map[string]int{
+	"thumb":    154,
+	"medium":   342,
+	"original": 0,
+}
+
+// Posters larger than this aren't downloaded
+const maxPosterBytes = 10 << 20
+
+var ErrNoPoster = errors.New("The movie has no poster")
+
+// The posterCache variable is the global cache of movie posters
+var posterCache *PosterCache
+
+type Poster struct {
+	Bytes       []byte
+	ContentType string
+	ETag        string
+	Modified    time.Time
+	Placeholder bool
+}
+
+type posterEntry struct {
+	name string
+	size int64
+}
+
+// The PosterCache keeps downloaded posters and their renditions in a directory, so they survive
+// restarts. The directory is kept under MaxBytes by removing the least recently used files.
+// After a restart the files start out in the order they were downloaded.
+type PosterCache struct {
+	sync.Mutex
+	Dir      string
+	MaxBytes int64
+	Client   *http.Client
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+// Creates the cache directory if needed and picks up the posters already in it
+func NewPosterCache(dir string, maxBytes int64, hc *http.Client) (*PosterCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	pc := &PosterCache{Dir: dir, MaxBytes: maxBytes, Client: hc, lru: list.New(), entries: make(map[string]*list.Element)}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(des))
+	for _, de := range des {
+		if de.IsDir() {
+			continue
+		}
+		//Left behind by a write that didn't finish
+		if strings.HasPrefix(de.Name(), ".poster") {
+			os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fi)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		pc.entries[fi.Name()] = pc.lru.PushFront(&posterEntry{name: fi.Name(), size: fi.Size()})
+		pc.size += fi.Size()
+	}
+	pc.Lock()
+	pc.evict()
+	pc.Unlock()
+	return pc, nil
+}
+
+// Removes the least recently used posters until the cache fits, the caller holds the lock
+func (pc *PosterCache) evict() {
+	for pc.size > pc.MaxBytes && pc.lru.Len() > 0 {
+		e := pc.lru.Remove(pc.lru.Back()).(*posterEntry)
+		delete(pc.entries, e.name)
+		pc.size -= e.size
+		err := os.Remove(filepath.Join(pc.Dir, e.name))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Couldn't remove cached poster", e.name, err)
+		}
+	}
+}
+
+// The file a rendition is kept in. It carries a hash of the poster url, so a movie that gets a
+// new poster doesn't keep serving the old one.
+func posterFileName(m *Movie, size string) string {
+	h := fnv.New32a()
+	h.Write([]byte(m.Poster))
+	return fmt.Sprintf("%d-%s-%08x", m.Id, size, h.Sum32())
+}
+
+// Returns the rendition of the movies poster, downloading and scaling it on first use
+func (pc *PosterCache) Get(m *Movie, size string) (*Poster, error) {
+	width, ok := posterSizes[size]
+	if !ok {
+		return nil, fmt.Errorf("Unknown poster size %s", size)
+	}
+	name := posterFileName(m, size)
+	if p, err := pc.read(name); err == nil {
+		return p, nil
+	}
+
+	var b []byte
+	var err error
+	if width == 0 {
+		b, err = pc.fetch(m.Poster)
+	} else {
+		var orig *Poster
+		orig, err = pc.Get(m, "original")
+		if err == nil {
+			b, err = scalePoster(orig.Bytes, width)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = pc.write(name, b)
+	if err != nil {
+		return nil, err
+	}
+	//The bytes in hand are served, the rendition may already have been evicted again, as it
+	//is when it alone is larger than the cache
+	return newPoster(name, b, time.Now()), nil
+}
+
+func newPoster(name string, b []byte, modified time.Time) *Poster {
+	return &Poster{Bytes: b, ContentType: http.DetectContentType(b), ETag: `"` + name + `"`, Modified: modified}
+}
+
+func (pc *PosterCache) read(name string) (*Poster, error) {
+	pc.Lock()
+	el, ok := pc.entries[name]
+	if ok {
+		pc.lru.MoveToFront(el)
+	}
+	pc.Unlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(pc.Dir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newPoster(name, b, fi.ModTime()), nil
+}
+
+// Writes the file through a temporary file, so a reader never sees half a poster
+func (pc *PosterCache) write(name string, b []byte) error {
+	f, err := os.CreateTemp(pc.Dir, ".poster")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(pc.Dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	pc.Lock()
+	defer pc.Unlock()
+	if el, ok := pc.entries[name]; ok {
+		pc.size -= el.Value.(*posterEntry).size
+		pc.lru.Remove(el)
+	}
+	pc.entries[name] = pc.lru.PushFront(&posterEntry{name: name, size: int64(len(b))})
+	pc.size += int64(len(b))
+	pc.evict()
+	return nil
+}
+
+// Downloads the poster. Megaplex posters come as paths on the megaplex site.
+func (pc *PosterCache) fetch(poster string) ([]byte, error) {
+	if poster == "" || poster == "N/A" {
+		return nil, ErrNoPoster
+	}
+	u, err := url.Parse(poster)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		base, err := url.Parse(*megaplexUrl)
+		if err != nil {
+			return nil, err
+		}
+		u = base.ResolveReference(u)
+	}
+	resp, err := pc.Client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching poster %s: %s", u, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxPosterBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPosterBytes {
+		return nil, fmt.Errorf("Poster %s is larger than %d bytes", u, maxPosterBytes)
+	}
+	if ct := http.DetectContentType(b); !strings.HasPrefix(ct, "image/") {
+		return nil, fmt.Errorf("Poster %s is %s, not an image", u, ct)
+	}
+	return b, nil
+}
+
+// Scales the poster down to the width as a jpeg. Posters that are already narrow enough are
+// kept as they are.
+func scalePoster(b []byte, width int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	sb := src.Bounds()
+	if sb.Dx() <= width {
+		return b, nil
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, sb.Dy()*width/sb.Dx()))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, sb, draw.Src, nil)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var placeholders = make(map[string]*Poster)
+var placeholdersMu sync.Mutex
+
+// Returns a plain poster shaped image, for movies whose poster can't be fetched
+func placeholderPoster(size string) *Poster {
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+	if p, ok := placeholders[size]; ok {
+		return p
+	}
+	width := posterSizes[size]
+	if width == 0 {
+		width = posterSizes["medium"]
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, width*3/2))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0x33, 0x33, 0x33, 0xff}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	p := &Poster{Bytes: buf.Bytes(), ContentType: "image/png", Placeholder: true}
+	placeholders[size] = p
+	return p
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The number of top voted showtimes that are rechecked while the vote is still open
+const recheckTopN = 3
+
+// An Invite is the calendar invitation sent out when a groups week is locked. It remembers the
+// showtime and start time that were sent, so that later changes to the showtime are noticed,
+// and every update to it goes out with a higher sequence.
+type Invite struct {
+	GroupId    int
+	WeekOf     time.Time
+	ShowtimeId int
+	Showtime   time.Time
+	Sequence   int
+	Cancelled  bool
+}
+
+type Rsvp struct {
+	GroupId    int
+	UserId     int
+	ShowtimeId int
+	Value      string
+}
+
+// Fetches the showtimes again from their theatres, so that performances the provider has since
+// cancelled or moved are marked as such. Each theatre is only fetched once for each date.
+func refreshShowtimes(showtimes []*Showtime) error {
+	dates := make([]time.Time, 0)
+	theatres := make(map[time.Time][]*Theatre)
+	fetched := make(map[string]bool)
+	for _, st := range showtimes {
+		t, err := store.GetTheatre(st.TheatreId)
+		if err != nil {
+			log.Println("refreshShowtimes:", st.Id, err)
+			continue
+		}
+		y, m, d := st.Showtime.In(t.Location()).Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		k := date.Format("2006-01-02") + t.Id
+		if fetched[k] {
+			continue
+		}
+		fetched[k] = true
+		if _, ok := theatres[date]; !ok {
+			dates = append(dates, date)
+		}
+		theatres[date] = append(theatres[date], t)
+	}
+	var ferr error
+	for _, d := range dates {
+		report, err := fetchShowtimes(theatres[d], d)
+		fmt.Println(report)
+		if err != nil {
+			ferr = err
+		}
+	}
+	return ferr
+}
+
+// Returns the performance that best stands in for a cancelled showtime. That is another showing
+// of the same movie in the same week, preferring the same theatre and then the closest start.
+func replacementShowtime(g *Group, st *Showtime, bow, eow time.Time) (*Showtime, error) {
+	showtimes, err := store.GetShowtimesForWeekOf(g.Id, bow, eow, 0)
+	if err != nil {
+		return nil, err
+	}
+	var best *Showtime
+	var bestScore time.Duration
+	for _, c := range showtimes {
+		if c.Id == st.Id || c.MovieId != st.MovieId {
+			continue
+		}
+		score := c.Showtime.Sub(st.Showtime)
+		if score < 0 {
+			score = -score
+		}
+		//Moving theatres is a bigger change than moving a day
+		if c.TheatreId != st.TheatreId {
+			score += 7 * 24 * time.Hour
+		}
+		if best == nil || score < bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best, nil
+}
+
+// Rechecks the winner of a locked week, or the top voted showtimes while the vote is open, with
+// the theatre. Votes on showtimes that were cancelled move to their replacement when there is
+// one. When the winner was cancelled or moved, everyone that hasn't declined the invite gets an
+// updated invite, or a cancellation if there is nothing to replace it with.
+func RecheckGroup(g *Group, now time.Time) error {
+	bow, eow := g.WeekOf(now)
+	inv, err := store.GetInvite(g.Id, bow)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	week, err := GetWeek(g, bow)
+	if err != nil {
+		return err
+	}
+	if inv == nil && week.Locked != nil {
+		//The week was locked before invites were kept, the invite that went out had no sequence
+		winner, err := store.GetShowtime(g.Id, week.ShowtimeId)
+		if err != nil {
+			return err
+		}
+		inv = &Invite{GroupId: g.Id, WeekOf: bow, ShowtimeId: winner.Id, Showtime: winner.Showtime}
+		err = store.SaveInvite(inv)
+		if err != nil {
+			return err
+		}
+	}
+	check, err := WeekStandings(g, bow, eow, 0)
+	if err != nil {
+		return err
+	}
+	if len(check) > recheckTopN {
+		check = check[:recheckTopN]
+	}
+	if inv != nil && !inv.Cancelled {
+		winner, err := store.GetShowtime(g.Id, inv.ShowtimeId)
+		if err != nil {
+			return err
+		}
+		check = []*Showtime{winner}
+	}
+	upcoming := make([]*Showtime, 0)
+	for _, st := range check {
+		if st.Showtime.After(now) {
+			upcoming = append(upcoming, st)
+		}
+	}
+	if len(upcoming) == 0 {
+		return nil
+	}
+	err = refreshShowtimes(upcoming)
+	if err != nil {
+		log.Println("RecheckGroup:1:", err)
+	}
+
+	cancelled, err := store.GetCancelledShowtimesForWeekOf(g.Id, bow, eow)
+	if err != nil {
+		return err
+	}
+	replaced := make(map[int]*Showtime)
+	for _, st := range cancelled {
+		if st.Showtime.Before(now) {
+			continue
+		}
+		r, err := replacementShowtime(g, st, bow, eow)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			fmt.Println("No replacement for cancelled showtime", st.Id, "of", st.Movie.MegaPlexTitle)
+			continue
+		}
+		err = store.MigrateVotes(g.Id, st.Id, r.Id)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Moved the votes of cancelled showtime", st.Id, "to", r.Id, "for group", g.Id)
+		replaced[st.Id] = r
+	}
+
+	if inv == nil || inv.Cancelled {
+		return nil
+	}
+	winner, err := store.GetShowtime(g.Id, inv.ShowtimeId)
+	if err != nil {
+		return err
+	}
+	loc := calendar.Location
+	if t, err := store.GetTheatre(winner.TheatreId); err == nil {
+		loc = t.Location()
+	}
+	var reason string
+	switch {
+	case winner.Cancelled && replaced[winner.Id] != nil:
+		r, err := store.GetShowtime(g.Id, replaced[winner.Id].Id)
+		if err != nil {
+			return err
+		}
+		reason = fmt.Sprintf("The %s showing was cancelled by the theatre, so we moved to the %s showing at %s.",
+			winner.Showtime.In(loc).Format("Mon 3:04PM"), r.Showtime.In(loc).Format("Mon 3:04PM"), r.Location)
+		winner = r
+	case winner.Cancelled:
+		reason = fmt.Sprintf("The %s showing was cancelled by the theatre.", winner.Showtime.In(loc).Format("Mon 3:04PM"))
+		inv.Cancelled = true
+	case !winner.Showtime.Equal(inv.Showtime):
+		reason = fmt.Sprintf("The theatre moved the showing from %s to %s.",
+			inv.Showtime.In(loc).Format("Mon 3:04PM"), winner.Showtime.In(loc).Format("Mon 3:04PM"))
+	default:
+		return nil
+	}
+
+	fmt.Println("Winner of group", g.Id, "changed:", reason)
+	return sendInviteChange(g, winner, inv, reason)
+}
+
+// Saves the invite with a higher sequence for the winner, then sends the update, or the
+// cancellation if the invite was cancelled, to everyone that answered the invite of the winner
+// and hasn't declined it
+func sendInviteChange(g *Group, winner *Showtime, inv *Invite, reason string) error {
+	rsvps, err := store.GetRsvps(g.Id, winner.Id)
+	if err != nil {
+		return err
+	}
+	inv.Sequence++
+	inv.ShowtimeId = winner.Id
+	inv.Showtime = winner.Showtime
+	err = store.SaveInvite(inv)
+	if err != nil {
+		return err
+	}
+	for _, r := range rsvps {
+		//Email responses come back as DECLINED
+		if strings.HasPrefix(r.Value, "DECLINE") {
+			continue
+		}
+		u, err := store.GetUser(r.UserId)
+		if err != nil {
+			log.Println("sendInviteChange:", err)
+			continue
+		}
+		if inv.Cancelled {
+			fmt.Println("Sending Cancel Email To", u.Email)
+			SendInviteCancelEmail(g, u, winner, inv, reason)
+		} else {
+			fmt.Println("Sending Update Email To", u.Email)
+			SendInviteUpdateEmail(g, u, winner, inv, reason)
+		}
+	}
+	return nil
+}
+
+// The recheck job rechecks every groups winner or top voted showtimes ahead of the event
+func RecheckJob(now time.Time) error {
+	groups, err := store.GetGroups()
+	if err != nil {
+		return err
+	}
+	var rerr error
+	for _, g := range groups {
+		err = RecheckGroup(g, now)
+		if err != nil {
+			log.Println("RecheckJob:", g.Id, err)
+			rerr = err
+		}
+	}
+	return rerr
+}
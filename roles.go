@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+)
+
+// These are the abilities checked by the admin endpoints. Abilities can be granted to a user
+// directly, or bundled into a role and granted by assigning the user that role.
+const (
+	AbilityAdminMovie     = "admin.movie"
+	AbilityAdminShowtimes = "admin.showtimes"
+	AbilityAdminLock      = "admin.lock"
+	AbilityAdminDownvote  = "admin.downvote"
+	AbilityAdminUsers     = "admin.users"
+	AbilityAdminBackup    = "admin.backup"
+	AbilityAdminGroups    = "admin.groups"
+	AbilityAdminJobs      = "admin.jobs"
+	AbilityAdminTheatres  = "admin.theatres"
+)
+
+var abilities = []string{
+	AbilityAdminMovie,
+	AbilityAdminShowtimes,
+	AbilityAdminLock,
+	AbilityAdminDownvote,
+	AbilityAdminUsers,
+	AbilityAdminBackup,
+	AbilityAdminGroups,
+	AbilityAdminJobs,
+	AbilityAdminTheatres,
+}
+
+// The roles seeded into the database on startup. Admins can do everything, curators manage
+// the ballot, and members can only vote.
+const (
+	RoleAdmin   = "admin"
+	RoleCurator = "curator"
+	RoleMember  = "member"
+)
+
+var roleAbilities = map[string][]string{
+	RoleAdmin:   abilities,
+	RoleCurator: {AbilityAdminMovie, AbilityAdminShowtimes, AbilityAdminDownvote, AbilityAdminTheatres},
+	RoleMember:  {},
+}
+
+func isAbility(ability string) bool {
+	return contains(abilities, ability)
+}
+
+func isRole(role string) bool {
+	_, ok := roleAbilities[role]
+	return ok
+}
+
+// Wraps a handler so that it is only reachable by logged in users that have the ability
+func RequireAbility(ability string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := LoggedInUser(r.Context())
+		if u == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !contains(u.Abilities, ability) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -1,171 +1,142 @@
 package main
 
 import (
-	"./mp"
 	"fmt"
-	"github.com/jinzhu/now"
 	"log"
-	"strings"
 	"sync"
 	"time"
 )
 
-func GetShowtimesRoutine(day, hour, minute int) {
-	for {
-		runAt := now.BeginningOfWeek().Add(time.Hour * 24 * time.Duration(day)).Add(time.Hour * time.Duration(hour)).Add(time.Minute * time.Duration(minute))
-		if time.Now().After(runAt) {
-			runAt = runAt.AddDate(0, 0, 7)
-		}
-		fmt.Println("Will update showtimes in", runAt.Sub(time.Now()))
-		time.Sleep(runAt.Sub(time.Now()))
-		tue := now.EndOfWeek().Add(time.Hour).AddDate(0, 0, 2).Local()
-		fetchShowtimes(mp.LocationThanksgivingPoint, tue)
-		time.Sleep(time.Hour)
-	}
-}
-
-func fetchShowtimes(location string, date time.Time) {
-	showtimes, err := mp.GetPerformancesForDay(location, date)
+// The showtimes job fetches the showtimes of the next event day of every group whose vote opened
+// since the day before, so the ballot fills as voting starts whatever day the group meets on.
+// Each group has the showtimes of the theatres it has enabled imported, and a theatre shared by
+// groups with the same event day is only fetched once. A run caught up after the server was
+// down is handed the time it was due, so it imports for the votes that opened then.
+func ShowtimesJob(now time.Time) error {
+	groups, err := store.GetGroups()
 	if err != nil {
-		log.Println("fetchShowtimes:1:\n", err)
-		return
-	}
-
-	movies := make(map[string]struct {
-		Id     int
-		Poster string
-	})
-	for _, st := range showtimes {
-		str := movies[""]
-		str.Id = 0
-		str.Poster = st.FeaturePoster
-		movies[st.FeatureTitle] = str
+		return err
 	}
-
-	for k, v := range movies {
-		//First check to see if I already have a movie for this title
-		var m *Movie
-		m, err = GetMovieByTitle(k)
+	dates := make([]time.Time, 0)
+	theatres := make(map[time.Time][]*Theatre)
+	fetched := make(map[string]bool)
+	for _, g := range groups {
+		c := g.Calendar()
+		if !c.VotingOpensAt(now).After(c.In(now).AddDate(0, 0, -1)) {
+			continue
+		}
+		eventDate := c.EventDate(now)
+		gts, err := store.GetGroupTheatres(g.Id)
 		if err != nil {
-			//If I don't go search
-			m, err = InsertMovieByTitle(k, "2015-2017")
-			if err != nil {
-				log.Println("Couldn't find movie for title", k)
-				//If I error and don't find, create a dummy movie placehoder that can be swapped
-				m, err = InsertDummyMovie(k)
-				if err != nil {
-					log.Println("fetchShowtimes:2: Error Creating dummy movie!\n", err)
-					return
-				}
+			return err
+		}
+		for _, t := range gts {
+			k := eventDate.Format("2006-01-02") + t.Id
+			if fetched[k] {
+				continue
 			}
-			if m.Poster == "N/A" || m.Poster == "" {
-				m.Poster = v.Poster
-				InsertMovie(m)
+			fetched[k] = true
+			if _, ok := theatres[eventDate]; !ok {
+				dates = append(dates, eventDate)
 			}
+			theatres[eventDate] = append(theatres[eventDate], t)
 		}
-		moviek := movies[k]
-		moviek.Id = m.Id
-		movies[k] = moviek
 	}
-
-	for _, st := range showtimes {
-		screen := st.Auditorium.Name
-		if len(st.Amenities) > 0 {
-			screen = strings.Join([]string{screen, strings.Join(st.Amenities, ",")}, ",")
-		}
-		if len(st.Formats) > 0 {
-			screen = strings.Join([]string{screen, strings.Join(st.Formats, ",")}, ",")
-		}
-		pl := "/" + mp.GetShortNameFromId(location) + "/tickets/" + fmt.Sprintf("%d", st.Id)
-		if st.Showtime.Hour() >= 17 {
-			InsertShowtime(movies[st.FeatureTitle].Id, st.Showtime, screen, mp.GetLocationFromId(location), mp.GetAddressFromId(location), fmt.Sprintf("%d", st.Number), pl)
+	var ferr error
+	for _, d := range dates {
+		report, err := fetchShowtimes(theatres[d], d)
+		fmt.Println(report)
+		if err != nil {
+			ferr = err
 		}
 	}
+	return ferr
 }
 
-// The weekly email routine sends Summary out Sat @ 7am MST
-func WeeklyEmailRoutine(day, hour, minute int) {
-	for {
-		//Find next saturday and sleep till then
-		emailAt := now.BeginningOfWeek().Add(time.Hour * 24 * time.Duration(day)).Add(time.Hour * time.Duration(hour)).Add(time.Minute * time.Duration(minute))
-		if time.Now().After(emailAt) {
-			emailAt = emailAt.AddDate(0, 0, 7)
-		}
-		fmt.Println("Will send weekly email in", emailAt.Sub(time.Now()))
-		time.Sleep(emailAt.Sub(time.Now()))
-		n := time.Now()
-		bow, eow := GetBeginningAndEndOfWeekForTime(n)
-		users, err := GetUsersForPreference(WeeklyPreferenceType)
+// The weekly email job sends the summary of the vote so far to every group
+func WeeklyEmailJob(now time.Time) error {
+	groups, err := store.GetGroups()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		bow, eow := g.WeekOf(now)
+		users, err := store.GetUsersForPreference(g.Id, WeeklyPreferenceType)
 		if err != nil {
-			log.Println("WeeklyEmailRoutine:", err)
-			return
+			log.Println("WeeklyEmailJob:", err)
+			continue
 		}
 		for _, u := range users {
 			fmt.Println("Sending Weekly Email To", u.Email)
-			showtimes, err := GetShowtimesForWeekOf(bow, eow, u.Id)
+			showtimes, err := WeekStandings(g, bow, eow, u.Id)
 			if err != nil {
 				log.Println("Error sending weekly email to", u.Id, err)
 				continue
 			}
-			SendWeeklyEmail(u, showtimes, bow, eow)
+			SendWeeklyEmail(g, u, showtimes, bow, eow)
 		}
-		time.Sleep(time.Hour)
 	}
+	return nil
 }
 
-// The we're locked routine that sends out calandar invitation email
-func LockEmailRoutine(day, hour, minute int) {
-	for {
-		//Find next tue and sleep till then
-		n := time.Now()
-		emailAt := now.BeginningOfWeek().Add(time.Hour * 24 * time.Duration(day)).Add(time.Hour * time.Duration(hour)).Add(time.Minute * time.Duration(minute))
-		if n.After(emailAt) {
-			emailAt = emailAt.AddDate(0, 0, 7)
+// The lock job locks the vote of every group whose lock time has passed, which sends out the
+// calendar invitation email. Locking is idempotent, so running late or more than once is safe.
+// A run caught up after the server was down is handed the time it was due, so it locks the week
+// that was open then rather than the one open now.
+func LockJob(now time.Time) error {
+	groups, err := store.GetGroups()
+	if err != nil {
+		return err
+	}
+	var lockErr error
+	for _, g := range groups {
+		if g.Calendar().LockTime(now).After(now) {
+			continue
 		}
-		fmt.Println("Will send lock email in", emailAt.Sub(n))
-		time.Sleep(emailAt.Sub(n))
-		n = time.Now()
-		bow, eow := GetBeginningAndEndOfWeekForTime(n)
-		showtimes, _ := GetTopShowtimesForWeekOf(bow, eow, 1)
-		if len(showtimes) > 0 {
-			winner := showtimes[0]
-			//If the vote is manually closed earlier, it will give the winner 1000 votes to ensure that it remains the winner
-			//Also it will have already sent out the emails, so this routine should just forego it's purpose
-			if winner.Votes < 1000 {
-				err := LockVoteForWinner(bow, eow, winner)
-				if err != nil {
-					log.Println("LockEmailRoutine:1:", err)
-					return
-				}
-				users, err := GetUsersForPreference(LockPreferenceType)
-				if err != nil {
-					log.Println("LockEmailRoutine:2:", err)
-					return
-				}
-				for _, u := range users {
-					fmt.Println("Sending Lock Email To", u.Email)
-					SendLockEmail(u, winner, bow)
-				}
-			}
+		//Make sure the winner is still playing before the invites go out
+		err := RecheckGroup(g, now)
+		if err != nil {
+			log.Println("LockJob:", g.Id, err)
+		}
+		bow, eow := g.WeekOf(now)
+		_, err = LockGroup(g, bow, eow, 0, "")
+		if err != nil && err != ErrAlreadyLocked && err != ErrNoShowtimes {
+			log.Println("LockJob:", g.Id, err)
+			lockErr = err
 		}
-		time.Sleep(time.Hour)
 	}
+	return lockErr
+}
+
+// The cron spec the showtimes job runs on. Voting for every group opens at the same time of
+// day, on the day after its event day, so it runs daily at that time.
+func showtimesSpec(c Calendar) string {
+	at := c.VotingOpens % (24 * time.Hour)
+	return fmt.Sprintf("%d %d * * *", int(at/time.Minute)%60, int(at/time.Hour))
+}
+
+// The cron spec the lock job runs on. Groups lock on different days but at the same time of
+// day, so it runs daily at that time.
+func lockSpec(c Calendar) string {
+	at := c.LockAt % (24 * time.Hour)
+	return fmt.Sprintf("%d %d * * *", int(at/time.Minute)%60, int(at/time.Hour))
 }
 
 type Activity struct {
 	User  *User
+	Group *Group
 	Votes []*Showtime
 	Time  time.Time
 }
 
 var activityChannel = make(chan Activity)
 var userActivityMap = UserActivityMap{
-	uam:             make(map[int]*Activity),
+	uam:             make(map[[2]int]*Activity),
 	nextAvailableAt: time.Now()}
 
 type UserActivityMap struct {
 	sync.Mutex
-	uam             map[int]*Activity
+	uam             map[[2]int]*Activity
 	nextAvailableAt time.Time
 }
 
@@ -173,7 +144,7 @@ func (uam *UserActivityMap) NewActivity(activity Activity) {
 	uam.Lock()
 	defer uam.Unlock()
 	activity.Time = time.Now().Add(time.Second * 90)
-	uam.uam[activity.User.Id] = &activity
+	uam.uam[[2]int{activity.Group.Id, activity.User.Id}] = &activity
 	uam.nextAvailableAt = activity.Time
 }
 
@@ -208,20 +179,26 @@ func ActivityProcessingRoutine() {
 func DelayedActivityNotificationRoutine() {
 	for {
 		//Pull relevant activities off of the map
-		bow, eow := GetBeginningAndEndOfWeekForTime(time.Now())
-		showtimes, _ := GetTopShowtimesForWeekOf(bow, eow, 3)
 		var a *Activity
 		var t time.Time
 		for a, t = userActivityMap.GetNextAvailableActivity(); a != nil; a, t = userActivityMap.GetNextAvailableActivity() {
+			bow, eow := a.Group.WeekOf(time.Now())
+			showtimes, _ := WeekStandings(a.Group, bow, eow, 0)
+			if len(showtimes) > 3 {
+				showtimes = showtimes[:3]
+			}
+			if len(showtimes) == 0 {
+				continue
+			}
 			//Send a buzz message to the channel
 			buzz := fmt.Sprintf("%s voted for [movie night](https://www.murphysean.com/movie-night). %s@%s leads with %d votes.",
 				a.User.Name, showtimes[0].Movie.Title,
-				showtimes[0].Showtime.Local().Format(time.Kitchen), showtimes[0].Votes)
+				calendar.In(showtimes[0].Showtime).Format(time.Kitchen), showtimes[0].Votes)
 			go SendBuzzMessage("Movie-Night: New Votes!", buzz)
 			//Send Activity email to all
-			go SendActivityEmails(a.User, a.Votes, showtimes, bow, eow)
+			go SendActivityEmails(a.Group, a.User, a.Votes, showtimes, bow, eow)
 			ScrubUser(a.User)
-			go sseManager.SendActivity(a.User, a.Votes)
+			go sseManager.SendActivity(a.Group.Id, a.User, a.Votes)
 		}
 
 		//Sleep 30 seconds, or until the next activity is due
@@ -230,3 +207,25 @@ func DelayedActivityNotificationRoutine() {
 }
 
 // TODO The daily update routine (email and buzz bot)
+
+// The session sweep job purges expired login sessions
+func SessionSweepJob(now time.Time) error {
+	n, err := DeleteExpiredSessions(now)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Println("Purged", n, "expired sessions")
+	}
+	return nil
+}
+
+// The backup job takes a backup of the database, keeping the last few
+func BackupJob(now time.Time) error {
+	path, err := BackupAndRotate(db, *backupDir, *backupKeep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Backed up the database to", path)
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"./mp"
+	"html/template"
+	"testing"
+	"time"
+)
+
+// Swaps in a memory store and a calendar in America/Denver, with emails printed rather than
+// sent, for as long as the test runs. Returns a group that meets on sundays, which is the day
+// the clocks change, with a member that voted for a showtime on the given sundays.
+func setupRoutineTest(t *testing.T, sundays ...time.Time) *Group {
+	oldStore, oldCalendar, oldMnt, oldDebug := store, calendar, mnt, *debug
+	t.Cleanup(func() {
+		store, calendar, mnt, *debug = oldStore, oldCalendar, oldMnt, oldDebug
+	})
+	c := denverCalendar(t, time.Sunday)
+	ms := NewMemoryStore()
+	store, calendar, mnt, *debug = ms, c, template.Must(template.ParseGlob("templates/*")), true
+
+	g, err := store.InsertGroup("Sunday Night", time.Sunday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.RegisterUser("Voter", "voter@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetUserPassword(u.Id, "hash")
+	store.AddGroupMember(g.Id, u.Id)
+	m, err := store.InsertMovie(&Movie{Imdb: "tt0000001", Title: "The Movie", Runtime: "120 min"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range sundays {
+		st, err := store.InsertShowtime(&Showtime{MovieId: m.Id, TheatreId: "none", Showtime: d.Add(19 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bow, eow := g.WeekOf(d)
+		err = store.InsertVotesForUser(g.Id, bow, eow, u.Id, []*Showtime{{Id: st.Id, Vote: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g
+}
+
+// Runs the jobs of the scheduler as the clock moves forward to the given time
+func runUntil(s *Scheduler, fc *FakeClock, end time.Time) {
+	for {
+		next := s.RunDue()
+		if next.After(end) {
+			fc.Advance(end.Sub(fc.Now()))
+			return
+		}
+		fc.Advance(next.Sub(fc.Now()))
+	}
+}
+
+// Adds the job to the scheduler, keeping the times it is run with
+func recordJob(t *testing.T, s *Scheduler, name, spec string, run func(now time.Time) error) *[]time.Time {
+	runs := make([]time.Time, 0)
+	err := s.Add(name, spec, func(now time.Time) error {
+		runs = append(runs, now)
+		return run(now)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &runs
+}
+
+func isLocked(t *testing.T, g *Group, day time.Time) bool {
+	bow, _ := g.WeekOf(day)
+	w, err := GetWeek(g, bow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Locked != nil
+}
+
+func TestLockJobAcrossDST(t *testing.T) {
+	c := denverCalendar(t, time.Sunday)
+	tests := []struct {
+		name  string
+		start time.Time
+		event time.Time
+	}{
+		{"spring forward", at(c, 2024, 3, 9, 12, 0), at(c, 2024, 3, 10, 0, 0)},
+		{"fall back", at(c, 2024, 11, 2, 12, 0), at(c, 2024, 11, 3, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, event := tt.start, tt.event
+			g := setupRoutineTest(t, event)
+			fc := NewFakeClock(start)
+			s := NewScheduler(fc, store, calendar.Location)
+			runs := recordJob(t, s, "lock", lockSpec(calendar), LockJob)
+
+			lock := at(c, event.Year(), event.Month(), event.Day(), 16, 30)
+			runUntil(s, fc, lock.Add(-time.Minute))
+			if isLocked(t, g, event) {
+				t.Fatalf("the week was locked before %v", lock)
+			}
+			runUntil(s, fc, lock.Add(time.Minute))
+			if !isLocked(t, g, event) {
+				t.Fatalf("the week wasn't locked at %v", lock)
+			}
+			want := []time.Time{at(c, start.Year(), start.Month(), start.Day(), 16, 30), lock}
+			if len(*runs) != len(want) {
+				t.Fatalf("the lock job ran at %v, want %v", *runs, want)
+			}
+			for i, r := range *runs {
+				if !r.Equal(want[i]) {
+					t.Errorf("run %d was at %v, want %v", i, r, want[i])
+				}
+			}
+			bow, _ := g.WeekOf(event)
+			inv, err := store.GetInvite(g.Id, bow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !inv.Showtime.Equal(event.Add(19 * time.Hour)) {
+				t.Errorf("the invite is for %v, want %v", inv.Showtime, event.Add(19*time.Hour))
+			}
+		})
+	}
+}
+
+// A lock missed while the server was down is caught up for the week that was open then, even
+// once the next week has opened
+func TestLockJobCatchUp(t *testing.T) {
+	c := denverCalendar(t, time.Sunday)
+	event := at(c, 2024, 3, 10, 0, 0)
+	g := setupRoutineTest(t, event)
+	missed := at(c, 2024, 3, 10, 16, 30)
+	err := store.SaveJobState(&JobState{Name: "lock", Spec: lockSpec(calendar), NextRun: missed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFakeClock(at(c, 2024, 3, 11, 9, 0))
+	s := NewScheduler(fc, store, calendar.Location)
+	runs := recordJob(t, s, "lock", lockSpec(calendar), LockJob)
+	s.RunDue()
+	if len(*runs) != 1 || !(*runs)[0].Equal(missed) {
+		t.Fatalf("the lock job ran at %v, want %v", *runs, missed)
+	}
+	if !isLocked(t, g, event) {
+		t.Error("the missed week wasn't locked")
+	}
+	if isLocked(t, g, fc.Now()) {
+		t.Error("the open week was locked")
+	}
+}
+
+func TestWeeklyEmailJobAcrossDST(t *testing.T) {
+	c := denverCalendar(t, time.Sunday)
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		want  []time.Time
+	}{
+		{"spring forward", at(c, 2024, 3, 1, 12, 0), at(c, 2024, 3, 18, 12, 0),
+			[]time.Time{at(c, 2024, 3, 3, 1, 30), at(c, 2024, 3, 10, 1, 30), at(c, 2024, 3, 17, 1, 30)}},
+		//1:30 comes around twice the night the clocks fall back, the email only goes out once
+		{"fall back", at(c, 2024, 10, 25, 12, 0), at(c, 2024, 11, 11, 12, 0),
+			[]time.Time{at(c, 2024, 10, 27, 1, 30), at(c, 2024, 11, 3, 1, 30), at(c, 2024, 11, 10, 1, 30)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := setupRoutineTest(t, tt.want...)
+			fc := NewFakeClock(tt.start)
+			s := NewScheduler(fc, store, calendar.Location)
+			runs := recordJob(t, s, "weekly-email", "30 1 * * 0", WeeklyEmailJob)
+			runUntil(s, fc, tt.end)
+			if len(*runs) != len(tt.want) {
+				t.Fatalf("the weekly email went out at %v, want %v", *runs, tt.want)
+			}
+			for i, r := range *runs {
+				if !r.Equal(tt.want[i]) {
+					t.Errorf("run %d was at %v, want %v", i, r, tt.want[i])
+				}
+				//The email goes out the morning of the event, so it covers that week
+				bow, _ := g.WeekOf(r)
+				if want := at(c, r.Year(), r.Month(), r.Day(), 0, 0); !bow.Equal(want) {
+					t.Errorf("run %d covered the week of %v, want %v", i, bow, want)
+				}
+			}
+			for _, js := range s.Jobs() {
+				if js.LastError != "" {
+					t.Errorf("%s failed: %s", js.Name, js.LastError)
+				}
+			}
+		})
+	}
+}
+
+// The countingProvider keeps the theatres and days showtimes were fetched for
+type countingProvider struct {
+	mp.TheatreProvider
+	fetches []string
+}
+
+func (cp *countingProvider) GetPerformancesForDay(theatreId string, date time.Time) ([]mp.Performance, error) {
+	cp.fetches = append(cp.fetches, date.Format("2006-01-02")+" "+theatreId)
+	return cp.TheatreProvider.GetPerformancesForDay(theatreId, date)
+}
+
+// Each group has its showtimes imported when its vote opens, on the day after its event day
+func TestShowtimesJobFollowsEventDays(t *testing.T) {
+	c := denverCalendar(t, time.Tuesday)
+	setupRoutineTest(t)
+	oldTheatres, oldMovies := theatreProvider, movieProvider
+	t.Cleanup(func() { theatreProvider, movieProvider = oldTheatres, oldMovies })
+	cp := &countingProvider{TheatreProvider: mp.NewFixtureProvider("mp/testdata/megaplex")}
+	theatreProvider, movieProvider = cp, NewStubMetadataProvider()
+	if _, err := SyncTheatres(theatreProvider); err != nil {
+		t.Fatal(err)
+	}
+	monday, err := store.InsertGroup("Monday Night", time.Monday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuesday, err := store.InsertGroup("Tuesday Night", time.Tuesday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetGroupTheatre(monday.Id, mp.LocationThanksgivingPoint, true)
+	store.SetGroupTheatre(tuesday.Id, mp.LocationThanksgivingPoint, true)
+	store.SetGroupTheatre(tuesday.Id, mp.LocationJordanCommons, true)
+
+	fc := NewFakeClock(at(c, 2026, 10, 10, 12, 0))
+	s := NewScheduler(fc, store, calendar.Location)
+	runs := recordJob(t, s, "showtimes", showtimesSpec(calendar), ShowtimesJob)
+	runUntil(s, fc, at(c, 2026, 10, 17, 12, 0))
+	if len(*runs) != 7 {
+		t.Fatalf("the showtimes job ran %d times in a week, want daily", len(*runs))
+	}
+	want := []string{
+		//The vote for the monday the 19th opens on tuesday the 13th
+		"2026-10-19 " + mp.LocationThanksgivingPoint,
+		//and for the tuesday the 20th on wednesday the 14th, theatres by name
+		"2026-10-20 " + mp.LocationJordanCommons,
+		"2026-10-20 " + mp.LocationThanksgivingPoint,
+	}
+	if len(cp.fetches) != len(want) {
+		t.Fatalf("fetched %v, want %v", cp.fetches, want)
+	}
+	for i, f := range cp.fetches {
+		if f != want[i] {
+			t.Errorf("fetch %d was %s, want %s", i, f, want[i])
+		}
+	}
+	sts, err := store.GetShowtimesForTheatre(megaplexProvider, mp.LocationThanksgivingPoint, at(c, 2026, 10, 19, 0, 0), at(c, 2026, 10, 21, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 4 {
+		t.Errorf("imported %d evening showtimes at Thanksgiving Point, want 4", len(sts))
+	}
+}
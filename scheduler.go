@@ -0,0 +1,485 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Clock tells the scheduler what time it is and lets it wait. The scheduler runs on the
+// realClock, a FakeClock lets jobs be driven deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// A FakeClock only moves when it is told to. Channels handed out by After fire once the clock
+// has been advanced past their deadline.
+type FakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.now.Add(d), c: c})
+	return c
+}
+
+// Moves the clock forward, firing any waiters that are now due
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.now = fc.now.Add(d)
+	waiting := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- fc.now
+	}
+	fc.waiters = waiting
+}
+
+// A CronSchedule is a parsed cron expression with the usual five fields:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Fields take *, numbers, ranges (1-5), lists (1,3,5) and steps (*/15, 8-18/2). Sunday is 0
+// (or 7). When both day fields are restricted a day matching either one runs, as in cron. The
+// shortcuts @hourly, @daily and @weekly are also understood. Times are worked out in the given
+// zone, a time skipped by a daylight saving change doesn't run that day.
+type CronSchedule struct {
+	Spec   string
+	loc    *time.Location
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAny bool
+	dowAny bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly": "0 * * * *",
+	"@daily":  "0 0 * * *",
+	"@weekly": "0 0 * * 0",
+}
+
+func ParseCron(spec string, loc *time.Location) (*CronSchedule, error) {
+	expanded := spec
+	if s, ok := cronShortcuts[spec]; ok {
+		expanded = s
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression '%s' must have 5 fields", spec)
+	}
+	cs := &CronSchedule{Spec: spec, loc: loc}
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cs.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	//Sunday can be written as 7
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.domAny = fields[2] == "*"
+	cs.dowAny = fields[4] == "*"
+	return cs, nil
+}
+
+// Returns a bit set with a bit for every value the field allows
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in cron field '%s'", field)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("Invalid cron field '%s'", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("Invalid cron field '%s'", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Cron field '%s' must be within %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (cs *CronSchedule) matchDay(day time.Time) bool {
+	if cs.month&(1<<uint(day.Month())) == 0 {
+		return false
+	}
+	dom := cs.dom&(1<<uint(day.Day())) != 0
+	dow := cs.dow&(1<<uint(day.Weekday())) != 0
+	if cs.domAny || cs.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Returns the first time after t the schedule runs, or the zero time if it never does
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	start := t.In(cs.loc).Truncate(time.Minute).Add(time.Minute)
+	y, m, d := start.Date()
+	//Five years covers every schedule that can run at all, like the 29th of february
+	for i := 0; i < 5*366; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, cs.loc)
+		if !cs.matchDay(day) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if cs.hour&(1<<uint(h)) == 0 {
+				continue
+			}
+			for min := 0; min < 60; min++ {
+				if cs.minute&(1<<uint(min)) == 0 {
+					continue
+				}
+				next := time.Date(day.Year(), day.Month(), day.Day(), h, min, 0, 0, cs.loc)
+				if next.Before(start) || next.Hour() != h {
+					continue
+				}
+				return next
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// The JobState is what the scheduler remembers about a job between restarts
+type JobState struct {
+	Name      string    `json:"name"`
+	Spec      string    `json:"spec"`
+	LastRun   time.Time `json:"lastRun"`
+	NextRun   time.Time `json:"nextRun"`
+	LastError string    `json:"lastError"`
+	Failures  int       `json:"failures"`
+	Running   bool      `json:"running"`
+}
+
+// Returns the state with its times in the given zone
+func (js JobState) In(loc *time.Location) JobState {
+	if !js.LastRun.IsZero() {
+		js.LastRun = js.LastRun.In(loc)
+	}
+	js.NextRun = js.NextRun.In(loc)
+	return js
+}
+
+// A Job is run with the time it was due, which is in the past for a run that is caught up or
+// retried, or the time it was triggered
+type Job struct {
+	Run      func(now time.Time) error
+	schedule *CronSchedule
+	state    JobState
+}
+
+var ErrJobRunning = errors.New("Job is already running")
+
+// Failed runs are retried after a minute, then two, four and so on, up to this many times.
+// After that the job waits for its next scheduled run.
+const jobMaxRetries = 5
+
+func jobBackoff(failures int) time.Duration {
+	d := time.Minute << uint(failures-1)
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// The Scheduler runs jobs on cron schedules. When a job is added its state is loaded from the
+// store, so a run that was missed while the server was down is caught up once on startup
+// rather than once for every missed run. The caught up run is handed the time it was missed at.
+type Scheduler struct {
+	sync.Mutex
+	Clock    Clock
+	Store    Store
+	Location *time.Location
+	jobs     map[string]*Job
+	wake     chan struct{}
+}
+
+func NewScheduler(clock Clock, st Store, loc *time.Location) *Scheduler {
+	return &Scheduler{Clock: clock, Store: st, Location: loc, jobs: make(map[string]*Job), wake: make(chan struct{}, 1)}
+}
+
+// The scheduler variable is the global scheduler the routines are registered with
+var scheduler *Scheduler
+
+func (s *Scheduler) Add(name, spec string, run func(now time.Time) error) error {
+	cs, err := ParseCron(spec, s.Location)
+	if err != nil {
+		return err
+	}
+	now := s.Clock.Now()
+	j := &Job{Run: run, schedule: cs}
+	js, err := s.Store.GetJobState(name)
+	switch {
+	case err == sql.ErrNoRows:
+		j.state = JobState{Name: name, Spec: spec, NextRun: cs.Next(now)}
+	case err != nil:
+		return err
+	case js.Spec != spec:
+		//A changed schedule starts over from now
+		j.state = *js
+		j.state.Spec = spec
+		j.state.NextRun = cs.Next(now)
+		j.state.Failures = 0
+	default:
+		j.state = *js
+	}
+	j.state.Running = false
+	err = s.Store.SaveJobState(&j.state)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.jobs[name] = j
+	s.Unlock()
+	s.poke()
+	fmt.Println("Scheduled", name, "("+spec+") next at", j.state.NextRun.In(s.Location))
+	return nil
+}
+
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the state of every job, ordered by name
+func (s *Scheduler) Jobs() []JobState {
+	s.Lock()
+	defer s.Unlock()
+	ret := make([]JobState, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		ret = append(ret, j.state)
+	}
+	sort.Slice(ret, func(i, k int) bool { return ret[i].Name < ret[k].Name })
+	return ret
+}
+
+// Runs every job that is due, and returns when the next job is due
+func (s *Scheduler) RunDue() time.Time {
+	now := s.Clock.Now()
+	s.Lock()
+	due := make([]string, 0)
+	at := make(map[string]time.Time)
+	for name, j := range s.jobs {
+		if !j.state.Running && !j.state.NextRun.After(now) {
+			due = append(due, name)
+			at[name] = j.state.NextRun
+		}
+	}
+	s.Unlock()
+	sort.Strings(due)
+	for _, name := range due {
+		s.run(name, at[name])
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	next := s.Clock.Now().Add(time.Hour)
+	for _, j := range s.jobs {
+		if !j.state.Running && j.state.NextRun.Before(next) {
+			next = j.state.NextRun
+		}
+	}
+	return next
+}
+
+// Runs a job right away, whether or not it is due
+func (s *Scheduler) Trigger(name string) (JobState, error) {
+	s.Lock()
+	_, ok := s.jobs[name]
+	s.Unlock()
+	if !ok {
+		return JobState{}, sql.ErrNoRows
+	}
+	return s.run(name, s.Clock.Now())
+}
+
+func (s *Scheduler) run(name string, at time.Time) (JobState, error) {
+	s.Lock()
+	j := s.jobs[name]
+	if j.state.Running {
+		s.Unlock()
+		return j.state, ErrJobRunning
+	}
+	j.state.Running = true
+	s.Unlock()
+
+	start := s.Clock.Now()
+	err := runJob(j, at)
+	now := s.Clock.Now()
+
+	s.Lock()
+	j.state.Running = false
+	j.state.LastRun = start
+	if err == nil {
+		j.state.LastError = ""
+		j.state.Failures = 0
+		j.state.NextRun = j.schedule.Next(now)
+	} else {
+		log.Println("Scheduler:", name, err)
+		j.state.LastError = err.Error()
+		j.state.Failures++
+		j.state.NextRun = j.schedule.Next(now)
+		if j.state.Failures <= jobMaxRetries {
+			if retry := now.Add(jobBackoff(j.state.Failures)); retry.Before(j.state.NextRun) {
+				j.state.NextRun = retry
+			}
+		} else {
+			j.state.Failures = 0
+		}
+	}
+	state := j.state
+	s.Unlock()
+
+	serr := s.Store.SaveJobState(&state)
+	if serr != nil {
+		log.Println("Scheduler:", name, serr)
+	}
+	s.poke()
+	return state, err
+}
+
+// Runs the job, turning a panic into an error so that one bad run can't take the scheduler down
+func runJob(j *Job, now time.Time) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.Run(now)
+}
+
+// Runs jobs as they come due until the process exits
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			next := s.RunDue()
+			select {
+			case <-s.Clock.After(next.Sub(s.Clock.Now())):
+			case <-s.wake:
+			}
+		}
+	}()
+}
+
+// This api handler lists the scheduled jobs, and runs one on demand.
+//
+//	GET /api/admin/jobs              Every job with its last and next run
+//	POST /api/admin/jobs/{name}/run  Runs the job now, responding with its state afterwards
+func APIAdminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	loc := LoggedInUser(r.Context()).Location()
+	re := regexp.MustCompile(`^/api/admin/jobs/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	switch {
+	case r.Method == http.MethodGet && pm[1] == "":
+		jobs := scheduler.Jobs()
+		for i := range jobs {
+			jobs[i] = jobs[i].In(loc)
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&jobs)
+	case r.Method == http.MethodPost && pm[1] != "" && pm[2] == "run":
+		js, err := scheduler.Trigger(pm[1])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if err == ErrJobRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		//A failed run still responds with the state, which holds the error
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		js = js.In(loc)
+		e := json.NewEncoder(w)
+		e.Encode(&js)
+	case pm[1] == "" || pm[2] == "run":
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
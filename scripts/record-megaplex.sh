@@ -0,0 +1,23 @@
+#!/bin/sh
+
+#Records the megaplex api responses used by the FixtureProvider and fixture server. Pass the
+#theatre id, and optionally a performance number to record its tickets, layout and preview.
+#	./scripts/record-megaplex.sh 683b08d3-6f8a-4501-a00f-a24601228dd6 10452
+API=${API:-https://www.megaplextheatres.com}
+DIR=${DIR:-mp/testdata/megaplex}
+THEATRE=${1:-683b08d3-6f8a-4501-a00f-a24601228dd6}
+PERFORMANCE=$2
+
+record() {
+	mkdir -p `dirname "$DIR$1.json"`
+	echo "Recording $1"
+	curl -sf "$API$1" | python3 -m json.tool --indent 1 > "$DIR$1.json" || echo "Failed to record $1"
+}
+
+record /api/theatres/all
+record /api/theatres/schedule/$THEATRE
+if [ -n "$PERFORMANCE" ]; then
+	record /api/theatres/tickets/$PERFORMANCE
+	record /api/features/performances/seats/layout/$PERFORMANCE/$THEATRE
+	record /api/features/performances/seats/preview/$PERFORMANCE/$THEATRE
+fi
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The number of genres the stats of a user list
+const favoriteGenres = 5
+
+type GenreCount struct {
+	Genre  string `json:"genre"`
+	Movies int    `json:"movies"`
+}
+
+// The Attendance of a user is how they rsvped to the locked weeks they voted in. Weeks counts
+// those weeks, and a week they didn't rsvp to is a NoResponse whether or not they were emailed.
+type Attendance struct {
+	Weeks      int `json:"weeks"`
+	Accepted   int `json:"accepted"`
+	Declined   int `json:"declined"`
+	Tentative  int `json:"tentative"`
+	NoResponse int `json:"noResponse"`
+}
+
+// An Agreement is how alike the ballots of two members were over the weeks they both voted in,
+// from 0 for never voting for the same showtimes to 1 for always voting for the same ones
+type Agreement struct {
+	UserId    int     `json:"userId"`
+	Name      string  `json:"name"`
+	Weeks     int     `json:"weeks"`
+	Agreement float64 `json:"agreement"`
+}
+
+// The UserStats sum up how a user voted in the locked weeks of a group
+type UserStats struct {
+	UserId      int           `json:"userId"`
+	GroupId     int           `json:"groupId"`
+	Weeks       int           `json:"weeks"`
+	WeeksVoted  int           `json:"weeksVoted"`
+	TopPickWins int           `json:"topPickWins"`
+	WinRate     float64       `json:"winRate"`
+	Genres      []*GenreCount `json:"genres"`
+	Attendance  Attendance    `json:"attendance"`
+	Agreements  []*Agreement  `json:"agreements"`
+}
+
+// Whether the ballot voted for or vetoed anything
+func votedOn(b *Ballot) bool {
+	for _, v := range b.Votes {
+		if v > 0 {
+			return true
+		}
+	}
+	return len(b.Vetoes) > 0
+}
+
+// Returns the share of the showtimes either ballot voted for that both voted for, or false if
+// neither voted for any
+func ballotOverlap(a, b *Ballot) (float64, bool) {
+	both, either := 0, 0
+	for id, v := range a.Votes {
+		if v > 0 {
+			either++
+			if b.Votes[id] > 0 {
+				both++
+			}
+		}
+	}
+	for id, v := range b.Votes {
+		if v > 0 && a.Votes[id] <= 0 {
+			either++
+		}
+	}
+	if either == 0 {
+		return 0, false
+	}
+	return float64(both) / float64(either), true
+}
+
+func roundShare(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// Sums up how the user voted in the locked weeks of the group. A user voted in a week when they
+// voted for or vetoed a showtime, and their top pick won when the week locked on a showtime the
+// voting method of the week says their ballot put first. Agreements with the other members are
+// only worked out when agreements is set.
+func GetUserStats(g *Group, userId int, agreements bool) (*UserStats, error) {
+	weeks, _, err := store.GetLockedWeeks(g.Id, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	stats := &UserStats{UserId: userId, GroupId: g.Id, Weeks: len(weeks), Genres: make([]*GenreCount, 0), Agreements: make([]*Agreement, 0)}
+	genres := make(map[string]int)
+	type agreement struct {
+		weeks int
+		sum   float64
+	}
+	agreed := make(map[int]*agreement)
+	for _, w := range weeks {
+		bow, eow := g.Calendar().WeekAt(g.Calendar().In(w.WeekOf))
+		method, err := GetVotingMethod(w.Method)
+		if err != nil {
+			return nil, err
+		}
+		ballots, err := store.GetBallots(g.Id, bow, eow)
+		if err != nil {
+			return nil, err
+		}
+		var mine *Ballot
+		for _, b := range ballots {
+			if b.UserId == userId && votedOn(b) {
+				mine = b
+			}
+		}
+		if mine == nil {
+			continue
+		}
+		stats.WeeksVoted++
+		for _, id := range method.TopChoices(mine.Votes) {
+			if id == w.ShowtimeId {
+				stats.TopPickWins++
+			}
+		}
+
+		//Each movie counts once a week, however many of its showtimes got votes. Showtimes that
+		//were since cancelled, hidden or removed are left out.
+		sts, err := store.GetShowtimesForWeekOf(g.Id, bow, eow, 0)
+		if err != nil {
+			return nil, err
+		}
+		showtimes := make(map[int]*Showtime, len(sts))
+		for _, st := range sts {
+			showtimes[st.Id] = st
+		}
+		movies := make(map[int]bool)
+		for id, v := range mine.Votes {
+			st, ok := showtimes[id]
+			if v <= 0 || !ok {
+				continue
+			}
+			if movies[st.MovieId] {
+				continue
+			}
+			movies[st.MovieId] = true
+			for _, genre := range strings.Split(st.Movie.Genre, ",") {
+				genre = strings.TrimSpace(genre)
+				if genre != "" && genre != "N/A" {
+					genres[genre]++
+				}
+			}
+		}
+
+		rsvps, err := store.GetRsvps(g.Id, w.ShowtimeId)
+		if err != nil {
+			return nil, err
+		}
+		value := ""
+		for _, r := range rsvps {
+			if r.UserId == userId {
+				value = r.Value
+			}
+		}
+		stats.Attendance.Weeks++
+		//Email responses come back as ACCEPTED, DECLINED and TENTATIVE
+		switch {
+		case strings.HasPrefix(value, "ACCEPT"):
+			stats.Attendance.Accepted++
+		case strings.HasPrefix(value, "DECLINE"):
+			stats.Attendance.Declined++
+		case strings.HasPrefix(value, "TEN"):
+			stats.Attendance.Tentative++
+		default:
+			stats.Attendance.NoResponse++
+		}
+
+		if !agreements {
+			continue
+		}
+		for _, b := range ballots {
+			if b.UserId == userId || !votedOn(b) {
+				continue
+			}
+			share, ok := ballotOverlap(mine, b)
+			if !ok {
+				continue
+			}
+			a, ok := agreed[b.UserId]
+			if !ok {
+				a = new(agreement)
+				agreed[b.UserId] = a
+			}
+			a.weeks++
+			a.sum += share
+		}
+	}
+	if stats.WeeksVoted > 0 {
+		stats.WinRate = roundShare(float64(stats.TopPickWins) / float64(stats.WeeksVoted))
+	}
+	for genre, n := range genres {
+		stats.Genres = append(stats.Genres, &GenreCount{Genre: genre, Movies: n})
+	}
+	sort.Slice(stats.Genres, func(i, j int) bool {
+		if stats.Genres[i].Movies != stats.Genres[j].Movies {
+			return stats.Genres[i].Movies > stats.Genres[j].Movies
+		}
+		return stats.Genres[i].Genre < stats.Genres[j].Genre
+	})
+	if len(stats.Genres) > favoriteGenres {
+		stats.Genres = stats.Genres[:favoriteGenres]
+	}
+	for id, a := range agreed {
+		u, err := store.GetUser(id)
+		if err != nil {
+			return nil, err
+		}
+		stats.Agreements = append(stats.Agreements, &Agreement{UserId: id, Name: u.Name, Weeks: a.weeks, Agreement: roundShare(a.sum / float64(a.weeks))})
+	}
+	sort.Slice(stats.Agreements, func(i, j int) bool {
+		if stats.Agreements[i].Agreement != stats.Agreements[j].Agreement {
+			return stats.Agreements[i].Agreement > stats.Agreements[j].Agreement
+		}
+		return stats.Agreements[i].UserId < stats.Agreements[j].UserId
+	})
+	return stats, nil
+}
+
+// This api handler sums up how the user voted in the group given by the 'group' query param, or
+// the logged in users first group. When movie night runs with -anonymousBallots only the user
+// and group admins see their stats, and the agreements with other members are left out.
+//
+//	GET /api/users/{id|me}/stats
+func APIUserStatsHandler(w http.ResponseWriter, r *http.Request, userId int) {
+	u := LoggedInUser(r.Context())
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if *anonymousBallots && userId != u.Id && !contains(u.Abilities, AbilityAdminGroups) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	target, err := store.GetUser(userId)
+	if err == sql.ErrNoRows || (err == nil && !IsGroupMember(g.Id, target)) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	var stats *UserStats
+	if err == nil {
+		stats, err = GetUserStats(g, userId, !*anonymousBallots)
+	}
+	if err != nil {
+		log.Println("APIUserStatsHandler:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&stats)
+}
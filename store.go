@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A Store persists the core movie night data: users, groups, movies, showtimes, votes and
+// rsvps. The SQLiteStore is used when running the application, and the MemoryStore lets
+// handlers be exercised without touching disk.
+type Store interface {
+	GetUser(id int) (*User, error)
+	GetUserForEmail(email string) (*User, error)
+	GetUserForOtt(ott string) (*User, error)
+	// Returns a registered user along with their encoded password hash
+	GetUserPassword(email string) (*User, string, error)
+	GetUserAbilities(userId int) ([]string, error)
+	// Returns the registered members of the group that have opted into the notification
+	GetUsersForPreference(groupId int, n PreferenceType) ([]*User, error)
+	RegisterUser(name, email, ott string) (*User, error)
+	SetUserOtt(email, ott string) error
+	SetUserPassword(userId int, hash string) error
+	// Sets the password of the user holding the one time token, and clears the token
+	CompleteRegistration(ott, hash string) (*User, error)
+	UpdateUserPrefs(user *User) error
+
+	GetMovie(id int) (*Movie, error)
+	// Returns the movie with the megaplex title, ignoring case, or the movie the title was merged into
+	GetMovieByTitle(title string) (*Movie, error)
+	// Inserts or replaces the movie, the id is derived from the imdb id unless it is a placeholder
+	InsertMovie(movie *Movie) (*Movie, error)
+	// Makes GetMovieByTitle return the movie for another megaplex title, like its 3D showing
+	InsertMovieAlias(title string, movieId int) error
+	// Returns a page of the movies matching the query along with how many match in all. Text
+	// matches are ranked best first, otherwise movies are ordered by title.
+	SearchMovies(q MovieQuery) ([]*Movie, int, error)
+	// Returns every showtime of the movie, cancelled or not, without the movie
+	GetShowtimesForMovie(movieId int) ([]*Showtime, error)
+	// Returns the votes the groups members gave each showtime of the movie, by showtime id
+	GetMovieVotes(groupId, movieId int) (map[int]int, error)
+	// Returns the cached movie metadata response for the key, or sql.ErrNoRows if there is none
+	GetMetadataCache(key string) (*MetadataCacheEntry, error)
+	SaveMetadataCache(e *MetadataCacheEntry) error
+
+	// Queues the match for review. A match already queued for the title has its movie and
+	// candidates replaced while it is still pending.
+	InsertMovieMatch(mm *MovieMatch) (*MovieMatch, error)
+	GetMovieMatch(id int) (*MovieMatch, error)
+	// Returns the match queued for the megaplex title, ignoring case, or sql.ErrNoRows
+	GetMovieMatchForTitle(title string) (*MovieMatch, error)
+	// Returns the matches with the status, oldest first
+	GetMovieMatches(status string) ([]*MovieMatch, error)
+	ResolveMovieMatch(id int, status string, movieId, userId int) error
+
+	// Returns what merging the movies would move, the movie to merge into needn't exist yet
+	PreviewMovieMerge(fromId, toId int) (*MovieMerge, error)
+	// Moves the showtimes and aliases of one movie to another, removes it and aliases its
+	// megaplex title to the other movie, all in one transaction. The merge is logged.
+	MergeMovies(fromId, toId, userId int) (*MovieMerge, error)
+	// Puts the removed movie back along with its showtimes and aliases
+	UndoMovieMerge(id, userId int) (*MovieMerge, error)
+	GetMovieMerge(id int) (*MovieMerge, error)
+	// Returns the merge log, newest first
+	GetMovieMerges() ([]*MovieMerge, error)
+
+	// Returns the showtime with the votes the group gave it, or the votes of every group when
+	// groupId is 0
+	GetShowtime(groupId, id int) (*Showtime, error)
+	// Returns the showtimes between bow and eow with the groups total votes and vetoes and the
+	// users vote and veto, leaving out showtimes an admin hid from the group. Only showtimes at
+	// the theatres the group has enabled are returned, unless the group hasn't enabled any.
+	GetShowtimesForWeekOf(groupId int, bow, eow time.Time, userId int) ([]*Showtime, error)
+	InsertShowtime(st *Showtime) (*Showtime, error)
+	// Updates the movie, time, screen, buy link, cancelled flag and change of the showtime
+	UpdateShowtime(st *Showtime) error
+	// Returns the showtime imported for the performance, or sql.ErrNoRows if there isn't one
+	GetShowtimeForPerformance(provider, theatreId, performance string) (*Showtime, error)
+	// Returns every showtime of the theatre from the provider in [from, to), cancelled or not
+	GetShowtimesForTheatre(provider, theatreId string, from, to time.Time) ([]*Showtime, error)
+
+	// Replaces the users votes and vetoes in the group for the week with the given ones, and
+	// adds them to the ballot history. Returns ErrWeekLocked if the week is locked.
+	InsertVotesForUser(groupId int, bow, eow time.Time, userId int, votes []*Showtime) error
+	// Returns every version of the ballots sent in for the groups week, oldest first
+	GetBallotHistory(groupId int, bow time.Time) ([]*BallotVersion, error)
+	// Hides the showtime from the group, or returns ErrAlreadyHidden if it is hidden
+	HideShowtime(h *ShowtimeHide) (*ShowtimeHide, error)
+	// Puts a hidden showtime back, or returns ErrHideRestored if it was already put back
+	RestoreShowtime(id, userId int) (*ShowtimeHide, error)
+	GetShowtimeHide(id int) (*ShowtimeHide, error)
+	// Returns the groups hidden showtimes, newest first, along with the restored ones if all
+	// is set
+	GetShowtimeHides(groupId int, all bool) ([]*ShowtimeHide, error)
+
+	InsertRsvp(groupId int, userId int, showtimeId int, value string) error
+	GetRsvps(groupId, showtimeId int) ([]*Rsvp, error)
+	// Moves the groups votes and rsvps from one showtime to another. Users that voted for both
+	// keep the larger of their votes, and their veto if neither got a vote. A week locked on the
+	// showtime is locked on the other.
+	MigrateVotes(groupId, fromShowtimeId, toShowtimeId int) error
+	// Returns the votes and vetoes of each user of the group on the showtimes between bow and
+	// eow, leaving out the votes of the system
+	GetBallots(groupId int, bow, eow time.Time) ([]*Ballot, error)
+	// Returns the cancelled showtimes between bow and eow that still hold votes of the group
+	GetCancelledShowtimesForWeekOf(groupId int, bow, eow time.Time) ([]*Showtime, error)
+
+	// Returns the invite sent for the groups week, or sql.ErrNoRows if the week wasn't locked
+	GetInvite(groupId int, bow time.Time) (*Invite, error)
+	SaveInvite(inv *Invite) error
+	// Returns the groups week, or sql.ErrNoRows if nothing was set for it
+	GetWeek(groupId int, bow time.Time) (*Week, error)
+	SaveWeek(w *Week) error
+	// Saves the week unless the group already has it, so it keeps the voting method and tie
+	// break it opened with
+	OpenWeek(w *Week) error
+	// Returns a page of the groups locked weeks, newest first, along with how many there are in
+	// all. A limit of -1 returns every one.
+	GetLockedWeeks(groupId, limit, offset int) ([]*Week, int, error)
+	// Locks the week on its showtime, or returns ErrAlreadyLocked if it is locked, and logs it
+	LockWeek(w *Week, reason string) error
+	// Unlocks the week, or returns ErrNotLocked if it isn't locked, and logs it
+	UnlockWeek(groupId int, bow time.Time, userId int, reason string) error
+	// Records that the lock email of the week went out, returning false if it already had
+	MarkLockEmail(groupId int, bow, at time.Time) (bool, error)
+	// Returns the log of the weeks locks and unlocks, oldest first
+	GetWeekLocks(groupId int, bow time.Time) ([]*WeekLock, error)
+
+	GetGroup(id int) (*Group, error)
+	GetGroups() ([]*Group, error)
+	GetGroupsForUser(userId int) ([]*Group, error)
+	InsertGroup(name string, eventDay time.Weekday) (*Group, error)
+	GetGroupMembers(groupId int) ([]*User, error)
+	AddGroupMember(groupId, userId int) error
+	RemoveGroupMember(groupId, userId int) error
+
+	// Returns the state the scheduler saved for the job, or sql.ErrNoRows if it has none
+	GetJobState(name string) (*JobState, error)
+	SaveJobState(js *JobState) error
+
+	GetTheatre(id string) (*Theatre, error)
+	GetTheatres() ([]*Theatre, error)
+	// Inserts the theatre, or updates it if a theatre with the same id already exists
+	UpsertTheatre(t *Theatre) error
+	// Returns the theatres the group has enabled
+	GetGroupTheatres(groupId int) ([]*Theatre, error)
+	SetGroupTheatre(groupId int, theatreId string, enabled bool) error
+}
+
+// The store variable is the global store the handlers and routines work against
+var store Store
+
+var _ Store = (*SQLiteStore)(nil)
+var _ Store = (*MemoryStore)(nil)
+
+var ErrInvalidPassword = errors.New("Invalid email or password")
+
+// Validates the users password. Users whose password was hashed with an older algorithm, or
+// with weaker parameters, will have their password silently rehashed.
+func ValidateUser(email, password string) (*User, error) {
+	u, encoded, err := store.GetUserPassword(email)
+	if err != nil {
+		return nil, ErrInvalidPassword
+	}
+	ok, rehash, err := VerifyPassword(password, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidPassword
+	}
+	if rehash {
+		if hash, err := HashPassword(password); err == nil {
+			err = store.SetUserPassword(u.Id, hash)
+			if err != nil {
+				log.Println("ValidateUser:rehash:", err)
+			}
+		}
+	}
+	return u, nil
+}
+
+func ResetPassword(email, ott string) (*User, error) {
+	err := store.SetUserOtt(email, ott)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetUserForEmail(email)
+}
+
+func FinishRegistration(ott, password string) (*User, error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return store.CompleteRegistration(ott, hash)
+}
+
+func ScrubUser(user *User) *User {
+	user.GiftCard = ""
+	user.GiftCardPin = ""
+	user.RewardCard = ""
+	user.Zip = ""
+	user.Phone = ""
+	user.Carrier = ""
+	return user
+}
+
+func InsertMovieByIMDBId(imdbId string, title string) (*Movie, error) {
+	var id int
+	_, err := fmt.Sscanf(imdbId, "tt%d", &id)
+	if err != nil {
+		return nil, err
+	}
+	movie, err := movieProvider.MovieByIMDBId(imdbId)
+	if err != nil {
+		return nil, err
+	}
+	if title == "" {
+		title = movie.Title
+	}
+	movie.MegaPlexTitle = title
+	return store.InsertMovie(movie)
+}
+
+// Returns the id the movie is stored under, which is the number of its imdb id. Placeholder
+// movies don't have an imdb id and keep their own.
+func movieIdFor(movie *Movie) (int, error) {
+	if movie.Id >= placeholderMovieIdBase {
+		return movie.Id, nil
+	}
+	var id int
+	_, err := fmt.Sscanf(movie.Imdb, "tt%d", &id)
+	return id, err
+}
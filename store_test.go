@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns a SQLiteStore on a fresh database file, migrated and seeded like the one the server
+// runs on
+func newSQLiteTestStore(t *testing.T) Store {
+	d, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "mn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDb := db
+	db = d
+	t.Cleanup(func() {
+		db = oldDb
+		d.Close()
+	})
+	InitDB(d)
+	s, err := NewSQLiteStore(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Runs the test against both stores, which have to behave the same
+func runStoreTests(t *testing.T, test func(t *testing.T, s Store)) {
+	stores := []struct {
+		name string
+		new  func(t *testing.T) Store
+	}{
+		{"sqlite", newSQLiteTestStore},
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			test(t, st.new(t))
+		})
+	}
+}
+
+// The week the store tests vote in
+var testWeek = time.Date(2024, 3, 10, 6, 0, 0, 0, time.UTC)
+
+// A group with two members voting on three showtimes of a movie in the week of bow
+type storeFixture struct {
+	g         *Group
+	users     []*User
+	movie     *Movie
+	showtimes []*Showtime
+	bow, eow  time.Time
+}
+
+func newStoreFixture(t *testing.T, s Store, bow time.Time) *storeFixture {
+	f := &storeFixture{bow: bow, eow: bow.Add(7*24*time.Hour - time.Nanosecond)}
+	var err error
+	f.g, err = s.InsertGroup("Tuesday Night", time.Tuesday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		u, err := s.RegisterUser(email[:1], email, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetUserPassword(u.Id, "hash")
+		err = s.AddGroupMember(f.g.Id, u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.users = append(f.users, u)
+	}
+	f.movie = insertTestMovie(t, s, "tt0000001", "The Movie")
+	for i := 0; i < 3; i++ {
+		st, err := s.InsertShowtime(&Showtime{MovieId: f.movie.Id, TheatreId: "0000", Showtime: f.bow.Add(time.Duration(48+i) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.showtimes = append(f.showtimes, st)
+	}
+	return f
+}
+
+func insertTestMovie(t *testing.T, s Store, imdb, title string) *Movie {
+	m, err := s.InsertMovie(&Movie{Imdb: imdb, Title: title, MegaPlexTitle: title})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Returns the ballot of the user, or nil if they have none
+func ballotOf(ballots []*Ballot, userId int) *Ballot {
+	for _, b := range ballots {
+		if b.UserId == userId {
+			return b
+		}
+	}
+	return nil
+}
+
+func showtimeIn(showtimes []*Showtime, id int) *Showtime {
+	for _, st := range showtimes {
+		if st.Id == id {
+			return st
+		}
+	}
+	return nil
+}
+
+func TestStoreWeekLocks(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		if _, err := s.GetWeek(f.g.Id, f.bow); err != sql.ErrNoRows {
+			t.Fatalf("GetWeek of an unsaved week = %v, want sql.ErrNoRows", err)
+		}
+		err := s.OpenWeek(&Week{GroupId: f.g.Id, WeekOf: f.bow, Method: "irv", TieBreak: "earliest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.OpenWeek(&Week{GroupId: f.g.Id, WeekOf: f.bow, Method: "points", TieBreak: "coin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := s.GetWeek(f.g.Id, f.bow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Method != "irv" || w.TieBreak != "earliest" {
+			t.Errorf("the week opened with irv and earliest, it has %s and %s", w.Method, w.TieBreak)
+		}
+
+		now := time.Now().UTC()
+		w.Locked, w.LockedBy, w.ShowtimeId = &now, f.users[0].Id, f.showtimes[1].Id
+		if err = s.LockWeek(w, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.LockWeek(w, ""); err != ErrAlreadyLocked {
+			t.Errorf("locking a locked week = %v, want ErrAlreadyLocked", err)
+		}
+		err = s.InsertVotesForUser(f.g.Id, f.bow, f.eow, f.users[1].Id, []*Showtime{{Id: f.showtimes[0].Id, Vote: 1}})
+		if err != ErrWeekLocked {
+			t.Errorf("voting on a locked week = %v, want ErrWeekLocked", err)
+		}
+		weeks, total, err := s.GetLockedWeeks(f.g.Id, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(weeks) != 1 || weeks[0].ShowtimeId != f.showtimes[1].Id || weeks[0].LockedBy != f.users[0].Id {
+			t.Errorf("the locked weeks are %+v of %d, want the week locked on %d", weeks, total, f.showtimes[1].Id)
+		}
+
+		if err = s.UnlockWeek(f.g.Id, f.bow, f.users[0].Id, "Recount"); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.UnlockWeek(f.g.Id, f.bow, f.users[0].Id, "Recount"); err != ErrNotLocked {
+			t.Errorf("unlocking an open week = %v, want ErrNotLocked", err)
+		}
+		w, err = s.GetWeek(f.g.Id, f.bow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Locked != nil || w.ShowtimeId != 0 || w.Method != "irv" {
+			t.Errorf("the unlocked week is %+v", w)
+		}
+		if _, total, _ = s.GetLockedWeeks(f.g.Id, -1, 0); total != 0 {
+			t.Errorf("%d weeks are locked after the unlock, want 0", total)
+		}
+		locks, err := s.GetWeekLocks(f.g.Id, f.bow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locks) != 2 || locks[0].Action != WeekLockActionLock || locks[1].Action != WeekLockActionUnlock {
+			t.Fatalf("the lock log is %+v, want a lock and an unlock", locks)
+		}
+		if locks[1].Reason != "Recount" || locks[1].ShowtimeId != f.showtimes[1].Id || locks[1].UserId != f.users[0].Id {
+			t.Errorf("the unlock was logged as %+v", locks[1])
+		}
+	})
+}
+
+func TestStoreVotesAndVetoes(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		a, b := f.users[0].Id, f.users[1].Id
+		st0, st1, st2 := f.showtimes[0].Id, f.showtimes[1].Id, f.showtimes[2].Id
+		err := s.InsertVotesForUser(f.g.Id, f.bow, f.eow, a, []*Showtime{{Id: st0, Vote: 3}, {Id: st1, Veto: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.InsertVotesForUser(f.g.Id, f.bow, f.eow, b, []*Showtime{{Id: st0, Vote: 1}, {Id: st2, Vote: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sts, err := s.GetShowtimesForWeekOf(f.g.Id, f.bow, f.eow, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sts) != 3 {
+			t.Fatalf("got %d showtimes for the week, want 3", len(sts))
+		}
+		if st := showtimeIn(sts, st0); st.Votes != 4 || st.Vote != 3 || st.Veto {
+			t.Errorf("showtime %d has %d votes, a vote of %d and veto %v, want 4, 3 and false", st0, st.Votes, st.Vote, st.Veto)
+		}
+		if st := showtimeIn(sts, st1); st.Vetoes != 1 || !st.Veto || st.Vote != 0 {
+			t.Errorf("showtime %d has %d vetoes, a veto %v and a vote of %d, want 1, true and 0", st1, st.Vetoes, st.Veto, st.Vote)
+		}
+
+		ballots, err := s.GetBallots(f.g.Id, f.bow, f.eow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ballots) != 2 {
+			t.Fatalf("got %d ballots, want 2", len(ballots))
+		}
+		ba := ballotOf(ballots, a)
+		if ba == nil || ba.Votes[st0] != 3 || !ba.Vetoes[st1] || ba.Vetoes[st0] {
+			t.Errorf("the ballot of %d is %+v", a, ba)
+		}
+		if bb := ballotOf(ballots, b); bb == nil || bb.Votes[st0] != 1 || bb.Votes[st2] != 2 || len(bb.Vetoes) != 0 {
+			t.Errorf("the ballot of %d is %+v", b, bb)
+		}
+
+		//The votes belong to the group they were sent to
+		other, err := s.InsertGroup("Other", time.Tuesday)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := s.GetShowtime(other.Id, st0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Votes != 0 {
+			t.Errorf("showtime %d has %d votes in another group, want 0", st0, st.Votes)
+		}
+		if st, err = s.GetShowtime(0, st0); err != nil || st.Votes != 4 {
+			t.Errorf("showtime %d has %d votes in every group, want 4 (%v)", st0, st.Votes, err)
+		}
+
+		//A new ballot replaces the old one
+		err = s.InsertVotesForUser(f.g.Id, f.bow, f.eow, a, []*Showtime{{Id: st2, Vote: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ballots, err = s.GetBallots(f.g.Id, f.bow, f.eow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ba = ballotOf(ballots, a); ba == nil || ba.Votes[st0] != 0 || ba.Votes[st2] != 1 || len(ba.Vetoes) != 0 {
+			t.Errorf("the replaced ballot of %d is %+v", a, ba)
+		}
+	})
+}
+
+func TestStoreBallotHistory(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		a := f.users[0].Id
+		st0, st1 := f.showtimes[0].Id, f.showtimes[1].Id
+		ballots := [][]*Showtime{
+			{{Id: st0, Vote: 2}, {Id: st1, Veto: true}},
+			{{Id: st0, Vote: 0}, {Id: st1, Vote: 3}},
+		}
+		for _, votes := range ballots {
+			err := s.InsertVotesForUser(f.g.Id, f.bow, f.eow, a, votes)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		history, err := s.GetBallotHistory(f.g.Id, f.bow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("got %d ballot versions, want 2", len(history))
+		}
+		want := []struct {
+			votes  map[int]int
+			vetoes []int
+		}{
+			{map[int]int{st0: 2}, []int{st1}},
+			{map[int]int{st1: 3}, []int{}},
+		}
+		for i, bv := range history {
+			if bv.UserId != a || bv.GroupId != f.g.Id || bv.WeekOf.Unix() != f.bow.Unix() {
+				t.Errorf("version %d is of user %d in group %d for %v", i, bv.UserId, bv.GroupId, bv.WeekOf)
+			}
+			if !reflect.DeepEqual(bv.Votes, want[i].votes) || !reflect.DeepEqual(bv.Vetoes, want[i].vetoes) {
+				t.Errorf("version %d has votes %v and vetoes %v, want %v and %v", i, bv.Votes, bv.Vetoes, want[i].votes, want[i].vetoes)
+			}
+		}
+		if other, _ := s.GetBallotHistory(f.g.Id, f.bow.Add(7*24*time.Hour)); len(other) != 0 {
+			t.Errorf("the next week has %d ballot versions, want 0", len(other))
+		}
+	})
+}
+
+func TestStoreHides(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		st0 := f.showtimes[0].Id
+		h, err := s.HideShowtime(&ShowtimeHide{GroupId: f.g.Id, ShowtimeId: st0, Reason: "Sold out", UserId: f.users[0].Id, Created: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.HideShowtime(&ShowtimeHide{GroupId: f.g.Id, ShowtimeId: st0, Reason: "Again", UserId: f.users[0].Id, Created: time.Now().UTC()})
+		if err != ErrAlreadyHidden {
+			t.Errorf("hiding a hidden showtime = %v, want ErrAlreadyHidden", err)
+		}
+		sts, err := s.GetShowtimesForWeekOf(f.g.Id, f.bow, f.eow, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sts) != 2 || showtimeIn(sts, st0) != nil {
+			t.Errorf("the hidden showtime %d is still on the ballot", st0)
+		}
+		//Hides only apply to the group
+		other, err := s.InsertGroup("Other", time.Tuesday)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sts, _ = s.GetShowtimesForWeekOf(other.Id, f.bow, f.eow, 0); len(sts) != 3 {
+			t.Errorf("another group has %d showtimes, want 3", len(sts))
+		}
+		if hides, _ := s.GetShowtimeHides(f.g.Id, false); len(hides) != 1 || hides[0].Id != h.Id || hides[0].Reason != "Sold out" {
+			t.Errorf("the hides are %+v, want hide %d", hides, h.Id)
+		}
+
+		r, err := s.RestoreShowtime(h.Id, f.users[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Restored == nil || r.RestoredBy != f.users[1].Id {
+			t.Errorf("the restored hide is %+v", r)
+		}
+		if _, err = s.RestoreShowtime(h.Id, f.users[1].Id); err != ErrHideRestored {
+			t.Errorf("restoring a restored showtime = %v, want ErrHideRestored", err)
+		}
+		if sts, _ = s.GetShowtimesForWeekOf(f.g.Id, f.bow, f.eow, 0); len(sts) != 3 {
+			t.Errorf("got %d showtimes after the restore, want 3", len(sts))
+		}
+		if hides, _ := s.GetShowtimeHides(f.g.Id, false); len(hides) != 0 {
+			t.Errorf("%d showtimes are hidden after the restore, want 0", len(hides))
+		}
+		if hides, _ := s.GetShowtimeHides(f.g.Id, true); len(hides) != 1 || hides[0].Restored == nil {
+			t.Errorf("all hides are %+v, want the restored hide", hides)
+		}
+		//Once restored the showtime can be hidden again
+		if _, err = s.HideShowtime(&ShowtimeHide{GroupId: f.g.Id, ShowtimeId: st0, Reason: "Sold out again", UserId: f.users[0].Id, Created: time.Now().UTC()}); err != nil {
+			t.Errorf("hiding a restored showtime = %v", err)
+		}
+	})
+}
+
+func TestStoreMovieMerges(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		to := insertTestMovie(t, s, "tt0000002", "The Movie (Open Caption)")
+		err := s.InsertVotesForUser(f.g.Id, f.bow, f.eow, f.users[0].Id, []*Showtime{{Id: f.showtimes[0].Id, Vote: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mm, err := s.InsertMovieMatch(&MovieMatch{Title: "The Movie 3D", MovieId: f.movie.Id, Status: MatchPending, Created: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = s.MergeMovies(f.movie.Id, f.movie.Id, 1); err != ErrMergeSameMovie {
+			t.Errorf("merging a movie into itself = %v, want ErrMergeSameMovie", err)
+		}
+		merge, err := s.MergeMovies(f.movie.Id, to.Id, f.users[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(merge.ShowtimeIds) != 3 || merge.Votes != 1 || merge.Alias != "The Movie" || !reflect.DeepEqual(merge.MatchIds, []int{mm.Id}) {
+			t.Errorf("the merge is %+v", merge)
+		}
+		if _, err = s.GetMovie(f.movie.Id); err != sql.ErrNoRows {
+			t.Errorf("getting the merged movie = %v, want sql.ErrNoRows", err)
+		}
+		if m, err := s.GetMovieByTitle("the movie"); err != nil || m.Id != to.Id {
+			t.Errorf("the title of the merged movie resolves to %+v (%v), want movie %d", m, err, to.Id)
+		}
+		if st, _ := s.GetShowtime(f.g.Id, f.showtimes[0].Id); st.MovieId != to.Id || st.Votes != 2 {
+			t.Errorf("the moved showtime is of movie %d with %d votes, want %d and 2", st.MovieId, st.Votes, to.Id)
+		}
+		if m, _ := s.GetMovieMatch(mm.Id); m.MovieId != to.Id {
+			t.Errorf("the match resolves to %d, want %d", m.MovieId, to.Id)
+		}
+		if merges, _ := s.GetMovieMerges(); len(merges) != 1 || merges[0].Id != merge.Id || merges[0].From.Title != "The Movie" {
+			t.Errorf("the merge log is %+v", merges)
+		}
+
+		undone, err := s.UndoMovieMerge(merge.Id, f.users[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if undone.Undone == nil || undone.UndoneBy != f.users[1].Id {
+			t.Errorf("the undone merge is %+v", undone)
+		}
+		if _, err = s.UndoMovieMerge(merge.Id, f.users[1].Id); err != ErrMergeUndone {
+			t.Errorf("undoing an undone merge = %v, want ErrMergeUndone", err)
+		}
+		if m, err := s.GetMovie(f.movie.Id); err != nil || m.Id != f.movie.Id || m.Title != "The Movie" {
+			t.Errorf("the restored movie is %+v (%v)", m, err)
+		}
+		if m, err := s.GetMovieByTitle("the movie"); err != nil || m.Id != f.movie.Id {
+			t.Errorf("the title resolves to %+v (%v) after the undo, want movie %d", m, err, f.movie.Id)
+		}
+		if st, _ := s.GetShowtime(f.g.Id, f.showtimes[0].Id); st.MovieId != f.movie.Id || st.Votes != 2 {
+			t.Errorf("the restored showtime is of movie %d with %d votes, want %d and 2", st.MovieId, st.Votes, f.movie.Id)
+		}
+		if m, _ := s.GetMovieMatch(mm.Id); m.MovieId != f.movie.Id {
+			t.Errorf("the match resolves to %d after the undo, want %d", m.MovieId, f.movie.Id)
+		}
+
+		//A merge can't be undone once the movie it went into was merged again
+		first, err := s.MergeMovies(f.movie.Id, to.Id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		third := insertTestMovie(t, s, "tt0000003", "Another Movie")
+		second, err := s.MergeMovies(to.Id, third.Id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UndoMovieMerge(first.Id, 1); err != ErrMergeConflict {
+			t.Errorf("undoing a merge merged again since = %v, want ErrMergeConflict", err)
+		}
+		if _, err = s.UndoMovieMerge(second.Id, 1); err != nil {
+			t.Fatal(err)
+		}
+		//Nor once the removed movie was imported again
+		insertTestMovie(t, s, "tt0000001", "The Movie Reimported")
+		if _, err = s.UndoMovieMerge(first.Id, 1); err != ErrMergeReimported {
+			t.Errorf("undoing a merge over a reimported movie = %v, want ErrMergeReimported", err)
+		}
+		if m, _ := s.GetMovie(f.movie.Id); m == nil || m.Title != "The Movie Reimported" {
+			t.Errorf("the reimported movie is %+v", m)
+		}
+	})
+}
+
+func TestStoreMigrateVotes(t *testing.T) {
+	runStoreTests(t, func(t *testing.T, s Store) {
+		f := newStoreFixture(t, s, testWeek)
+		a, b := f.users[0].Id, f.users[1].Id
+		from, to := f.showtimes[0].Id, f.showtimes[1].Id
+		err := s.InsertVotesForUser(f.g.Id, f.bow, f.eow, a, []*Showtime{{Id: from, Vote: 3}, {Id: to, Vote: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.InsertVotesForUser(f.g.Id, f.bow, f.eow, b, []*Showtime{{Id: from, Veto: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.InsertRsvp(f.g.Id, a, from, "ACCEPTED"); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().UTC()
+		err = s.LockWeek(&Week{GroupId: f.g.Id, WeekOf: f.bow, Method: "points", TieBreak: "earliest", Locked: &now, ShowtimeId: from}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = s.MigrateVotes(f.g.Id, from, to); err != nil {
+			t.Fatal(err)
+		}
+		ballots, err := s.GetBallots(f.g.Id, f.bow, f.eow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ba := ballotOf(ballots, a); ba == nil || ba.Votes[to] != 3 || ba.Votes[from] != 0 {
+			t.Errorf("the ballot of %d is %+v, want the larger vote of 3 on %d", a, ba, to)
+		}
+		if bb := ballotOf(ballots, b); bb == nil || !bb.Vetoes[to] || bb.Vetoes[from] {
+			t.Errorf("the ballot of %d is %+v, want the veto moved to %d", b, bb, to)
+		}
+		if rsvps, _ := s.GetRsvps(f.g.Id, to); len(rsvps) != 1 || rsvps[0].UserId != a {
+			t.Errorf("the rsvps of %d are %+v, want the rsvp of %d", to, rsvps, a)
+		}
+		if w, _ := s.GetWeek(f.g.Id, f.bow); w == nil || w.ShowtimeId != to {
+			t.Errorf("the week is %+v, want it locked on %d", w, to)
+		}
+	})
+}
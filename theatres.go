@@ -0,0 +1,181 @@
+package main
+
+import (
+	"./mp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A Theatre is a cinema showtimes are imported from. The catalogue is synced from the theatre
+// provider, and each group enables the theatres it wants to vote on.
+type Theatre struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	ShortName string `json:"shortName"`
+	Address   string `json:"address"`
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+	Phone     string `json:"phone"`
+	TimeZone  string `json:"timeZone"`
+
+	// Whether the group the theatres were listed for has the theatre enabled
+	Enabled bool `json:"enabled"`
+}
+
+// Returns the time zone the theatre is in
+func (t *Theatre) Location() *time.Location {
+	if loc, err := time.LoadLocation(t.TimeZone); err == nil {
+		return loc
+	}
+	return calendar.Location
+}
+
+func theatreFromProvider(mt mp.Theatre) *Theatre {
+	parts := make([]string, 0)
+	for _, v := range []string{mt.Street, mt.City, strings.TrimSpace(mt.State + " " + mt.Zip)} {
+		if v = strings.TrimSpace(v); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return &Theatre{
+		Id:        mt.Id,
+		Name:      mt.Name,
+		ShortName: mt.ShortName(),
+		Address:   strings.Join(parts, ", "),
+		Latitude:  mt.Latitude,
+		Longitude: mt.Longitude,
+		Phone:     mt.Phone,
+		TimeZone:  mt.TimeZone(),
+	}
+}
+
+// Brings the theatre catalogue up to date with the provider. Theatres the provider no longer
+// lists are kept, as showtimes may still reference them.
+func SyncTheatres(p mp.TheatreProvider) (int, error) {
+	ts, err := p.GetTheatres()
+	if err != nil {
+		return 0, err
+	}
+	for _, mt := range ts {
+		if mt.Id == "" {
+			continue
+		}
+		err = store.UpsertTheatre(theatreFromProvider(mt))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ts), nil
+}
+
+// The theatres job keeps the theatre catalogue in sync with the provider
+func TheatresJob(now time.Time) error {
+	n, err := SyncTheatres(theatreProvider)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Synced", n, "theatres")
+	return nil
+}
+
+// Returns every theatre, marking the ones the group has enabled
+func theatresForGroup(groupId int) ([]*Theatre, error) {
+	theatres, err := store.GetTheatres()
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := store.GetGroupTheatres(groupId)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range theatres {
+		for _, e := range enabled {
+			if e.Id == t.Id {
+				t.Enabled = true
+			}
+		}
+	}
+	return theatres, nil
+}
+
+// This api handler manages the theatre catalogue and the theatres a group votes on. Like the
+// showtimes, it acts on the group named by the 'group' query param.
+//
+//	GET /api/theatres           Every theatre, with whether the group has it enabled
+//	POST /api/theatres/sync     Syncs the catalogue from the theatre provider
+//	PUT /api/theatres/{id}      Enables or disables the theatre for the group {"enabled":true}
+//
+// Syncing and enabling theatres requires the admin.theatres ability.
+func APITheatresHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	re := regexp.MustCompile(`^/api/theatres/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	if pm == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && (u == nil || !contains(u.Abilities, AbilityAdminTheatres)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && pm[1] == "":
+	case r.Method == http.MethodPost && pm[1] == "sync":
+		_, err = SyncTheatres(theatreProvider)
+		if err != nil {
+			log.Println("APITheatresHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	case r.Method == http.MethodPut && pm[1] != "" && pm[1] != "sync":
+		var body = struct {
+			Enabled bool `json:"enabled"`
+		}{}
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := store.GetTheatre(pm[1])
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		err = store.SetGroupTheatre(g.Id, t.Id, body.Enabled)
+		if err != nil {
+			log.Println("APITheatresHandler:2:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.Enabled = body.Enabled
+		e := json.NewEncoder(w)
+		e.Encode(&t)
+		return
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	theatres, err := theatresForGroup(g.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	err = e.Encode(&theatres)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
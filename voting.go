@@ -0,0 +1,611 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// A Ballot holds the votes of one user for the showtimes of a week, by showtime id. What a vote
+// means is up to the voting method of the week. Vetoes are the showtimes the user doesn't want
+// to see at all, whatever the method.
+type Ballot struct {
+	UserId int
+	Votes  map[int]int
+	Vetoes map[int]bool
+}
+
+// A BallotVersion is a ballot as the user sent it in. Every version of a ballot is kept, so a
+// week can be looked back on as it was voted.
+type BallotVersion struct {
+	Id      int         `json:"id"`
+	GroupId int         `json:"groupId"`
+	UserId  int         `json:"userId"`
+	WeekOf  time.Time   `json:"weekOf"`
+	Votes   map[int]int `json:"votes"`
+	Vetoes  []int       `json:"vetoes"`
+	Created time.Time   `json:"created"`
+}
+
+// A VotingMethod decides how users vote and how the votes pick the winner of a week.
+type VotingMethod interface {
+	Name() string
+	// Checks the votes a user sends in, which only hold the showtimes the user voted on
+	Validate(votes []*Showtime) error
+	// Returns the showtimes ordered from the winner down, with their votes set to the score
+	// the method gave them. Showtimes that can't be told apart go by the tie break, and the
+	// showtimes it had to decide between on the way to the winner are returned too.
+	Tally(showtimes []*Showtime, ballots []*Ballot, tie TieBreak) ([]*Showtime, []int)
+	// Returns the showtimes a ballot puts first, more than one when the ballot puts them level
+	TopChoices(votes map[int]int) []int
+}
+
+var votingMethods = map[string]VotingMethod{
+	"points":   PointsMethod{},
+	"approval": ApprovalMethod{},
+	"irv":      InstantRunoffMethod{},
+	"schulze":  SchulzeMethod{},
+}
+
+var ErrUnknownVotingMethod = errors.New("Unknown voting method, use points, approval, irv or schulze")
+
+var ErrVetoBudget = errors.New("Too many vetoes this week")
+
+// Checks the vetoes a user sends in against the veto budget. A showtime can't be both voted for
+// and vetoed.
+func ValidateVetoes(votes []*Showtime) error {
+	n := 0
+	for _, v := range votes {
+		if !v.Veto {
+			continue
+		}
+		if v.Vote > 0 {
+			return errors.New("A vetoed showtime can't also get votes")
+		}
+		n++
+	}
+	if n > *vetoBudget {
+		return ErrVetoBudget
+	}
+	return nil
+}
+
+func GetVotingMethod(name string) (VotingMethod, error) {
+	m, ok := votingMethods[name]
+	if !ok {
+		return nil, ErrUnknownVotingMethod
+	}
+	return m, nil
+}
+
+// A TieBreak orders two showtimes the voting method scored the same, returning whether a goes
+// first
+type TieBreak func(a, b *Showtime) bool
+
+// The tie break policies, each picking the tie break for a tally
+var tieBreaks = map[string]func(t *WeekTally) TieBreak{
+	"earliest": func(t *WeekTally) TieBreak { return earliestShowtime },
+	"vetoes":   fewestVetoes,
+	"coin":     coinFlip,
+	"admin":    adminDecides,
+}
+
+var ErrUnknownTieBreak = errors.New("Unknown tie break, use earliest, vetoes, coin or admin")
+
+func GetTieBreak(name string) (func(t *WeekTally) TieBreak, error) {
+	tb, ok := tieBreaks[name]
+	if !ok {
+		return nil, ErrUnknownTieBreak
+	}
+	return tb, nil
+}
+
+// The earlier showing goes first, and then the one imported first
+func earliestShowtime(a, b *Showtime) bool {
+	if !a.Showtime.Equal(b.Showtime) {
+		return a.Showtime.Before(b.Showtime)
+	}
+	return a.Id < b.Id
+}
+
+// The showtime fewer users vetoed goes first, and then the earlier showing
+func fewestVetoes(t *WeekTally) TieBreak {
+	return func(a, b *Showtime) bool {
+		if t.Vetoes[a.Id] != t.Vetoes[b.Id] {
+			return t.Vetoes[a.Id] < t.Vetoes[b.Id]
+		}
+		return earliestShowtime(a, b)
+	}
+}
+
+// Flips a coin seeded from the week, so the same tie always lands the same way however often
+// the week is tallied
+func coinFlip(t *WeekTally) TieBreak {
+	flip := func(st *Showtime) uint64 {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d-%d-%d", t.Week.GroupId, t.Week.WeekOf.Unix(), st.Id)
+		return h.Sum64()
+	}
+	return func(a, b *Showtime) bool {
+		fa, fb := flip(a), flip(b)
+		if fa != fb {
+			return fa < fb
+		}
+		return a.Id < b.Id
+	}
+}
+
+// The showtime the admin picked goes first. Until they pick one the earlier showing does.
+func adminDecides(t *WeekTally) TieBreak {
+	return func(a, b *Showtime) bool {
+		if a.Id == t.Week.TieWinner || b.Id == t.Week.TieWinner {
+			return a.Id == t.Week.TieWinner
+		}
+		return earliestShowtime(a, b)
+	}
+}
+
+// Orders the showtimes by their score, highest first, and sets their votes to it
+func rankByScore(showtimes []*Showtime, score map[int]int, tie TieBreak) []*Showtime {
+	ranked := make([]*Showtime, len(showtimes))
+	copy(ranked, showtimes)
+	for _, st := range ranked {
+		st.Votes = score[st.Id]
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Votes != ranked[j].Votes {
+			return ranked[i].Votes > ranked[j].Votes
+		}
+		return tie(ranked[i], ranked[j])
+	})
+	return ranked
+}
+
+// Returns the showtimes that tied the winner, when more than one did
+func topTied(ranked []*Showtime) []int {
+	tied := make([]int, 0)
+	for _, st := range ranked {
+		if st.Votes != ranked[0].Votes {
+			break
+		}
+		tied = append(tied, st.Id)
+	}
+	if len(tied) == 1 {
+		return tied[:0]
+	}
+	return tied
+}
+
+// Returns the showtimes given the highest vote, when any vote is above 0
+func highestVotes(votes map[int]int) []int {
+	best := 0
+	for _, v := range votes {
+		if v > best {
+			best = v
+		}
+	}
+	top := make([]int, 0)
+	for id, v := range votes {
+		if best > 0 && v == best {
+			top = append(top, id)
+		}
+	}
+	sort.Ints(top)
+	return top
+}
+
+// The points method is the original movie night vote. Each showtime gets from 0 to 3 points,
+// with at most 6 points handed out, and the most points wins. A veto takes a point away, like
+// the -1 vote it replaced.
+type PointsMethod struct{}
+
+func (PointsMethod) Name() string { return "points" }
+
+func (PointsMethod) Validate(votes []*Showtime) error {
+	sum := 0
+	for _, v := range votes {
+		if v.Vote > 3 {
+			return errors.New("No vote can be greater than 3")
+		}
+		if v.Vote < 0 {
+			return errors.New("No vote can be less than 0, veto the showtime instead")
+		}
+		sum += v.Vote
+	}
+	if sum > 6 {
+		return errors.New("Sum of all votes can't exceed 6")
+	}
+	return nil
+}
+
+func (PointsMethod) Tally(showtimes []*Showtime, ballots []*Ballot, tie TieBreak) ([]*Showtime, []int) {
+	score := make(map[int]int)
+	for _, b := range ballots {
+		for id, v := range b.Votes {
+			score[id] += v
+		}
+		for id := range b.Vetoes {
+			score[id]--
+		}
+	}
+	ranked := rankByScore(showtimes, score, tie)
+	return ranked, topTied(ranked)
+}
+
+func (PointsMethod) TopChoices(votes map[int]int) []int {
+	return highestVotes(votes)
+}
+
+// With the approval method users approve of as many showtimes as they like with a vote of 1,
+// and the showtime most users approve of wins.
+type ApprovalMethod struct{}
+
+func (ApprovalMethod) Name() string { return "approval" }
+
+func (ApprovalMethod) Validate(votes []*Showtime) error {
+	for _, v := range votes {
+		if v.Vote != 0 && v.Vote != 1 {
+			return errors.New("Approval votes are 1 to approve of a showtime or 0")
+		}
+	}
+	return nil
+}
+
+func (ApprovalMethod) Tally(showtimes []*Showtime, ballots []*Ballot, tie TieBreak) ([]*Showtime, []int) {
+	score := make(map[int]int)
+	for _, b := range ballots {
+		for id, v := range b.Votes {
+			if v > 0 {
+				score[id]++
+			}
+		}
+	}
+	ranked := rankByScore(showtimes, score, tie)
+	return ranked, topTied(ranked)
+}
+
+// Every showtime the user approves of is their top choice
+func (ApprovalMethod) TopChoices(votes map[int]int) []int {
+	return highestVotes(votes)
+}
+
+// Ranked ballots give each showtime the user cares about a rank, 1 being their first choice.
+// Showtimes left at 0 are unranked.
+func validateRanks(votes []*Showtime) error {
+	seen := make(map[int]bool)
+	for _, v := range votes {
+		if v.Vote < 0 {
+			return errors.New("Ranks start at 1 for the first choice, 0 leaves a showtime unranked")
+		}
+		if v.Vote > 0 && seen[v.Vote] {
+			return fmt.Errorf("Only one showtime can be ranked %d", v.Vote)
+		}
+		seen[v.Vote] = true
+	}
+	return nil
+}
+
+// Returns the showtime ids the ballot ranks, first choice first, leaving out showtimes that
+// aren't on the ballot this week
+func rankedChoices(b *Ballot, candidates map[int]bool) []int {
+	choices := make([]int, 0, len(b.Votes))
+	for id, rank := range b.Votes {
+		if rank > 0 && candidates[id] {
+			choices = append(choices, id)
+		}
+	}
+	sort.Slice(choices, func(i, j int) bool { return b.Votes[choices[i]] < b.Votes[choices[j]] })
+	return choices
+}
+
+// Returns the showtime ranked first, ranks needn't start at 1
+func firstRanked(votes map[int]int) []int {
+	first := 0
+	for id, rank := range votes {
+		if rank > 0 && (first == 0 || rank < votes[first]) {
+			first = id
+		}
+	}
+	if first == 0 {
+		return []int{}
+	}
+	return []int{first}
+}
+
+// The instant runoff method counts each ballot for its highest ranked showtime that is still
+// running. Until a showtime has a majority of those, the showtime with the fewest is dropped
+// and its ballots move on to their next choice. The winner is followed by the showtimes still
+// running by their count, and then the dropped showtimes, the last dropped first. A tie for
+// the fewest goes by the tie break, unless they have none, as dropping showtimes no ballot
+// counts for moves no ballots whatever the order.
+type InstantRunoffMethod struct{}
+
+func (InstantRunoffMethod) Name() string { return "irv" }
+
+func (InstantRunoffMethod) Validate(votes []*Showtime) error {
+	return validateRanks(votes)
+}
+
+func (InstantRunoffMethod) TopChoices(votes map[int]int) []int {
+	return firstRanked(votes)
+}
+
+func (InstantRunoffMethod) Tally(showtimes []*Showtime, ballots []*Ballot, tie TieBreak) ([]*Showtime, []int) {
+	running := make(map[int]bool)
+	for _, st := range showtimes {
+		running[st.Id] = true
+	}
+	choices := make([][]int, 0, len(ballots))
+	for _, b := range ballots {
+		choices = append(choices, rankedChoices(b, running))
+	}
+	remaining := make([]*Showtime, len(showtimes))
+	copy(remaining, showtimes)
+	dropped := make([]*Showtime, 0)
+	score := make(map[int]int)
+	tied := make([]int, 0)
+	seen := make(map[int]bool)
+	//Adds the showtimes still running with the count to the ones the tie break decided between
+	tiedAt := func(count int) {
+		for _, st := range remaining {
+			if st.Votes == count && !seen[st.Id] {
+				seen[st.Id] = true
+				tied = append(tied, st.Id)
+			}
+		}
+	}
+	for {
+		counts := make(map[int]int)
+		active := 0
+		for _, c := range choices {
+			for _, id := range c {
+				if running[id] {
+					counts[id]++
+					active++
+					break
+				}
+			}
+		}
+		remaining = rankByScore(remaining, counts, tie)
+		for _, st := range remaining {
+			score[st.Id] = counts[st.Id]
+		}
+		if len(remaining) <= 1 || active == 0 || counts[remaining[0].Id]*2 > active {
+			if len(remaining) > 1 && counts[remaining[1].Id] == counts[remaining[0].Id] {
+				tiedAt(counts[remaining[0].Id])
+			}
+			break
+		}
+		last := remaining[len(remaining)-1]
+		if n := counts[last.Id]; n > 0 && counts[remaining[len(remaining)-2].Id] == n {
+			tiedAt(n)
+		}
+		remaining = remaining[:len(remaining)-1]
+		running[last.Id] = false
+		dropped = append(dropped, last)
+	}
+	ranked := remaining
+	for i := len(dropped) - 1; i >= 0; i-- {
+		ranked = append(ranked, dropped[i])
+	}
+	for _, st := range ranked {
+		st.Votes = score[st.Id]
+	}
+	return ranked, tied
+}
+
+// The Schulze method is a Condorcet method. Every pair of showtimes is compared by how many
+// users ranked one above the other, a ranked showtime being above the unranked ones. Showtimes
+// are ordered by how many others they beat through the strongest chain of such preferences,
+// and a showtime that beats every other one head to head always wins.
+type SchulzeMethod struct{}
+
+func (SchulzeMethod) Name() string { return "schulze" }
+
+func (SchulzeMethod) Validate(votes []*Showtime) error {
+	return validateRanks(votes)
+}
+
+func (SchulzeMethod) TopChoices(votes map[int]int) []int {
+	return firstRanked(votes)
+}
+
+func (SchulzeMethod) Tally(showtimes []*Showtime, ballots []*Ballot, tie TieBreak) ([]*Showtime, []int) {
+	n := len(showtimes)
+	index := make(map[int]int)
+	for i, st := range showtimes {
+		index[st.Id] = i
+	}
+	//d[i][j] is the number of users that prefer showtime i over showtime j
+	d := make([][]int, n)
+	p := make([][]int, n)
+	for i := range d {
+		d[i] = make([]int, n)
+		p[i] = make([]int, n)
+	}
+	for _, b := range ballots {
+		rank := make([]int, n)
+		for id, r := range b.Votes {
+			if i, ok := index[id]; ok && r > 0 {
+				rank[i] = r
+			}
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if i != j && rank[i] > 0 && (rank[j] == 0 || rank[i] < rank[j]) {
+					d[i][j]++
+				}
+			}
+		}
+	}
+	//p[i][j] is the strength of the strongest path from i to j
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j && d[i][j] > d[j][i] {
+				p[i][j] = d[i][j]
+			}
+		}
+	}
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			if i == k {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				if j == i || j == k {
+					continue
+				}
+				if s := minInt(p[i][k], p[k][j]); s > p[i][j] {
+					p[i][j] = s
+				}
+			}
+		}
+	}
+	score := make(map[int]int)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j && p[i][j] > p[j][i] {
+				score[showtimes[i].Id]++
+			}
+		}
+	}
+	ranked := rankByScore(showtimes, score, tie)
+	return ranked, topTied(ranked)
+}
+
+// A Week is one voting week of a group, with the voting method and tie break it is tallied
+// with. A locked week is decided, it holds the showtime it was locked on, when and by whom.
+// LockedBy is the admin that locked it, or 0 for the scheduler.
+type Week struct {
+	GroupId    int        `json:"groupId"`
+	WeekOf     time.Time  `json:"weekOf"`
+	Method     string     `json:"method"`
+	TieBreak   string     `json:"tieBreak"`
+	TieWinner  int        `json:"tieWinner,omitempty"`
+	Locked     *time.Time `json:"locked,omitempty"`
+	LockedBy   int        `json:"lockedBy,omitempty"`
+	ShowtimeId int        `json:"showtimeId,omitempty"`
+	// When the lock email went out, it only ever goes out once
+	LockEmail *time.Time `json:"lockEmail,omitempty"`
+}
+
+const (
+	WeekLockActionLock   = "lock"
+	WeekLockActionUnlock = "unlock"
+)
+
+// A WeekLock is an entry in the log of a weeks locks and unlocks
+type WeekLock struct {
+	Id         int       `json:"id"`
+	GroupId    int       `json:"groupId"`
+	WeekOf     time.Time `json:"weekOf"`
+	Action     string    `json:"action"`
+	ShowtimeId int       `json:"showtimeId"`
+	Reason     string    `json:"reason"`
+	UserId     int       `json:"userId"`
+	Created    time.Time `json:"created"`
+}
+
+// Returns the week of the group. A week is saved with the default voting method and tie break
+// once the first ballot is in, until then it goes by the defaults unless others were picked.
+func GetWeek(g *Group, bow time.Time) (*Week, error) {
+	w, err := store.GetWeek(g.Id, bow)
+	if err == sql.ErrNoRows {
+		return &Week{GroupId: g.Id, WeekOf: bow, Method: *votingMethod, TieBreak: *tieBreak}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.WeekOf = g.Calendar().In(w.WeekOf)
+	return w, nil
+}
+
+// A WeekTally is the outcome of a groups week under its voting method
+type WeekTally struct {
+	Week      *Week
+	Standings []*Showtime
+	Ballots   []*Ballot
+	// The number of users that vetoed each showtime
+	Vetoes map[int]int
+	// The showtimes the tie break had to decide between on the way to the winner, if any
+	Tied []int
+	// The showtime the week is locked on, if it is
+	Locked *Showtime
+}
+
+// Tallies the showtimes of the groups week with the voting method and tie break of the week.
+// The showtimes have their votes set to the score the method gave them and the vote of the
+// user filled in. Showtimes an admin hid, or that enough members vetoed to reach the veto
+// threshold, are left out. A locked week keeps the showtime it was locked on on top.
+func TallyWeek(g *Group, bow, eow time.Time, userId int) (*WeekTally, error) {
+	showtimes, err := store.GetShowtimesForWeekOf(g.Id, bow, eow, userId)
+	if err != nil {
+		return nil, err
+	}
+	week, err := GetWeek(g, bow)
+	if err != nil {
+		return nil, err
+	}
+	method, err := GetVotingMethod(week.Method)
+	if err != nil {
+		return nil, err
+	}
+	tie, err := GetTieBreak(week.TieBreak)
+	if err != nil {
+		return nil, err
+	}
+	ballots, err := store.GetBallots(g.Id, bow, eow)
+	if err != nil {
+		return nil, err
+	}
+	t := &WeekTally{Week: week, Ballots: ballots, Vetoes: make(map[int]int)}
+	for _, b := range ballots {
+		for id := range b.Vetoes {
+			t.Vetoes[id]++
+		}
+	}
+	candidates := make([]*Showtime, 0, len(showtimes))
+	for _, st := range showtimes {
+		if *vetoThreshold > 0 && t.Vetoes[st.Id] >= *vetoThreshold {
+			continue
+		}
+		candidates = append(candidates, st)
+	}
+	ranked, tied := method.Tally(candidates, ballots, tie(t))
+	t.Standings, t.Tied = ranked, tied
+	if week.Locked != nil {
+		for _, st := range ranked {
+			if st.Id == week.ShowtimeId {
+				t.Locked = st
+			}
+		}
+		//The group may have vetoed the showtime since, or an admin hid it
+		if t.Locked == nil {
+			t.Locked, err = store.GetShowtime(g.Id, week.ShowtimeId)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t.Locked.Locked = true
+		t.Standings = []*Showtime{t.Locked}
+		for _, st := range ranked {
+			if st != t.Locked {
+				t.Standings = append(t.Standings, st)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Returns the showtimes of the groups week ranked by the voting method of the week, see
+// TallyWeek
+func WeekStandings(g *Group, bow, eow time.Time, userId int) ([]*Showtime, error) {
+	t, err := TallyWeek(g, bow, eow, userId)
+	if err != nil {
+		return nil, err
+	}
+	return t.Standings, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns showtimes 1 to n, each showing an hour after the one before, so the earliest tie
+// break orders them by id
+func testShowtimes(n int) []*Showtime {
+	start := time.Date(2024, 3, 12, 17, 0, 0, 0, time.UTC)
+	sts := make([]*Showtime, 0, n)
+	for i := 1; i <= n; i++ {
+		sts = append(sts, &Showtime{Id: i, Showtime: start.Add(time.Duration(i) * time.Hour)})
+	}
+	return sts
+}
+
+// Returns a ballot ranking the showtimes in the order given, first choice first
+func ranked(userId int, ids ...int) *Ballot {
+	b := &Ballot{UserId: userId, Votes: make(map[int]int)}
+	for i, id := range ids {
+		b.Votes[id] = i + 1
+	}
+	return b
+}
+
+// Returns copies of the ballot, for the given number of users voting alike
+func repeated(n int, b *Ballot) []*Ballot {
+	ret := make([]*Ballot, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, &Ballot{UserId: b.UserId + i, Votes: b.Votes, Vetoes: b.Vetoes})
+	}
+	return ret
+}
+
+// The later showing goes first, the reverse of the default tie break
+func latestShowtime(a, b *Showtime) bool {
+	return earliestShowtime(b, a)
+}
+
+type tallyTest struct {
+	name      string
+	showtimes int
+	ballots   []*Ballot
+	tie       TieBreak
+	order     []int
+	votes     []int
+	// The showtimes the tie break decided between
+	tied []int
+}
+
+func runTallyTests(t *testing.T, m VotingMethod, tests []tallyTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tie := tt.tie
+			if tie == nil {
+				tie = earliestShowtime
+			}
+			standings, tied := m.Tally(testShowtimes(tt.showtimes), tt.ballots, tie)
+			order, votes := make([]int, 0), make([]int, 0)
+			for _, st := range standings {
+				order = append(order, st.Id)
+				votes = append(votes, st.Votes)
+			}
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("order = %v, want %v", order, tt.order)
+			}
+			if !reflect.DeepEqual(votes, tt.votes) {
+				t.Errorf("votes = %v, want %v", votes, tt.votes)
+			}
+			want := tt.tied
+			if want == nil {
+				want = []int{}
+			}
+			if !reflect.DeepEqual(tied, want) {
+				t.Errorf("tied = %v, want %v", tied, want)
+			}
+		})
+	}
+}
+
+func TestPointsTally(t *testing.T) {
+	runTallyTests(t, PointsMethod{}, []tallyTest{
+		{
+			name:      "most points wins",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 3, 2: 1}},
+				{UserId: 2, Votes: map[int]int{2: 3}},
+			},
+			order: []int{2, 1, 3},
+			votes: []int{4, 3, 0},
+		},
+		{
+			name:      "a veto takes a point away",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 2, 2: 2}},
+				{UserId: 2, Votes: map[int]int{}, Vetoes: map[int]bool{1: true}},
+			},
+			order: []int{2, 1, 3},
+			votes: []int{2, 1, 0},
+		},
+		{
+			name:      "a tie goes to the earlier showing",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 2}},
+				{UserId: 2, Votes: map[int]int{2: 2}},
+			},
+			order: []int{1, 2, 3},
+			votes: []int{2, 2, 0},
+			tied:  []int{1, 2},
+		},
+		{
+			name:      "a tie goes by the tie break",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 2}},
+				{UserId: 2, Votes: map[int]int{2: 2}},
+			},
+			tie:   latestShowtime,
+			order: []int{2, 1, 3},
+			votes: []int{2, 2, 0},
+			tied:  []int{2, 1},
+		},
+	})
+}
+
+func TestApprovalTally(t *testing.T) {
+	runTallyTests(t, ApprovalMethod{}, []tallyTest{
+		{
+			name:      "most approvals wins",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 1, 2: 1}},
+				{UserId: 2, Votes: map[int]int{2: 1}},
+				{UserId: 3, Votes: map[int]int{3: 1}},
+			},
+			order: []int{2, 1, 3},
+			votes: []int{2, 1, 1},
+		},
+		{
+			name:      "a tie goes by the tie break",
+			showtimes: 3,
+			ballots: []*Ballot{
+				{UserId: 1, Votes: map[int]int{1: 1, 3: 0}},
+				{UserId: 2, Votes: map[int]int{2: 1}},
+			},
+			tie:   latestShowtime,
+			order: []int{2, 1, 3},
+			votes: []int{1, 1, 0},
+			tied:  []int{2, 1},
+		},
+	})
+}
+
+func TestInstantRunoffTally(t *testing.T) {
+	runTallyTests(t, InstantRunoffMethod{}, []tallyTest{
+		{
+			name:      "an outright majority wins in the first round",
+			showtimes: 3,
+			ballots: []*Ballot{
+				ranked(1, 2, 1),
+				ranked(2, 2),
+				ranked(3, 3, 1),
+			},
+			order: []int{2, 3, 1},
+			votes: []int{2, 1, 0},
+		},
+		{
+			name:      "the dropped showtime's ballots move on to their next choice",
+			showtimes: 3,
+			ballots: append(append(
+				repeated(2, ranked(1, 1)),
+				repeated(2, ranked(3, 2))...),
+				ranked(5, 3, 2)),
+			order: []int{2, 1, 3},
+			votes: []int{3, 2, 1},
+		},
+		{
+			name:      "a showtime no one ranks first is dropped first, however many rank it second",
+			showtimes: 4,
+			ballots: []*Ballot{
+				ranked(1, 1, 4),
+				ranked(2, 2, 4),
+				ranked(3, 3, 4),
+			},
+			order: []int{1, 2, 3, 4},
+			votes: []int{1, 1, 1, 0},
+			tied:  []int{1, 2, 3},
+		},
+		{
+			name:      "a tie for the fewest drops the showtime the tie break puts last",
+			showtimes: 3,
+			ballots: append(append(
+				repeated(3, ranked(1, 1)),
+				repeated(2, ranked(4, 2, 3))...),
+				repeated(2, ranked(6, 3, 2))...),
+			tie:   latestShowtime,
+			order: []int{3, 1, 2},
+			votes: []int{4, 3, 2},
+			tied:  []int{3, 2},
+		},
+	})
+}
+
+func TestSchulzeTally(t *testing.T) {
+	runTallyTests(t, SchulzeMethod{}, []tallyTest{
+		{
+			name:      "the condorcet winner wins without the most first choices",
+			showtimes: 3,
+			ballots: append(append(
+				repeated(2, ranked(1, 1, 2, 3)),
+				repeated(2, ranked(3, 3, 2, 1))...),
+				ranked(5, 2, 1, 3)),
+			order: []int{2, 1, 3},
+			votes: []int{2, 1, 0},
+		},
+		{
+			name:      "a cycle is broken by its weakest link",
+			showtimes: 3,
+			ballots: append(append(
+				repeated(4, ranked(1, 3, 1, 2)),
+				repeated(3, ranked(5, 1, 2, 3))...),
+				repeated(2, ranked(8, 2, 3, 1))...),
+			order: []int{3, 1, 2},
+			votes: []int{2, 1, 0},
+		},
+		{
+			name:      "an even cycle goes by the tie break",
+			showtimes: 3,
+			ballots: []*Ballot{
+				ranked(1, 1, 2, 3),
+				ranked(2, 2, 3, 1),
+				ranked(3, 3, 1, 2),
+			},
+			tie:   latestShowtime,
+			order: []int{3, 2, 1},
+			votes: []int{0, 0, 0},
+			tied:  []int{3, 2, 1},
+		},
+	})
+}
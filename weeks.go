@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const defaultWeeksPageSize = 10
+const maxWeeksPageSize = 100
+
+// A WeekSummary is a locked week with the showtime it was locked on
+type WeekSummary struct {
+	Week   *Week     `json:"week"`
+	Winner *Showtime `json:"winner"`
+}
+
+type WeekPage struct {
+	Weeks    []*WeekSummary `json:"weeks"`
+	Total    int            `json:"total"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"pageSize"`
+}
+
+// Returns the week of the group the path names, by a day in it like 2024-03-10, or current for
+// the week being voted on now
+func weekForPath(g *Group, day string) (time.Time, time.Time, error) {
+	if day == "current" {
+		bow, eow := g.WeekOf(time.Now())
+		return bow, eow, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", day, g.Calendar().Location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	bow, eow := g.Calendar().WeekAt(t)
+	return bow, eow, nil
+}
+
+// A BallotResult is what one ballot put in to the tally of a week
+type BallotResult struct {
+	Voter  string      `json:"voter"`
+	UserId int         `json:"userId,omitempty"`
+	Votes  map[int]int `json:"votes"`
+	Vetoes []int       `json:"vetoes"`
+}
+
+// The WeekResults publish how a week was decided
+type WeekResults struct {
+	Week      *Week           `json:"week"`
+	Standings []*Showtime     `json:"standings"`
+	Ballots   []*BallotResult `json:"ballots"`
+	Vetoes    map[int]int     `json:"vetoes"`
+	// The showtimes the tie break had to decide between on the way to the winner, and the tie
+	// break that did, when it had to
+	Tied        []int  `json:"tied"`
+	TieBrokenBy string `json:"tieBrokenBy,omitempty"`
+	// Whether the week is open, or was locked manually or by the scheduler, and the log of its
+	// locks and unlocks
+	Lock  string      `json:"lock"`
+	Locks []*WeekLock `json:"locks"`
+}
+
+// Signs the user and week with the salt, sorting on it shuffles the ballots of a week in an
+// order that can't be worked back to the users without the salt
+func shuffleKey(w *Week, userId int) string {
+	mac := hmac.New(sha256.New, []byte(*salt))
+	fmt.Fprintf(mac, "%d-%d-%d", w.GroupId, w.WeekOf.Unix(), userId)
+	return string(mac.Sum(nil))
+}
+
+// Returns the results of the groups week. The voters are left out when anonymous is set.
+func GetWeekResults(g *Group, bow, eow time.Time, anonymous bool) (*WeekResults, error) {
+	t, err := TallyWeek(g, bow, eow, 0)
+	if err != nil {
+		return nil, err
+	}
+	res := &WeekResults{Week: t.Week, Standings: t.Standings, Ballots: make([]*BallotResult, 0, len(t.Ballots)), Vetoes: t.Vetoes, Tied: t.Tied, Lock: "open"}
+	if len(t.Tied) > 0 {
+		res.TieBrokenBy = t.Week.TieBreak
+	}
+	switch {
+	case t.Week.Locked != nil && t.Week.LockedBy != 0:
+		res.Lock = "manual"
+	case t.Week.Locked != nil:
+		res.Lock = "scheduler"
+	}
+	res.Locks, err = store.GetWeekLocks(g.Id, bow)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range res.Locks {
+		l.WeekOf = g.Calendar().In(l.WeekOf)
+	}
+	ballots := t.Ballots
+	if anonymous {
+		//The ballots come ordered by user, which would give the voters away from week to week
+		ballots = make([]*Ballot, len(t.Ballots))
+		copy(ballots, t.Ballots)
+		keys := make(map[int]string, len(ballots))
+		for _, b := range ballots {
+			keys[b.UserId] = shuffleKey(t.Week, b.UserId)
+		}
+		sort.Slice(ballots, func(i, j int) bool {
+			return keys[ballots[i].UserId] < keys[ballots[j].UserId]
+		})
+	}
+	for i, b := range ballots {
+		br := &BallotResult{Voter: fmt.Sprintf("Voter %d", i+1), Votes: b.Votes, Vetoes: make([]int, 0, len(b.Vetoes))}
+		for id := range b.Vetoes {
+			br.Vetoes = append(br.Vetoes, id)
+		}
+		sort.Ints(br.Vetoes)
+		if !anonymous {
+			u, err := store.GetUser(b.UserId)
+			if err != nil {
+				return nil, err
+			}
+			br.Voter, br.UserId = u.Name, u.Id
+		}
+		res.Ballots = append(res.Ballots, br)
+	}
+	return res, nil
+}
+
+// This api handler reads and changes the voting weeks of the group given by the 'group' query
+// param, or the users first group.
+//
+//	GET /api/weeks/{day|current}          The week holding the day, like 2024-03-10
+//	PUT /api/weeks/{day|current}          Picks the voting method {"method":"irv"}, only until
+//	                                      the first votes are in, the tie break
+//	                                      {"tieBreak":"admin"} or the showtime that wins a tie
+//	                                      {"tieWinner":12}, only until the week is locked
+//	GET /api/weeks/{day|current}/results  The tally, ballots, vetoes and tie break of the week
+//	POST /api/weeks/{day|current}/lock    Locks the week on its winner, a week that was
+//	                                      unlocked needs a reason {"reason":"Fixed the tally"}
+//	DELETE /api/weeks/{day|current}/lock  Unlocks the week with a reason {"reason":"Recount"}
+//	GET /api/weeks/{day|current}/history  Every version of the ballots sent in for the week
+//	GET /api/weeks?page=1&pageSize=10     The locked weeks and their winners, newest first
+func APIWeeksHandler(w http.ResponseWriter, r *http.Request) {
+	u := LoggedInUser(r.Context())
+	g, code, err := GroupForRequest(r, u)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if r.URL.Path == "/api/weeks" {
+		APIWeekListHandler(w, r, g)
+		return
+	}
+	re := regexp.MustCompile(`^/api/weeks/?([^/]*)/?([^/]*)`)
+	pm := re.FindStringSubmatch(r.URL.Path)
+	if pm[1] == "" {
+		pm[1] = "current"
+	}
+	bow, eow, err := weekForPath(g, pm[1])
+	if err != nil {
+		http.Error(w, "Weeks are named by a day like 2006-01-02 or current", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && pm[2] == "results":
+		//Only members see who voted for what
+		res, err := GetWeekResults(g, bow, eow, *anonymousBallots || !IsGroupMember(g.Id, u))
+		if err != nil {
+			log.Println("APIWeeksHandler:1:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&res)
+		return
+	case r.Method == http.MethodGet && pm[2] == "history":
+		//Members only see their own ballots when the ballots are anonymous
+		if !IsGroupMember(g.Id, u) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		history, err := store.GetBallotHistory(g.Id, bow)
+		if err != nil {
+			log.Println("APIWeeksHandler:6:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if *anonymousBallots {
+			mine := make([]*BallotVersion, 0)
+			for _, bv := range history {
+				if bv.UserId == u.Id {
+					mine = append(mine, bv)
+				}
+			}
+			history = mine
+		}
+		for _, bv := range history {
+			bv.WeekOf = g.Calendar().In(bv.WeekOf)
+		}
+		e := json.NewEncoder(w)
+		e.Encode(&history)
+		return
+	case pm[2] == "lock" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		if u == nil || !contains(u.Abilities, AbilityAdminLock) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var body = struct {
+			Reason string `json:"reason"`
+		}{}
+		//The first lock of a week needs no reason, so the body can be left out
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(&body)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			err = UnlockGroup(g, bow, u.Id, body.Reason)
+		} else {
+			_, err = AdminLockGroup(g, bow, eow, u.Id, body.Reason)
+		}
+		switch err {
+		case nil:
+			action := "Locked"
+			if r.Method == http.MethodDelete {
+				action = "Unlocked"
+			}
+			fmt.Println(action, "the week of", bow.Format("2006-01-02"), "for group", g.Id, body.Reason)
+		case ErrNoReason, ErrNoShowtimes:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case ErrAlreadyLocked, ErrNotLocked:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.Println("APIWeeksHandler:5:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case pm[2] != "":
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPut:
+		if u == nil || !contains(u.Abilities, AbilityAdminLock) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var body = struct {
+			Method    string `json:"method"`
+			TieBreak  string `json:"tieBreak"`
+			TieWinner int    `json:"tieWinner"`
+		}{}
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t, err := TallyWeek(g, bow, eow, 0)
+		if err != nil {
+			log.Println("APIWeeksHandler:2:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		week := t.Week
+		if week.Locked != nil {
+			http.Error(w, "The week is already locked", http.StatusConflict)
+			return
+		}
+		if body.Method != "" && body.Method != week.Method {
+			_, err = GetVotingMethod(body.Method)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			//Ballots mean different things under each method, so they can't carry over
+			if len(t.Ballots) > 0 {
+				http.Error(w, "Can't change the voting method once votes are in", http.StatusConflict)
+				return
+			}
+			week.Method = body.Method
+		}
+		if body.TieBreak != "" {
+			_, err = GetTieBreak(body.TieBreak)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			week.TieBreak = body.TieBreak
+		}
+		if body.TieWinner != 0 {
+			found := false
+			for _, st := range t.Standings {
+				found = found || st.Id == body.TieWinner
+			}
+			if !found {
+				http.Error(w, "The tie winner must be a showtime of the week", http.StatusBadRequest)
+				return
+			}
+			week.TieWinner = body.TieWinner
+		}
+		err = store.SaveWeek(week)
+		if err != nil {
+			log.Println("APIWeeksHandler:3:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Group", g.Id, "votes with", week.Method, "breaking ties by", week.TieBreak, "the week of", bow.Format("2006-01-02"))
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	week, err := GetWeek(g, bow)
+	if err != nil {
+		log.Println("APIWeeksHandler:4:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&week)
+}
+
+// This api handler pages through the locked weeks of the group and the showtimes they were
+// locked on, newest first.
+//
+//	GET /api/weeks?page=1&pageSize=10
+func APIWeekListHandler(w http.ResponseWriter, r *http.Request, g *Group) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, pageSize, err := pageParams(r.URL.Query(), defaultWeeksPageSize, maxWeeksPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	weeks, total, err := store.GetLockedWeeks(g.Id, pageSize, (page-1)*pageSize)
+	if err != nil {
+		log.Println("APIWeekListHandler:1:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := &WeekPage{Weeks: make([]*WeekSummary, 0, len(weeks)), Total: total, Page: page, PageSize: pageSize}
+	for _, week := range weeks {
+		week.WeekOf = g.Calendar().In(week.WeekOf)
+		ws := &WeekSummary{Week: week}
+		//A week whose showtime is gone is still listed, without its winner
+		ws.Winner, err = store.GetShowtime(g.Id, week.ShowtimeId)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("APIWeekListHandler:2:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Weeks = append(res.Weeks, ws)
+	}
+	e := json.NewEncoder(w)
+	e.Encode(&res)
+}
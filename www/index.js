@@ -28,6 +28,7 @@ function initMe(){
 			document.querySelector('#settings-form input[name=rewardcard]').value = this.response.rewardCard;
 			document.querySelector('#settings-form input[name=zip]').value = this.response.zip;
 			document.querySelector('#settings-form input[name=phone]').value = this.response.phone;
+			document.querySelector('#settings-form input[name=timezone]').value = this.response.timeZone;
 			let sel = document.querySelector('#settings-form select[name=carrier]');
 			sel.selectedIndex = sel.options.length - 1;
 			for(let i = 0; i < sel.options.length; i++){
@@ -87,6 +88,10 @@ function initShowtimes(){
 			window.showtimes = this.response;
 			var remainingVotes = 6;
 			for(i =0; i < this.response.length; i++){
+				//A veto shows as the thumb down
+				if(this.response[i].veto){
+					this.response[i].vote = -1;
+				}
 				if(this.response[i].vote > 0){
 					remainingVotes -= this.response[i].vote;
 				}
@@ -172,7 +177,7 @@ function initShowtimes(){
 				ul.attributes.setNamedItem(data);
 				ul.innerHTML = '<li class="mdl-menu__item"><a href="http://www.imdb.com/title/'+this.response[i].movie.imdbID+'" target="_blank">IMDB</a></li>';
 				ul.innerHTML += '<li class="mdl-menu__item"><a href="https://www.megaplextheatres.com'+this.response[i].buyTicketsLink+'" target="_blank">Purchase</a></li>';
-				if(this.response[i].votes >= 1000){
+				if(this.response[i].locked){
 					ul.innerHTML += '<li class="mdl-menu__item"><a onclick="rsvp(\'' + this.response[i].id + '\', \'yes\')">RSVP Yes</a></li>';
 					ul.innerHTML += '<li class="mdl-menu__item"><a onclick="rsvp(\'' + this.response[i].id  + '\', \'maybe\')">RSVP Maybe</a></li>';
 					ul.innerHTML += '<li class="mdl-menu__item"><a onclick="rsvp(\'' + this.response[i].id  + '\', \'no\')">RSVP No</a></li>';
@@ -184,7 +189,7 @@ function initShowtimes(){
 
 				h2.appendChild(document.createTextNode(this.response[i].movie.Title));
 				p.innerHTML = this.response[i].location + '<br/>';
-				p.innerHTML += new Date(this.response[i].showtime).toLocaleTimeString() + '<br/>';
+				p.innerHTML += new Date(this.response[i].showtime).toLocaleTimeString([], window.user && window.user.timeZone ? {timeZone:window.user.timeZone} : {}) + '<br/>';
 				p.innerHTML += this.response[i].screen;
 				p.innerHTML += '<img src="api/preview?showtimeid='+this.response[i].id+'" alt="preview image" height="18px" onerror="this.style.display=\'none\';">';
 				header.appendChild(h2);
@@ -251,6 +256,8 @@ function postVotes(votes){
 	showtimesxhr.onload = function(e){
 		if(this.status == '200'){
 			document.querySelector('.mdl-js-snackbar').MaterialSnackbar.showSnackbar({message:"Votes Posted"});
+		}else if(this.status == '400'){
+			document.querySelector('.mdl-js-snackbar').MaterialSnackbar.showSnackbar({message:"Votes weren't posted, you may have vetoed too many showtimes"});
 		}
 	};
 	showtimesxhr.send(JSON.stringify(votes));
@@ -341,6 +348,7 @@ function postLogin(fd){
 			document.querySelector('#settings-form input[name=giftcardpin]').value = this.response.giftCardPin;
 			document.querySelector('#settings-form input[name=rewardcard]').value = this.response.rewardCard;
 			document.querySelector('#settings-form input[name=zip]').value = this.response.zip;
+			document.querySelector('#settings-form input[name=timezone]').value = this.response.timeZone;
 			toggleUserUI(true, this.response.abilities);
 			//Kick off a redownload of the showtimes
 			initShowtimes()
@@ -374,7 +382,8 @@ function postSettings(fd){
 		rewardCard:fd.get('rewardcard'),
 		zip:fd.get('zip'),
 		phone:fd.get('phone'),
-		carrier:fd.get('carrier')
+		carrier:fd.get('carrier'),
+		timeZone:fd.get('timezone')
 	}));
 }
 
@@ -426,24 +435,34 @@ function postResetPassword(fd){
 	}));
 }
 
-function adminLockVote(){
+function adminLockVote(reason){
 	var xhr = new XMLHttpRequest();
-	xhr.open('GET', 'admin/lock', true);
+	xhr.open('GET', 'admin/lock' + (reason ? '?reason='+encodeURIComponent(reason) : ''), true);
 	xhr.onload = function(e){
 		if(this.status == '200'){
 			document.querySelector('.mdl-js-snackbar').MaterialSnackbar.showSnackbar({message:"Voting Locked!"});
+		}else if(this.status == '400' && !reason && this.responseText.indexOf('reason') >= 0){
+			//A week that was unlocked needs a reason to be locked again
+			reason = prompt("Why lock the vote again?");
+			if(reason){
+				adminLockVote(reason);
+			}
 		}
 	}
 	xhr.send();
 }
 
 function adminDownvote(showtimeId){
-	//Call the endpoint that will add -5 votes to this showtime
+	//Hides the showtime from the group, hides need a reason
+	var reason = prompt("Why hide this showtime?");
+	if(!reason){
+		return;
+	}
 	var xhr = new XMLHttpRequest();
-	xhr.open('GET', 'admin/downvote?showtimeId='+encodeURIComponent(showtimeId), true);
+	xhr.open('GET', 'admin/downvote?showtimeId='+encodeURIComponent(showtimeId)+'&reason='+encodeURIComponent(reason), true);
 	xhr.onload = function(e){
 		if(this.status == '200'){
-			document.querySelector('.mdl-js-snackbar').MaterialSnackbar.showSnackbar({message:"Admin Downvote Succeeded!"});
+			document.querySelector('.mdl-js-snackbar').MaterialSnackbar.showSnackbar({message:"Showtime Hidden"});
 		}
 	}
 	xhr.send();
@@ -493,7 +512,9 @@ function submitVotes(){
 	for(var i = 0; i < showtimes.length; i++){
 		var id = parseInt(showtimes[i].getAttribute('data-id'));
 		var vote = parseInt(showtimes[i].getAttribute('data-vote'));
-		if(vote != 0){
+		if(vote < 0){
+			votes.push({id:id,vote:0,veto:true});
+		}else if(vote != 0){
 			votes.push({id:id,vote:vote});
 		}
 	}